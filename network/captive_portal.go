@@ -0,0 +1,177 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+type ConnectivityState int
+
+const (
+	// none of the connectivity
+	// endpoints could be reached
+	NoNetwork ConnectivityState = iota
+	// requests to the connectivity endpoints are
+	// redirected or answered by a captive portal
+	CaptivePortal
+	// a connectivity endpoint
+	// responded as expected
+	InternetAvailable
+)
+
+func (s ConnectivityState) String() string {
+	switch s {
+	case NoNetwork:
+		return "no network"
+	case CaptivePortal:
+		return "captive portal"
+	case InternetAvailable:
+		return "internet available"
+	default:
+		return "unknown"
+	}
+}
+
+// an http endpoint that returns a known response which
+// is replaced by the login page or a redirect to the
+// login page if the host is behind a captive portal
+type ConnectivityEndpoint struct {
+	URL string
+	// the status of the expected response
+	ExpectedStatus int
+	// content the body of the expected response must
+	// contain. the body is not checked if it is empty.
+	ExpectedContent string
+}
+
+// maximum size of the response body
+// read from a connectivity endpoint
+const connectivityBodyLimit = 64 * 1024
+
+// well-known endpoints used by operating
+// systems to detect captive portals
+var DefaultConnectivityEndpoints = []ConnectivityEndpoint{
+	{
+		URL:            "http://connectivitycheck.gstatic.com/generate_204",
+		ExpectedStatus: http.StatusNoContent,
+	},
+	{
+		URL:             "http://captive.apple.com/hotspot-detect.html",
+		ExpectedStatus:  http.StatusOK,
+		ExpectedContent: "Success",
+	},
+	{
+		URL:             "http://www.msftconnecttest.com/connecttest.txt",
+		ExpectedStatus:  http.StatusOK,
+		ExpectedContent: "Microsoft Connect Test",
+	},
+}
+
+// result of a connectivity check
+type ConnectivityResult struct {
+	State ConnectivityState `json:"state"`
+	// url of the captive portal's login page
+	// if the host is behind a captive portal
+	PortalURL string `json:"portalURL,omitempty"`
+	// results of the requests sent to
+	// the connectivity endpoints
+	Probes []*ProbeResult `json:"probes"`
+}
+
+// detects whether the host has internet access by sending
+// requests to connectivity endpoints over plain http which
+// captive portals intercept
+type ConnectivityDetector struct {
+	endpoints []ConnectivityEndpoint
+	client    *http.Client
+}
+
+// returns a detector that checks the given endpoints or
+// the default endpoints if no endpoints are given
+func NewConnectivityDetector(endpoints ...ConnectivityEndpoint) *ConnectivityDetector {
+
+	if len(endpoints) == 0 {
+		endpoints = DefaultConnectivityEndpoints
+	}
+	return &ConnectivityDetector{
+		endpoints: endpoints,
+		// proxies are not used as the proxy
+		// itself may be behind the portal
+		client: &http.Client{
+			Transport: &http.Transport{
+				DisableKeepAlives: true,
+			},
+		},
+	}
+}
+
+// checks the endpoints in order until one of them returns
+// the expected response. if none of them do the host is
+// behind a captive portal if any endpoint responded with
+// a different response. otherwise it has no network.
+func (d *ConnectivityDetector) Detect(ctx context.Context) *ConnectivityResult {
+
+	result := &ConnectivityResult{
+		State:  NoNetwork,
+		Probes: []*ProbeResult{},
+	}
+	for _, endpoint := range d.endpoints {
+		if ctx.Err() != nil {
+			break
+		}
+
+		probe, body := probeHTTPGet(ctx, endpoint.URL, d.client, connectivityBodyLimit)
+		result.Probes = append(result.Probes, probe)
+		if probe.HTTPStatus == 0 {
+			// the endpoint could not be reached
+			continue
+		}
+
+		if probe.HTTPStatus == endpoint.ExpectedStatus &&
+			bytes.Contains(body, []byte(endpoint.ExpectedContent)) {
+
+			result.State = InternetAvailable
+			result.PortalURL = ""
+			return result
+		}
+		if result.State != CaptivePortal {
+			result.State = CaptivePortal
+			result.PortalURL = portalURL(endpoint.URL, probe, body)
+		}
+	}
+	return result
+}
+
+var metaRefreshPattern = regexp.MustCompile(
+	`(?i)<meta[^>]+http-equiv=["']?refresh["']?[^>]+content=["']?\s*\d*\s*;\s*url=['"]?([^"'>\s]+)`,
+)
+
+// returns the url of the login page of the portal that intercepted
+// the request to the given endpoint. the login page is where the
+// endpoint was redirected to or the endpoint itself if the portal
+// responded with the login page in place of the endpoint.
+func portalURL(endpointURL string, probe *ProbeResult, body []byte) string {
+
+	location := probe.Location
+	if len(location) == 0 {
+		if m := metaRefreshPattern.FindSubmatch(body); m != nil {
+			location = string(m[1])
+		}
+	}
+	if len(location) == 0 {
+		return endpointURL
+	}
+	// the location may be relative to the endpoint
+	base, err := url.Parse(endpointURL)
+	if err != nil {
+		return location
+	}
+	ref, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	return base.ResolveReference(ref).String()
+}
@@ -0,0 +1,92 @@
+package network_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/mevansam/goutils/network"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Captive Portal Detector", func() {
+
+	var (
+		server *httptest.Server
+		portal string
+	)
+
+	BeforeEach(func() {
+		portal = ""
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch portal {
+			case "redirect":
+				http.Redirect(w, r, "/portal/login?orig=" + r.URL.Path, http.StatusFound)
+				return
+			case "intercept":
+				w.Write([]byte(`<html><head><meta http-equiv="refresh" content="0; url=https://portal.example/login"></head></html>`))
+				return
+			}
+			switch r.URL.Path {
+			case "/generate_204":
+				w.WriteHeader(http.StatusNoContent)
+			case "/hotspot-detect.html":
+				w.Write([]byte("<HTML><HEAD><TITLE>Success</TITLE></HEAD><BODY>Success</BODY></HTML>"))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	newDetector := func() *network.ConnectivityDetector {
+		return network.NewConnectivityDetector(
+			network.ConnectivityEndpoint{
+				URL:            server.URL + "/generate_204",
+				ExpectedStatus: http.StatusNoContent,
+			},
+			network.ConnectivityEndpoint{
+				URL:             server.URL + "/hotspot-detect.html",
+				ExpectedStatus:  http.StatusOK,
+				ExpectedContent: "Success",
+			},
+		)
+	}
+
+	It("detects internet access", func() {
+		result := newDetector().Detect(context.Background())
+		Expect(result.State).To(Equal(network.InternetAvailable))
+		Expect(result.PortalURL).To(BeEmpty())
+		Expect(result.Probes).To(HaveLen(1))
+	})
+
+	It("detects captive portals that redirect requests", func() {
+		portal = "redirect"
+		result := newDetector().Detect(context.Background())
+		Expect(result.State).To(Equal(network.CaptivePortal))
+		Expect(result.PortalURL).To(Equal(server.URL + "/portal/login?orig=/generate_204"))
+		Expect(result.Probes).To(HaveLen(2))
+	})
+
+	It("detects captive portals that respond in place of the endpoint", func() {
+		portal = "intercept"
+		result := newDetector().Detect(context.Background())
+		Expect(result.State).To(Equal(network.CaptivePortal))
+		Expect(result.PortalURL).To(Equal("https://portal.example/login"))
+	})
+
+	It("detects when there is no network", func() {
+		detector := newDetector()
+		server.Close()
+		result := detector.Detect(context.Background())
+		Expect(result.State).To(Equal(network.NoNetwork))
+		Expect(result.Probes).To(HaveLen(2))
+		Expect(result.Probes[0].Success).To(BeFalse())
+		Expect(result.Probes[0].Error).ToNot(BeEmpty())
+	})
+})
@@ -0,0 +1,532 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/mevansam/goutils/logger"
+)
+
+const dnsMaxMessageSize = 65535
+
+var (
+	// maximum time answers are cached for
+	// regardless of the ttl of the answers
+	DNSCacheMaxTTL = time.Hour
+	// maximum number of cached answers
+	DNSCacheSize = 4096
+
+	// time after which idle tcp
+	// connections are closed
+	DNSForwarderIdleTimeout = 10 * time.Second
+)
+
+// A dns forwarder listens for queries on a local address
+// and forwards them to the upstream servers of the longest
+// domain suffix that matches the queried name. Queries
+// that do not match any domain are forwarded to the
+// upstreams of the root domain ".". Answers are cached
+// until their ttl expires.
+type DNSForwarder struct {
+	mx sync.RWMutex
+
+	// upstreams by domain in canonical
+	// form with a trailing dot
+	upstreams map[string][]DNSUpstream
+
+	cacheMx sync.Mutex
+	cache   map[dnsCacheKey]*dnsCacheEntry
+
+	udpConn     net.PacketConn
+	tcpListener net.Listener
+
+	// accepted tcp connections which are closed
+	// when the forwarder is closed. nil once the
+	// forwarder has been closed.
+	connsMx sync.Mutex
+	conns   map[net.Conn]bool
+
+	wg sync.WaitGroup
+}
+
+type dnsCacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type dnsCacheEntry struct {
+	response dnsmessage.Message
+	cached   time.Time
+	expires  time.Time
+}
+
+func NewDNSForwarder() *DNSForwarder {
+	return &DNSForwarder{
+		upstreams: make(map[string][]DNSUpstream),
+		cache:     make(map[dnsCacheKey]*dnsCacheEntry),
+	}
+}
+
+// sets the upstream servers queries for names in the
+// given domain are forwarded to. the servers of the
+// root domain "." are used for all other names. the
+// upstreams of the domain are removed if no servers
+// are given.
+func (f *DNSForwarder) SetUpstreams(domain string, servers ...string) error {
+
+	upstreams := []DNSUpstream{}
+	for _, server := range servers {
+		upstream, err := NewDNSUpstream(server)
+		if err != nil {
+			return err
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	f.SetUpstream(domain, upstreams...)
+	return nil
+}
+
+// sets the upstreams queries for names in
+// the given domain are forwarded to
+func (f *DNSForwarder) SetUpstream(domain string, upstreams ...DNSUpstream) {
+
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	domain = canonicalDomain(domain)
+	if len(upstreams) == 0 {
+		delete(f.upstreams, domain)
+	} else {
+		f.upstreams[domain] = upstreams
+	}
+
+	// answers cached for the domain may have
+	// been resolved by the previous upstreams
+	f.cacheMx.Lock()
+	for key := range f.cache {
+		if isSubdomain(key.name, domain) {
+			delete(f.cache, key)
+		}
+	}
+	f.cacheMx.Unlock()
+}
+
+// starts listening for udp and tcp queries on the given
+// address i.e. "127.0.0.53:53". the forwarder must listen
+// on port 53 to be added as a dns server of the host.
+func (f *DNSForwarder) Listen(address string) error {
+
+	var (
+		err error
+	)
+
+	if f.udpConn != nil {
+		return fmt.Errorf("dns forwarder is already listening on %s", f.udpConn.LocalAddr())
+	}
+	if f.udpConn, err = net.ListenPacket("udp", address); err != nil {
+		return err
+	}
+	// listen for tcp queries on the port udp queries are
+	// received on in case a random port was requested
+	if f.tcpListener, err = net.Listen("tcp", f.udpConn.LocalAddr().String()); err != nil {
+		f.udpConn.Close()
+		f.udpConn = nil
+		return err
+	}
+
+	f.connsMx.Lock()
+	f.conns = make(map[net.Conn]bool)
+	f.connsMx.Unlock()
+
+	f.wg.Add(2)
+	go f.serveUDP(f.udpConn)
+	go f.serveTCP(f.tcpListener)
+	return nil
+}
+
+// returns the address the forwarder is listening on
+func (f *DNSForwarder) Addr() net.Addr {
+	if f.udpConn == nil {
+		return nil
+	}
+	return f.udpConn.LocalAddr()
+}
+
+// returns the ip address of the forwarder which can be
+// added as a dns server via the dns manager
+func (f *DNSForwarder) Server() string {
+	if f.udpConn == nil {
+		return ""
+	}
+	return f.udpConn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// stops listening for queries, closes the tcp
+// connections of clients and clears the cache
+func (f *DNSForwarder) Close() error {
+
+	if f.udpConn == nil {
+		return nil
+	}
+	f.udpConn.Close()
+	f.tcpListener.Close()
+
+	f.connsMx.Lock()
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+	f.connsMx.Unlock()
+
+	f.wg.Wait()
+	f.udpConn = nil
+	f.tcpListener = nil
+
+	f.cacheMx.Lock()
+	f.cache = make(map[dnsCacheKey]*dnsCacheEntry)
+	f.cacheMx.Unlock()
+	return nil
+}
+
+func (f *DNSForwarder) serveUDP(conn net.PacketConn) {
+	defer f.wg.Done()
+
+	buffer := make([]byte, dnsMaxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if !isClosedConnError(err) {
+				logger.ErrorMessage("DNSForwarder.serveUDP(): Error reading query: %s", err.Error())
+			}
+			return
+		}
+		query := append([]byte{}, buffer[:n]...)
+
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			if response := f.Resolve(context.Background(), query, true); response != nil {
+				if _, err := conn.WriteTo(response, addr); err != nil {
+					logger.DebugMessage("DNSForwarder.serveUDP(): Error sending response to %s: %s", addr, err.Error())
+				}
+			}
+		}()
+	}
+}
+
+func (f *DNSForwarder) serveTCP(listener net.Listener) {
+	defer f.wg.Done()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !isClosedConnError(err) {
+				logger.ErrorMessage("DNSForwarder.serveTCP(): Error accepting connection: %s", err.Error())
+			}
+			return
+		}
+
+		// connections accepted while the
+		// forwarder is closing are not served
+		f.connsMx.Lock()
+		if f.conns == nil {
+			f.connsMx.Unlock()
+			conn.Close()
+			return
+		}
+		f.conns[conn] = true
+		f.connsMx.Unlock()
+
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			defer func() {
+				conn.Close()
+				f.connsMx.Lock()
+				delete(f.conns, conn)
+				f.connsMx.Unlock()
+			}()
+
+			// serve queries until the connection
+			// is idle or the forwarder is closed
+			for {
+				conn.SetDeadline(time.Now().Add(DNSForwarderIdleTimeout))
+				query, err := readStreamMessage(conn)
+				if err != nil {
+					return
+				}
+				if response := f.Resolve(context.Background(), query, false); response != nil {
+					if err = writeStreamMessage(conn, response); err != nil {
+						return
+					}
+				}
+			}
+		}()
+	}
+}
+
+// Resolves the packed query and returns the packed response.
+// The response is served from the cache if the query has been
+// answered before and the answer has not expired. Otherwise the
+// query is forwarded to the upstreams of its domain in order
+// until one of them responds. A server failure is returned if
+// none of the upstreams respond. Responses to udp queries that
+// are larger than the query allows are truncated. Nil is
+// returned for queries that cannot be parsed.
+func (f *DNSForwarder) Resolve(ctx context.Context, query []byte, udp bool) []byte {
+
+	var (
+		err error
+
+		parser   dnsmessage.Parser
+		header   dnsmessage.Header
+		question dnsmessage.Question
+		response []byte
+	)
+
+	if header, err = parser.Start(query); err != nil || header.Response {
+		return nil
+	}
+	if question, err = parser.Question(); err != nil {
+		return nil
+	}
+	maxSize := 512
+	if udp {
+		if err = parser.SkipAllQuestions(); err == nil {
+			if err = parser.SkipAllAnswers(); err == nil {
+				if err = parser.SkipAllAuthorities(); err == nil {
+					for {
+						rh, err := parser.AdditionalHeader()
+						if err != nil {
+							break
+						}
+						if rh.Type == dnsmessage.TypeOPT && int(rh.Class) > maxSize {
+							// the udp payload size of an edns query
+							maxSize = int(rh.Class)
+						}
+						if err = parser.SkipAdditional(); err != nil {
+							break
+						}
+					}
+				}
+			}
+		}
+	} else {
+		maxSize = dnsMaxMessageSize
+	}
+
+	key := dnsCacheKey{
+		name:  strings.ToLower(question.Name.String()),
+		qtype: question.Type,
+		class: question.Class,
+	}
+	if msg, ok := f.lookup(key); ok {
+		msg.Header.ID = header.ID
+		msg.Header.RecursionDesired = header.RecursionDesired
+		return packResponse(msg, maxSize)
+	}
+
+	upstreams := f.upstreamsFor(key.name)
+	for _, upstream := range upstreams {
+		if response, err = upstream.Exchange(ctx, query); err != nil {
+			logger.DebugMessage(
+				"DNSForwarder.Resolve(): Error forwarding query for '%s' to %s: %s",
+				key.name, upstream, err.Error(),
+			)
+			continue
+		}
+
+		msg := dnsmessage.Message{}
+		if err = msg.Unpack(response); err != nil {
+			// forward responses that cannot
+			// be parsed without caching them
+			return response
+		}
+		f.store(key, msg)
+		return packResponse(msg, maxSize)
+	}
+
+	if len(upstreams) == 0 {
+		logger.DebugMessage("DNSForwarder.Resolve(): No upstreams for '%s'", key.name)
+	}
+	failure := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 header.ID,
+			Response:           true,
+			OpCode:             header.OpCode,
+			RecursionDesired:   header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              dnsmessage.RCodeServerFailure,
+		},
+		Questions: []dnsmessage.Question{ question },
+	}
+	response, _ = failure.Pack()
+	return response
+}
+
+// returns the upstreams of the longest
+// domain that the given name is in
+func (f *DNSForwarder) upstreamsFor(name string) []DNSUpstream {
+
+	f.mx.RLock()
+	defer f.mx.RUnlock()
+
+	for domain := name; ; {
+		if upstreams, ok := f.upstreams[domain]; ok {
+			return upstreams
+		}
+		if domain == "." {
+			return nil
+		}
+		if i := strings.Index(domain, "."); i >= 0 && i < len(domain)-1 {
+			domain = domain[i+1:]
+		} else {
+			domain = "."
+		}
+	}
+}
+
+// returns a copy of the cached response to the
+// query with the ttls reduced by the time the
+// response has been cached for
+func (f *DNSForwarder) lookup(key dnsCacheKey) (dnsmessage.Message, bool) {
+
+	f.cacheMx.Lock()
+	defer f.cacheMx.Unlock()
+
+	entry, ok := f.cache[key]
+	if !ok {
+		return dnsmessage.Message{}, false
+	}
+	now := time.Now()
+	if !now.Before(entry.expires) {
+		delete(f.cache, key)
+		return dnsmessage.Message{}, false
+	}
+
+	elapsed := uint32(now.Sub(entry.cached) / time.Second)
+	msg := entry.response
+	msg.Answers = adjustTTLs(msg.Answers, elapsed)
+	msg.Authorities = adjustTTLs(msg.Authorities, elapsed)
+	msg.Additionals = adjustTTLs(msg.Additionals, elapsed)
+	return msg, true
+}
+
+// caches the response for the minimum ttl of its records.
+// negative responses are cached for the ttl of the soa
+// record of the zone. other failures are not cached.
+func (f *DNSForwarder) store(key dnsCacheKey, msg dnsmessage.Message) {
+
+	if msg.Header.Truncated ||
+		msg.Header.RCode != dnsmessage.RCodeSuccess && msg.Header.RCode != dnsmessage.RCodeNameError {
+		return
+	}
+
+	ttl := DNSCacheMaxTTL
+	records := 0
+	for _, section := range [][]dnsmessage.Resource{ msg.Answers, msg.Authorities, msg.Additionals } {
+		for _, r := range section {
+			if r.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			recordTTL := time.Duration(r.Header.TTL) * time.Second
+			if soa, ok := r.Body.(*dnsmessage.SOAResource); ok && time.Duration(soa.MinTTL) * time.Second < recordTTL {
+				recordTTL = time.Duration(soa.MinTTL) * time.Second
+			}
+			if recordTTL < ttl {
+				ttl = recordTTL
+			}
+			records++
+		}
+	}
+	if records == 0 || ttl <= 0 {
+		return
+	}
+
+	f.cacheMx.Lock()
+	defer f.cacheMx.Unlock()
+
+	now := time.Now()
+	if len(f.cache) >= DNSCacheSize {
+		for k, entry := range f.cache {
+			if !now.Before(entry.expires) {
+				delete(f.cache, k)
+			}
+		}
+		// evict an arbitrary entry if
+		// none of the entries expired
+		for k := range f.cache {
+			if len(f.cache) < DNSCacheSize {
+				break
+			}
+			delete(f.cache, k)
+		}
+	}
+	f.cache[key] = &dnsCacheEntry{
+		response: msg,
+		cached:   now,
+		expires:  now.Add(ttl),
+	}
+}
+
+// packs the response and truncates it if
+// it is larger than the given size
+func packResponse(msg dnsmessage.Message, maxSize int) []byte {
+
+	response, err := msg.Pack()
+	if err != nil {
+		logger.ErrorMessage("DNSForwarder.Resolve(): Error packing response: %s", err.Error())
+		return nil
+	}
+	if len(response) > maxSize {
+		msg.Header.Truncated = true
+		msg.Answers = nil
+		msg.Authorities = nil
+		msg.Additionals = nil
+		response, _ = msg.Pack()
+	}
+	return response
+}
+
+// returns a copy of the resources with
+// their ttls reduced by the given seconds
+func adjustTTLs(resources []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+
+	adjusted := make([]dnsmessage.Resource, len(resources))
+	for i, r := range resources {
+		adjusted[i] = r
+		if r.Header.Type == dnsmessage.TypeOPT {
+			// the ttl of an opt record holds
+			// the extended flags of the message
+			continue
+		}
+		if r.Header.TTL > elapsed {
+			adjusted[i].Header.TTL = r.Header.TTL - elapsed
+		} else {
+			adjusted[i].Header.TTL = 0
+		}
+	}
+	return adjusted
+}
+
+// returns the domain in lower case with a trailing dot
+func canonicalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(domain, "~"), "."))
+	return domain + "."
+}
+
+// returns whether the name is in the given domain
+func isSubdomain(name, domain string) bool {
+	return domain == "." || name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+func isClosedConnError(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
@@ -0,0 +1,218 @@
+package network_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/mevansam/goutils/network"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DNS Forwarder", func() {
+
+	var (
+		err error
+
+		forwarder *network.DNSForwarder
+
+		defaultUpstream *fakeDNSServer
+		corpUpstream    *fakeDNSServer
+	)
+
+	BeforeEach(func() {
+		defaultUpstream = newFakeDNSServer("198.51.100.1", 300)
+		corpUpstream = newFakeDNSServer("10.8.0.10", 1)
+
+		forwarder = network.NewDNSForwarder()
+		err = forwarder.SetUpstreams(".", defaultUpstream.addr())
+		Expect(err).ToNot(HaveOccurred())
+		err = forwarder.SetUpstreams("corp.example", corpUpstream.addr())
+		Expect(err).ToNot(HaveOccurred())
+		err = forwarder.Listen("127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(forwarder.Server()).To(Equal("127.0.0.1"))
+	})
+
+	AfterEach(func() {
+		forwarder.Close()
+		defaultUpstream.close()
+		corpUpstream.close()
+	})
+
+	lookup := func(network, name string) []string {
+		resolver := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				d := net.Dialer{}
+				return d.DialContext(ctx, network, forwarder.Addr().String())
+			},
+		}
+		addrs, err := resolver.LookupHost(context.Background(), name)
+		Expect(err).ToNot(HaveOccurred())
+		return addrs
+	}
+
+	It("forwards queries to the upstreams of the longest matching domain", func() {
+		Expect(lookup("udp", "www.example.com")).To(Equal([]string{ "198.51.100.1" }))
+		Expect(lookup("udp", "host.corp.example")).To(Equal([]string{ "10.8.0.10" }))
+		Expect(lookup("tcp", "HOST.Dev.Corp.Example")).To(Equal([]string{ "10.8.0.10" }))
+
+		// names in removed domains are forwarded
+		// to the upstreams of the root domain
+		err = forwarder.SetUpstreams("corp.example")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(lookup("udp", "host.corp.example")).To(Equal([]string{ "198.51.100.1" }))
+	})
+
+	It("caches answers until their ttl expires", func() {
+		Expect(lookup("udp", "www.example.com")).To(Equal([]string{ "198.51.100.1" }))
+		queries := defaultUpstream.queries.Load()
+		Expect(lookup("udp", "www.example.com")).To(Equal([]string{ "198.51.100.1" }))
+		Expect(defaultUpstream.queries.Load()).To(Equal(queries))
+
+		Expect(lookup("udp", "host.corp.example")).To(Equal([]string{ "10.8.0.10" }))
+		queries = corpUpstream.queries.Load()
+		time.Sleep(1100 * time.Millisecond)
+		Expect(lookup("udp", "host.corp.example")).To(Equal([]string{ "10.8.0.10" }))
+		Expect(corpUpstream.queries.Load()).To(BeNumerically(">", queries))
+	})
+
+	It("returns a server failure if no upstream responds", func() {
+		corpUpstream.close()
+
+		query := dnsmessage.Message{
+			Header:    dnsmessage.Header{ ID: 0x1234, RecursionDesired: true },
+			Questions: []dnsmessage.Question{ {
+				Name:  dnsmessage.MustNewName("host.corp.example."),
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+			} },
+		}
+		packed, err := query.Pack()
+		Expect(err).ToNot(HaveOccurred())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		response := dnsmessage.Message{}
+		Expect(response.Unpack(forwarder.Resolve(ctx, packed, true))).To(Succeed())
+		Expect(response.Header.ID).To(Equal(uint16(0x1234)))
+		Expect(response.Header.RCode).To(Equal(dnsmessage.RCodeServerFailure))
+	})
+
+	It("closes the tcp connections of clients when it is closed", func() {
+		query := dnsmessage.Message{
+			Header:    dnsmessage.Header{ ID: 0x1234, RecursionDesired: true },
+			Questions: []dnsmessage.Question{ {
+				Name:  dnsmessage.MustNewName("www.example.com."),
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+			} },
+		}
+		packed, err := query.Pack()
+		Expect(err).ToNot(HaveOccurred())
+
+		// connection that is held open after
+		// a query has been answered
+		conn, err := net.Dial("tcp", forwarder.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		_, err = conn.Write(append([]byte{ byte(len(packed) >> 8), byte(len(packed)) }, packed...))
+		Expect(err).ToNot(HaveOccurred())
+		length := make([]byte, 2)
+		_, err = io.ReadFull(conn, length)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = io.ReadFull(conn, make([]byte, int(length[0]) << 8 | int(length[1])))
+		Expect(err).ToNot(HaveOccurred())
+
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			forwarder.Close()
+		}()
+		Eventually(closed, time.Second).Should(BeClosed())
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(length)
+		Expect(err).To(Equal(io.EOF))
+	})
+})
+
+// fake dns server that answers all a queries with
+// the given ip and ttl and counts the a queries
+type fakeDNSServer struct {
+	conn    net.PacketConn
+	ip      [4]byte
+	ttl     uint32
+	queries atomic.Int32
+}
+
+func newFakeDNSServer(ip string, ttl uint32) *fakeDNSServer {
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+
+	s := &fakeDNSServer{ conn: conn, ttl: ttl }
+	copy(s.ip[:], net.ParseIP(ip).To4())
+
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			if response := s.answer(buffer[:n]); response != nil {
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+	return s
+}
+
+// returns the packed response to the packed query
+func (s *fakeDNSServer) answer(packed []byte) []byte {
+
+	query := dnsmessage.Message{}
+	if err := query.Unpack(packed); err != nil || len(query.Questions) == 0 {
+		return nil
+	}
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.Header.ID,
+			Response:           true,
+			Authoritative:      true,
+			RecursionDesired:   query.Header.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: query.Questions,
+	}
+	if q := query.Questions[0]; q.Type == dnsmessage.TypeA {
+		s.queries.Add(1)
+		response.Answers = []dnsmessage.Resource{ {
+			Header: dnsmessage.ResourceHeader{
+				Name:  q.Name,
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+				TTL:   s.ttl,
+			},
+			Body: &dnsmessage.AResource{ A: s.ip },
+		} }
+	}
+	packed, _ = response.Pack()
+	return packed
+}
+
+func (s *fakeDNSServer) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *fakeDNSServer) close() {
+	s.conn.Close()
+}
@@ -99,6 +99,10 @@ func (m *dnsManager) AddSearchDomains(domains []string) error {
 	return nil
 }
 
+func (m *dnsManager) SetInterfaceDNS(ifaceName string, dns InterfaceDNS) error {
+	return fmt.Errorf("interface dns settings have not been implemented for darwin os")
+}
+
 func (m *dnsManager) Clear() {
 
 	var (
@@ -4,11 +4,13 @@ package network
 
 import (
 	"context"
+	"fmt"
 	"net/netip"
 	"strings"
 	"time"
 
 	"github.com/godbus/dbus/v5"
+	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
 
 	"github.com/mevansam/goutils/logger"
@@ -16,6 +18,7 @@ import (
 
 type dnsManager struct {
 	nc       *networkContext
+	conn     *dbus.Conn
 	resolved dbus.BusObject
 }
 
@@ -36,6 +39,7 @@ const (
 	dbusResolvedObject                    = "org.freedesktop.resolve1"
 	dbusResolvedPath      dbus.ObjectPath = "/org/freedesktop/resolve1"
 	dbusResolvedInterface                 = "org.freedesktop.resolve1.Manager"
+	dbusResolvedLinkInterface             = "org.freedesktop.resolve1.Link"
 	dbusPath              dbus.ObjectPath = "/org/freedesktop/DBus"
 	dbusInterface                         = "org.freedesktop.DBus"
 	dbusOwnerSignal                       = "NameOwnerChanged" // broadcast when a well-known name's owning process changes.
@@ -51,8 +55,51 @@ type resolvedLinkDomain struct {
 	RoutingOnly bool
 }
 
+// returns whether systemd-resolved is running
+// on the host's system bus. replaced by tests.
+var resolvedAvailable = func() bool {
+
+	var (
+		err error
+
+		conn     *dbus.Conn
+		hasOwner bool
+	)
+
+	if conn, err = dbus.SystemBus(); err != nil {
+		return false
+	}
+	if err = conn.Object(dbusInterface, dbusPath).Call(
+		dbusInterface+".NameHasOwner", 0, dbusResolvedObject,
+	).Store(&hasOwner); err != nil {
+		return false
+	}
+	return hasOwner
+}
+
 func (c *networkContext) NewDNSManager() (DNSManager, error) {
 
+	var (
+		err error
+
+		dm *dnsManager
+	)
+
+	if !resolvedAvailable() {
+		// hosts without systemd-resolved are
+		// configured via their resolv.conf
+		c.dm = newResolvConfManager(c)
+		return c.dm, nil
+	}
+	if dm, err = newDNSManager(c); err != nil {
+		return nil, err
+	}
+	c.dm = dm
+	return c.dm, nil
+}
+
+func newDNSManager(c *networkContext) (*dnsManager, error) {
+
 	var (
 		err error
 
@@ -62,13 +109,11 @@ func (c *networkContext) NewDNSManager() (DNSManager, error) {
 	if conn, err = dbus.SystemBus(); err != nil {
 		return nil, err
 	}
-
-	dm := &dnsManager{
+	return &dnsManager{
 		nc:       c,
+		conn:     conn,
 		resolved: conn.Object(dbusResolvedObject, dbus.ObjectPath(dbusResolvedPath)),
-	}
-	c.dm = dm
-	return c.dm, nil
+	}, nil
 }
 
 func (m *dnsManager) AddDNSServers(servers []string) error {
@@ -94,18 +139,7 @@ func (m *dnsManager) AddDNSServers(servers []string) error {
 				)
 				continue
 			}
-			nsIPAddr := ip.As16()
-			if ip.Is4() {
-				linkNameservers[i] = resolvedLinkNameserver{
-					Family:  unix.AF_INET,
-					Address: nsIPAddr[12:],
-				}
-			} else {
-				linkNameservers[i] = resolvedLinkNameserver{
-					Family:  unix.AF_INET6,
-					Address: nsIPAddr[:],
-				}
-			}
+			linkNameservers[i] = newResolvedLinkNameserver(ip)
 		}
 	
 		if err = m.resolved.CallWithContext(
@@ -184,6 +218,74 @@ func (m *dnsManager) AddSearchDomains(domains []string) error {
 	return nil
 }
 
+func (m *dnsManager) SetInterfaceDNS(ifaceName string, dns InterfaceDNS) error {
+
+	var (
+		err error
+
+		link netlink.Link
+	)
+
+	for _, d := range dns.Domains {
+		if len(d.Domain) == 0 {
+			return fmt.Errorf("dns domains of interface '%s' cannot be empty", ifaceName)
+		}
+	}
+	if link, err = netlink.LinkByName(ifaceName); err != nil {
+		return err
+	}
+	index := link.Attrs().Index
+
+	if err = m.setLinkDNS(index, linkDNSSettings(dns)); err != nil {
+		return fmt.Errorf("unable to set DNS of interface '%s': %s", ifaceName, err.Error())
+	}
+	if m.nc.dnsLinks == nil {
+		m.nc.dnsLinks = make(map[int]InterfaceDNS)
+	}
+	if len(dns.Servers) == 0 && len(dns.Domains) == 0 {
+		delete(m.nc.dnsLinks, index)
+		return nil
+	}
+	m.nc.dnsLinks[index] = dns
+
+	if dns.DefaultRoute {
+		// only one of the interfaces configured
+		// by the manager is the default dns route
+		for i, other := range m.nc.dnsLinks {
+			if i != index && other.DefaultRoute {
+				other.DefaultRoute = false
+				if err = m.setLinkDNS(i, linkDNSSettings(other)); err != nil {
+					logger.ErrorMessage(
+						"dnsManager.SetInterfaceDNS(): Error removing default DNS route from link %d: %s",
+						i, err.Error(),
+					)
+					continue
+				}
+				m.nc.dnsLinks[i] = other
+			}
+		}
+	}
+	return nil
+}
+
+// returns the settings of a link for the given dns
+// settings. the routing only domain "." is added to
+// the default dns route so that the link is preferred
+// for all names that do not match a more specific
+// routing domain of any link.
+func linkDNSSettings(dns InterfaceDNS) *InterfaceDNS {
+
+	settings := &InterfaceDNS{
+		Servers:      append([]netip.Addr{}, dns.Servers...),
+		Domains:      append([]DNSDomain{}, dns.Domains...),
+		DefaultRoute: dns.DefaultRoute,
+	}
+	if dns.DefaultRoute {
+		settings.Domains = append(settings.Domains, DNSDomain{ Domain: ".", RoutingOnly: true })
+	}
+	return settings
+}
+
 func (m *dnsManager) Clear() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
 	defer cancel()
@@ -206,4 +308,121 @@ func (m *dnsManager) Clear() {
 			}	
 		}
 	}
+	// reset DNS configurations set for interfaces
+	for index := range m.nc.dnsLinks {
+		if err = m.resolved.CallWithContext(
+			ctx, dbusResolvedInterface+".RevertLink", 0, index,
+		).Err; err != nil {
+			logger.DebugMessage(
+				"dnsManager.Clear(): Error reverting DNS settings on link %d: %s", 
+				index, err.Error(),
+			)
+		}
+	}
+	m.nc.dnsLinks = nil
+}
+
+// returns the dns settings of the link with the given index
+func (m *dnsManager) linkDNS(index int) (*InterfaceDNS, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+
+	var (
+		err error
+
+		linkPath    dbus.ObjectPath
+		nameservers []resolvedLinkNameserver
+		domains     []resolvedLinkDomain
+	)
+
+	if err = m.resolved.CallWithContext(
+		ctx, dbusResolvedInterface+".GetLink", 0, index,
+	).Store(&linkPath); err != nil {
+		return nil, err
+	}
+	link := m.conn.Object(dbusResolvedObject, linkPath)
+	if err = link.StoreProperty(dbusResolvedLinkInterface+".DNS", &nameservers); err != nil {
+		return nil, err
+	}
+	if err = link.StoreProperty(dbusResolvedLinkInterface+".Domains", &domains); err != nil {
+		return nil, err
+	}
+
+	dns := &InterfaceDNS{
+		Servers: []netip.Addr{},
+		Domains: []DNSDomain{},
+	}
+	for _, ns := range nameservers {
+		if ip, ok := netip.AddrFromSlice(ns.Address); ok {
+			dns.Servers = append(dns.Servers, ip)
+		}
+	}
+	for _, d := range domains {
+		dns.Domains = append(dns.Domains, DNSDomain{ Domain: d.Domain, RoutingOnly: d.RoutingOnly })
+	}
+	// older versions of the resolver do not
+	// have a default route setting for links
+	if err = link.StoreProperty(dbusResolvedLinkInterface+".DefaultRoute", &dns.DefaultRoute); err != nil {
+		logger.DebugMessage(
+			"dnsManager.linkDNS(): Unable to read the DNS default route setting of link %d: %s",
+			index, err.Error(),
+		)
+	}
+	return dns, nil
+}
+
+// sets the dns settings of the link with the given index.
+// links without any dns servers or domains are reverted
+// so that their settings are managed by the host again.
+func (m *dnsManager) setLinkDNS(index int, dns *InterfaceDNS) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+
+	var (
+		err error
+	)
+
+	if len(dns.Servers) == 0 && len(dns.Domains) == 0 {
+		return m.resolved.CallWithContext(ctx, dbusResolvedInterface+".RevertLink", 0, index).Err
+	}
+
+	linkNameservers := make([]resolvedLinkNameserver, 0, len(dns.Servers))
+	for _, ip := range dns.Servers {
+		linkNameservers = append(linkNameservers, newResolvedLinkNameserver(ip))
+	}
+	linkDomains := make([]resolvedLinkDomain, 0, len(dns.Domains))
+	for _, d := range dns.Domains {
+		linkDomains = append(linkDomains, resolvedLinkDomain{ Domain: d.Domain, RoutingOnly: d.RoutingOnly })
+	}
+
+	if err = m.resolved.CallWithContext(
+		ctx, dbusResolvedInterface+".SetLinkDNS", 0, index, linkNameservers,
+	).Err; err != nil {
+		return err
+	}
+	if err = m.resolved.CallWithContext(
+		ctx, dbusResolvedInterface+".SetLinkDomains", 0, index, linkDomains,
+	).Err; err != nil {
+		return err
+	}
+	if err = m.resolved.CallWithContext(
+		ctx, dbusResolvedInterface+".SetLinkDefaultRoute", 0, index, dns.DefaultRoute,
+	).Err; err != nil {
+		return err
+	}
+	return m.resolved.CallWithContext(ctx, dbusResolvedInterface+".FlushCaches", 0).Err
+}
+
+func newResolvedLinkNameserver(ip netip.Addr) resolvedLinkNameserver {
+	nsIPAddr := ip.As16()
+	if ip.Is4() {
+		return resolvedLinkNameserver{
+			Family:  unix.AF_INET,
+			Address: nsIPAddr[12:],
+		}
+	}
+	return resolvedLinkNameserver{
+		Family:  unix.AF_INET6,
+		Address: nsIPAddr[:],
+	}
 }
@@ -0,0 +1,303 @@
+//go:build linux
+
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/mevansam/goutils/logger"
+)
+
+// the resolv.conf dns manager is used on hosts that do not run
+// systemd-resolved. the host's resolv.conf is backed up before
+// it is replaced and the backup is restored when the manager is
+// cleared. if resolv.conf is managed by resolvconf the settings
+// are added to resolvconf as a record of their own instead.
+type resolvConfManager struct {
+	nc *networkContext
+
+	path       string
+	backupPath string
+
+	// path of the resolvconf command if the
+	// host's resolv.conf is managed by resolvconf
+	resolvconf string
+
+	servers []netip.Addr
+	domains []string
+}
+
+const resolvConfHeader = `# Generated by the mycs dns manager. The original
+# configuration will be restored once it is cleared.
+`
+
+// root of the file system containing the
+// host's resolv.conf. replaced by tests.
+var resolvConfRoot = "/"
+
+// renames files. replaced by tests.
+var renameFile = os.Rename
+
+func newResolvConfManager(c *networkContext) *resolvConfManager {
+
+	path := filepath.Join(resolvConfRoot, "etc", "resolv.conf")
+	m := &resolvConfManager{
+		nc: c,
+
+		path:       path,
+		backupPath: path + ".mycs-backup",
+	}
+	// resolv.conf is a symlink to the file
+	// generated by resolvconf if it is in use
+	if target, err := os.Readlink(path); err == nil && strings.Contains(target, "resolvconf") {
+		for _, cmd := range []string{ "sbin/resolvconf", "usr/sbin/resolvconf" } {
+			cmdPath := filepath.Join(resolvConfRoot, cmd)
+			if info, err := os.Stat(cmdPath); err == nil && info.Mode()&0111 != 0 {
+				m.resolvconf = cmdPath
+				break
+			}
+		}
+	}
+	return m
+}
+
+func (m *resolvConfManager) AddDNSServers(servers []string) error {
+
+	for _, server := range servers {
+		ip, err := netip.ParseAddr(server)
+		if err != nil {
+			logger.ErrorMessage(
+				"resolvConfManager.AddDNSServers(): Error parsing DNS server '%s': %s",
+				server, err.Error(),
+			)
+			continue
+		}
+		m.servers = append(m.servers, ip)
+	}
+	return m.apply()
+}
+
+func (m *resolvConfManager) AddSearchDomains(domains []string) error {
+
+	for _, domain := range domains {
+		// resolv.conf does not support routing only domains
+		domain = strings.TrimSuffix(strings.TrimPrefix(domain, "~"), ".")
+		if len(domain) > 0 {
+			m.domains = append(m.domains, domain)
+		}
+	}
+	return m.apply()
+}
+
+func (m *resolvConfManager) SetInterfaceDNS(ifaceName string, dns InterfaceDNS) error {
+
+	if len(dns.Servers) == 0 && len(dns.Domains) == 0 {
+		m.Clear()
+		return nil
+	}
+	// all lookups are sent to the servers in resolv.conf so
+	// they can only be set for the default dns route
+	if !dns.DefaultRoute {
+		return fmt.Errorf(
+			"dns of interface '%s' can only be routed by domain if the host runs systemd-resolved",
+			ifaceName,
+		)
+	}
+
+	m.servers = append([]netip.Addr{}, dns.Servers...)
+	m.domains = []string{}
+	for _, d := range dns.Domains {
+		if !d.RoutingOnly {
+			m.domains = append(m.domains, strings.TrimSuffix(d.Domain, "."))
+		}
+	}
+	return m.apply()
+}
+
+func (m *resolvConfManager) Clear() {
+
+	var (
+		err error
+	)
+
+	m.servers = nil
+	m.domains = nil
+
+	if len(m.resolvconf) > 0 {
+		if err = runResolvconf(m.resolvconf, []string{ "-d", m.recordName() }, nil); err != nil {
+			logger.DebugMessage(
+				"resolvConfManager.Clear(): Error removing resolvconf record '%s': %s",
+				m.recordName(), err.Error(),
+			)
+		}
+		return
+	}
+
+	// restore the backup which may have been left
+	// behind by an instance that was not cleared
+	if _, err = os.Lstat(m.backupPath); err != nil {
+		return
+	}
+	if err = replaceFile(m.backupPath, m.path); err != nil {
+		logger.ErrorMessage(
+			"resolvConfManager.Clear(): Error restoring '%s' from '%s': %s",
+			m.path, m.backupPath, err.Error(),
+		)
+	}
+}
+
+// writes the dns settings to resolv.conf or
+// adds them to resolvconf if it is in use
+func (m *resolvConfManager) apply() error {
+
+	var (
+		err error
+
+		options []string
+	)
+
+	if len(m.resolvconf) > 0 {
+		return runResolvconf(m.resolvconf, []string{ "-a", m.recordName() }, m.content(nil))
+	}
+
+	if err = m.backup(); err != nil {
+		return err
+	}
+	// keep the resolver options of the original configuration
+	if data, err := os.ReadFile(m.backupPath); err == nil {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); strings.HasPrefix(line, "options") {
+				options = append(options, line)
+			}
+		}
+	}
+
+	// write to a temporary file and rename it so
+	// that resolv.conf is replaced atomically. if
+	// resolv.conf is a symlink the link is replaced
+	// and not the file it links to.
+	tmpFile := m.path + ".tmp"
+	if err = os.WriteFile(tmpFile, append([]byte(resolvConfHeader), m.content(options)...), 0644); err != nil {
+		return err
+	}
+	return replaceFile(tmpFile, m.path)
+}
+
+// replaces the file at the given path by renaming the given
+// file. a file that is a mount point such as a resolv.conf
+// bind-mounted into a container cannot be replaced so it is
+// truncated and rewritten in place with the given file's
+// content which is then removed.
+func replaceFile(file, path string) error {
+
+	var (
+		err error
+
+		data []byte
+	)
+
+	if err = renameFile(file, path); err == nil || !errors.Is(err, syscall.EBUSY) {
+		return err
+	}
+	if data, err = os.ReadFile(file); err != nil {
+		return err
+	}
+	if err = os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
+
+// backs up resolv.conf unless a backup exists. an
+// existing backup was made by an instance that was
+// not cleared so it is kept as resolv.conf has not
+// been restored since.
+func (m *resolvConfManager) backup() error {
+
+	var (
+		err error
+
+		info   os.FileInfo
+		target string
+		data   []byte
+	)
+
+	if _, err = os.Lstat(m.backupPath); err == nil {
+		return nil
+	}
+	if info, err = os.Lstat(m.path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if target, err = os.Readlink(m.path); err != nil {
+			return err
+		}
+		return os.Symlink(target, m.backupPath)
+	}
+
+	if data, err = os.ReadFile(m.path); err != nil {
+		return err
+	}
+	tmpFile := m.backupPath + ".tmp"
+	if err = os.WriteFile(tmpFile, data, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, m.backupPath)
+}
+
+// returns the resolv.conf content of the dns settings
+func (m *resolvConfManager) content(options []string) []byte {
+
+	var (
+		content bytes.Buffer
+	)
+
+	for _, server := range m.servers {
+		content.WriteString(fmt.Sprintf("nameserver %s\n", server))
+	}
+	if len(m.domains) > 0 {
+		content.WriteString(fmt.Sprintf("search %s\n", strings.Join(m.domains, " ")))
+	}
+	for _, option := range options {
+		content.WriteString(option + "\n")
+	}
+	return content.Bytes()
+}
+
+// returns the name of the resolvconf record
+// which is named after the routed interface
+func (m *resolvConfManager) recordName() string {
+	if len(m.nc.routedItfs) > 0 {
+		return m.nc.routedItfs[0].link.Attrs().Name
+	}
+	return "mycs"
+}
+
+func runResolvconf(cmd string, args []string, stdin []byte) error {
+
+	var (
+		output bytes.Buffer
+	)
+
+	resolvconf := exec.Command(cmd, args...)
+	resolvconf.Stdin = bytes.NewReader(stdin)
+	resolvconf.Stdout = &output
+	resolvconf.Stderr = &output
+	if err := resolvconf.Run(); err != nil {
+		return fmt.Errorf("%s %s failed: %s: %s", cmd, strings.Join(args, " "), err.Error(), output.String())
+	}
+	return nil
+}
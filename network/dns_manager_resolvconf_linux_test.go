@@ -0,0 +1,157 @@
+//go:build linux
+
+package network_test
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+
+	"github.com/mevansam/goutils/network"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Resolv.conf DNS Manager", func() {
+
+	var (
+		err error
+
+		root        string
+		resolvConf  string
+		restoreRoot func()
+
+		dnsManager network.DNSManager
+	)
+
+	const origResolvConf = "nameserver 10.0.0.1\nsearch lan\noptions edns0 trust-ad\n"
+
+	BeforeEach(func() {
+		root, err = os.MkdirTemp("", "resolvconf")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.MkdirAll(filepath.Join(root, "etc"), 0755)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(root, "run", "resolvconf"), 0755)).To(Succeed())
+		resolvConf = filepath.Join(root, "etc", "resolv.conf")
+
+		restoreRoot = network.UseResolvConfRoot(root)
+	})
+
+	AfterEach(func() {
+		restoreRoot()
+		os.RemoveAll(root)
+	})
+
+	newDNSManager := func() {
+		nc, err := network.NewNetworkContext()
+		Expect(err).ToNot(HaveOccurred())
+		dnsManager, err = nc.NewDNSManager()
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	readFile := func(path string) string {
+		data, err := os.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		return string(data)
+	}
+
+	It("replaces resolv.conf and restores it when cleared", func() {
+		Expect(os.WriteFile(resolvConf, []byte(origResolvConf), 0644)).To(Succeed())
+		newDNSManager()
+
+		err = dnsManager.AddDNSServers([]string{ "1.1.1.1", "2606:4700::1111" })
+		Expect(err).ToNot(HaveOccurred())
+		err = dnsManager.AddSearchDomains([]string{ "corp.example." })
+		Expect(err).ToNot(HaveOccurred())
+
+		content := readFile(resolvConf)
+		Expect(content).To(ContainSubstring("nameserver 1.1.1.1\nnameserver 2606:4700::1111\nsearch corp.example\noptions edns0 trust-ad\n"))
+		Expect(content).ToNot(ContainSubstring("10.0.0.1"))
+
+		// routing dns lookups by domain is not supported
+		err = dnsManager.SetInterfaceDNS("lo", network.InterfaceDNS{
+			Servers: []netip.Addr{ netip.MustParseAddr("10.8.0.1") },
+			Domains: network.ParseDNSDomains([]string{ "~corp.example" }),
+		})
+		Expect(err).To(HaveOccurred())
+
+		// a new instance restores the backup left by an
+		// instance that was not cleared
+		newDNSManager()
+		dnsManager.Clear()
+		Expect(readFile(resolvConf)).To(Equal(origResolvConf))
+		_, err = os.Lstat(resolvConf + ".mycs-backup")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("rewrites resolv.conf in place if it is a mount point", func() {
+		Expect(os.WriteFile(resolvConf, []byte(origResolvConf), 0644)).To(Succeed())
+		restoreMount := network.UseMountedFile(resolvConf)
+		defer restoreMount()
+		info, err := os.Stat(resolvConf)
+		Expect(err).ToNot(HaveOccurred())
+		newDNSManager()
+
+		err = dnsManager.AddDNSServers([]string{ "1.1.1.1" })
+		Expect(err).ToNot(HaveOccurred())
+		Expect(readFile(resolvConf)).To(ContainSubstring("nameserver 1.1.1.1\noptions edns0 trust-ad\n"))
+		_, err = os.Lstat(resolvConf + ".tmp")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		dnsManager.Clear()
+		Expect(readFile(resolvConf)).To(Equal(origResolvConf))
+		_, err = os.Lstat(resolvConf + ".mycs-backup")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		// the file was never replaced
+		rewritten, err := os.Stat(resolvConf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.SameFile(info, rewritten)).To(BeTrue())
+	})
+
+	It("replaces a symlinked resolv.conf and restores the symlink when cleared", func() {
+		Expect(os.WriteFile(filepath.Join(root, "run", "resolv.conf"), []byte(origResolvConf), 0644)).To(Succeed())
+		Expect(os.Symlink("../run/resolv.conf", resolvConf)).To(Succeed())
+		newDNSManager()
+
+		err = dnsManager.SetInterfaceDNS("lo", network.InterfaceDNS{
+			Servers:      []netip.Addr{ netip.MustParseAddr("10.8.0.1") },
+			Domains:      network.ParseDNSDomains([]string{ "corp.example", "~internal.example" }),
+			DefaultRoute: true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		info, err := os.Lstat(resolvConf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode() & os.ModeSymlink).To(BeZero())
+		Expect(readFile(resolvConf)).To(ContainSubstring("nameserver 10.8.0.1\nsearch corp.example\noptions edns0 trust-ad\n"))
+		Expect(readFile(filepath.Join(root, "run", "resolv.conf"))).To(Equal(origResolvConf))
+
+		dnsManager.Clear()
+		target, err := os.Readlink(resolvConf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(target).To(Equal("../run/resolv.conf"))
+	})
+
+	It("adds a record to resolvconf if it manages resolv.conf", func() {
+		Expect(os.WriteFile(filepath.Join(root, "run", "resolvconf", "resolv.conf"), []byte(origResolvConf), 0644)).To(Succeed())
+		Expect(os.Symlink("../run/resolvconf/resolv.conf", resolvConf)).To(Succeed())
+
+		// fake resolvconf that logs its
+		// arguments and the records added
+		Expect(os.MkdirAll(filepath.Join(root, "sbin"), 0755)).To(Succeed())
+		Expect(os.WriteFile(
+			filepath.Join(root, "sbin", "resolvconf"),
+			[]byte("#!/bin/sh\necho \"$@\" >> \"$(dirname \"$0\")/../resolvconf.log\"\ncat >> \"$(dirname \"$0\")/../resolvconf.log\"\n"),
+			0755,
+		)).To(Succeed())
+		newDNSManager()
+
+		err = dnsManager.AddDNSServers([]string{ "1.1.1.1" })
+		Expect(err).ToNot(HaveOccurred())
+		dnsManager.Clear()
+
+		Expect(readFile(filepath.Join(root, "resolvconf.log"))).To(Equal("-a mycs\nnameserver 1.1.1.1\n-d mycs\n"))
+		Expect(readFile(resolvConf)).To(Equal(origResolvConf))
+	})
+})
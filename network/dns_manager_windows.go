@@ -2,6 +2,10 @@
 
 package network
 
+import (
+	"fmt"
+)
+
 type dnsManager struct {
 	nc *networkContext
 }
@@ -22,5 +26,9 @@ func (m *dnsManager) AddSearchDomains(domains []string) error {
 	return nil
 }
 
+func (m *dnsManager) SetInterfaceDNS(ifaceName string, dns InterfaceDNS) error {
+	return fmt.Errorf("interface dns settings have not been implemented for windows os")
+}
+
 func (m *dnsManager) Clear() {
 }
@@ -0,0 +1,169 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// resolves names by querying the given upstreams
+// directly instead of via the host's resolver. with
+// dns-over-https or dns-over-tls upstreams lookups
+// are not visible to the local network.
+type DNSResolver struct {
+	upstreams []DNSUpstream
+}
+
+// returns a resolver that queries the given
+// upstreams in order until one responds
+func NewDNSResolver(upstreams ...DNSUpstream) *DNSResolver {
+	return &DNSResolver{
+		upstreams: upstreams,
+	}
+}
+
+// returns a resolver that queries the given dns-over-https
+// or dns-over-tls endpoints in order until one responds
+func NewSecureDNSResolver(endpoints ...SecureDNSEndpoint) (*DNSResolver, error) {
+
+	r := &DNSResolver{}
+	for _, endpoint := range endpoints {
+		upstream, err := NewSecureDNSUpstream(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, upstream)
+	}
+	return r, nil
+}
+
+// returns the ipv4 and ipv6 addresses of the given name
+func (r *DNSResolver) LookupNetIP(ctx context.Context, name string) ([]netip.Addr, error) {
+
+	var (
+		wg sync.WaitGroup
+	)
+
+	if addr, err := netip.ParseAddr(name); err == nil {
+		return []netip.Addr{ addr }, nil
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, &net.DNSError{ Err: err.Error(), Name: name }
+	}
+
+	qtypes := []dnsmessage.Type{ dnsmessage.TypeA, dnsmessage.TypeAAAA }
+	addrs := make([][]netip.Addr, len(qtypes))
+	errs := make([]error, len(qtypes))
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(i int, qtype dnsmessage.Type) {
+			defer wg.Done()
+			addrs[i], errs[i] = r.lookup(ctx, qname, qtype)
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	result := append(addrs[0], addrs[1]...)
+	if len(result) == 0 {
+		for _, err := range errs {
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, &net.DNSError{ Err: "no such host", Name: name, IsNotFound: true }
+	}
+	return result, nil
+}
+
+// resolves the given names in the same way as ResolveNames
+func (r *DNSResolver) ResolveNames(dnsNames []string, flatten bool) ([]string, [][]string, error) {
+
+	return resolveNames(dnsNames, flatten, func(name string) ([]net.IP, error) {
+
+		ctx, cancel := context.WithTimeout(context.Background(), DNSUpstreamTimeout)
+		defer cancel()
+
+		addrs, err := r.LookupNetIP(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		ips := make([]net.IP, 0, len(addrs))
+		for _, addr := range addrs {
+			ips = append(ips, net.IP(addr.AsSlice()))
+		}
+		return ips, nil
+	})
+}
+
+// queries the upstreams in order for the given record type
+func (r *DNSResolver) lookup(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) ([]netip.Addr, error) {
+
+	var (
+		err error
+
+		query    []byte
+		response []byte
+	)
+
+	if len(r.upstreams) == 0 {
+		return nil, fmt.Errorf("no dns upstreams have been configured")
+	}
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               uint16(rand.Uint32()),
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{ {
+			Name:  name,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		} },
+	}
+	if query, err = msg.Pack(); err != nil {
+		return nil, err
+	}
+
+	for _, upstream := range r.upstreams {
+		if response, err = upstream.Exchange(ctx, query); err != nil {
+			err = &net.DNSError{ Err: err.Error(), Name: name.String(), Server: upstream.String() }
+			continue
+		}
+		if err = msg.Unpack(response); err != nil {
+			err = &net.DNSError{ Err: err.Error(), Name: name.String(), Server: upstream.String() }
+			continue
+		}
+
+		switch msg.Header.RCode {
+		case dnsmessage.RCodeSuccess:
+			addrs := []netip.Addr{}
+			for _, answer := range msg.Answers {
+				switch body := answer.Body.(type) {
+				case *dnsmessage.AResource:
+					addrs = append(addrs, netip.AddrFrom4(body.A))
+				case *dnsmessage.AAAAResource:
+					addrs = append(addrs, netip.AddrFrom16(body.AAAA))
+				}
+			}
+			return addrs, nil
+
+		case dnsmessage.RCodeNameError:
+			return nil, &net.DNSError{ Err: "no such host", Name: name.String(), Server: upstream.String(), IsNotFound: true }
+
+		default:
+			// try the next upstream
+			err = &net.DNSError{ Err: msg.Header.RCode.String(), Name: name.String(), Server: upstream.String() }
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,181 @@
+package network_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/mevansam/goutils/network"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Secure DNS Resolver", func() {
+
+	var (
+		err error
+
+		upstream *fakeDNSServer
+
+		dohServer   *httptest.Server
+		dotListener net.Listener
+		pin         string
+	)
+
+	BeforeEach(func() {
+		upstream = newFakeDNSServer("198.51.100.7", 60)
+
+		dohServer = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query, _ := io.ReadAll(r.Body)
+			if r.Method != http.MethodPost ||
+				r.Header.Get("Content-Type") != "application/dns-message" ||
+				len(query) < 2 || query[0] != 0 || query[1] != 0 {
+
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/dns-message")
+			w.Write(upstream.answer(query))
+		}))
+		pin = network.CertificatePin(dohServer.Certificate())
+
+		// dns-over-tls server with the
+		// certificate of the https server
+		dotListener, err = tls.Listen("tcp", "127.0.0.1:0", dohServer.TLS)
+		Expect(err).ToNot(HaveOccurred())
+		go func() {
+			for {
+				conn, err := dotListener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					length := make([]byte, 2)
+					if _, err := io.ReadFull(conn, length); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(length))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					response := upstream.answer(query)
+					binary.BigEndian.PutUint16(length, uint16(len(response)))
+					conn.Write(append(length, response...))
+				}()
+			}
+		}()
+	})
+
+	AfterEach(func() {
+		dotListener.Close()
+		dohServer.Close()
+		upstream.close()
+	})
+
+	It("resolves names via dns-over-https with a pinned certificate", func() {
+		resolver, err := network.NewSecureDNSResolver(network.SecureDNSEndpoint{
+			URL:  "https://example.com/dns-query",
+			Addr: dohServer.Listener.Addr().String(),
+			Pins: []string{ pin },
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		ips, namedIPs, err := resolver.ResolveNames([]string{ "www.example.com", "10.1.1.1" }, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ips).To(Equal([]string{ "198.51.100.7", "10.1.1.1" }))
+		Expect(namedIPs).To(Equal([][]string{ { "198.51.100.7" }, { "10.1.1.1" } }))
+	})
+
+	It("resolves names via dns-over-tls with a pinned certificate", func() {
+		resolver, err := network.NewSecureDNSResolver(network.SecureDNSEndpoint{
+			URL:  "tls://" + dotListener.Addr().String(),
+			Pins: []string{ pin },
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		ips, _, err := resolver.ResolveNames([]string{ "www.example.com" }, false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ips).To(Equal([]string{ "198.51.100.7" }))
+	})
+
+	It("does not resolve names via endpoints that do not match the pins", func() {
+		resolver, err := network.NewSecureDNSResolver(
+			network.SecureDNSEndpoint{
+				URL:  dohServer.URL + "/dns-query",
+				Pins: []string{ "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=" },
+			},
+			network.SecureDNSEndpoint{
+				URL: "tls://" + dotListener.Addr().String(),
+			},
+		)
+		Expect(err).ToNot(HaveOccurred())
+
+		queries := upstream.queries.Load()
+		_, _, err = resolver.ResolveNames([]string{ "www.example.com" }, false)
+		Expect(err).To(HaveOccurred())
+		Expect(upstream.queries.Load()).To(Equal(queries))
+	})
+
+	It("does not trust unrelated certificates presented with a pinned certificate", func() {
+
+		// self-signed certificate for the endpoint's host which
+		// is presented with the pinned certificate appended
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{ CommonName: "example.com" },
+			DNSNames:     []string{ "example.com" },
+			IPAddresses:  []net.IP{ net.ParseIP("127.0.0.1") },
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{ x509.ExtKeyUsageServerAuth },
+		}
+		certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		Expect(err).ToNot(HaveOccurred())
+
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{ {
+				Certificate: [][]byte{ certDER, dohServer.Certificate().Raw },
+				PrivateKey:  key,
+			} },
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					conn.(*tls.Conn).Handshake()
+				}()
+			}
+		}()
+
+		resolver, err := network.NewSecureDNSResolver(network.SecureDNSEndpoint{
+			URL:  "tls://" + listener.Addr().String(),
+			Pins: []string{ pin },
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		_, _, err = resolver.ResolveNames([]string{ "www.example.com" }, false)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("not signed by a pinned certificate"))
+	})
+})
@@ -0,0 +1,170 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// timeout of a query sent to an upstream dns server
+var DNSUpstreamTimeout = 5 * time.Second
+
+// an upstream dns server queries are forwarded to
+type DNSUpstream interface {
+	// sends the packed dns query to the upstream
+	// server and returns the packed response
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+
+	String() string
+}
+
+// returns the upstream for the given server address which
+// is an ip address with an optional port or the url of a
+// dns-over-https or dns-over-tls endpoint
+func NewDNSUpstream(server string) (DNSUpstream, error) {
+
+	var (
+		err error
+
+		addrPort netip.AddrPort
+	)
+
+	if strings.HasPrefix(server, "https://") || strings.HasPrefix(server, "tls://") {
+		return NewSecureDNSUpstream(SecureDNSEndpoint{ URL: server })
+	}
+	if addr, err := netip.ParseAddr(server); err == nil {
+		return &plainDNSUpstream{ addr: netip.AddrPortFrom(addr, 53).String() }, nil
+	}
+	if addrPort, err = netip.ParseAddrPort(server); err != nil {
+		return nil, fmt.Errorf("invalid dns server address '%s': %s", server, err.Error())
+	}
+	return &plainDNSUpstream{ addr: addrPort.String() }, nil
+}
+
+// an upstream that is queried via udp and via tcp
+// if the response does not fit in a udp message
+type plainDNSUpstream struct {
+	addr string
+}
+
+func (u *plainDNSUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+
+	var (
+		err error
+
+		response []byte
+		header   dnsmessage.Header
+		parser   dnsmessage.Parser
+	)
+
+	if response, err = u.exchange(ctx, "udp", query); err != nil {
+		return nil, err
+	}
+	if header, err = parser.Start(response); err != nil {
+		return nil, err
+	}
+	if header.Truncated {
+		return u.exchange(ctx, "tcp", query)
+	}
+	return response, nil
+}
+
+func (u *plainDNSUpstream) exchange(ctx context.Context, network string, query []byte) ([]byte, error) {
+
+	var (
+		err error
+
+		dialer net.Dialer
+		conn   net.Conn
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, DNSUpstreamTimeout)
+	defer cancel()
+
+	if conn, err = dialer.DialContext(ctx, network, u.addr); err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		return exchangeStream(conn, query)
+	}
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, dnsMaxMessageSize)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		// ignore responses to other queries
+		if n >= 2 && buffer[0] == query[0] && buffer[1] == query[1] {
+			return append([]byte{}, buffer[:n]...), nil
+		}
+	}
+}
+
+func (u *plainDNSUpstream) String() string {
+	return u.addr
+}
+
+// sends a query over a stream connection and reads the
+// response. messages sent over streams are prefixed
+// with their length as two bytes in network byte order.
+func exchangeStream(conn io.ReadWriter, query []byte) ([]byte, error) {
+
+	var (
+		err error
+
+		response []byte
+	)
+
+	if err = writeStreamMessage(conn, query); err != nil {
+		return nil, err
+	}
+	if response, err = readStreamMessage(conn); err != nil {
+		return nil, err
+	}
+	if len(response) < 2 || response[0] != query[0] || response[1] != query[1] {
+		return nil, fmt.Errorf("dns response does not match the query")
+	}
+	return response, nil
+}
+
+func readStreamMessage(r io.Reader) ([]byte, error) {
+
+	var (
+		length [2]byte
+	)
+
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeStreamMessage(w io.Writer, msg []byte) error {
+
+	if len(msg) > dnsMaxMessageSize {
+		return fmt.Errorf("dns message of %d bytes is too large", len(msg))
+	}
+	data := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(data, uint16(len(msg)))
+	_, err := w.Write(append(data, msg...))
+	return err
+}
@@ -0,0 +1,269 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// a dns-over-https (RFC 8484) or
+// dns-over-tls (RFC 7858) endpoint
+type SecureDNSEndpoint struct {
+	// url of the endpoint i.e. "https://dns.example/dns-query"
+	// for dns-over-https or "tls://dns.example" for
+	// dns-over-tls which is served on port 853 by default
+	URL string
+	// address the endpoint is connected to instead of the
+	// address its host resolves to. this avoids looking
+	// up the endpoint via the host's resolver.
+	Addr string
+	// pins of the certificates the endpoint may present as
+	// returned by CertificatePin. if pins are given the
+	// endpoint is trusted only if its leaf certificate is
+	// pinned or is signed via its chain by a pinned
+	// certificate. otherwise the endpoint's certificate
+	// is verified against the host's roots.
+	Pins []string
+}
+
+// returns the pin of the given certificate which is the
+// base64 encoded sha256 hash of its public key info
+func CertificatePin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// returns an upstream that sends queries to
+// the given dns-over-https or dns-over-tls endpoint
+func NewSecureDNSUpstream(endpoint SecureDNSEndpoint) (DNSUpstream, error) {
+
+	var (
+		err error
+
+		endpointURL *url.URL
+	)
+
+	if endpointURL, err = url.Parse(endpoint.URL); err != nil {
+		return nil, fmt.Errorf("invalid dns endpoint url '%s': %s", endpoint.URL, err.Error())
+	}
+	if len(endpointURL.Hostname()) == 0 {
+		return nil, fmt.Errorf("dns endpoint url '%s' has no host", endpoint.URL)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: endpointURL.Hostname(),
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(endpoint.Pins) > 0 {
+		// the chain is verified against the pinned
+		// certificates instead of the host's roots so
+		// that the endpoint may use a self-signed
+		// certificate
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = verifyPinnedConnection(endpointURL.Hostname(), endpoint.Pins)
+	}
+
+	switch endpointURL.Scheme {
+	case "https":
+		addr := endpointURL.Host
+		if len(endpointURL.Port()) == 0 {
+			addr = net.JoinHostPort(endpointURL.Hostname(), "443")
+		}
+		return newDoHUpstream(endpointURL.String(), dialAddr(addr, endpoint.Addr), tlsConfig), nil
+
+	case "tls":
+		addr := endpointURL.Host
+		if len(endpointURL.Port()) == 0 {
+			addr = net.JoinHostPort(endpointURL.Hostname(), "853")
+		}
+		return &dotUpstream{
+			url:       endpointURL.String(),
+			addr:      dialAddr(addr, endpoint.Addr),
+			tlsConfig: tlsConfig,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported dns endpoint scheme '%s'", endpointURL.Scheme)
+	}
+}
+
+// an upstream that is queried via dns-over-https
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func newDoHUpstream(url, addr string, tlsConfig *tls.Config) *dohUpstream {
+
+	dialer := &net.Dialer{}
+	return &dohUpstream{
+		url: url,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, addr)
+				},
+				TLSClientConfig:     tlsConfig,
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: 2,
+				IdleConnTimeout:     30 * time.Second,
+			},
+		},
+	}
+}
+
+func (u *dohUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+
+	var (
+		err error
+
+		request  *http.Request
+		response *http.Response
+		body     []byte
+	)
+
+	if len(query) < 2 {
+		return nil, fmt.Errorf("invalid dns query")
+	}
+	ctx, cancel := context.WithTimeout(ctx, DNSUpstreamTimeout)
+	defer cancel()
+
+	// the id of queries sent via https should be
+	// zero so that responses can be cached by
+	// http caches. the id of the response is set
+	// to the id of the original query.
+	msg := append([]byte{ 0, 0 }, query[2:]...)
+	if request, err = http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(msg)); err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/dns-message")
+	request.Header.Set("Accept", "application/dns-message")
+
+	if response, err = u.client.Do(request); err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns endpoint '%s' returned status %d", u.url, response.StatusCode)
+	}
+	if body, err = io.ReadAll(io.LimitReader(response.Body, dnsMaxMessageSize+1)); err != nil {
+		return nil, err
+	}
+	if len(body) < 2 || len(body) > dnsMaxMessageSize {
+		return nil, fmt.Errorf("dns endpoint '%s' returned an invalid response", u.url)
+	}
+	body[0], body[1] = query[0], query[1]
+	return body, nil
+}
+
+func (u *dohUpstream) String() string {
+	return u.url
+}
+
+// an upstream that is queried via dns-over-tls
+type dotUpstream struct {
+	url       string
+	addr      string
+	tlsConfig *tls.Config
+}
+
+func (u *dotUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+
+	var (
+		err error
+
+		conn net.Conn
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, DNSUpstreamTimeout)
+	defer cancel()
+
+	dialer := &tls.Dialer{ Config: u.tlsConfig }
+	if conn, err = dialer.DialContext(ctx, "tcp", u.addr); err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return exchangeStream(conn, query)
+}
+
+func (u *dotUpstream) String() string {
+	return u.url
+}
+
+// returns a tls connection verifier that accepts the connection
+// if the chain presented by the endpoint is valid for the host and
+// leads from the leaf certificate to a pinned certificate. pinned
+// certificates in the chain are trusted as roots so the leaf must
+// be pinned itself or be signed via the chain by a pinned
+// certificate. matching a pin to any certificate of an unverified
+// chain is not sufficient as the chain may have been made up.
+func verifyPinnedConnection(host string, pins []string) func(tls.ConnectionState) error {
+
+	return func(state tls.ConnectionState) error {
+
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("dns endpoint did not present a certificate")
+		}
+
+		roots := x509.NewCertPool()
+		intermediates := x509.NewCertPool()
+		pinned := false
+		for _, cert := range state.PeerCertificates {
+			if isPinned(cert, pins) {
+				roots.AddCert(cert)
+				pinned = true
+			} else {
+				intermediates.AddCert(cert)
+			}
+		}
+		if !pinned {
+			return fmt.Errorf("certificate of dns endpoint '%s' does not match any of the pinned certificates", host)
+		}
+		if _, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+			DNSName:       host,
+			Roots:         roots,
+			Intermediates: intermediates,
+		}); err != nil {
+			return fmt.Errorf("certificate of dns endpoint '%s' is not signed by a pinned certificate: %s", host, err.Error())
+		}
+		return nil
+	}
+}
+
+// returns whether the given certificate is pinned
+func isPinned(cert *x509.Certificate, pins []string) bool {
+	certPin := CertificatePin(cert)
+	for _, pin := range pins {
+		if certPin == pin {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the address to dial which is the given
+// address with the host replaced by the override
+func dialAddr(addr, override string) string {
+
+	if len(override) == 0 {
+		return addr
+	}
+	if _, _, err := net.SplitHostPort(override); err == nil {
+		return override
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	return net.JoinHostPort(override, port)
+}
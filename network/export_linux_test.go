@@ -0,0 +1,194 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// replaces the kernel's packet filter with an in-memory
+// packet filter that is shared by the filter routers
+// created until the returned function is called
+func UseInMemoryPacketFilter() (restore func()) {
+	nft := newMemNftConn()
+	newNftConn = func() nftConn {
+		return nft
+	}
+	return func() {
+		newNftConn = func() nftConn {
+			return &kernelNftConn{}
+		}
+	}
+}
+
+// makes the first retrieval of rules from the in-memory
+// packet filter after it is next flushed fail as if the
+// kernel could not be read once a batch was committed
+func FailRuleRetrievalAfterNextCommit() {
+	newNftConn().(*memNftConn).flushedRulesErr = fmt.Errorf("unable to list rules")
+}
+
+// turns the ip lists in the in-memory packet filter into
+// sets as created by older versions of the router which
+// were neither interval sets nor had element timeouts. the
+// lists must only contain permanent addresses that are
+// not adjacent so each is a range of a single address.
+func DowngradeIPLists() {
+	nft := newNftConn().(*memNftConn)
+	for _, pt := range nft.model.tables {
+		for _, ps := range pt.sets {
+			if ps.set.Name != ipDenyListKey && ps.set.Name != ipAllowListKey {
+				continue
+			}
+			set := *ps.set
+			set.Interval, set.HasTimeout = false, false
+			ps.set = &set
+
+			elems := []memElement{}
+			for _, pe := range ps.elems {
+				if !pe.IntervalEnd {
+					elems = append(elems, pe)
+				}
+			}
+			ps.elems = elems
+		}
+	}
+}
+
+// replaces the resolution of names and the kernel's routing
+// table used by named routes. names are resolved by calling
+// the given function and the returned function lists the
+// destinations that are routed.
+func UseFakeNamedRouting(resolve func(name string) ([]netip.Addr, error)) (routed func() []string, restore func()) {
+
+	var (
+		mx sync.Mutex
+	)
+	routes := make(map[string]bool)
+
+	lookupNetIP = func(_ context.Context, _, name string) ([]netip.Addr, error) {
+		return resolve(name)
+	}
+	routeAdd = func(route *netlink.Route) error {
+		mx.Lock()
+		defer mx.Unlock()
+		if routes[route.Dst.String()] {
+			return fmt.Errorf("route to %s exists", route.Dst)
+		}
+		routes[route.Dst.String()] = true
+		return nil
+	}
+	routeDel = func(route *netlink.Route) error {
+		mx.Lock()
+		defer mx.Unlock()
+		if !routes[route.Dst.String()] {
+			return fmt.Errorf("route to %s does not exist", route.Dst)
+		}
+		delete(routes, route.Dst.String())
+		return nil
+	}
+
+	routed = func() []string {
+		mx.Lock()
+		defer mx.Unlock()
+		return sortedKeys(routes)
+	}
+	restore = func() {
+		lookupNetIP = net.DefaultResolver.LookupNetIP
+		routeAdd = netlink.RouteAdd
+		routeDel = netlink.RouteDel
+	}
+	return routed, restore
+}
+
+// replaces the kernel's link, address and route updates
+// and its routing table used by the network monitor. the
+// updates sent on the returned channels are delivered to
+// the monitor and the routing table is listed by calling
+// the given function.
+func UseFakeNetworkUpdates(routes func(family int) []netlink.Route) (
+	links chan<- netlink.LinkUpdate,
+	addrs chan<- netlink.AddrUpdate,
+	routeUpdates chan<- netlink.RouteUpdate,
+	restore func(),
+) {
+	fakeLinks := make(chan netlink.LinkUpdate)
+	fakeAddrs := make(chan netlink.AddrUpdate)
+	fakeRoutes := make(chan netlink.RouteUpdate)
+
+	subscribeNetlink = func(
+		links chan netlink.LinkUpdate,
+		addrs chan netlink.AddrUpdate,
+		routes chan netlink.RouteUpdate,
+		done chan struct{},
+	) error {
+		go func() {
+			defer func() {
+				close(links)
+				close(addrs)
+				close(routes)
+			}()
+			for {
+				select {
+				case <-done:
+					return
+				case u := <-fakeLinks:
+					links <- u
+				case u := <-fakeAddrs:
+					addrs <- u
+				case u := <-fakeRoutes:
+					routes <- u
+				}
+			}
+		}()
+		return nil
+	}
+	listRoutes = func(_ netlink.Link, family int) ([]netlink.Route, error) {
+		return routes(family), nil
+	}
+
+	restore = func() {
+		subscribeNetlink = subscribeKernelUpdates
+		listRoutes = netlink.RouteList
+		loadNetworkInfo()
+	}
+	return fakeLinks, fakeAddrs, fakeRoutes, restore
+}
+
+// makes the dns managers created until the returned
+// function is called manage the resolv.conf in the
+// given root directory instead of systemd-resolved
+func UseResolvConfRoot(root string) (restore func()) {
+	origResolvedAvailable := resolvedAvailable
+	resolvedAvailable = func() bool {
+		return false
+	}
+	resolvConfRoot = root
+	return func() {
+		resolvedAvailable = origResolvedAvailable
+		resolvConfRoot = "/"
+	}
+}
+
+// makes the replacement of the given file by renaming
+// another file onto it fail as it does when the file is
+// a mount point such as a bind-mounted resolv.conf
+func UseMountedFile(path string) (restore func()) {
+	renameFile = func(oldpath, newpath string) error {
+		if newpath == path {
+			return &os.LinkError{ Op: "rename", Old: oldpath, New: newpath, Err: syscall.EBUSY }
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	return func() {
+		renameFile = os.Rename
+	}
+}
@@ -0,0 +1,48 @@
+package network
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// minimum mtu of ipv4 and ipv6 links
+	MinIPv4MTU = 576
+	MinIPv6MTU = 1280
+
+	// overhead of the ip, udp and wireguard headers
+	// added to the packets sent through a wireguard
+	// tunnel with an ipv4 or ipv6 endpoint
+	WireguardOverhead4 = 60
+	WireguardOverhead6 = 80
+)
+
+var (
+	// time to wait for an icmp error in response to
+	// a path mtu probe before the path mtu is read
+	PathMTUProbeTimeout = 500 * time.Millisecond
+	// maximum number of probes sent to discover the path mtu
+	PathMTUProbes = 8
+	// port path mtu probes are sent to which
+	// defaults to the udp discard port
+	PathMTUProbePort = 9
+)
+
+// returns the mtu of a tunnel whose packets are sent over a
+// path with the given mtu and are encapsulated with the given
+// overhead. the mtu is not reduced below the minimum mtu of
+// ipv6 links so that ipv6 can be routed through the tunnel.
+func TunnelMTU(pathMTU, overhead int) int {
+	mtu := pathMTU - overhead
+	if mtu < MinIPv6MTU {
+		return MinIPv6MTU
+	}
+	return mtu
+}
+
+func validateMTU(mtu int) error {
+	if mtu < MinIPv4MTU || mtu > 65535 {
+		return fmt.Errorf("invalid mtu %d", mtu)
+	}
+	return nil
+}
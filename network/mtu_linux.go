@@ -0,0 +1,112 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// discovers the mtu of the path to the given destination. udp
+// probes the size of the path mtu known to the kernel are sent
+// with the don't fragment bit set. routers along the path that
+// cannot forward a probe respond with an icmp error which lowers
+// the path mtu cached by the kernel. probes are sent until the
+// cached path mtu no longer changes.
+func DiscoverPathMTU(ctx context.Context, dst netip.Addr) (int, error) {
+
+	var (
+		err error
+
+		conn    *net.UDPConn
+		rawConn syscall.RawConn
+		mtu     int
+	)
+
+	level, discoverOpt, discoverDo, mtuOpt, headerSize :=
+		unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO, unix.IP_MTU, 28
+	if dst.Unmap().Is6() {
+		level, discoverOpt, discoverDo, mtuOpt, headerSize =
+			unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO, unix.IPV6_MTU, 48
+	} else {
+		dst = dst.Unmap()
+	}
+
+	if conn, err = net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(dst, uint16(PathMTUProbePort)))); err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if rawConn, err = conn.SyscallConn(); err != nil {
+		return 0, err
+	}
+
+	// returns the path mtu cached by the kernel
+	// which is the mtu of the route to the
+	// destination if no probe has failed
+	pathMTU := func() (int, error) {
+		var mtu int
+		cerr := rawConn.Control(func(fd uintptr) {
+			mtu, err = unix.GetsockoptInt(int(fd), level, mtuOpt)
+		})
+		if cerr != nil {
+			return 0, cerr
+		}
+		// the mtu of links such as the loopback
+		// may exceed the maximum ip packet size
+		if mtu > 65535 {
+			mtu = 65535
+		}
+		return mtu, err
+	}
+
+	if cerr := rawConn.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), level, discoverOpt, discoverDo)
+	}); cerr != nil {
+		return 0, cerr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unable to set the don't fragment bit on path mtu probes: %s", err.Error())
+	}
+	if mtu, err = pathMTU(); err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < PathMTUProbes; i++ {
+		if _, err = conn.Write(make([]byte, mtu-headerSize)); err != nil &&
+			!errors.Is(err, unix.EMSGSIZE) &&
+			!errors.Is(err, unix.ECONNREFUSED) {
+
+			// the path mtu was lowered if the probe was too large
+			// and the destination may respond to probes with port
+			// unreachable errors. any other error is a failure.
+			return 0, err
+		}
+		if err == nil {
+			// wait for a router along the
+			// path to reject the probe
+			select {
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case <-time.After(PathMTUProbeTimeout):
+			}
+		}
+
+		probedMTU := mtu
+		if mtu, err = pathMTU(); err != nil {
+			return 0, err
+		}
+		if mtu == probedMTU {
+			// the probe of the path mtu
+			// size was not rejected
+			return mtu, nil
+		}
+	}
+	return mtu, nil
+}
@@ -0,0 +1,40 @@
+//go:build linux
+
+package network_test
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/mevansam/goutils/network"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Path MTU", func() {
+
+	It("discovers the path mtu to a destination", func() {
+		lo, err := net.InterfaceByName("lo")
+		Expect(err).ToNot(HaveOccurred())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+		defer cancel()
+
+		mtu, err := network.DiscoverPathMTU(ctx, netip.MustParseAddr("127.0.0.1"))
+		Expect(err).ToNot(HaveOccurred())
+		if lo.MTU > 65535 {
+			Expect(mtu).To(Equal(65535))
+		} else {
+			Expect(mtu).To(Equal(lo.MTU))
+		}
+	})
+
+	It("returns the mtu of a tunnel over a path", func() {
+		Expect(network.TunnelMTU(1500, network.WireguardOverhead4)).To(Equal(1440))
+		Expect(network.TunnelMTU(1500, network.WireguardOverhead6)).To(Equal(1420))
+		Expect(network.TunnelMTU(1300, network.WireguardOverhead6)).To(Equal(network.MinIPv6MTU))
+	})
+})
@@ -0,0 +1,13 @@
+//go:build windows
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+)
+
+func DiscoverPathMTU(ctx context.Context, dst netip.Addr) (int, error) {
+	return 0, fmt.Errorf("path mtu discovery has not been implemented for windows os")
+}
@@ -1,6 +1,11 @@
 package network
 
-import "net/netip"
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
 
 const (
 	WORLD4 = "0.0.0.0/0"
@@ -32,6 +37,273 @@ type PortGroup struct {
 
 	FromPort, 
 	ToPort int
+
+	// optional limits on the traffic to the port group.
+	// packet rate and connection limits apply to new
+	// connections and byte rate limits apply to all the
+	// packets of the port group. packets that exceed a
+	// limit are dropped.
+	RateLimit *RateLimit
+	ConnLimit uint32 // max concurrent connections per source address
+}
+type RateLimit struct {
+	// packets per second of new connections
+	// or bytes per second of all packets if
+	// Bytes is set
+	Rate  uint64
+	Burst uint32
+	Bytes bool
+}
+
+// The complete desired state of the filters
+// managed by a FilterRouter. Filters that are
+// installed but not present in the spec are
+// removed when the spec is applied.
+type FilterSpec struct {
+	DenyList  []netip.Addr
+	AllowList []netip.Addr
+
+	DenyPrefixes  []netip.Prefix
+	AllowPrefixes []netip.Prefix
+
+	// security groups keyed by the name of the
+	// inbound interface they should be applied
+	// to. security groups keyed by an empty name
+	// apply to traffic from all interfaces.
+	SecurityGroups map[string][]SecurityGroup
+
+	PortForwards    []PortForward
+	TrafficForwards []TrafficForward
+	TrafficMarks    []TrafficMark
+}
+type PortForward struct {
+	Proto Protocol
+
+	// optional ip the forwarded port is bound to
+	DstIP   netip.Addr
+	DstPort int
+	// optional end of a range of ports starting at
+	// DstPort that is forwarded to the range of the
+	// same size starting at ForwardPort
+	DstToPort int
+
+	ForwardIP   netip.Addr
+	ForwardPort int
+
+	// optional backends the forwarded traffic is
+	// distributed across instead of ForwardIP
+	ForwardIPs []netip.Addr
+	Balance    LoadBalance
+}
+
+// how forwarded traffic is distributed across backends
+type LoadBalance string
+const (
+	BalanceRoundRobin LoadBalance = "round-robin" // default
+	BalanceRandom     LoadBalance = "random"
+	// connections from a source address are
+	// always forwarded to the same backend
+	BalanceSourceHash LoadBalance = "source-hash"
+)
+type TrafficForward struct {
+	SrcItfName, 
+	DstItfName string
+
+	SrcNetwork,
+	DstNetwork netip.Prefix
+
+	WithNat bool
+	// optional source nat of the forwarded traffic
+	// when WithNat is set. traffic is masqueraded
+	// to the address of the destination interface
+	// if no nat address is given.
+	Snat SourceNat
+}
+type SourceNat struct {
+	// address or range of addresses the source
+	// address of the traffic is translated to
+	FromIP,
+	ToIP netip.Addr // optional end of the address range
+
+	// map a source address to the same nat
+	// address for all of its connections
+	Persistent bool
+	// randomize the mapping of source ports
+	Random bool
+}
+
+// sets a firewall mark on the traffic matched by its
+// selectors so that it can be routed by a routing rule
+// that matches the mark. traffic originating from the
+// host is also marked if no source interface is given.
+type TrafficMark struct {
+	// optional selectors of the traffic to mark
+	SrcItfName string
+
+	SrcNetwork,
+	DstNetwork netip.Prefix
+
+	Proto   Protocol
+	DstPort int
+
+	Mark uint32
+}
+
+// routes the traffic matched by its selectors using the
+// routes of a custom routing table. at least one selector
+// is required. rules without a source prefix are added
+// for both ipv4 and ipv6 traffic.
+type RoutingRule struct {
+	// optional priority of the rule. the
+	// kernel assigns one if it is not set
+	Priority int
+	Table    int
+
+	SrcPrefix netip.Prefix
+	IifName   string
+
+	Mark uint32
+	Mask uint32 // optional mask applied to the mark
+}
+
+// a route added to a custom routing table
+type TableRoute struct {
+	Table int
+	Dst   netip.Prefix
+
+	// optional gateway the route is via
+	GatewayIP     netip.Addr
+	InterfaceName string
+}
+
+// the configuration of a wireguard interface. keys
+// are base64 encoded as created by CreateVPNKeyPair.
+type WireguardConfig struct {
+	PrivateKey string
+	// optional port to listen on. a random
+	// port is used if it is not given.
+	ListenPort int
+
+	// the interface's peers replace
+	// any existing peers when configured
+	Peers []WireguardPeer
+}
+
+type WireguardPeer struct {
+	PublicKey    string
+	PresharedKey string // optional
+
+	// optional "host:port" of the peer
+	Endpoint   string
+	AllowedIPs []netip.Prefix
+
+	// optional interval at which keepalive
+	// packets are sent to the peer
+	PersistentKeepalive time.Duration
+}
+
+// an element of an ip allow or deny list. single
+// addresses are listed as full length prefixes.
+type IPListElement struct {
+	Prefix netip.Prefix
+
+	// the ttl the element was added with and
+	// the time remaining before it expires. both
+	// are zero for elements that do not expire.
+	TTL       time.Duration
+	Remaining time.Duration
+}
+
+// a snapshot of the host's routes, routing rules,
+// interface addresses and interface dns settings.
+// snapshots can be saved to disk so that a recovery
+// process can undo the changes left behind by a
+// process that did not exit cleanly.
+type NetworkSnapshot struct {
+	Interfaces []InterfaceSnapshot `json:"interfaces"`
+	Routes     []RouteSnapshot     `json:"routes"`
+	Rules      []RuleSnapshot      `json:"rules"`
+}
+
+type InterfaceSnapshot struct {
+	Name      string         `json:"name"`
+	Addresses []netip.Prefix `json:"addresses"`
+
+	// the dns settings of the interface. nil
+	// if they could not be read from the host's
+	// resolver in which case they are not restored.
+	DNS *InterfaceDNS `json:"dns,omitempty"`
+}
+
+type InterfaceDNS struct {
+	Servers      []netip.Addr `json:"servers"`
+	Domains      []DNSDomain  `json:"domains"`
+	DefaultRoute bool         `json:"defaultRoute"`
+}
+
+type DNSDomain struct {
+	Domain      string `json:"domain"`
+	RoutingOnly bool   `json:"routingOnly"`
+}
+
+type RouteSnapshot struct {
+	Table int          `json:"table"`
+	Dst   netip.Prefix `json:"dst"`
+
+	GatewayIP     netip.Addr `json:"gateway"`
+	SrcIP         netip.Addr `json:"src"`
+	InterfaceName string     `json:"interface"`
+
+	Metric   int `json:"metric"`
+	Scope    int `json:"scope"`
+	Protocol int `json:"protocol"`
+}
+
+type RuleSnapshot struct {
+	IsIPv6   bool `json:"ipv6"`
+	Priority int  `json:"priority"`
+	Table    int  `json:"table"`
+
+	SrcPrefix netip.Prefix `json:"src"`
+	DstPrefix netip.Prefix `json:"dst"`
+	IifName   string       `json:"iifName"`
+	OifName   string       `json:"oifName"`
+
+	Mark uint32 `json:"mark"`
+	Mask uint32 `json:"mask"`
+
+	// -1 if the rule does not suppress
+	// routes by their prefix length
+	SuppressPrefixLen int  `json:"suppressPrefixLen"`
+	Invert            bool `json:"invert"`
+}
+
+type NetworkEventType int
+const (
+	DefaultRouteChanged NetworkEventType = iota
+	InterfaceUp
+	InterfaceDown
+	AddressAdded
+	AddressRemoved
+)
+
+// a change of the network. the global Network
+// properties have already been refreshed when
+// a default route changed event is received.
+type NetworkEvent struct {
+	Type NetworkEventType
+
+	InterfaceIndex int
+	InterfaceName  string
+
+	// the address that was added or removed
+	Address netip.Prefix
+
+	// the new default route of the family whose
+	// default route changed. nil if the default
+	// route of the family has been removed.
+	DefaultRoute *Route
+	IsIPv6       bool
 }
 
 type NetworkContext interface {	
@@ -42,6 +314,16 @@ type NetworkContext interface {
 
 	DisableIPv6() error
 
+	// subscribes to changes of the network. events are
+	// sent on the returned channel until unsubscribe is
+	// called after which the channel is closed.
+	Subscribe() (events <-chan NetworkEvent, unsubscribe func(), err error)
+
+	// captures the host's routing and dns state and
+	// returns the host to a previously captured state
+	Snapshot() (*NetworkSnapshot, error)
+	Restore(snapshot *NetworkSnapshot) error
+
 	NewDNSManager() (DNSManager, error)
 	NewRouteManager() (RouteManager, error)
 
@@ -52,6 +334,16 @@ type DNSManager interface {
 	AddDNSServers(servers []string) error
 	AddSearchDomains(domains []string) error
 
+	// sets the dns servers and domains of the given
+	// interface. lookups of names in its routing only
+	// domains are sent to the interface's servers. if
+	// the interface is the default dns route all other
+	// lookups are also sent to its servers and the other
+	// interfaces configured by the manager no longer
+	// are. the interface's settings are reverted if it
+	// has neither servers nor domains.
+	SetInterfaceDNS(ifaceName string, dns InterfaceDNS) error
+
 	Clear()
 }
 
@@ -60,20 +352,57 @@ type RouteManager interface {
 	GetRoutableInterface(ifaceName string) (RoutableInterface, error)
 	NewRoutableInterface(ifaceName, tunAddress string) (RoutableInterface, error)
 
-	NewFilterRouter(denyAll bool) (FilterRouter, error)
+	NewFilterRouter(denyAll bool, options ...FilterRouterOption) (FilterRouter, error)
+
+	// creates tun and wireguard interfaces that are
+	// deleted when the route manager is cleared. the
+	// next available name with the prefix "tun" or
+	// "wg" is used if an interface name is not given.
+	CreateTunInterface(ifaceName string) (string, error)
+	CreateWireguardInterface(ifaceName string, config WireguardConfig) (string, error)
+	ConfigureWireguardInterface(ifaceName string, config WireguardConfig) error
+	DeleteInterface(ifaceName string) error
 
 	AddExternalRouteToIPs(ips []string) error
 	AddDefaultRoute(gateway string) error
 
+	// policy based routing via custom routing tables
+	AddRoutingRule(rule RoutingRule) error
+	DeleteRoutingRule(rule RoutingRule) error
+	AddTableRoute(route TableRoute) error
+	DeleteTableRoute(route TableRoute) error
+
+	// routes the addresses the given names resolve to
+	// via the given interface. the names are resolved
+	// again at the given interval and the routes are
+	// updated as the addresses of the names change.
+	AddRoutesToNames(names []string, ifaceName string, refresh time.Duration) (NamedRoutes, error)
+
 	Clear()
 }
 
+// routes to the addresses of a set of dns names
+type NamedRoutes interface {
+	// the routed addresses keyed by name
+	Addresses() map[string][]netip.Addr
+
+	// resolves the names and updates the routes
+	Refresh() error
+	// stops resolving the names and
+	// deletes the routes to their addresses
+	Delete() error
+}
+
 type RoutableInterface interface {
 	Name() string
 	Address4() (string, string, error)
 	Address6() (string, string, error)
 	MakeDefaultRoute() error
 
+	// the maximum transmission unit of the interface
+	MTU() (int, error)
+	SetMTU(mtu int) error
+
 	SetSecurityGroups(sgs []SecurityGroup) error
 	DeleteSecurityGroups(sgs []SecurityGroup) error
 
@@ -88,11 +417,25 @@ type RoutableInterface interface {
 
 type FilterRouter interface {
 
+	Apply(desired FilterSpec) error
+
 	AddIPsToDenyList(ips []netip.Addr) error
+	AddIPsToDenyListWithTTL(ips []netip.Addr, ttl time.Duration) error
 	DeleteIPsFromDenyList(ips []netip.Addr) error
+	ListDenyList() ([]IPListElement, error)
+
+	AddPrefixesToDenyList(prefixes []netip.Prefix) error
+	AddPrefixesToDenyListWithTTL(prefixes []netip.Prefix, ttl time.Duration) error
+	DeletePrefixesFromDenyList(prefixes []netip.Prefix) error
 	
 	AddIPsToAllowList(ips []netip.Addr) error
+	AddIPsToAllowListWithTTL(ips []netip.Addr, ttl time.Duration) error
 	DeleteIPsFromAllowList(ips []netip.Addr) error
+	ListAllowList() ([]IPListElement, error)
+
+	AddPrefixesToAllowList(prefixes []netip.Prefix) error
+	AddPrefixesToAllowListWithTTL(prefixes []netip.Prefix, ttl time.Duration) error
+	DeletePrefixesFromAllowList(prefixes []netip.Prefix) error
 
 	SetSecurityGroups(sgs []SecurityGroup, iifName string) error
 	DeleteSecurityGroups(sgs []SecurityGroup, iifName string) error
@@ -103,10 +446,139 @@ type FilterRouter interface {
 	ForwardPortOnIP(dstPort, forwardPort int, dstIP, forwardIP netip.Addr, proto Protocol) (string, error)
 	DeleteForwardPortOnIP(dstPort, forwardPort int, dstIP, forwardIP netip.Addr, proto Protocol) error
 
+	// forwards port ranges and load balances
+	// ports across backends
+	AddPortForward(pf PortForward) (string, error)
+	DeletePortForward(pf PortForward) error
+
 	ForwardTraffic(srcItfName, dstItfName string, srcNetwork, dstNetwork netip.Prefix, withNat bool) (string, error)
+	ForwardTrafficWithSnat(srcItfName, dstItfName string, srcNetwork, dstNetwork netip.Prefix, snat SourceNat) (string, error)
 	DeleteForwardTraffic(srcItfName, dstItfName string, srcNetwork, dstNetwork netip.Prefix) error
 
+	MarkTraffic(tm TrafficMark) (string, error)
+	DeleteTrafficMark(tm TrafficMark) error
+
 	DeleteFilter(key string) error
 
+	Stats() (map[string]FilterStats, error)
+
+	// returns the router's tables as a script
+	// that can be loaded with 'nft -f'
+	NftScript() (string, error)
+
+	// returns the changes recorded by a
+	// router created in dry-run mode
+	Plan() FilterPlan
+
 	Clear()
 }
+
+// the traffic matched by the rules of a filter
+type FilterStats struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// an option of a new filter router which is
+// either FilterDryRun or a DropLogging value
+type FilterRouterOption interface {
+	filterRouterOption()
+}
+
+type filterRouterFlag int
+
+func (filterRouterFlag) filterRouterOption() {}
+
+const (
+	// the filter router records the changes it would
+	// make to the packet filter in its plan instead of
+	// applying them
+	FilterDryRun filterRouterFlag = iota
+)
+
+// packets dropped by the deny lists, deny security
+// groups and the deny all policy of a filter router
+// created with this option are logged to the kernel
+// log before they are dropped
+type DropLogging struct {
+	// prefix of the kernel log messages. the reason
+	// the packet was dropped is appended to it.
+	Prefix string
+	// syslog level name as used by nft i.e.
+	// "emerg", "alert", "crit", "err", "warn",
+	// "notice", "info" or "debug". defaults to
+	// "warn" if not set.
+	Level string
+	// maximum number of messages logged per second
+	// for each logging rule. 0 means no limit.
+	RateLimit uint64
+}
+
+func (DropLogging) filterRouterOption() {}
+
+// the changes recorded by a filter router in
+// dry-run mode in the order they were made
+type FilterPlan []FilterPlanStep
+
+type FilterPlanStep struct {
+	// "add", "insert" or "delete"
+	Op string
+	// "table", "chain", "set", "map", "element" or "rule"
+	Object string
+	// family and name of the table i.e. "ip mycs_router_ipv4"
+	Table string
+	// name of the chain or set
+	Name string
+	// handle of a deleted rule or of the rule
+	// a rule is added after or inserted before
+	Handle uint64
+	// the rule statement, the set elements or
+	// the definition of a chain or set
+	Spec string
+}
+
+// returns the step as an nft command
+func (s FilterPlanStep) String() string {
+	cmd := []string{ s.Op, s.Object, s.Table }
+	if len(s.Name) > 0 {
+		cmd = append(cmd, s.Name)
+	}
+	if s.Handle > 0 {
+		if s.Op == "delete" {
+			cmd = append(cmd, fmt.Sprintf("handle %d", s.Handle))
+		} else {
+			cmd = append(cmd, fmt.Sprintf("position %d", s.Handle))
+		}
+	}
+	if len(s.Spec) > 0 {
+		cmd = append(cmd, s.Spec)
+	}
+	return strings.Join(cmd, " ")
+}
+
+// returns the plan as nft commands
+func (p FilterPlan) String() string {
+	var out strings.Builder
+	for _, s := range p {
+		out.WriteString(s.String())
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+func (t NetworkEventType) String() string {
+	switch t {
+	case DefaultRouteChanged:
+		return "default route changed"
+	case InterfaceUp:
+		return "interface up"
+	case InterfaceDown:
+		return "interface down"
+	case AddressAdded:
+		return "address added"
+	case AddressRemoved:
+		return "address removed"
+	default:
+		return fmt.Sprintf("unknown network event %d", int(t))
+	}
+}
@@ -3,6 +3,7 @@ package network
 import (
 	"fmt"
 	"net/netip"
+	"sync"
 	"time"
 )
 
@@ -39,6 +40,10 @@ var (
 	initErr     chan error
 	initialized bool
 
+	// guards the global network properties
+	// which are refreshed as the network changes
+	networkMx sync.RWMutex
+
 	prefixWorld4 = netip.MustParsePrefix(WORLD4)
 	prefixWorld6 = netip.MustParsePrefix(WORLD6)
 )
@@ -62,15 +67,36 @@ func (r *Route) String() string {
 // network context type common functions
 
 func (c *networkContext) DefaultInterface() string {
-	return Network.DefaultIPv4Route.InterfaceName
+	defaultRoute, _ := defaultRoutes()
+	if defaultRoute == nil {
+		return ""
+	}
+	return defaultRoute.InterfaceName
 }
 
 func (c *networkContext) DefaultGateway() string {
-	return Network.DefaultIPv4Route.GatewayIP.String()
+	defaultRoute, _ := defaultRoutes()
+	if defaultRoute == nil {
+		return ""
+	}
+	return defaultRoute.GatewayIP.String()
 }
 
 func (c *networkContext) DefaultIP() string {
-	return Network.DefaultIPv4Route.SrcIP.String()
+	defaultRoute, _ := defaultRoutes()
+	if defaultRoute == nil {
+		return ""
+	}
+	return defaultRoute.SrcIP.String()
+}
+
+// returns the current ipv4 and ipv6 default routes. the
+// routes are replaced and not modified when the global
+// network properties are refreshed.
+func defaultRoutes() (*Route, *Route) {
+	networkMx.RLock()
+	defer networkMx.RUnlock()
+	return Network.DefaultIPv4Route, Network.DefaultIPv6Route
 }
 
 // commong network context initialization functions
@@ -64,6 +64,18 @@ func (c *networkContext) DisableIPv6() error {
 	return nil
 }
 
+func (c *networkContext) Subscribe() (<-chan NetworkEvent, func(), error) {
+	return nil, nil, fmt.Errorf("network change monitoring has not been implemented for darwin os")
+}
+
+func (c *networkContext) Snapshot() (*NetworkSnapshot, error) {
+	return nil, fmt.Errorf("network snapshots have not been implemented for darwin os")
+}
+
+func (c *networkContext) Restore(snapshot *NetworkSnapshot) error {
+	return fmt.Errorf("network snapshots have not been implemented for darwin os")
+}
+
 func (c *networkContext) Clear() {
 	
 	var (
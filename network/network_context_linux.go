@@ -16,7 +16,30 @@ type networkContext struct {
 	routedItfs []routableInterface
 	routedIPs  []netlink.Route
 
-	dm *dnsManager
+	// policy routing rules and the
+	// routes of their custom tables
+	routingRules []RoutingRule
+	tableRoutes  []TableRoute
+
+	// routes to the addresses of dns names
+	namedRoutes []*namedRoutes
+
+	// dns settings of interfaces set by
+	// the dns manager by interface index
+	dnsLinks map[int]InterfaceDNS
+
+	// names of the tun and wireguard
+	// interfaces created by the context
+	createdLinks []string
+
+	// the default routes of each address family
+	// (0 = ipv4, 1 = ipv6) that were replaced by
+	// the route manager and are restored when the
+	// context is cleared. nil if the family had
+	// no default route.
+	replacedDefaultRoutes map[int]*Route
+
+	dm DNSManager
 	rm *routeManager
 }
 
@@ -30,7 +53,11 @@ func NewNetworkContext() (NetworkContext, error) {
 }
 
 func (c *networkContext) DefaultDeviceName() string {
-	return Network.DefaultIPv4Route.InterfaceName
+	defaultRoute, _ := defaultRoutes()
+	if defaultRoute == nil {
+		return ""
+	}
+	return defaultRoute.InterfaceName
 }
 
 func (c *networkContext) DisableIPv6() error {
@@ -53,64 +80,100 @@ func init() {
 
 func readNetworkInfo() {
 
+	if err := loadNetworkInfo(); err != nil {
+		initErr <- err
+		return
+	}
+	if defaultRoute, _ := defaultRoutes(); defaultRoute == nil {
+		initErr <- fmt.Errorf("unable to determine default network interface and gateway")
+		return
+	}
+	initErr <- nil
+}
+
+// reads the routing tables and replaces the global
+// network properties. the properties are replaced
+// under a lock once both tables have been read so
+// they can be refreshed as the network changes.
+func loadNetworkInfo() error {
+
 	var (
 		err error
 
-		routes []netlink.Route
+		defaultIPv4Route,
+		defaultIPv6Route *Route
+		staticRoutes []*Route
 	)
 
+	if defaultIPv4Route, defaultIPv6Route, staticRoutes, err = readDefaultRoutes(); err != nil {
+		return err
+	}
+
+	networkMx.Lock()
+	defer networkMx.Unlock()
+
+	Network.DefaultIPv4Route = defaultIPv4Route
+	Network.DefaultIPv6Route = defaultIPv6Route
 	Network.ScopedDefaults = nil
-	Network.StaticRoutes = nil
+	Network.StaticRoutes = staticRoutes
+	return nil
+}
+
+// reads the routing tables and returns the ipv4 and
+// ipv6 default routes and the static routes
+func readDefaultRoutes() (*Route, *Route, []*Route, error) {
+
+	var (
+		err error
 
-	if routes, err = netlink.RouteList(nil, netlink.FAMILY_V4); err != nil {
+		routes []netlink.Route
+
+		defaultIPv4Route,
+		defaultIPv6Route *Route
+		staticRoutes4,
+		staticRoutes6 []*Route
+	)
+
+	if routes, err = listRoutes(nil, netlink.FAMILY_V4); err != nil {
 		logger.ErrorMessage("networkContext.init(): Error looking up ipv4 routes: %s", err.Error())
-		initErr <- err
-		return
+		return nil, nil, nil, err
 	}
-	if err = readRoutes(
+	if defaultIPv4Route, staticRoutes4, err = readRoutes(
 		netip.MustParseAddr("0.0.0.0"), 
 		netip.MustParsePrefix("0.0.0.0/0"), 
 		routes,
-		netlink.FAMILY_V4,
 	); err != nil {
-		initErr <- err
-		return
+		return nil, nil, nil, err
 	}
 
-	if routes, err = netlink.RouteList(nil, netlink.FAMILY_V6); err != nil {
+	if routes, err = listRoutes(nil, netlink.FAMILY_V6); err != nil {
 		logger.ErrorMessage("networkContext.init(): Error looking up ipv6 routes: %s", err.Error())
-		initErr <- err
-		return
+		return nil, nil, nil, err
 	}
-	if err = readRoutes(
+	if defaultIPv6Route, staticRoutes6, err = readRoutes(
 		netip.MustParseAddr("::"),
 		netip.MustParsePrefix("::/0"),
 		routes,
-		netlink.FAMILY_V6,
 	); err != nil {
-		initErr <- err
-		return
-	}
-
-	if Network.DefaultIPv4Route == nil {
-		initErr <- fmt.Errorf("unable to determine default network interface and gateway")
-		return
+		return nil, nil, nil, err
 	}
 
-	initErr <- nil
+	return defaultIPv4Route, defaultIPv6Route, append(staticRoutes4, staticRoutes6...), nil
 }
 
 func readRoutes(
 	defaultRouteIP netip.Addr, 
 	defaultRouteCIDR netip.Prefix,  
 	routes []netlink.Route,
-	family int,
-) error {
+) (*Route, []*Route, error) {
 
 	var (
 		err error
 		ok  bool
 
+		defaultRoute *Route
+		staticRoutes []*Route
+
 		iface  *net.Interface
 		addrs  []net.Addr
 		prefix netip.Prefix
@@ -123,7 +186,7 @@ func readRoutes(
 				route.LinkIndex,
 				err.Error(),
 			)
-			return err
+			return nil, nil, err
 		}
 		r := &Route{
 			InterfaceIndex:    route.LinkIndex,
@@ -159,11 +222,7 @@ func readRoutes(
 			r.DestIP = defaultRouteIP
 			r.DestCIDR = defaultRouteCIDR
 
-			if family == netlink.FAMILY_V4 {
-				Network.DefaultIPv4Route = r
-			} else {
-				Network.DefaultIPv6Route = r
-			}
+			defaultRoute = r
 
 		} else {
 			if r.DestIP, ok = netip.AddrFromSlice(route.Dst.IP); !ok {
@@ -172,9 +231,9 @@ func readRoutes(
 			}
 			ones, _ := route.Dst.Mask.Size()
 			r.DestCIDR = netip.PrefixFrom(r.DestIP, ones)
-			Network.StaticRoutes = append(Network.StaticRoutes, r)
+			staticRoutes = append(staticRoutes, r)
 		}
 	}
 
-	return nil
+	return defaultRoute, staticRoutes, nil
 }
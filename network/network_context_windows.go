@@ -2,6 +2,10 @@
 
 package network
 
+import (
+	"fmt"
+)
+
 type networkContext struct {
 }
 
@@ -19,3 +23,15 @@ func (c *networkContext) DisableIPv6() error {
 
 func (c *networkContext) Clear() {
 }
+
+func (c *networkContext) Subscribe() (<-chan NetworkEvent, func(), error) {
+	return nil, nil, fmt.Errorf("network change monitoring has not been implemented for windows os")
+}
+
+func (c *networkContext) Snapshot() (*NetworkSnapshot, error) {
+	return nil, fmt.Errorf("network snapshots have not been implemented for windows os")
+}
+
+func (c *networkContext) Restore(snapshot *NetworkSnapshot) error {
+	return fmt.Errorf("network snapshots have not been implemented for windows os")
+}
@@ -0,0 +1,303 @@
+//go:build linux
+
+package network
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/mevansam/goutils/logger"
+)
+
+var (
+	// number of events buffered for a subscriber. events
+	// are dropped if a subscriber's buffer is full.
+	NetworkEventBufferSize = 64
+
+	// subscribes to the kernel's link, address and route
+	// updates and lists the routing and link tables.
+	// replaced by rootless tests.
+	subscribeNetlink = subscribeKernelUpdates
+	listRoutes       = netlink.RouteList
+	listLinks        = netlink.LinkList
+
+	// the monitor shared by all subscriptions. it is
+	// started by the first subscription and stopped
+	// once all subscriptions have been cancelled.
+	monitor   *networkMonitor
+	monitorMx sync.Mutex
+)
+
+type networkMonitor struct {
+	subscribers map[chan NetworkEvent]bool
+
+	// whether each link is running by index
+	linksUp map[int]bool
+
+	done chan struct{}
+}
+
+func (c *networkContext) Subscribe() (<-chan NetworkEvent, func(), error) {
+
+	var (
+		err error
+
+		once sync.Once
+	)
+
+	monitorMx.Lock()
+	defer monitorMx.Unlock()
+
+	if monitor == nil {
+		if monitor, err = startNetworkMonitor(); err != nil {
+			return nil, nil, err
+		}
+	}
+	m := monitor
+
+	events := make(chan NetworkEvent, NetworkEventBufferSize)
+	m.subscribers[events] = true
+
+	unsubscribe := func() {
+		once.Do(func() {
+			monitorMx.Lock()
+			defer monitorMx.Unlock()
+
+			delete(m.subscribers, events)
+			close(events)
+			if len(m.subscribers) == 0 && monitor == m {
+				close(m.done)
+				monitor = nil
+			}
+		})
+	}
+	return events, unsubscribe, nil
+}
+
+func subscribeKernelUpdates(
+	links chan netlink.LinkUpdate,
+	addrs chan netlink.AddrUpdate,
+	routes chan netlink.RouteUpdate,
+	done chan struct{},
+) error {
+	if err := netlink.LinkSubscribe(links, done); err != nil {
+		return err
+	}
+	if err := netlink.AddrSubscribe(addrs, done); err != nil {
+		return err
+	}
+	return netlink.RouteSubscribe(routes, done)
+}
+
+// subscribes to netlink updates and starts the
+// go routine that translates them to events
+func startNetworkMonitor() (*networkMonitor, error) {
+
+	var (
+		err error
+
+		links []netlink.Link
+	)
+
+	m := &networkMonitor{
+		subscribers: make(map[chan NetworkEvent]bool),
+		linksUp:     make(map[int]bool),
+		done:        make(chan struct{}),
+	}
+	if links, err = listLinks(); err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		m.linksUp[link.Attrs().Index] = link.Attrs().RawFlags&unix.IFF_RUNNING != 0
+	}
+	// refresh the global network properties so
+	// events are emitted for changes made after
+	// the monitor has started
+	if err = loadNetworkInfo(); err != nil {
+		return nil, err
+	}
+
+	linkUpdates := make(chan netlink.LinkUpdate)
+	addrUpdates := make(chan netlink.AddrUpdate)
+	routeUpdates := make(chan netlink.RouteUpdate)
+	if err = subscribeNetlink(linkUpdates, addrUpdates, routeUpdates, m.done); err != nil {
+		close(m.done)
+		return nil, err
+	}
+
+	go func() {
+		for {
+			select {
+			case <-m.done:
+				// drain the updates until the
+				// subscriptions have been closed
+				if linkUpdates != nil {
+					go func(ch chan netlink.LinkUpdate) { for range ch {} }(linkUpdates)
+				}
+				if addrUpdates != nil {
+					go func(ch chan netlink.AddrUpdate) { for range ch {} }(addrUpdates)
+				}
+				if routeUpdates != nil {
+					go func(ch chan netlink.RouteUpdate) { for range ch {} }(routeUpdates)
+				}
+				return
+
+			case u, ok := <-linkUpdates:
+				if !ok {
+					if !m.stopped() {
+						logger.ErrorMessage("networkMonitor: Subscription to link updates has been closed")
+					}
+					linkUpdates = nil
+					continue
+				}
+				m.linkUpdate(u)
+
+			case u, ok := <-addrUpdates:
+				if !ok {
+					if !m.stopped() {
+						logger.ErrorMessage("networkMonitor: Subscription to address updates has been closed")
+					}
+					addrUpdates = nil
+					continue
+				}
+				m.addrUpdate(u)
+				// the source addresses of the
+				// default routes may have changed
+				m.refresh()
+
+			case _, ok := <-routeUpdates:
+				if !ok {
+					if !m.stopped() {
+						logger.ErrorMessage("networkMonitor: Subscription to route updates has been closed")
+					}
+					routeUpdates = nil
+					continue
+				}
+				m.refresh()
+			}
+		}
+	}()
+	return m, nil
+}
+
+func (m *networkMonitor) stopped() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// emits an event if the running state of a link changed
+func (m *networkMonitor) linkUpdate(u netlink.LinkUpdate) {
+
+	index := int(u.Index)
+	up := u.Header.Type != unix.RTM_DELLINK && u.Flags&unix.IFF_RUNNING != 0
+	if wasUp, ok := m.linksUp[index]; ok && wasUp == up {
+		return
+	}
+	if u.Header.Type == unix.RTM_DELLINK {
+		delete(m.linksUp, index)
+	} else {
+		m.linksUp[index] = up
+	}
+
+	event := NetworkEvent{
+		Type:           InterfaceDown,
+		InterfaceIndex: index,
+	}
+	if u.Link != nil {
+		event.InterfaceName = u.Attrs().Name
+	}
+	if up {
+		event.Type = InterfaceUp
+	}
+	m.emit(event)
+}
+
+func (m *networkMonitor) addrUpdate(u netlink.AddrUpdate) {
+
+	addr, ok := netip.AddrFromSlice(u.LinkAddress.IP)
+	if !ok {
+		return
+	}
+	ones, _ := u.LinkAddress.Mask.Size()
+
+	event := NetworkEvent{
+		Type:           AddressRemoved,
+		InterfaceIndex: u.LinkIndex,
+		Address:        netip.PrefixFrom(addr.Unmap(), ones),
+		IsIPv6:         !addr.Unmap().Is4(),
+	}
+	if iface, err := net.InterfaceByIndex(u.LinkIndex); err == nil {
+		event.InterfaceName = iface.Name
+	}
+	if u.NewAddr {
+		event.Type = AddressAdded
+	}
+	m.emit(event)
+}
+
+// refreshes the global network properties and emits an
+// event for each family whose default route changed
+func (m *networkMonitor) refresh() {
+
+	oldIPv4Route, oldIPv6Route := defaultRoutes()
+	if err := loadNetworkInfo(); err != nil {
+		logger.ErrorMessage("networkMonitor.refresh(): Unable to refresh network info: %s", err.Error())
+		return
+	}
+	newIPv4Route, newIPv6Route := defaultRoutes()
+
+	if routeChanged(oldIPv4Route, newIPv4Route) {
+		m.emitDefaultRouteChanged(newIPv4Route, false)
+	}
+	if routeChanged(oldIPv6Route, newIPv6Route) {
+		m.emitDefaultRouteChanged(newIPv6Route, true)
+	}
+}
+
+func (m *networkMonitor) emitDefaultRouteChanged(route *Route, isIPv6 bool) {
+
+	event := NetworkEvent{
+		Type:         DefaultRouteChanged,
+		DefaultRoute: route,
+		IsIPv6:       isIPv6,
+	}
+	if route != nil {
+		event.InterfaceIndex = route.InterfaceIndex
+		event.InterfaceName = route.InterfaceName
+	}
+	m.emit(event)
+}
+
+// sends the event to all subscribers without blocking
+func (m *networkMonitor) emit(event NetworkEvent) {
+
+	monitorMx.Lock()
+	defer monitorMx.Unlock()
+
+	for events := range m.subscribers {
+		select {
+		case events <- event:
+		default:
+			logger.ErrorMessage("networkMonitor.emit(): Dropping event '%s' as a subscriber is not receiving events", event.Type)
+		}
+	}
+}
+
+// returns whether the route traffic
+// is sent via has changed
+func routeChanged(old, new *Route) bool {
+	if old == nil || new == nil {
+		return old != new
+	}
+	return old.InterfaceIndex != new.InterfaceIndex ||
+		old.GatewayIP != new.GatewayIP ||
+		old.SrcIP != new.SrcIP
+}
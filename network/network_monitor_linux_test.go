@@ -0,0 +1,127 @@
+//go:build linux
+
+package network_test
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/mevansam/goutils/network"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Network Monitor", func() {
+
+	var (
+		mx      sync.Mutex
+		gateway net.IP
+
+		links   chan<- netlink.LinkUpdate
+		addrs   chan<- netlink.AddrUpdate
+		routes  chan<- netlink.RouteUpdate
+		restore func()
+
+		networkContext network.NetworkContext
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		networkContext, err = network.NewNetworkContext()
+		Expect(err).ToNot(HaveOccurred())
+
+		gateway = net.ParseIP("198.51.100.1").To4()
+		links, addrs, routes, restore = network.UseFakeNetworkUpdates(func(family int) []netlink.Route {
+			mx.Lock()
+			defer mx.Unlock()
+			// default routes via the loopback interface
+			if family == netlink.FAMILY_V6 {
+				return []netlink.Route{{ LinkIndex: 1, Gw: net.ParseIP("2001:db8::1") }}
+			}
+			if gateway != nil {
+				return []netlink.Route{{ LinkIndex: 1, Gw: gateway }}
+			}
+			return nil
+		})
+	})
+
+	AfterEach(func() {
+		restore()
+	})
+
+	It("emits events as the network changes", func() {
+		events, unsubscribe, err := networkContext.Subscribe()
+		Expect(err).ToNot(HaveOccurred())
+
+		mx.Lock()
+		gateway = net.ParseIP("198.51.100.2").To4()
+		mx.Unlock()
+		routes <- netlink.RouteUpdate{ Type: unix.RTM_NEWROUTE }
+		event := <-events
+		Expect(event.Type).To(Equal(network.DefaultRouteChanged))
+		Expect(event.InterfaceName).To(Equal("lo"))
+		Expect(event.IsIPv6).To(BeFalse())
+		Expect(event.DefaultRoute.GatewayIP).To(Equal(netip.MustParseAddr("198.51.100.2")))
+
+		// the global network properties are refreshed
+		// before the event is emitted
+		Expect(network.Network.DefaultIPv4Route.GatewayIP).To(Equal(netip.MustParseAddr("198.51.100.2")))
+		Expect(network.Network.DefaultIPv6Route.GatewayIP).To(Equal(netip.MustParseAddr("2001:db8::1")))
+
+		// no event is emitted if the default route is unchanged
+		routes <- netlink.RouteUpdate{ Type: unix.RTM_NEWROUTE }
+		Consistently(events, 100 * time.Millisecond).ShouldNot(Receive())
+
+		link := &netlink.Dummy{ LinkAttrs: netlink.LinkAttrs{ Name: "fake0", Index: 9999 } }
+		update := netlink.LinkUpdate{ Link: link }
+		update.Header.Type = unix.RTM_NEWLINK
+		update.Index = 9999
+		update.Flags = unix.IFF_UP | unix.IFF_RUNNING
+		links <- update
+		Eventually(events).Should(Receive(Equal(network.NetworkEvent{
+			Type:           network.InterfaceUp,
+			InterfaceIndex: 9999,
+			InterfaceName:  "fake0",
+		})))
+		update.Flags = unix.IFF_UP
+		links <- update
+		Eventually(events).Should(Receive(Equal(network.NetworkEvent{
+			Type:           network.InterfaceDown,
+			InterfaceIndex: 9999,
+			InterfaceName:  "fake0",
+		})))
+
+		addrs <- netlink.AddrUpdate{
+			LinkAddress: net.IPNet{ IP: net.ParseIP("203.0.113.5").To4(), Mask: net.CIDRMask(24, 32) },
+			LinkIndex:   1,
+			NewAddr:     true,
+		}
+		Eventually(events).Should(Receive(Equal(network.NetworkEvent{
+			Type:           network.AddressAdded,
+			InterfaceIndex: 1,
+			InterfaceName:  "lo",
+			Address:        netip.MustParsePrefix("203.0.113.5/24"),
+		})))
+
+		// the default route is removed
+		mx.Lock()
+		gateway = nil
+		mx.Unlock()
+		routes <- netlink.RouteUpdate{ Type: unix.RTM_DELROUTE }
+		Eventually(events).Should(Receive(Equal(network.NetworkEvent{
+			Type: network.DefaultRouteChanged,
+		})))
+		Expect(network.Network.DefaultIPv4Route).To(BeNil())
+		Expect(networkContext.DefaultGateway()).To(BeEmpty())
+
+		unsubscribe()
+		Eventually(events).Should(BeClosed())
+	})
+})
@@ -0,0 +1,50 @@
+package network
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// saves the snapshot to the given file
+func (s *NetworkSnapshot) Save(path string) error {
+
+	var (
+		err error
+
+		data []byte
+	)
+
+	if data, err = json.MarshalIndent(s, "", "  "); err != nil {
+		return err
+	}
+	// write to a temporary file and rename it
+	// so the snapshot is replaced atomically
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmpFile := path + ".tmp"
+	if err = os.WriteFile(tmpFile, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, path)
+}
+
+// loads a snapshot saved to the given file
+func LoadNetworkSnapshot(path string) (*NetworkSnapshot, error) {
+
+	var (
+		err error
+
+		data []byte
+	)
+
+	if data, err = os.ReadFile(path); err != nil {
+		return nil, err
+	}
+	snapshot := &NetworkSnapshot{}
+	if err = json.Unmarshal(data, snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,421 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/mevansam/goutils/logger"
+)
+
+// Captures the routes of all routing tables, the routing
+// rules, the addresses of all interfaces and the dns
+// settings of each interface. Routes that are maintained
+// by the kernel, i.e. routes of the local table, routes
+// created for interface addresses and routes learned via
+// router advertisements, as well as ipv6 link-local
+// addresses are not captured as they are recreated by the
+// kernel. Multipath routes are not captured.
+func (c *networkContext) Snapshot() (*NetworkSnapshot, error) {
+
+	var (
+		err error
+
+		links  []netlink.Link
+		addrs  []netlink.Addr
+		routes []netlink.Route
+		rules  []netlink.Rule
+		dm     *dnsManager
+	)
+
+	snapshot := &NetworkSnapshot{
+		Interfaces: []InterfaceSnapshot{},
+		Routes:     []RouteSnapshot{},
+		Rules:      []RuleSnapshot{},
+	}
+
+	if links, err = netlink.LinkList(); err != nil {
+		return nil, err
+	}
+	if dm, err = newDNSManager(c); err != nil {
+		logger.DebugMessage(
+			"networkContext.Snapshot(): DNS settings will not be captured as the resolver is not available: %s",
+			err.Error(),
+		)
+	}
+	linkNames := make(map[int]string)
+	for _, link := range links {
+		linkNames[link.Attrs().Index] = link.Attrs().Name
+
+		if addrs, err = netlink.AddrList(link, netlink.FAMILY_ALL); err != nil {
+			return nil, err
+		}
+		itf := InterfaceSnapshot{
+			Name:      link.Attrs().Name,
+			Addresses: snapshotAddresses(addrs),
+		}
+		if dm != nil {
+			if itf.DNS, err = dm.linkDNS(link.Attrs().Index); err != nil {
+				logger.DebugMessage(
+					"networkContext.Snapshot(): Unable to read DNS settings of interface '%s': %s",
+					itf.Name, err.Error(),
+				)
+			}
+		}
+		snapshot.Interfaces = append(snapshot.Interfaces, itf)
+	}
+
+	for _, family := range []int{ netlink.FAMILY_V4, netlink.FAMILY_V6 } {
+		if routes, err = listAllRoutes(family); err != nil {
+			return nil, err
+		}
+		for _, route := range routes {
+			if !isSnapshotRoute(route) {
+				continue
+			}
+			snapshot.Routes = append(snapshot.Routes, snapshotRoute(route, family, linkNames))
+		}
+
+		if rules, err = netlink.RuleList(family); err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			snapshot.Rules = append(snapshot.Rules, snapshotRule(rule, family))
+		}
+	}
+	return snapshot, nil
+}
+
+// Returns the host to the state captured by the given
+// snapshot. Routes, rules and addresses that are not in
+// the snapshot are removed and the ones that are missing
+// are added. Interfaces that no longer exist are skipped.
+// Interfaces that were created after the snapshot was
+// taken are not deleted as they may be managed by other
+// services but their dns settings are reverted so that
+// lookups are no longer routed to them. All changes are
+// attempted even if some of them fail.
+func (c *networkContext) Restore(snapshot *NetworkSnapshot) error {
+
+	var (
+		err, restoreErr error
+
+		current *NetworkSnapshot
+		link    netlink.Link
+		dm      *dnsManager
+	)
+
+	if current, err = c.Snapshot(); err != nil {
+		return err
+	}
+	failed := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		logger.ErrorMessage("networkContext.Restore(): %s", msg)
+		if restoreErr == nil {
+			restoreErr = fmt.Errorf("%s", msg)
+		}
+	}
+
+	// remove the rules and routes that were
+	// added after the snapshot was taken
+
+	snapshotRules := make(map[RuleSnapshot]bool)
+	for _, rule := range snapshot.Rules {
+		snapshotRules[rule] = true
+	}
+	for _, rule := range current.Rules {
+		if !snapshotRules[rule] && rule.Table != unix.RT_TABLE_LOCAL {
+			if err = netlink.RuleDel(rule.netlinkRule()); err != nil {
+				failed("unable to delete rule %+v: %s", rule, err.Error())
+			}
+		}
+	}
+	snapshotRoutes := make(map[RouteSnapshot]bool)
+	for _, route := range snapshot.Routes {
+		snapshotRoutes[route] = true
+	}
+	for _, route := range current.Routes {
+		if !snapshotRoutes[route] {
+			if link, err = netlink.LinkByName(route.InterfaceName); err != nil {
+				failed("unable to delete route %+v: %s", route, err.Error())
+				continue
+			}
+			if err = netlink.RouteDel(route.netlinkRoute(link)); err != nil {
+				failed("unable to delete route %+v: %s", route, err.Error())
+			}
+		}
+	}
+
+	// restore the interface addresses
+
+	currentItfs := make(map[string]InterfaceSnapshot)
+	for _, itf := range current.Interfaces {
+		currentItfs[itf.Name] = itf
+	}
+	for _, itf := range snapshot.Interfaces {
+		currentItf, ok := currentItfs[itf.Name]
+		if !ok {
+			logger.DebugMessage(
+				"networkContext.Restore(): Skipping interface '%s' as it no longer exists",
+				itf.Name,
+			)
+			continue
+		}
+		if link, err = netlink.LinkByName(itf.Name); err != nil {
+			failed("unable to lookup interface '%s': %s", itf.Name, err.Error())
+			continue
+		}
+		for _, prefix := range prefixDiff(currentItf.Addresses, itf.Addresses) {
+			if err = netlink.AddrDel(link, &netlink.Addr{ IPNet: prefixIPNet(prefix) }); err != nil {
+				failed("unable to delete address %s of interface '%s': %s", prefix, itf.Name, err.Error())
+			}
+		}
+		for _, prefix := range prefixDiff(itf.Addresses, currentItf.Addresses) {
+			if err = netlink.AddrAdd(link, &netlink.Addr{ IPNet: prefixIPNet(prefix) }); err != nil {
+				failed("unable to add address %s to interface '%s': %s", prefix, itf.Name, err.Error())
+			}
+		}
+
+		if itf.DNS != nil && currentItf.DNS != nil && !reflect.DeepEqual(itf.DNS, currentItf.DNS) {
+			if dm == nil {
+				if dm, err = newDNSManager(c); err != nil {
+					failed("unable to restore DNS settings of interface '%s': %s", itf.Name, err.Error())
+					continue
+				}
+			}
+			if err = dm.setLinkDNS(link.Attrs().Index, itf.DNS); err != nil {
+				failed("unable to restore DNS settings of interface '%s': %s", itf.Name, err.Error())
+			}
+		}
+	}
+
+	// revert the dns settings of interfaces
+	// created after the snapshot was taken
+
+	snapshotItfs := make(map[string]bool)
+	for _, itf := range snapshot.Interfaces {
+		snapshotItfs[itf.Name] = true
+	}
+	for _, itf := range current.Interfaces {
+		if snapshotItfs[itf.Name] || itf.DNS == nil ||
+			len(itf.DNS.Servers) == 0 && len(itf.DNS.Domains) == 0 {
+			continue
+		}
+		if link, err = netlink.LinkByName(itf.Name); err != nil {
+			failed("unable to lookup interface '%s': %s", itf.Name, err.Error())
+			continue
+		}
+		if dm == nil {
+			if dm, err = newDNSManager(c); err != nil {
+				failed("unable to revert DNS settings of interface '%s': %s", itf.Name, err.Error())
+				continue
+			}
+		}
+		if err = dm.setLinkDNS(link.Attrs().Index, &InterfaceDNS{}); err != nil {
+			failed("unable to revert DNS settings of interface '%s': %s", itf.Name, err.Error())
+		}
+	}
+
+	// add the routes and rules that were
+	// removed after the snapshot was taken
+
+	currentRoutes := make(map[RouteSnapshot]bool)
+	for _, route := range current.Routes {
+		currentRoutes[route] = true
+	}
+	for _, route := range snapshot.Routes {
+		if !currentRoutes[route] {
+			if link, err = netlink.LinkByName(route.InterfaceName); err != nil {
+				failed("unable to add route %+v: %s", route, err.Error())
+				continue
+			}
+			if err = netlink.RouteAdd(route.netlinkRoute(link)); err != nil {
+				failed("unable to add route %+v: %s", route, err.Error())
+			}
+		}
+	}
+	currentRules := make(map[RuleSnapshot]bool)
+	for _, rule := range current.Rules {
+		currentRules[rule] = true
+	}
+	for _, rule := range snapshot.Rules {
+		if !currentRules[rule] && rule.Table != unix.RT_TABLE_LOCAL {
+			if err = netlink.RuleAdd(rule.netlinkRule()); err != nil {
+				failed("unable to add rule %+v: %s", rule, err.Error())
+			}
+		}
+	}
+
+	return restoreErr
+}
+
+// lists the routes of all routing tables
+func listAllRoutes(family int) ([]netlink.Route, error) {
+	return netlink.RouteListFiltered(
+		family,
+		&netlink.Route{ Table: unix.RT_TABLE_UNSPEC },
+		netlink.RT_FILTER_TABLE,
+	)
+}
+
+// returns whether the route is captured by snapshots
+func isSnapshotRoute(route netlink.Route) bool {
+	return route.Table != unix.RT_TABLE_LOCAL &&
+		route.Type == unix.RTN_UNICAST &&
+		route.Protocol != unix.RTPROT_KERNEL &&
+		route.Protocol != unix.RTPROT_RA &&
+		len(route.MultiPath) == 0
+}
+
+func snapshotRoute(route netlink.Route, family int, linkNames map[int]string) RouteSnapshot {
+
+	r := RouteSnapshot{
+		Table:         route.Table,
+		Dst:           prefixWorld4,
+		InterfaceName: linkNames[route.LinkIndex],
+		Metric:        route.Priority,
+		Scope:         int(route.Scope),
+		Protocol:      int(route.Protocol),
+	}
+	if family == netlink.FAMILY_V6 {
+		r.Dst = prefixWorld6
+	}
+	if route.Dst != nil {
+		if addr, ok := netip.AddrFromSlice(route.Dst.IP); ok {
+			ones, _ := route.Dst.Mask.Size()
+			r.Dst = netip.PrefixFrom(addr.Unmap(), ones)
+		}
+	}
+	if addr, ok := netip.AddrFromSlice(route.Gw); ok {
+		r.GatewayIP = addr.Unmap()
+	}
+	if addr, ok := netip.AddrFromSlice(route.Src); ok {
+		r.SrcIP = addr.Unmap()
+	}
+	return r
+}
+
+func (r RouteSnapshot) netlinkRoute(link netlink.Link) *netlink.Route {
+
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Table:     r.Table,
+		Dst:       prefixIPNet(r.Dst),
+		Priority:  r.Metric,
+		Scope:     netlink.Scope(r.Scope),
+		Protocol:  r.Protocol,
+	}
+	if r.GatewayIP.IsValid() {
+		route.Gw = r.GatewayIP.AsSlice()
+	}
+	if r.SrcIP.IsValid() {
+		route.Src = r.SrcIP.AsSlice()
+	}
+	return route
+}
+
+func snapshotRule(rule netlink.Rule, family int) RuleSnapshot {
+
+	r := RuleSnapshot{
+		IsIPv6:            family == netlink.FAMILY_V6,
+		Priority:          rule.Priority,
+		Table:             rule.Table,
+		IifName:           rule.IifName,
+		OifName:           rule.OifName,
+		SuppressPrefixLen: rule.SuppressPrefixlen,
+		Invert:            rule.Invert,
+	}
+	if rule.Src != nil {
+		r.SrcPrefix = ipNetPrefix(rule.Src)
+	}
+	if rule.Dst != nil {
+		r.DstPrefix = ipNetPrefix(rule.Dst)
+	}
+	if rule.Mark >= 0 {
+		r.Mark = uint32(rule.Mark)
+	}
+	if rule.Mask >= 0 {
+		r.Mask = uint32(rule.Mask)
+	}
+	return r
+}
+
+func (r RuleSnapshot) netlinkRule() *netlink.Rule {
+
+	rule := netlink.NewRule()
+	rule.Family = netlink.FAMILY_V4
+	if r.IsIPv6 {
+		rule.Family = netlink.FAMILY_V6
+	}
+	rule.Priority = r.Priority
+	rule.Table = r.Table
+	if r.SrcPrefix.IsValid() {
+		rule.Src = prefixIPNet(r.SrcPrefix)
+	}
+	if r.DstPrefix.IsValid() {
+		rule.Dst = prefixIPNet(r.DstPrefix)
+	}
+	rule.IifName = r.IifName
+	rule.OifName = r.OifName
+	if r.Mark != 0 {
+		rule.Mark = int(r.Mark)
+		if r.Mask != 0 {
+			rule.Mask = int(r.Mask)
+		}
+	}
+	rule.SuppressPrefixlen = r.SuppressPrefixLen
+	rule.Invert = r.Invert
+	return rule
+}
+
+// returns the addresses captured by snapshots
+func snapshotAddresses(addrs []netlink.Addr) []netip.Prefix {
+
+	prefixes := []netip.Prefix{}
+	for _, addr := range addrs {
+		prefix := ipNetPrefix(addr.IPNet)
+		if !prefix.IsValid() || prefix.Addr().Is6() && prefix.Addr().IsLinkLocalUnicast() {
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// returns the prefixes in a that are not in b
+func prefixDiff(a, b []netip.Prefix) []netip.Prefix {
+
+	inB := make(map[netip.Prefix]bool)
+	for _, prefix := range b {
+		inB[prefix] = true
+	}
+	diff := []netip.Prefix{}
+	for _, prefix := range a {
+		if !inB[prefix] {
+			diff = append(diff, prefix)
+		}
+	}
+	return diff
+}
+
+func ipNetPrefix(ipNet *net.IPNet) netip.Prefix {
+	addr, ok := netip.AddrFromSlice(ipNet.IP)
+	if !ok {
+		return netip.Prefix{}
+	}
+	ones, _ := ipNet.Mask.Size()
+	return netip.PrefixFrom(addr.Unmap(), ones)
+}
+
+func prefixIPNet(prefix netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   prefix.Addr().AsSlice(),
+		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+	}
+}
@@ -0,0 +1,69 @@
+//go:build linux
+
+package network_test
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+
+	"github.com/mevansam/goutils/network"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Network Snapshot", func() {
+
+	var (
+		err error
+
+		networkContext network.NetworkContext
+	)
+
+	BeforeEach(func() {
+		networkContext, err = network.NewNetworkContext()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("captures the network state and saves it to disk", func() {
+		snapshot, err := networkContext.Snapshot()
+		Expect(err).ToNot(HaveOccurred())
+
+		var lo *network.InterfaceSnapshot
+		for i, itf := range snapshot.Interfaces {
+			if itf.Name == "lo" {
+				lo = &snapshot.Interfaces[i]
+			}
+		}
+		Expect(lo).ToNot(BeNil())
+		Expect(lo.Addresses).To(ContainElement(netip.MustParsePrefix("127.0.0.1/8")))
+
+		// the default routes are captured
+		// but not the kernel's local routes
+		Expect(snapshot.Routes).To(ContainElement(
+			WithTransform(func(r network.RouteSnapshot) netip.Prefix {
+				return r.Dst
+			}, Equal(netip.MustParsePrefix("0.0.0.0/0"))),
+		))
+		for _, route := range snapshot.Routes {
+			Expect(route.Table).ToNot(Equal(255))
+		}
+		Expect(snapshot.Rules).ToNot(BeEmpty())
+
+		dir, err := os.MkdirTemp("", "snapshot")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		snapshotFile := filepath.Join(dir, "state", "snapshot.json")
+		err = snapshot.Save(snapshotFile)
+		Expect(err).ToNot(HaveOccurred())
+		saved, err := network.LoadNetworkSnapshot(snapshotFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(saved).To(Equal(snapshot))
+
+		// restoring the unchanged state makes no changes
+		err = networkContext.Restore(saved)
+		Expect(err).ToNot(HaveOccurred())
+	})
+})
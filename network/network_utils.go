@@ -6,6 +6,7 @@ import (
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/mevansam/goutils/logger"
 )
@@ -62,6 +63,22 @@ func GetNextAvailabeInterface(prefix string) (string, error) {
 	return prefix + strconv.FormatInt(int64(maxIndex+1), 10), nil
 }
 
+// returns the dns domains with the given names. names
+// prefixed with a "~" such as "~corp.example" are routing
+// only domains which are not used as search domains.
+func ParseDNSDomains(names []string) []DNSDomain {
+
+	domains := make([]DNSDomain, 0, len(names))
+	for _, name := range names {
+		if strings.HasPrefix(name, "~") {
+			domains = append(domains, DNSDomain{ Domain: name[1:], RoutingOnly: true })
+		} else {
+			domains = append(domains, DNSDomain{ Domain: name })
+		}
+	}
+	return domains
+}
+
 func IncIP(ip net.IP) {
 	for j := len(ip) - 1; j >= 0; j-- {
 		ip[j]++
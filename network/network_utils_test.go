@@ -30,6 +30,31 @@ var _ = Describe("Wireguard Client", func() {
 		Expect(found).To(BeFalse())
 	})
 
+	It("parses search and routing only dns domains", func() {
+
+		Expect(network.ParseDNSDomains([]string{ "example.com", "~corp.example", "~." })).To(Equal([]network.DNSDomain{
+			{ Domain: "example.com" },
+			{ Domain: "corp.example", RoutingOnly: true },
+			{ Domain: ".", RoutingOnly: true },
+		}))
+	})
+
+	It("resolves names to ips", func() {
+
+		ips, namedIPs, err := network.ResolveNames([]string{ "10.1.1.1", "10.1.1.2" }, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(Equal([]string{ "10.1.1.1", "10.1.1.2" }))
+		Expect(namedIPs).To(Equal([][]string{ { "10.1.1.1" }, { "10.1.1.2" } }))
+
+		_, err = net.LookupIP("localhost")
+		if err == nil {
+			ips, namedIPs, err = network.ResolveNames([]string{ "localhost" }, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(namedIPs).To(HaveLen(1))
+			Expect(namedIPs[0]).To(Equal(ips))
+		}
+	})
+
 // 	It("determine the configured default gateways", func() {
 
 // 		fmt.Println("\n\n**** ROUTE TABLE INFO ****")
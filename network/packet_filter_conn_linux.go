@@ -0,0 +1,59 @@
+//go:build linux
+
+package network
+
+import (
+	"github.com/google/nftables"
+)
+
+// the nftables operations used by the packet filter router.
+// operations that change the packet filter are queued and
+// applied atomically when the connection is flushed.
+type nftConn interface {
+	AddTable(t *nftables.Table) *nftables.Table
+	DelTable(t *nftables.Table)
+	ListTablesOfFamily(family nftables.TableFamily) ([]*nftables.Table, error)
+
+	AddChain(c *nftables.Chain) *nftables.Chain
+
+	AddSet(s *nftables.Set, vals []nftables.SetElement) error
+	DelSet(s *nftables.Set)
+	GetSets(t *nftables.Table) ([]*nftables.Set, error)
+	SetAddElements(s *nftables.Set, vals []nftables.SetElement) error
+	SetDeleteElements(s *nftables.Set, vals []nftables.SetElement) error
+	GetSetElements(s *nftables.Set) ([]nftables.SetElement, error)
+
+	AddRule(r *nftables.Rule) *nftables.Rule
+	InsertRule(r *nftables.Rule) *nftables.Rule
+	DelRule(r *nftables.Rule) error
+	GetRules(t *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error)
+
+	Flush() error
+
+	// returns the elements of a set including their
+	// expiration and the verdicts of map elements
+	getSetElements(s *nftables.Set) ([]setElement, error)
+	// discards all queued operations
+	reset()
+}
+
+// returns the connection to the packet filter
+// that is changed by a new filter router
+var newNftConn = func() nftConn {
+	return &kernelNftConn{}
+}
+
+// nftables connection to the kernel
+type kernelNftConn struct {
+	nftables.Conn
+}
+
+func (c *kernelNftConn) getSetElements(s *nftables.Set) ([]setElement, error) {
+	return getSetElements(s)
+}
+
+func (c *kernelNftConn) reset() {
+	// the nftables connection has no means of dropping
+	// queued messages so replace it with a new one
+	c.Conn = nftables.Conn{}
+}
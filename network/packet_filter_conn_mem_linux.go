@@ -0,0 +1,597 @@
+//go:build linux
+
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// A connection to a packet filter that is modelled in
+// memory. Operations are queued and applied to the model
+// when the connection is flushed as they would be applied
+// by the kernel and each applied operation is recorded as
+// a step of a plan. It is used by routers in dry-run mode
+// and in place of the kernel when the router is tested.
+
+// nftables connection to an in-memory packet filter
+type memNftConn struct {
+	model *memModel
+	queue []memOp
+
+	plan FilterPlan
+
+	// errors returned by the first GetRules call after
+	// the next flush. set by tests to simulate failures.
+	flushedRulesErr,
+	rulesErr error
+}
+
+// a queued operation that is applied to the model and
+// returns the plan step that describes the operation
+type memOp func(m *memModel) (*FilterPlanStep, error)
+
+type memModel struct {
+	tables []*memTable
+	handle uint64
+}
+
+type memTable struct {
+	table  *nftables.Table
+	chains []*memChain
+	sets   []*memSet
+}
+
+type memChain struct {
+	chain *nftables.Chain
+	rules []*nftables.Rule
+}
+
+type memSet struct {
+	set   *nftables.Set
+	elems []memElement
+}
+
+type memElement struct {
+	nftables.SetElement
+	expires time.Time
+}
+
+// returns a connection to an empty in-memory packet filter
+func newMemNftConn() *memNftConn {
+	return &memNftConn{
+		model: &memModel{},
+		plan:  FilterPlan{},
+	}
+}
+
+// returns a copy of the model that can be changed
+// without changing the model it was copied from
+func (m *memModel) clone() *memModel {
+
+	mc := &memModel{
+		tables: make([]*memTable, 0, len(m.tables)),
+		handle: m.handle,
+	}
+	for _, pt := range m.tables {
+		ptc := &memTable{
+			table:  pt.table,
+			chains: make([]*memChain, 0, len(pt.chains)),
+			sets:   make([]*memSet, 0, len(pt.sets)),
+		}
+		for _, pc := range pt.chains {
+			ptc.chains = append(ptc.chains, &memChain{
+				chain: pc.chain,
+				rules: append([]*nftables.Rule{}, pc.rules...),
+			})
+		}
+		for _, ps := range pt.sets {
+			ptc.sets = append(ptc.sets, &memSet{
+				set:   ps.set,
+				elems: append([]memElement{}, ps.elems...),
+			})
+		}
+		mc.tables = append(mc.tables, ptc)
+	}
+	return mc
+}
+
+func (m *memModel) getTable(t *nftables.Table) *memTable {
+	for _, pt := range m.tables {
+		if pt.table.Name == t.Name && pt.table.Family == t.Family {
+			return pt
+		}
+	}
+	return nil
+}
+
+func (m *memModel) getChain(t *nftables.Table, name string) (*memTable, *memChain) {
+	if pt := m.getTable(t); pt != nil {
+		for _, pc := range pt.chains {
+			if pc.chain.Name == name {
+				return pt, pc
+			}
+		}
+		return pt, nil
+	}
+	return nil, nil
+}
+
+func (m *memModel) getSet(t *nftables.Table, name string) (*memTable, *memSet) {
+	if pt := m.getTable(t); pt != nil {
+		for _, ps := range pt.sets {
+			if ps.set.Name == name {
+				return pt, ps
+			}
+		}
+		return pt, nil
+	}
+	return nil, nil
+}
+
+// nftConn implementation
+
+func (c *memNftConn) AddTable(t *nftables.Table) *nftables.Table {
+	c.queue = append(c.queue, func(m *memModel) (*FilterPlanStep, error) {
+		if m.getTable(t) != nil {
+			return nil, nil
+		}
+		m.tables = append(m.tables, &memTable{ table: t })
+		return &FilterPlanStep{ Op: "add", Object: "table", Table: nftTableText(t) }, nil
+	})
+	return t
+}
+
+func (c *memNftConn) DelTable(t *nftables.Table) {
+	c.queue = append(c.queue, func(m *memModel) (*FilterPlanStep, error) {
+		for i, pt := range m.tables {
+			if pt.table.Name == t.Name && pt.table.Family == t.Family {
+				m.tables = append(m.tables[:i], m.tables[i+1:]...)
+				return &FilterPlanStep{ Op: "delete", Object: "table", Table: nftTableText(t) }, nil
+			}
+		}
+		return nil, fmt.Errorf("table '%s' does not exist", t.Name)
+	})
+}
+
+func (c *memNftConn) ListTablesOfFamily(family nftables.TableFamily) ([]*nftables.Table, error) {
+	tables := []*nftables.Table{}
+	for _, pt := range c.model.tables {
+		if pt.table.Family == family {
+			tables = append(tables, pt.table)
+		}
+	}
+	return tables, nil
+}
+
+func (c *memNftConn) AddChain(ch *nftables.Chain) *nftables.Chain {
+	c.queue = append(c.queue, func(m *memModel) (*FilterPlanStep, error) {
+		pt, pc := m.getChain(ch.Table, ch.Name)
+		if pt == nil {
+			return nil, fmt.Errorf("table '%s' of chain '%s' does not exist", ch.Table.Name, ch.Name)
+		}
+		if pc != nil {
+			// adding an existing chain updates its policy
+			pc.chain = ch
+			return nil, nil
+		}
+		pt.chains = append(pt.chains, &memChain{ chain: ch })
+		return &FilterPlanStep{
+			Op:     "add",
+			Object: "chain",
+			Table:  nftTableText(ch.Table),
+			Name:   ch.Name,
+			Spec:   nftChainSpec(ch),
+		}, nil
+	})
+	return ch
+}
+
+func (c *memNftConn) AddSet(s *nftables.Set, vals []nftables.SetElement) error {
+	c.queue = append(c.queue, func(m *memModel) (*FilterPlanStep, error) {
+		pt, ps := m.getSet(s.Table, s.Name)
+		if pt == nil {
+			return nil, fmt.Errorf("table '%s' of set '%s' does not exist", s.Table.Name, s.Name)
+		}
+		if ps != nil {
+			// as with the kernel a set cannot be
+			// re-added with different flags
+			if ps.set.Interval != s.Interval || ps.set.HasTimeout != s.HasTimeout {
+				return nil, fmt.Errorf("set '%s' exists with different flags", s.Name)
+			}
+			// the set's definition may not have been
+			// fully decoded when it was loaded
+			ps.set = s
+			return nil, nil
+		}
+		pt.sets = append(pt.sets, &memSet{ set: s })
+		return &FilterPlanStep{
+			Op:     "add",
+			Object: nftSetObject(s),
+			Table:  nftTableText(s.Table),
+			Name:   s.Name,
+			Spec:   nftSetSpec(s),
+		}, nil
+	})
+	if len(vals) > 0 {
+		return c.SetAddElements(s, vals)
+	}
+	return nil
+}
+
+func (c *memNftConn) DelSet(s *nftables.Set) {
+	c.queue = append(c.queue, func(m *memModel) (*FilterPlanStep, error) {
+		pt, ps := m.getSet(s.Table, s.Name)
+		if ps == nil {
+			return nil, fmt.Errorf("set '%s' does not exist", s.Name)
+		}
+		for _, pc := range pt.chains {
+			for _, rule := range pc.rules {
+				if ruleReferencesSet(rule, s.Name) {
+					return nil, fmt.Errorf("set '%s' is in use by rule with handle %d", s.Name, rule.Handle)
+				}
+			}
+		}
+		for i := range pt.sets {
+			if pt.sets[i] == ps {
+				pt.sets = append(pt.sets[:i], pt.sets[i+1:]...)
+				break
+			}
+		}
+		return &FilterPlanStep{
+			Op:     "delete",
+			Object: nftSetObject(ps.set),
+			Table:  nftTableText(s.Table),
+			Name:   s.Name,
+		}, nil
+	})
+}
+
+func (c *memNftConn) GetSets(t *nftables.Table) ([]*nftables.Set, error) {
+	pt := c.model.getTable(t)
+	if pt == nil {
+		return nil, fmt.Errorf("table '%s' does not exist", t.Name)
+	}
+	sets := []*nftables.Set{}
+	for _, ps := range pt.sets {
+		sets = append(sets, ps.set)
+	}
+	return sets, nil
+}
+
+func (c *memNftConn) SetAddElements(s *nftables.Set, vals []nftables.SetElement) error {
+	c.queue = append(c.queue, func(m *memModel) (*FilterPlanStep, error) {
+		_, ps := m.getSet(s.Table, s.Name)
+		if ps == nil {
+			return nil, fmt.Errorf("set '%s' does not exist", s.Name)
+		}
+		now := time.Now()
+		for _, val := range vals {
+			if ps.find(val) == -1 {
+				pe := memElement{ SetElement: val }
+				if val.Timeout > 0 {
+					pe.expires = now.Add(val.Timeout)
+				}
+				ps.elems = append(ps.elems, pe)
+			}
+		}
+		return &FilterPlanStep{
+			Op:     "add",
+			Object: "element",
+			Table:  nftTableText(s.Table),
+			Name:   s.Name,
+			Spec:   nftElementsSpec(ps.set, vals),
+		}, nil
+	})
+	return nil
+}
+
+func (c *memNftConn) SetDeleteElements(s *nftables.Set, vals []nftables.SetElement) error {
+	c.queue = append(c.queue, func(m *memModel) (*FilterPlanStep, error) {
+		_, ps := m.getSet(s.Table, s.Name)
+		if ps == nil {
+			return nil, fmt.Errorf("set '%s' does not exist", s.Name)
+		}
+		for _, val := range vals {
+			i := ps.find(val)
+			if i == -1 {
+				return nil, fmt.Errorf("element %x does not exist in set '%s'", val.Key, s.Name)
+			}
+			ps.elems = append(ps.elems[:i], ps.elems[i+1:]...)
+		}
+		return &FilterPlanStep{
+			Op:     "delete",
+			Object: "element",
+			Table:  nftTableText(s.Table),
+			Name:   s.Name,
+			Spec:   nftElementsSpec(ps.set, vals),
+		}, nil
+	})
+	return nil
+}
+
+func (c *memNftConn) GetSetElements(s *nftables.Set) ([]nftables.SetElement, error) {
+	_, ps := c.model.getSet(s.Table, s.Name)
+	if ps == nil {
+		return nil, fmt.Errorf("set '%s' does not exist", s.Name)
+	}
+	elems := []nftables.SetElement{}
+	for _, pe := range ps.live(time.Now()) {
+		elems = append(elems, pe.SetElement)
+	}
+	return elems, nil
+}
+
+func (c *memNftConn) AddRule(r *nftables.Rule) *nftables.Rule {
+	c.queue = append(c.queue, func(m *memModel) (*FilterPlanStep, error) {
+		return m.addRule(r, "add")
+	})
+	return r
+}
+
+func (c *memNftConn) InsertRule(r *nftables.Rule) *nftables.Rule {
+	c.queue = append(c.queue, func(m *memModel) (*FilterPlanStep, error) {
+		return m.addRule(r, "insert")
+	})
+	return r
+}
+
+func (c *memNftConn) DelRule(r *nftables.Rule) error {
+	c.queue = append(c.queue, func(m *memModel) (*FilterPlanStep, error) {
+		_, pc := m.getChain(r.Table, r.Chain.Name)
+		if pc == nil {
+			return nil, fmt.Errorf("chain '%s' does not exist", r.Chain.Name)
+		}
+		for i, rule := range pc.rules {
+			if rule.Handle == r.Handle {
+				pc.rules = append(pc.rules[:i], pc.rules[i+1:]...)
+				return &FilterPlanStep{
+					Op:     "delete",
+					Object: "rule",
+					Table:  nftTableText(r.Table),
+					Name:   r.Chain.Name,
+					Handle: r.Handle,
+				}, nil
+			}
+		}
+		return nil, fmt.Errorf("rule with handle %d does not exist in chain '%s'", r.Handle, r.Chain.Name)
+	})
+	return nil
+}
+
+func (c *memNftConn) GetRules(t *nftables.Table, ch *nftables.Chain) ([]*nftables.Rule, error) {
+	if err := c.rulesErr; err != nil {
+		c.rulesErr = nil
+		return nil, err
+	}
+	// as with the kernel no rules are
+	// returned for a chain that does
+	// not exist
+	rules := []*nftables.Rule{}
+	if _, pc := c.model.getChain(t, ch.Name); pc != nil {
+		for _, rule := range pc.rules {
+			rules = append(rules, &nftables.Rule{
+				Table:  rule.Table,
+				Chain:  rule.Chain,
+				Handle: rule.Handle,
+				Exprs:  append([]expr.Any{}, rule.Exprs...),
+			})
+		}
+	}
+	return rules, nil
+}
+
+// applies the queued operations to a copy of the model
+// which replaces the model only if all operations could
+// be applied
+func (c *memNftConn) Flush() error {
+
+	var (
+		err  error
+		step *FilterPlanStep
+	)
+
+	queue := c.queue
+	c.queue = nil
+
+	m := c.model.clone()
+	steps := FilterPlan{}
+	for _, op := range queue {
+		if step, err = op(m); err != nil {
+			return err
+		}
+		if step != nil {
+			steps = append(steps, *step)
+		}
+	}
+	c.model = m
+	c.plan = append(c.plan, steps...)
+	c.rulesErr, c.flushedRulesErr = c.flushedRulesErr, nil
+	return nil
+}
+
+func (c *memNftConn) getSetElements(s *nftables.Set) ([]setElement, error) {
+	_, ps := c.model.getSet(s.Table, s.Name)
+	if ps == nil {
+		return nil, fmt.Errorf("set '%s' does not exist", s.Name)
+	}
+	now := time.Now()
+	elems := []setElement{}
+	for _, pe := range ps.live(now) {
+		elem := setElement{
+			key:         pe.Key,
+			intervalEnd: pe.IntervalEnd,
+			verdict:     pe.VerdictData,
+			val:         pe.Val,
+			timeout:     pe.Timeout,
+		}
+		if !pe.expires.IsZero() {
+			elem.expiration = pe.expires.Sub(now)
+		}
+		elems = append(elems, elem)
+	}
+	return elems, nil
+}
+
+func (c *memNftConn) reset() {
+	c.queue = nil
+}
+
+// adds a copy of a rule to its chain at the rule's position
+func (m *memModel) addRule(r *nftables.Rule, op string) (*FilterPlanStep, error) {
+
+	var (
+		err  error
+		spec string
+	)
+
+	pt, pc := m.getChain(r.Table, r.Chain.Name)
+	if pc == nil {
+		return nil, fmt.Errorf("chain '%s' does not exist", r.Chain.Name)
+	}
+	// as with the kernel sets must
+	// exist before they are referenced
+	for _, e := range r.Exprs {
+		switch e := e.(type) {
+		case *expr.Lookup:
+			if !pt.hasSet(e.SetName) {
+				return nil, fmt.Errorf("set '%s' referenced by rule in chain '%s' does not exist", e.SetName, r.Chain.Name)
+			}
+		case *expr.Dynset:
+			if !pt.hasSet(e.SetName) {
+				return nil, fmt.Errorf("set '%s' referenced by rule in chain '%s' does not exist", e.SetName, r.Chain.Name)
+			}
+		}
+	}
+	if spec, err = nftRuleText(r); err != nil {
+		return nil, err
+	}
+
+	i := len(pc.rules)
+	if op == "insert" {
+		i = 0
+	}
+	if r.Position != 0 {
+		i = -1
+		for j, rule := range pc.rules {
+			if rule.Handle == r.Position {
+				i = j
+				break
+			}
+		}
+		if i == -1 {
+			return nil, fmt.Errorf("rule with handle %d does not exist in chain '%s'", r.Position, r.Chain.Name)
+		}
+		if op == "add" {
+			// rules are added after the rule
+			// at the position and inserted
+			// before it
+			i++
+		}
+	}
+
+	m.handle++
+	rule := &nftables.Rule{
+		Table:  r.Table,
+		Chain:  r.Chain,
+		Handle: m.handle,
+		Exprs:  append([]expr.Any{}, r.Exprs...),
+	}
+	pc.rules = append(pc.rules[:i], append([]*nftables.Rule{ rule }, pc.rules[i:]...)...)
+
+	return &FilterPlanStep{
+		Op:     op,
+		Object: "rule",
+		Table:  nftTableText(r.Table),
+		Name:   r.Chain.Name,
+		Handle: r.Position,
+		Spec:   spec,
+	}, nil
+}
+
+func (pt *memTable) hasSet(name string) bool {
+	for _, ps := range pt.sets {
+		if ps.set.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the index of the given element in the set or -1
+func (ps *memSet) find(val nftables.SetElement) int {
+	for i, pe := range ps.elems {
+		if bytes.Equal(pe.Key, val.Key) && pe.IntervalEnd == val.IntervalEnd {
+			return i
+		}
+	}
+	return -1
+}
+
+// returns the elements of the set that have not expired
+func (ps *memSet) live(now time.Time) []memElement {
+	elems := []memElement{}
+	for _, pe := range ps.elems {
+		if pe.expires.IsZero() || pe.expires.After(now) {
+			elems = append(elems, pe)
+		}
+	}
+	return elems
+}
+
+// returns true if the rule looks up or updates the named set
+func ruleReferencesSet(rule *nftables.Rule, name string) bool {
+	for _, e := range rule.Exprs {
+		switch e := e.(type) {
+		case *expr.Lookup:
+			if e.SetName == name {
+				return true
+			}
+		case *expr.Dynset:
+			if e.SetName == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// returns the elements as they are
+// written in an nft set declaration
+func nftElementsSpec(set *nftables.Set, vals []nftables.SetElement) string {
+
+	texts := []string{}
+	if set.Interval {
+		elems := make([]setElement, 0, len(vals))
+		for _, val := range vals {
+			elems = append(elems, setElement{
+				key:         val.Key,
+				intervalEnd: val.IntervalEnd,
+				timeout:     val.Timeout,
+			})
+		}
+		for _, rg := range ipSetElementRanges(elems) {
+			for _, prefix := range rg.prefixes() {
+				texts = append(texts, nftPrefixText(prefix)+nftTimeoutText(rg.ttl, 0))
+			}
+		}
+
+	} else {
+		for _, val := range vals {
+			text := nftDataText(set.KeyType, val.Key) + nftTimeoutText(val.Timeout, 0)
+			if set.IsMap && val.VerdictData != nil {
+				text += " : " + nftVerdictText(val.VerdictData)
+			} else if set.IsMap {
+				text += " : " + nftDataText(set.DataType, val.Val)
+			}
+			texts = append(texts, text)
+		}
+	}
+	return "{ " + strings.Join(texts, ", ") + " }"
+}
+
@@ -0,0 +1,272 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+
+	"github.com/mevansam/goutils/utils"
+)
+
+// prefix of the names of the maps
+// looked up by port forwarding rules
+const portForwardMapPrefix = "pfm"
+
+// returns the backends the port is forwarded to
+func (pf PortForward) backends() []netip.Addr {
+	if len(pf.ForwardIPs) > 0 {
+		return pf.ForwardIPs
+	}
+	return []netip.Addr{ pf.ForwardIP }
+}
+
+// returns true if a range of ports is forwarded
+func (pf PortForward) isRange() bool {
+	return pf.DstToPort > pf.DstPort
+}
+
+func (pf PortForward) validate() error {
+
+	if len(pf.ForwardIPs) > 0 {
+		if pf.ForwardIP.IsValid() {
+			return fmt.Errorf("port forward cannot have both a forward ip and backends: %+v", pf)
+		}
+	} else if !pf.ForwardIP.IsValid() {
+		return fmt.Errorf("port forward has an invalid forward ip: %+v", pf)
+	}
+
+	backends := pf.backends()
+	for _, ip := range backends {
+		if !ip.IsValid() || ip.Is4() != backends[0].Is4() {
+			return fmt.Errorf("port forward has an invalid backend '%s': %+v", ip, pf)
+		}
+	}
+	if pf.DstIP.IsValid() && pf.DstIP.Is4() != backends[0].Is4() {
+		return fmt.Errorf("port forward cannot mix ipv4 and ipv6 addresses: %+v", pf)
+	}
+	switch pf.Balance {
+	case "", BalanceRoundRobin, BalanceRandom, BalanceSourceHash:
+	default:
+		return fmt.Errorf("unsupported port forward load balancing: %s", pf.Balance)
+	}
+
+	if pf.DstPort < 0 || pf.DstPort > 0xffff || pf.ForwardPort < 0 || pf.ForwardPort > 0xffff {
+		return fmt.Errorf("port forward has an invalid port: %+v", pf)
+	}
+	if pf.DstToPort != 0 {
+		if pf.DstToPort < pf.DstPort || pf.DstToPort > 0xffff {
+			return fmt.Errorf("port forward has an invalid port range %d-%d", pf.DstPort, pf.DstToPort)
+		}
+		if pf.ForwardPort > 0 && pf.ForwardPort + (pf.DstToPort - pf.DstPort) > 0xffff {
+			return fmt.Errorf("port forward range %d-%d cannot be forwarded to port %d", pf.DstPort, pf.DstToPort, pf.ForwardPort)
+		}
+	}
+	return nil
+}
+
+// returns the maps looked up by the dnat rule of a port forward
+// and their elements. a port forward to more than one backend
+// looks up the backend address by the number generated for the
+// packet and a port range forwarded to a different range looks
+// up the port to forward to by the packet's destination port.
+func portForwardMaps(pf PortForward, table *nftables.Table) ([]*nftables.Set, [][]nftables.SetElement, error) {
+
+	var (
+		err error
+
+		name string
+	)
+
+	maps := []*nftables.Set{}
+	mapElems := [][]nftables.SetElement{}
+
+	backends := pf.backends()
+	shiftPorts := pf.isRange() && pf.ForwardPort > 0 && pf.ForwardPort != pf.DstPort
+	if len(backends) < 2 && !shiftPorts {
+		return maps, mapElems, nil
+	}
+	if name, err = utils.HashString(pf.key(), portForwardMapPrefix); err != nil {
+		return nil, nil, fmt.Errorf(
+			"failed to create port forward map name from key '%s': %s",
+			pf.key(), err.Error(),
+		)
+	}
+
+	if len(backends) > 1 {
+		// map <name>_addr {
+		//   type mark : ipv4_addr
+		// }
+		addrMap := &nftables.Set{
+			Name:     name + "_addr",
+			Table:    table,
+			IsMap:    true,
+			KeyType:  nftables.TypeMark,
+			DataType: ipSetElemTypes[0],
+		}
+		if !backends[0].Is4() {
+			addrMap.DataType = ipSetElemTypes[1]
+		}
+		elems := []nftables.SetElement{}
+		for i, ip := range backends {
+			elems = append(elems, nftables.SetElement{
+				Key: binaryutil.NativeEndian.PutUint32(uint32(i)),
+				Val: ip.AsSlice(),
+			})
+		}
+		maps = append(maps, addrMap)
+		mapElems = append(mapElems, elems)
+	}
+	if shiftPorts {
+		// map <name>_port {
+		//   type inet_service : inet_service
+		// }
+		portMap := &nftables.Set{
+			Name:     name + "_port",
+			Table:    table,
+			IsMap:    true,
+			KeyType:  nftables.TypeInetService,
+			DataType: nftables.TypeInetService,
+		}
+		elems := []nftables.SetElement{}
+		for p := pf.DstPort; p <= pf.DstToPort; p++ {
+			elems = append(elems, nftables.SetElement{
+				Key: binaryutil.BigEndian.PutUint16(uint16(p)),
+				Val: binaryutil.BigEndian.PutUint16(uint16(pf.ForwardPort + p - pf.DstPort)),
+			})
+		}
+		maps = append(maps, portMap)
+		mapElems = append(mapElems, elems)
+	}
+	return maps, mapElems, nil
+}
+
+// returns the expressions that translate the destination
+// of the forwarded traffic using the port forward's maps
+func dnatExprs(pf PortForward, maps []*nftables.Set, is4 bool) ([]expr.Any, error) {
+
+	addrLen, srcOffset, _, _ := ipHeaderOffsets(is4)
+
+	mapNamed := func(suffix string) string {
+		for _, m := range maps {
+			if strings.HasSuffix(m.Name, suffix) {
+				return m.Name
+			}
+		}
+		return ""
+	}
+
+	exprs := []expr.Any{}
+	backends := pf.backends()
+	if len(backends) == 1 {
+		exprs = append(exprs,
+			// [ immediate reg 1 <forwardIP> ]
+			&expr.Immediate{
+				Register: 1,
+				Data:     backends[0].AsSlice(),
+			},
+		)
+
+	} else {
+		addrMap := mapNamed("_addr")
+		if len(addrMap) == 0 {
+			return nil, fmt.Errorf("backend map of port forward '%s' not found", pf.key())
+		}
+		switch pf.Balance {
+		case BalanceSourceHash:
+			exprs = append(exprs,
+				// [ payload load 4b @ network header + 12 (src addr) => reg 1 ]
+				&expr.Payload{
+					DestRegister: 1,
+					Base:         expr.PayloadBaseNetworkHeader,
+					Offset:       srcOffset,
+					Len:          addrLen,
+				},
+				// [ hash reg 1 = jhash(reg 1, 4, 0x0) % mod <n> ]
+				&expr.Hash{
+					SourceRegister: 1,
+					DestRegister:   1,
+					Length:         addrLen,
+					Modulus:        uint32(len(backends)),
+					Type:           expr.HashTypeJenkins,
+				},
+			)
+		case BalanceRandom:
+			exprs = append(exprs,
+				// [ numgen reg 1 = random mod <n> ]
+				&expr.Numgen{
+					Register: 1,
+					Modulus:  uint32(len(backends)),
+					Type:     unix.NFT_NG_RANDOM,
+				},
+			)
+		default:
+			exprs = append(exprs,
+				// [ numgen reg 1 = inc mod <n> ]
+				&expr.Numgen{
+					Register: 1,
+					Modulus:  uint32(len(backends)),
+					Type:     unix.NFT_NG_INCREMENTAL,
+				},
+			)
+		}
+		exprs = append(exprs,
+			// [ lookup reg 1 set <name>_addr dreg 1 ]
+			&expr.Lookup{
+				SourceRegister: 1,
+				DestRegister:   1,
+				IsDestRegSet:   true,
+				SetName:        addrMap,
+			},
+		)
+	}
+
+	nat := &expr.NAT{
+		Type:       expr.NATTypeDestNAT,
+		Family:     ipFamily(is4),
+		RegAddrMin: 1,
+		RegAddrMax: 1,
+	}
+	switch {
+	case len(mapNamed("_port")) > 0:
+		exprs = append(exprs,
+			// [ payload load 2b @ transport header + 2 => reg 2 ]
+			&expr.Payload{
+				DestRegister: 2,
+				Base:         expr.PayloadBaseTransportHeader,
+				Offset:       2, // Destination Port
+				Len:          2,
+			},
+			// [ lookup reg 2 set <name>_port dreg 2 ]
+			&expr.Lookup{
+				SourceRegister: 2,
+				DestRegister:   2,
+				IsDestRegSet:   true,
+				SetName:        mapNamed("_port"),
+			},
+		)
+		nat.RegProtoMin, nat.RegProtoMax = 2, 2
+
+	case pf.isRange() || pf.ForwardPort == 0:
+		// the destination port is not changed
+
+	default:
+		exprs = append(exprs,
+			// [ immediate reg 2 <forwardPort> ]
+			&expr.Immediate{
+				Register: 2,
+				Data:     binaryutil.BigEndian.PutUint16(uint16(pf.ForwardPort)),
+			},
+		)
+		nat.RegProtoMin, nat.RegProtoMax = 2, 2
+	}
+
+	// [ nat dnat ip addr_min reg 1 addr_max reg 0 proto_min reg 2 proto_max reg 0 ]
+	return append(exprs, nat), nil
+}
@@ -0,0 +1,689 @@
+//go:build linux
+
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// The ip allow and deny lists are interval sets so they can
+// hold whole networks as well as single addresses. Each
+// list is kept as a set of non-overlapping address ranges.
+// Permanent ranges that overlap or are adjacent are merged
+// and timed ranges are kept separate so each can expire on
+// its own. Changes are applied as the difference between the
+// current and the updated ranges so untouched ranges keep
+// their remaining time.
+
+// an inclusive range of addresses in an ip list
+type ipRange struct {
+	start,
+	end netip.Addr
+
+	ttl,
+	remaining time.Duration
+
+	// the timeout of the range's elements in the kernel
+	// which is less than the ttl if the range was
+	// re-created with its remaining time
+	timeout time.Duration
+
+	// set on ranges being added so they are
+	// re-created even if they already exist
+	// which resets the time they expire
+	refresh bool
+}
+
+func (r *packetFilterRouter) AddPrefixesToDenyList(prefixes []netip.Prefix) error {
+	return r.addPrefixesToList(ipDenyListKey, prefixes, 0)
+}
+
+func (r *packetFilterRouter) AddPrefixesToDenyListWithTTL(prefixes []netip.Prefix, ttl time.Duration) error {
+	return r.addPrefixesToList(ipDenyListKey, prefixes, ttl)
+}
+
+func (r *packetFilterRouter) DeletePrefixesFromDenyList(prefixes []netip.Prefix) error {
+	return r.deletePrefixesFromList(ipDenyListKey, prefixes)
+}
+
+func (r *packetFilterRouter) AddPrefixesToAllowList(prefixes []netip.Prefix) error {
+	return r.addPrefixesToList(ipAllowListKey, prefixes, 0)
+}
+
+func (r *packetFilterRouter) AddPrefixesToAllowListWithTTL(prefixes []netip.Prefix, ttl time.Duration) error {
+	return r.addPrefixesToList(ipAllowListKey, prefixes, ttl)
+}
+
+func (r *packetFilterRouter) DeletePrefixesFromAllowList(prefixes []netip.Prefix) error {
+	return r.deletePrefixesFromList(ipAllowListKey, prefixes)
+}
+
+func (r *packetFilterRouter) ListDenyList() ([]IPListElement, error) {
+	return r.listIPs(ipDenyListKey)
+}
+
+func (r *packetFilterRouter) ListAllowList() ([]IPListElement, error) {
+	return r.listIPs(ipAllowListKey)
+}
+
+// adds prefixes to the given list. if ttl is greater
+// than zero the prefixes are removed from the list by
+// the kernel once the ttl expires. timed prefixes that
+// are covered by permanent prefixes are ignored.
+func (r *packetFilterRouter) addPrefixesToList(listKey string, prefixes []netip.Prefix, ttl time.Duration) error {
+
+	var (
+		err error
+
+		addRanges [][]ipRange
+	)
+
+	if ttl < 0 {
+		return fmt.Errorf("invalid ttl %s for prefixes added to list '%s'", ttl, listKey)
+	}
+	if addRanges, err = prefixRanges(prefixes); err != nil {
+		return err
+	}
+	if len(prefixes) > 0 {
+		b := r.newFilterBatch()
+		if _, err = r.queueIPListUpdate(listKey, func(i int, current []ipRange) []ipRange {
+			return addIPRanges(current, addRanges[i], ttl)
+		}); err != nil {
+			r.discardFilterBatch(b)
+			return err
+		}
+		if err = r.queueIPListRules(b, listKey); err != nil {
+			r.discardFilterBatch(b)
+			return err
+		}
+		return r.commitFilterBatch(b)
+	}
+	return nil
+}
+
+// removes prefixes from the given list. ranges in the list
+// that partially overlap a prefix are split so that only
+// the addresses of the prefix are removed.
+func (r *packetFilterRouter) deletePrefixesFromList(listKey string, prefixes []netip.Prefix) error {
+
+	var (
+		err  error
+		ok   bool
+		size int
+
+		deleteRanges [][]ipRange
+	)
+
+	if deleteRanges, err = prefixRanges(prefixes); err != nil {
+		return err
+	}
+	b := r.newFilterBatch()
+	if size, err = r.queueIPListUpdate(listKey, func(i int, current []ipRange) []ipRange {
+		return subtractIPRanges(current, mergeIPRanges(deleteRanges[i]))
+	}); err != nil {
+		r.discardFilterBatch(b)
+		return err
+	}
+	if _, ok = r.ruleMap[listKey]; ok && size == 0 {
+		// unbind the list once it is empty
+		if err = r.queueDeleteFilter(b, listKey); err != nil {
+			r.discardFilterBatch(b)
+			return err
+		}
+	}
+	return r.commitFilterBatch(b)
+}
+
+// lists the prefixes in the ip set pair of the given
+// list along with the time remaining for timed prefixes
+func (r *packetFilterRouter) listIPs(listKey string) ([]IPListElement, error) {
+
+	var (
+		err error
+
+		ranges []ipRange
+	)
+
+	elems := []IPListElement{}
+	for _, set := range r.ipListSet(listKey) {
+		if ranges, err = r.getIPSetRanges(set); err != nil {
+			return nil, err
+		}
+		for _, rg := range ranges {
+			for _, prefix := range rg.prefixes() {
+				elems = append(elems, IPListElement{
+					Prefix:    prefix,
+					TTL:       rg.ttl,
+					Remaining: rg.remaining,
+				})
+			}
+		}
+	}
+	return elems, nil
+}
+
+// queues the element changes that update the ranges in the
+// ip set pair of the given list using the given update
+// function and returns the number of ranges in the lists
+func (r *packetFilterRouter) queueIPListUpdate(
+	listKey string,
+	update func(i int, current []ipRange) []ipRange,
+) (int, error) {
+
+	var (
+		err error
+
+		current []ipRange
+	)
+
+	size := 0
+	for i, set := range r.ipListSet(listKey) {
+		if current, err = r.getIPSetRanges(set); err != nil {
+			return 0, err
+		}
+		updated := update(i, current)
+		if err = r.queueIPSetRanges(set, current, updated); err != nil {
+			return 0, err
+		}
+		size += len(updated)
+	}
+	return size, nil
+}
+
+// queues the deletion of the current ranges of an ip
+// set that are not in the updated ranges and the
+// addition of the updated ranges that are not current
+func (r *packetFilterRouter) queueIPSetRanges(set *nftables.Set, current, updated []ipRange) error {
+
+	var (
+		err error
+	)
+
+	var rangeKey = func(rg ipRange) string {
+		return fmt.Sprintf("%s-%s/%d", rg.start, rg.end, rg.ttl)
+	}
+
+	currentKeys := make(map[string]bool)
+	for _, rg := range current {
+		currentKeys[rangeKey(rg)] = true
+	}
+	updatedKeys := make(map[string]bool)
+	addElems := []nftables.SetElement{}
+	addTTLs := make(map[string]time.Duration)
+	for _, rg := range updated {
+		key := rangeKey(rg)
+		updatedKeys[key] = !rg.refresh
+		if !currentKeys[key] || rg.refresh {
+			addElems = append(addElems, rg.setElements()...)
+			if rg.timeout = rg.elementTimeout(); rg.timeout != rg.ttl {
+				addTTLs[ipRangeTTLKey(set, rg)] = rg.ttl
+			}
+		}
+	}
+	deleteElems := []nftables.SetElement{}
+	keptKeys := make(map[string]bool)
+	for _, rg := range current {
+		if keep, ok := updatedKeys[rangeKey(rg)]; ok && keep {
+			keptKeys[ipRangeTTLKey(set, rg)] = true
+		} else {
+			for _, elem := range rg.setElements() {
+				deleteElems = append(deleteElems, nftables.SetElement{
+					Key:         elem.Key,
+					IntervalEnd: elem.IntervalEnd,
+				})
+			}
+		}
+	}
+
+	// the ttls kept for the set's ranges that were re-created
+	// with their remaining time are replaced with those of
+	// the kept ranges and the ranges being re-created
+	prefix := set.Table.Name + "/" + set.Name + "/"
+	for key := range r.ipRangeTTLs {
+		if strings.HasPrefix(key, prefix) && !keptKeys[key] {
+			delete(r.ipRangeTTLs, key)
+		}
+	}
+	for key, ttl := range addTTLs {
+		r.ipRangeTTLs[key] = ttl
+	}
+
+	// deletions are queued first so refreshed
+	// ranges can be re-created in the same batch
+	if len(deleteElems) > 0 {
+		if err = r.nft.SetDeleteElements(set, deleteElems); err != nil {
+			return err
+		}
+	}
+	if len(addElems) > 0 {
+		if err = r.nft.SetAddElements(set, addElems); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returns the ranges of the given ranges when the ranges
+// to add with the given ttl have been added to them
+func addIPRanges(current, add []ipRange, ttl time.Duration) []ipRange {
+
+	permanent, timed := []ipRange{}, []ipRange{}
+	for _, rg := range current {
+		if rg.ttl == 0 {
+			permanent = append(permanent, rg)
+		} else {
+			timed = append(timed, rg)
+		}
+	}
+
+	add = mergeIPRanges(add)
+	if ttl == 0 {
+		// timed ranges covered by the
+		// new permanent ranges are removed
+		permanent = mergeIPRanges(append(permanent, add...))
+		timed = subtractIPRanges(timed, permanent)
+
+	} else {
+		// timed ranges cannot shorten the life of
+		// addresses that are permanently in the list
+		add = subtractIPRanges(add, permanent)
+		for i := range add {
+			add[i].ttl = ttl
+			add[i].remaining = 0
+			add[i].refresh = true
+		}
+		timed = append(subtractIPRanges(timed, add), add...)
+	}
+	return sortIPRanges(append(permanent, timed...))
+}
+
+// merges overlapping and adjacent ranges. the merged ranges
+// are permanent as only permanent ranges are merged.
+func mergeIPRanges(ranges []ipRange) []ipRange {
+
+	merged := []ipRange{}
+	for _, rg := range sortIPRanges(ranges) {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if last.end.Next().IsValid() && rg.start.Compare(last.end.Next()) <= 0 || !last.end.Next().IsValid() {
+				if rg.end.Compare(last.end) > 0 {
+					last.end = rg.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, ipRange{ start: rg.start, end: rg.end })
+	}
+	return merged
+}
+
+// returns the given ranges with the addresses in the
+// cut ranges removed. the cut ranges must be sorted
+// and not overlap.
+func subtractIPRanges(ranges, cut []ipRange) []ipRange {
+
+	result := []ipRange{}
+	for _, rg := range ranges {
+		pieces := []ipRange{ rg }
+		for _, c := range cut {
+			next := []ipRange{}
+			for _, p := range pieces {
+				if c.end.Compare(p.start) < 0 || c.start.Compare(p.end) > 0 {
+					// no overlap
+					next = append(next, p)
+					continue
+				}
+				if c.start.Compare(p.start) > 0 {
+					left := p
+					left.end = c.start.Prev()
+					next = append(next, left)
+				}
+				if c.end.Compare(p.end) < 0 {
+					right := p
+					right.start = c.end.Next()
+					next = append(next, right)
+				}
+			}
+			pieces = next
+		}
+		result = append(result, pieces...)
+	}
+	return result
+}
+
+func sortIPRanges(ranges []ipRange) []ipRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start.Less(ranges[j].start)
+	})
+	return ranges
+}
+
+// returns the interval set elements for a range. the range
+// end element is omitted if the range ends at the last
+// address of the address space.
+func (rg ipRange) setElements() []nftables.SetElement {
+	elems := []nftables.SetElement{
+		{
+			Key:     rg.start.AsSlice(),
+			Timeout: rg.elementTimeout(),
+		},
+	}
+	if end := rg.end.Next(); end.IsValid() {
+		elems = append(elems, nftables.SetElement{
+			Key:         end.AsSlice(),
+			IntervalEnd: true,
+		})
+	}
+	return elems
+}
+
+// returns the timeout of the range's elements. timed ranges that
+// are re-created because they were split by a deletion expire
+// after their remaining time and not their full ttl. elements
+// cannot be given an expiration apart from their timeout so the
+// router keeps the ttl of such ranges.
+func (rg ipRange) elementTimeout() time.Duration {
+	if rg.ttl > 0 && rg.remaining > 0 && !rg.refresh {
+		if rg.remaining < time.Millisecond {
+			// a zero timeout would make the range permanent
+			return time.Millisecond
+		}
+		return rg.remaining
+	}
+	return rg.ttl
+}
+
+// returns the smallest list of prefixes that cover a range
+func (rg ipRange) prefixes() []netip.Prefix {
+
+	prefixes := []netip.Prefix{}
+	start := rg.start
+	for start.IsValid() && start.Compare(rg.end) <= 0 {
+		// find the largest prefix that begins at
+		// start and does not extend beyond the end
+		bits := start.BitLen()
+		for b := 0; b <= start.BitLen(); b++ {
+			p := netip.PrefixFrom(start, b)
+			if p.Masked().Addr() == start && lastAddr(p).Compare(rg.end) <= 0 {
+				bits = b
+				break
+			}
+		}
+		p := netip.PrefixFrom(start, bits)
+		prefixes = append(prefixes, p)
+		start = lastAddr(p).Next()
+	}
+	return prefixes
+}
+
+// returns the ranges of the given prefixes
+// separated by ipv4 and ipv6 address types
+func prefixRanges(prefixes []netip.Prefix) ([][]ipRange, error) {
+
+	ranges := make([][]ipRange, 2)
+	for _, p := range prefixes {
+		if !p.IsValid() {
+			return nil, fmt.Errorf("invalid prefix: %s", p)
+		}
+		if p.Addr().Is4In6() {
+			// ipv4 mapped ipv6 prefixes are added to the
+			// ipv4 lists so the mapping bits are dropped
+			if p.Bits() < 96 {
+				return nil, fmt.Errorf("prefix %s exceeds the ipv4 mapped address range", p)
+			}
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		p = p.Masked()
+		rg := ipRange{ start: p.Addr(), end: lastAddr(p) }
+		if p.Addr().Is4() {
+			ranges[0] = append(ranges[0], rg)
+		} else {
+			ranges[1] = append(ranges[1], rg)
+		}
+	}
+	return ranges, nil
+}
+
+// returns the single address prefixes of the given ips
+func ipPrefixes(ips []netip.Addr) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(ips))
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+	}
+	return prefixes
+}
+
+// returns the last address of a prefix
+func lastAddr(p netip.Prefix) netip.Addr {
+	addr := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(addr)*8; i++ {
+		addr[i/8] |= 0x80 >> (i%8)
+	}
+	last, _ := netip.AddrFromSlice(addr)
+	return last
+}
+
+// retrieves the ranges of an ip interval set
+func (r *packetFilterRouter) getIPSetRanges(set *nftables.Set) ([]ipRange, error) {
+
+	var (
+		err error
+
+		elems []setElement
+	)
+
+	if elems, err = r.nft.getSetElements(set); err != nil {
+		return nil, err
+	}
+	ranges := ipSetElementRanges(elems)
+	for i, rg := range ranges {
+		// the timeout of ranges that were re-created with
+		// their remaining time is not their configured ttl
+		if ttl, ok := r.ipRangeTTLs[ipRangeTTLKey(set, rg)]; ok {
+			ranges[i].ttl = ttl
+		}
+	}
+	return ranges, nil
+}
+
+// returns the key of the configured ttl of a range
+// that was re-created with its remaining time
+func ipRangeTTLKey(set *nftables.Set, rg ipRange) string {
+	return fmt.Sprintf("%s/%s/%s-%s/%d", set.Table.Name, set.Name, rg.start, rg.end, rg.timeout.Milliseconds())
+}
+
+// a set element decoded from a set element list message
+type setElement struct {
+	key         []byte
+	intervalEnd bool
+
+	// data of map elements
+	verdict *expr.Verdict
+	val     []byte
+
+	timeout,
+	expiration time.Duration
+}
+
+// retrieves the elements of a set directly via netlink as the
+// nftables package does not decode the expiration time of set
+// elements or the data of map elements
+func getSetElements(set *nftables.Set) ([]setElement, error) {
+
+	var (
+		err error
+
+		conn *netlink.Conn
+		data []byte
+		msgs []netlink.Message
+	)
+
+	if conn, err = netlink.Dial(unix.NETLINK_NETFILTER, nil); err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if data, err = netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_SET_ELEM_LIST_TABLE, Data: []byte(set.Table.Name + "\x00")},
+		{Type: unix.NFTA_SET_ELEM_LIST_SET, Data: []byte(set.Name + "\x00")},
+	}); err != nil {
+		return nil, err
+	}
+	if msgs, err = conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | unix.NFT_MSG_GETSETELEM),
+			Flags: netlink.Request | netlink.Dump,
+		},
+		// nfgenmsg { family, version, res_id }
+		Data: append([]byte{ byte(set.Table.Family), unix.NFNETLINK_V0, 0, 0 }, data...),
+	}); err != nil {
+		return nil, err
+	}
+
+	elems := []setElement{}
+	for _, msg := range msgs {
+		if len(msg.Data) < 4 {
+			continue
+		}
+		if elems, err = decodeSetElements(msg.Data[4:], elems); err != nil {
+			return nil, err
+		}
+	}
+	return elems, nil
+}
+
+// decodes the set elements in a set element list message
+func decodeSetElements(data []byte, elems []setElement) ([]setElement, error) {
+
+	var (
+		err error
+
+		ad *netlink.AttributeDecoder
+	)
+
+	if ad, err = netlink.NewAttributeDecoder(data); err != nil {
+		return nil, err
+	}
+	ad.ByteOrder = binary.BigEndian
+
+	for ad.Next() {
+		if ad.Type() != unix.NFTA_SET_ELEM_LIST_ELEMENTS {
+			continue
+		}
+		ad.Nested(func(lad *netlink.AttributeDecoder) error {
+			for lad.Next() {
+				if lad.Type() != unix.NFTA_LIST_ELEM {
+					continue
+				}
+				elem := setElement{}
+				lad.Nested(func(ead *netlink.AttributeDecoder) error {
+					ead.ByteOrder = binary.BigEndian
+					for ead.Next() {
+						switch ead.Type() {
+						case unix.NFTA_SET_ELEM_KEY:
+							ead.Nested(func(kad *netlink.AttributeDecoder) error {
+								for kad.Next() {
+									if kad.Type() == unix.NFTA_DATA_VALUE {
+										elem.key = kad.Bytes()
+									}
+								}
+								return nil
+							})
+						case unix.NFTA_SET_ELEM_DATA:
+							ead.Nested(func(dad *netlink.AttributeDecoder) error {
+								for dad.Next() {
+									if dad.Type() == unix.NFTA_DATA_VALUE {
+										elem.val = dad.Bytes()
+									}
+									if dad.Type() == unix.NFTA_DATA_VERDICT {
+										elem.verdict = &expr.Verdict{}
+										dad.Nested(func(vad *netlink.AttributeDecoder) error {
+											vad.ByteOrder = binary.BigEndian
+											for vad.Next() {
+												switch vad.Type() {
+												case unix.NFTA_VERDICT_CODE:
+													elem.verdict.Kind = expr.VerdictKind(int32(vad.Uint32()))
+												case unix.NFTA_VERDICT_CHAIN:
+													elem.verdict.Chain = vad.String()
+												}
+											}
+											return nil
+										})
+									}
+								}
+								return nil
+							})
+						case unix.NFTA_SET_ELEM_FLAGS:
+							elem.intervalEnd = (ead.Uint32() & unix.NFT_SET_ELEM_INTERVAL_END) != 0
+						case unix.NFTA_SET_ELEM_TIMEOUT:
+							elem.timeout = time.Duration(ead.Uint64()) * time.Millisecond
+						case unix.NFTA_SET_ELEM_EXPIRATION:
+							elem.expiration = time.Duration(ead.Uint64()) * time.Millisecond
+						}
+					}
+					return nil
+				})
+				if len(elem.key) > 0 {
+					elems = append(elems, elem)
+				}
+			}
+			return nil
+		})
+	}
+	return elems, ad.Err()
+}
+
+// pairs the start and end elements of an ip interval set
+func ipSetElementRanges(elems []setElement) []ipRange {
+
+	// sort by key with end elements before start
+	// elements of the same key so adjacent ranges
+	// are paired correctly
+	sort.Slice(elems, func(i, j int) bool {
+		if c := bytes.Compare(elems[i].key, elems[j].key); c != 0 {
+			return c < 0
+		}
+		return elems[i].intervalEnd && !elems[j].intervalEnd
+	})
+
+	ranges := []ipRange{}
+	for i := 0; i < len(elems); i++ {
+		if elems[i].intervalEnd {
+			// end element without a start such as the
+			// zero address end element added by nft
+			continue
+		}
+		start, ok := netip.AddrFromSlice(elems[i].key)
+		if !ok {
+			continue
+		}
+		rg := ipRange{
+			start:     start,
+			ttl:       elems[i].timeout,
+			remaining: elems[i].expiration,
+			timeout:   elems[i].timeout,
+		}
+		if i+1 < len(elems) && elems[i+1].intervalEnd {
+			end, _ := netip.AddrFromSlice(elems[i+1].key)
+			rg.end = end.Prev()
+			i++
+		} else {
+			// range extends to the end of the address space
+			rg.end = lastAddr(netip.PrefixFrom(rg.start, 0))
+		}
+		ranges = append(ranges, rg)
+	}
+	return ranges
+}
@@ -0,0 +1,307 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+func (pg PortGroup) hasLimits() bool {
+	return pg.RateLimit != nil || pg.ConnLimit > 0
+}
+
+// limits only apply to traffic that is accepted
+// so they cannot be set on deny security groups
+func (sg SecurityGroup) validateLimits() error {
+	for _, pg := range sg.Ports {
+		if pg.hasLimits() {
+			if sg.Deny {
+				return fmt.Errorf("rate and connection limits cannot be applied to a security group that denies traffic")
+			}
+			if pg.RateLimit != nil && pg.RateLimit.Rate == 0 {
+				return fmt.Errorf("rate limit for port group %+v must be greater than zero", pg)
+			}
+		}
+	}
+	return nil
+}
+
+// returns true if the port group of the given security group
+// is filtered by its own rules instead of the port vmap
+func (r *packetFilterRouter) hasPortGroupRules(sg SecurityGroup, pg PortGroup) bool {
+	return pg.hasLimits() || (sg.Deny && r.dropLogging != nil)
+}
+
+// returns the rules that filter a port group which cannot be
+// added to the security group's port vmap. these are port groups
+// with rate and connection limits that need to be evaluated
+// before the port group's traffic is accepted and port groups
+// whose dropped packets are logged. byte rate limits are not
+// returned as they are applied by the rule returned by
+// createByteLimitRule.
+//
+// <sgExprs> meta l4proto <proto> th dport <from>-<to> ct state new limit rate over <rate>/second burst <burst> packets drop
+// <sgExprs> meta l4proto <proto> th dport <from>-<to> ct state new add @<meter> { ip saddr ct count over <n> } drop
+// <sgExprs> meta l4proto <proto> th dport <from>-<to> accept/drop
+func (r *packetFilterRouter) createPortGroupRules(
+	chain *nftables.Chain,
+	pos uint64,
+	sgExprs []expr.Any,
+	pg PortGroup,
+	verdict expr.VerdictKind,
+	meterName string,
+	is4 bool,
+) ([]*nftables.Rule, error) {
+
+	var (
+		err error
+	)
+
+	// returns a copy of the port group match
+	// expressions followed by the given exprs
+	var matchExprs = func(exprs ...expr.Any) []expr.Any {
+		return portGroupMatchExprs(sgExprs, pg, exprs...)
+	}
+
+	// returns a copy of the port group match expressions
+	// followed by a match of new connections and the given
+	// exprs. packet rate and connection limits are only
+	// applied to new connections as the rules may precede
+	// the rule that accepts the packets of established
+	// connections.
+	var newConnMatchExprs = func(exprs ...expr.Any) []expr.Any {
+		return matchExprs(append(
+			[]expr.Any{
+				// [ ct load state => reg 1 ]
+				&expr.Ct{
+					Register: 1,
+					Key:      expr.CtKeySTATE,
+				},
+				// [ bitwise reg 1 = (reg=1 & 0x00000008 ) ^ 0x00000000 ]
+				&expr.Bitwise{
+					SourceRegister: 1,
+					DestRegister:   1,
+					Len:            4,
+					Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitNEW),
+					Xor:            binaryutil.NativeEndian.PutUint32(0),
+				},
+				// [ cmp neq reg 1 0x00000000 ]
+				&expr.Cmp{
+					Op:       expr.CmpOpNeq,
+					Register: 1,
+					Data:     binaryutil.NativeEndian.PutUint32(0),
+				},
+			},
+			exprs...,
+		)...)
+	}
+
+	if _, err = pg.l4Proto(); err != nil {
+		return nil, err
+	}
+
+	rules := []*nftables.Rule{}
+
+	if pg.RateLimit != nil && !pg.RateLimit.Bytes {
+		rules = append(rules,
+			&nftables.Rule{
+				Table:    chain.Table,
+				Chain:    chain,
+				Position: pos,
+				Exprs: newConnMatchExprs(
+					// [ limit rate over <rate>/second burst <burst> ]
+					&expr.Limit{
+						Type:  expr.LimitTypePkts,
+						Rate:  pg.RateLimit.Rate,
+						Over:  true,
+						Unit:  expr.LimitTimeSecond,
+						Burst: pg.RateLimit.Burst,
+					},
+					// [ immediate reg 0 drop ]
+					&expr.Verdict{
+						Kind: expr.VerdictDrop,
+					},
+				),
+			},
+		)
+	}
+
+	if pg.ConnLimit > 0 {
+		// set <meter> {
+		//   type ipv4_addr
+		//   flags dynamic
+		// }
+		meter := &nftables.Set{
+			Name:    meterName,
+			Table:   chain.Table,
+			KeyType: ipSetElemTypes[0],
+			Dynamic: true,
+		}
+		if !is4 {
+			meter.KeyType = ipSetElemTypes[1]
+		}
+		if err = r.nft.AddSet(meter, nil); err != nil {
+			return nil, err
+		}
+
+		addrLen, srcOffset, _, _ := ipHeaderOffsets(is4)
+		rules = append(rules,
+			&nftables.Rule{
+				Table:    chain.Table,
+				Chain:    chain,
+				Position: pos,
+				Exprs: newConnMatchExprs(
+					// [ payload load 4b @ network header + 12 (src addr) => reg 1 ]
+					&expr.Payload{
+						DestRegister: 1,
+						Base:         expr.PayloadBaseNetworkHeader,
+						Offset:       srcOffset,
+						Len:          addrLen,
+					},
+					// [ dynset add reg_key 1 set <meter> expr [ connlimit count <n> flags 1 ] ]
+					//
+					// NOTE: the set id is not set as it is not
+					//       returned when rules are listed which
+					//       would prevent the rule from being
+					//       matched once it has been created
+					&expr.Dynset{
+						SrcRegKey: 1,
+						SetName:   meter.Name,
+						Operation: uint32(unix.NFT_DYNSET_OP_ADD),
+						Exprs: []expr.Any{
+							&expr.Connlimit{
+								Count: pg.ConnLimit,
+								Flags: expr.NFT_CONNLIMIT_F_INV,
+							},
+						},
+					},
+					// [ immediate reg 0 drop ]
+					&expr.Verdict{
+						Kind: expr.VerdictDrop,
+					},
+				),
+			},
+		)
+	}
+
+	rules = append(rules,
+		&nftables.Rule{
+			Table:    chain.Table,
+			Chain:    chain,
+			Position: pos,
+			Exprs: matchExprs(
+				// [ immediate reg 0 accept/drop ]
+				&expr.Verdict{
+					Kind: verdict,
+				},
+			),
+		},
+	)
+	return rules, nil
+}
+
+// returns the rule that applies the byte rate limit of a port
+// group. the limit applies to all packets of the port group so
+// the rule must be inserted before the ct state rule that
+// accepts the packets of established connections. the port
+// group's protocol must have been validated by the caller.
+//
+// <sgExprs> meta l4proto <proto> th dport <from>-<to> limit rate over <rate> bytes/second burst <burst> bytes drop
+func (r *packetFilterRouter) createByteLimitRule(
+	chain *nftables.Chain,
+	pos uint64,
+	sgExprs []expr.Any,
+	pg PortGroup,
+) *nftables.Rule {
+
+	return &nftables.Rule{
+		Table:    chain.Table,
+		Chain:    chain,
+		Position: pos,
+		Exprs: portGroupMatchExprs(sgExprs, pg,
+			// [ limit rate over <rate>/second burst <burst> type bytes ]
+			&expr.Limit{
+				Type:  expr.LimitTypePktBytes,
+				Rate:  pg.RateLimit.Rate,
+				Over:  true,
+				Unit:  expr.LimitTimeSecond,
+				Burst: pg.RateLimit.Burst,
+			},
+			// [ immediate reg 0 drop ]
+			&expr.Verdict{
+				Kind: expr.VerdictDrop,
+			},
+		),
+	}
+}
+
+// returns the ip protocol number of the port group's protocol
+func (pg PortGroup) l4Proto() (byte, error) {
+	switch pg.Proto {
+	case ICMP:
+		return unix.IPPROTO_ICMP, nil
+	case TCP:
+		return unix.IPPROTO_TCP, nil
+	case UDP:
+		return unix.IPPROTO_UDP, nil
+	default:
+		return 0, fmt.Errorf("unsupported protocol: %s", string(pg.Proto))
+	}
+}
+
+// returns a copy of the given security group match expressions
+// followed by the match of the port group and the given exprs
+func portGroupMatchExprs(sgExprs []expr.Any, pg PortGroup, exprs ...expr.Any) []expr.Any {
+
+	proto, _ := pg.l4Proto()
+
+	e := make([]expr.Any, 0, len(sgExprs)+len(exprs)+4)
+	e = append(e, sgExprs...)
+	e = append(e,
+		// [ meta load l4proto => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		// [ cmp eq reg 1 <proto> ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{proto},
+		},
+	)
+	if pg.Proto != ICMP {
+		// [ payload load 2b @ transport header + 2 (dest port) => reg 1 ]
+		e = append(e, &expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       2,
+			Len:          2,
+		})
+		if pg.FromPort == pg.ToPort {
+			// [ cmp eq reg 1 <port> ]
+			e = append(e, &expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     binaryutil.BigEndian.PutUint16(uint16(pg.FromPort)),
+			})
+		} else {
+			// [ range eq reg 1 <from port> <to port> ]
+			e = append(e, &expr.Range{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				FromData: binaryutil.BigEndian.PutUint16(uint16(pg.FromPort)),
+				ToData:   binaryutil.BigEndian.PutUint16(uint16(pg.ToPort)),
+			})
+		}
+	}
+	return append(e, exprs...)
+}
+
+// returns the name of the connection limit meter for
+// the port group at the given index of a security group
+func limitMeterName(sgKey string, pgIndex, tableIndex int) string {
+	return fmt.Sprintf("%s_ct%d_%d", sgKey, pgIndex, tableIndex)
+}
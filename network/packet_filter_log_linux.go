@@ -0,0 +1,147 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+var logLevels = map[string]expr.LogLevel{
+	"emerg":  expr.LogLevelEmerg,
+	"alert":  expr.LogLevelAlert,
+	"crit":   expr.LogLevelCrit,
+	"err":    expr.LogLevelErr,
+	"warn":   expr.LogLevelWarning,
+	"notice": expr.LogLevelNotice,
+	"info":   expr.LogLevelInfo,
+	"debug":  expr.LogLevelDebug,
+}
+
+// max length of a log prefix including the terminating null
+const maxLogPrefixLen = 128
+
+func (l *DropLogging) validate() error {
+	if _, ok := logLevels[l.Level]; !ok && len(l.Level) > 0 {
+		return fmt.Errorf("invalid drop logging level '%s'", l.Level)
+	}
+	if len(l.Prefix) + len("policy: ") >= maxLogPrefixLen {
+		return fmt.Errorf("drop logging prefix '%s' is too long", l.Prefix)
+	}
+	return nil
+}
+
+// returns the expressions that log a packet
+// that is dropped for the given reason
+//
+// limit rate <rate>/second log prefix "<prefix><reason>: " level <level>
+func (r *packetFilterRouter) dropLogExprs(reason string) []expr.Any {
+
+	exprs := []expr.Any{}
+	if r.dropLogging.RateLimit > 0 {
+		exprs = append(exprs,
+			// [ limit rate <rate>/second burst 5 type packets flags 0x0 ]
+			&expr.Limit{
+				Type:  expr.LimitTypePkts,
+				Rate:  r.dropLogging.RateLimit,
+				Unit:  expr.LimitTimeSecond,
+				Burst: 5,
+			},
+		)
+	}
+	level, ok := logLevels[r.dropLogging.Level]
+	if !ok {
+		level = expr.LogLevelWarning
+	}
+	return append(exprs,
+		// [ log prefix <prefix> level <level> ]
+		&expr.Log{
+			Key:   (1 << unix.NFTA_LOG_PREFIX) | (1 << unix.NFTA_LOG_LEVEL),
+			Level: level,
+			Data:  []byte(fmt.Sprintf("%s%s: ", r.dropLogging.Prefix, reason)),
+		},
+	)
+}
+
+// returns the given rules with a rule that logs the packets
+// matched by each drop rule added in front of the drop rule
+func (r *packetFilterRouter) withDropLogRules(rules []*nftables.Rule, reason string) []*nftables.Rule {
+
+	if r.dropLogging == nil {
+		return rules
+	}
+
+	loggedRules := make([]*nftables.Rule, 0, len(rules)*2)
+	for _, rule := range rules {
+		n := len(rule.Exprs)
+		if n > 0 {
+			if verdict, ok := rule.Exprs[n-1].(*expr.Verdict); ok && verdict.Kind == expr.VerdictDrop {
+				logExprs := make([]expr.Any, 0, n+1)
+				logExprs = append(logExprs, rule.Exprs[:n-1]...)
+				logExprs = append(logExprs, r.dropLogExprs(reason)...)
+
+				loggedRules = append(loggedRules,
+					&nftables.Rule{
+						Table:    rule.Table,
+						Chain:    rule.Chain,
+						Position: rule.Position,
+						Exprs:    logExprs,
+					},
+				)
+			}
+		}
+		loggedRules = append(loggedRules, rule)
+	}
+	return loggedRules
+}
+
+// adds a rule at the end of the given chains that logs the
+// packets that will be dropped by the chain's drop policy
+// if it does not exist and saves the rule's position so
+// rules appended to the chains are inserted before it
+func (r *packetFilterRouter) addPolicyDropLogRules(chains []*nftables.Chain) error {
+
+	var (
+		err error
+
+		rules []*nftables.Rule
+		rule  *nftables.Rule
+	)
+
+	logRule := func(chain *nftables.Chain) *nftables.Rule {
+		return &nftables.Rule{
+			Table: chain.Table,
+			Chain: chain,
+			Exprs: r.dropLogExprs("policy"),
+		}
+	}
+
+	added := false
+	for _, chain := range chains {
+		if rules, err = r.nft.GetRules(chain.Table, chain); err != nil {
+			return err
+		}
+		if findRuleInList(logRule(chain), rules) == nil {
+			r.nft.AddRule(logRule(chain))
+			added = true
+		}
+	}
+	if added {
+		if err = r.nft.Flush(); err != nil {
+			return err
+		}
+	}
+	for _, chain := range chains {
+		if rules, err = r.nft.GetRules(chain.Table, chain); err != nil {
+			return err
+		}
+		if rule = findRuleInList(logRule(chain), rules); rule == nil {
+			return fmt.Errorf("policy drop log rule not found in chain '%s' of table '%s'", chain.Name, chain.Table.Name)
+		}
+		r.policyLogPos[chain.Table.Name + "/" + chain.Name] = rule.Handle
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+func (r *packetFilterRouter) MarkTraffic(tm TrafficMark) (string, error) {
+
+	var (
+		err error
+
+		ruleKey string
+	)
+
+	b := r.newFilterBatch()
+	if ruleKey, err = r.queueTrafficMark(b, tm); err != nil {
+		r.discardFilterBatch(b)
+		return "", err
+	}
+	return ruleKey, r.commitFilterBatch(b)
+}
+
+func (r *packetFilterRouter) DeleteTrafficMark(tm TrafficMark) error {
+	return r.DeleteFilter(tm.key())
+}
+
+// queues the rules that mark the traffic matched by a
+// traffic mark on the given batch and returns the filter
+// key. traffic is marked in the mangle pre-routing chain
+// and if it is not bound to a source interface also in
+// the mangle output chain so that traffic originating
+// from the host is re-routed once it has been marked.
+func (r *packetFilterRouter) queueTrafficMark(b *filterBatch, tm TrafficMark) (string, error) {
+
+	var (
+		err error
+
+		table  *nftables.Table
+		chains []*nftables.Chain
+		rules  []*nftables.Rule
+	)
+
+	if err = tm.validate(); err != nil {
+		return "", err
+	}
+
+	families := []bool{ true, false }
+	if network := tm.network(); network.IsValid() {
+		families = []bool{ network.Addr().Is4() }
+	}
+	for _, is4 := range families {
+		if table, chains, err = r.getTable(is4); err != nil {
+			return "", err
+		}
+
+		exprs := tm.selectorExprs(is4)
+		exprs = append(exprs,
+			// [ immediate reg 1 <mark> ]
+			&expr.Immediate{
+				Register: 1,
+				Data:     binaryutil.NativeEndian.PutUint32(tm.Mark),
+			},
+			// [ meta set mark with reg 1 ]
+			&expr.Meta{
+				Key:            expr.MetaKeyMARK,
+				Register:       1,
+				SourceRegister: true,
+			},
+		)
+
+		// [iifname <srcItf>] [ip saddr <srcNetwork>] [ip daddr <dstNetwork>] [meta l4proto <proto> [th dport <dstPort>]] meta mark set <mark>
+		rules = append(rules,
+			&nftables.Rule{
+				Table: table,
+				Chain: chains[manglePreRoute],
+				Exprs: exprs,
+			},
+		)
+		if len(tm.SrcItfName) == 0 {
+			rules = append(rules,
+				&nftables.Rule{
+					Table: table,
+					Chain: chains[mangleOutput],
+					Exprs: append([]expr.Any{}, exprs...),
+				},
+			)
+		}
+	}
+
+	ruleKey := tm.key()
+	if err = r.queueFilterRules(b, ruleKey, rules, false); err != nil {
+		return "", err
+	}
+	r.trafficMarks[ruleKey] = tm
+	return ruleKey, nil
+}
+
+// returns the expressions that match the traffic
+// selected by a traffic mark in the given family
+func (tm TrafficMark) selectorExprs(is4 bool) []expr.Any {
+
+	addrLen, srcOffset, destOffset, _ := ipHeaderOffsets(is4)
+
+	exprs := []expr.Any{}
+	if len(tm.SrcItfName) > 0 {
+		exprs = append(exprs,
+			// [ meta load iifname => reg 1 ]
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			// [ cmp eq reg 1 <iifname> ]
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     []byte(tm.SrcItfName+"\x00"),
+			},
+		)
+	}
+
+	matchNetwork := func(network netip.Prefix, offset uint32) {
+		if !network.IsValid() || network.Bits() == 0 {
+			return
+		}
+		exprs = append(exprs,
+			// [ payload load 4b @ network header + <offset> => reg 1 ]
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseNetworkHeader,
+				Offset:       offset,
+				Len:          addrLen,
+			},
+			// [ bitwise reg 1 = (reg=1 & <network mask> ) ^ 0x00000000 ]
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            addrLen,
+				Mask:           []byte(net.CIDRMask(network.Bits(), int(addrLen)*8)),
+				Xor:            make([]byte, addrLen),
+			},
+			// [ cmp eq reg 1 <network in canonical form> ]
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     network.Masked().Addr().AsSlice(),
+			},
+		)
+	}
+	matchNetwork(tm.SrcNetwork, srcOffset)
+	matchNetwork(tm.DstNetwork, destOffset)
+
+	if len(tm.Proto) > 0 {
+		proto := byte(unix.IPPROTO_TCP)
+		switch tm.Proto {
+		case UDP:
+			proto = unix.IPPROTO_UDP
+		case ICMP:
+			proto = unix.IPPROTO_ICMP
+			if !is4 {
+				proto = unix.IPPROTO_ICMPV6
+			}
+		}
+		exprs = append(exprs,
+			// [ meta load l4proto => reg 1 ]
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			// [ cmp eq reg 1 <proto> ]
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     []byte{ proto },
+			},
+		)
+		if tm.DstPort > 0 {
+			exprs = append(exprs,
+				// [ payload load 2b @ transport header + 2 => reg 1 ]
+				&expr.Payload{
+					DestRegister: 1,
+					Base:         expr.PayloadBaseTransportHeader,
+					Offset:       2, // Destination Port
+					Len:          2,
+				},
+				// [ cmp eq reg 1 <dstPort> ]
+				&expr.Cmp{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					Data:     binaryutil.BigEndian.PutUint16(uint16(tm.DstPort)),
+				},
+			)
+		}
+	}
+	return exprs
+}
+
+// returns the network that determines the
+// family of the marked traffic if any
+func (tm TrafficMark) network() netip.Prefix {
+	if tm.SrcNetwork.IsValid() {
+		return tm.SrcNetwork
+	}
+	return tm.DstNetwork
+}
+
+func (tm TrafficMark) key() string {
+	return fmt.Sprintf("%s:%s>%s:%d|%s#mark",
+		tm.SrcItfName, tm.SrcNetwork.String(),
+		tm.DstNetwork.String(), tm.DstPort,
+		string(tm.Proto),
+	)
+}
+
+func (tm TrafficMark) validate() error {
+
+	if tm.Mark == 0 {
+		return fmt.Errorf("traffic mark cannot be zero: %+v", tm)
+	}
+	if tm.SrcNetwork.IsValid() && tm.DstNetwork.IsValid() && tm.SrcNetwork.Addr().Is4() != tm.DstNetwork.Addr().Is4() {
+		return fmt.Errorf("traffic mark cannot mix ipv4 and ipv6 types for SrcNetwork and DstNetwork: %+v", tm)
+	}
+	switch tm.Proto {
+	case "", ICMP, TCP, UDP:
+	default:
+		return fmt.Errorf("unsupported protocol: %s", string(tm.Proto))
+	}
+	if tm.DstPort != 0 && (tm.Proto != TCP && tm.Proto != UDP || tm.DstPort < 0 || tm.DstPort > 0xffff) {
+		return fmt.Errorf("traffic mark has an invalid destination port: %+v", tm)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+//go:build linux
+
+package network
+
+import (
+	"time"
+
+	"github.com/google/nftables"
+
+	"github.com/mevansam/goutils/logger"
+)
+
+// A filter router in dry-run mode uses an in-memory
+// connection and records each change it makes to the
+// packet filter as a step of its plan. The model starts
+// with the router's tables as they exist in the packet
+// filter the router would otherwise change if they can be
+// read so the plan reflects the changes that would be
+// made to them.
+
+// returns a connection to an in-memory packet filter with
+// the given tables as they exist in the given packet filter
+func newPlanNftConn(nft nftConn, tableNames ...string) *memNftConn {
+
+	var (
+		err error
+	)
+
+	c := newMemNftConn()
+	if mc, ok := nft.(*memNftConn); ok {
+		c.model = mc.model.clone()
+		c.model.retain(tableNames)
+		return c
+	}
+	if err = c.model.load(tableNames); err != nil {
+		logger.TraceMessage(
+			"newPlanNftConn(): Unable to read the existing tables so the plan will start with no tables: %s",
+			err.Error(),
+		)
+		c.model = &memModel{}
+	}
+	return c
+}
+
+// loads the given tables from the kernel
+func (m *memModel) load(tableNames []string) error {
+
+	var (
+		err error
+
+		nft    nftables.Conn
+		tables []*nftables.Table
+		chains []*nftables.Chain
+		sets   []*nftables.Set
+		rules  []*nftables.Rule
+		elems  []setElement
+	)
+
+	names := map[string]bool{}
+	for _, name := range tableNames {
+		names[name] = true
+	}
+	for _, family := range []nftables.TableFamily{ nftables.TableFamilyIPv4, nftables.TableFamilyIPv6 } {
+		if tables, err = nft.ListTablesOfFamily(family); err != nil {
+			return err
+		}
+		for _, table := range tables {
+			if names[table.Name] {
+				m.tables = append(m.tables, &memTable{ table: table })
+			}
+		}
+	}
+	if len(m.tables) == 0 {
+		return nil
+	}
+	if chains, err = nft.ListChains(); err != nil {
+		return err
+	}
+	for _, pt := range m.tables {
+		for _, chain := range chains {
+			if chain.Table.Name != pt.table.Name || chain.Table.Family != pt.table.Family {
+				continue
+			}
+			chain.Table = pt.table
+			if rules, err = nft.GetRules(pt.table, chain); err != nil {
+				return err
+			}
+			for _, rule := range rules {
+				if rule.Handle > m.handle {
+					m.handle = rule.Handle
+				}
+			}
+			pt.chains = append(pt.chains, &memChain{ chain: chain, rules: rules })
+		}
+		if sets, err = nft.GetSets(pt.table); err != nil {
+			return err
+		}
+		for _, set := range sets {
+			set.Table = pt.table
+			if elems, err = getSetElements(set); err != nil {
+				return err
+			}
+			ps := &memSet{ set: set }
+			for _, elem := range elems {
+				pe := memElement{
+					SetElement: nftables.SetElement{
+						Key:         elem.key,
+						IntervalEnd: elem.intervalEnd,
+						Timeout:     elem.timeout,
+						VerdictData: elem.verdict,
+						Val:         elem.val,
+					},
+				}
+				if elem.expiration > 0 {
+					pe.expires = time.Now().Add(elem.expiration)
+				}
+				ps.elems = append(ps.elems, pe)
+			}
+			pt.sets = append(pt.sets, ps)
+		}
+	}
+	return nil
+}
+
+// removes all tables from the model except the given tables
+func (m *memModel) retain(tableNames []string) {
+	tables := []*memTable{}
+	for _, pt := range m.tables {
+		for _, name := range tableNames {
+			if pt.table.Name == name {
+				tables = append(tables, pt)
+				break
+			}
+		}
+	}
+	m.tables = tables
+}
+
+// returns the changes recorded by a router in dry-run mode
+func (r *packetFilterRouter) Plan() FilterPlan {
+	if plan, ok := r.nft.(*memNftConn); ok && r.dryRun {
+		return append(FilterPlan{}, plan.plan...)
+	}
+	return nil
+}
@@ -7,7 +7,11 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
@@ -19,12 +23,24 @@ import (
 )
 
 type packetFilterRouter struct {
-	nft nftables.Conn
+	nft nftConn
+
+	// changes are recorded in a plan
+	// instead of being applied
+	dryRun bool
 
 	table  []*nftables.Table
 	chains [][]*nftables.Chain
 
 	forwardChainCtPos []uint64
+	inputChainCtPos   []uint64
+
+	// logging of dropped packets and the handles of
+	// the policy drop log rules keyed by table/chain
+	dropLogging  *DropLogging
+	policyLogPos map[string]uint64
+
+	ctstateVmap []*nftables.Set
 
 	ipDenyList, ipAllowList []*nftables.Set
 
@@ -36,6 +52,61 @@ type packetFilterRouter struct {
 	setMap  map[string]*nftables.Set
 	ruleMap map[string][]*nftables.Rule
 	ruleRef map[string]int
+
+	// rules of committed batches keyed by their filter
+	// key whose handles could not be retrieved. the
+	// router re-adopts them when the next batch is
+	// created.
+	untracked map[string][]*nftables.Rule
+
+	// configured ttls of the ip list ranges that were
+	// re-created with their remaining time as their
+	// element timeout keyed by set, range and timeout
+	ipRangeTTLs map[string]time.Duration
+
+	// specs of the filters that have been
+	// applied keyed by their filter key
+	portForwards    map[string]PortForward
+	trafficForwards map[string]TrafficForward
+	trafficMarks    map[string]TrafficMark
+	securityGroups  map[string]appliedSecurityGroup
+}
+
+type appliedSecurityGroup struct {
+	sg      SecurityGroup
+	iifName string
+}
+
+// a batch of rule changes that are queued
+// on the nftables connection and committed
+// to the kernel with a single flush
+type filterBatch struct {
+	// ref keys of rules queued for deletion
+	deleted map[string]bool
+	// rules queued for addition
+	added []*nftables.Rule
+
+	// rules to associate with each filter key
+	// once the batch has been committed
+	keys  []string
+	rules map[string][]*nftables.Rule
+
+	// router state when the batch was created
+	state filterState
+}
+
+// a copy of the router's filter state
+type filterState struct {
+	inboundChains map[string][]*nftables.Chain
+	sgPortVmaps   map[string]*nftables.Set
+
+	ruleMap map[string][]*nftables.Rule
+	ruleRef map[string]int
+
+	portForwards    map[string]PortForward
+	trafficForwards map[string]TrafficForward
+	trafficMarks    map[string]TrafficMark
+	securityGroups  map[string]appliedSecurityGroup
 }
 
 const (
@@ -45,6 +116,8 @@ const (
 	filterOutput
 	natPreRoute
 	natPostRoute
+	manglePreRoute
+	mangleOutput
 )
 
 var (
@@ -53,17 +126,33 @@ var (
 	// in the kernal with default priorities
 	NftChainPriorityOffset int32 = 0
 
+	// file to which the router's filters are saved so
+	// that a new router can adopt the tables created by
+	// a previous instance. if empty then the tables of
+	// a previous instance are always replaced.
+	FilterRouterStateFile = "/run/mycs/router_state.json"
+
 	ipSetElemTypes = []nftables.SetDatatype{ nftables.TypeIPAddr, nftables.TypeIP6Addr }
 )
 
-func (m *routeManager) NewFilterRouter(denyAll bool) (FilterRouter, error) {
+const (
+	ipDenyListKey  = "ip_denylist"
+	ipAllowListKey = "ip_allowlist"
+)
+
+func (m *routeManager) NewFilterRouter(denyAll bool, options ...FilterRouterOption) (FilterRouter, error) {
 
 	var (
 		err error
 
 		fwPolicy *nftables.ChainPolicy
 		
-		forwardRules []*nftables.Rule
+		forwardRules,
+		inputRules []*nftables.Rule
+
+		savedState  *savedFilterState
+		staleTables []*nftables.Table
+		ipLists     map[string][][]ipRange
 	)
 
 	r := &packetFilterRouter{
@@ -71,7 +160,11 @@ func (m *routeManager) NewFilterRouter(denyAll bool) (FilterRouter, error) {
 		chains: make([][]*nftables.Chain, 2),
 
 		forwardChainCtPos: make([]uint64, 2),
+		inputChainCtPos:   make([]uint64, 2),
 
+		policyLogPos: make(map[string]uint64),
+
+		ctstateVmap: make([]*nftables.Set, 2),
 		ipDenyList:  make([]*nftables.Set, 2),
 		ipAllowList: make([]*nftables.Set, 2),
 
@@ -81,7 +174,51 @@ func (m *routeManager) NewFilterRouter(denyAll bool) (FilterRouter, error) {
 
 		ruleMap: make(map[string][]*nftables.Rule),
 		ruleRef: make(map[string]int),
+
+		ipRangeTTLs: make(map[string]time.Duration),
+
+		portForwards:    make(map[string]PortForward),
+		trafficForwards: make(map[string]TrafficForward),
+		trafficMarks:    make(map[string]TrafficMark),
+		securityGroups:  make(map[string]appliedSecurityGroup),
+	}
+
+	for _, option := range options {
+		switch option := option.(type) {
+		case filterRouterFlag:
+			if option == FilterDryRun {
+				r.dryRun = true
+			}
+		case DropLogging:
+			if err = option.validate(); err != nil {
+				return nil, err
+			}
+			r.dropLogging = &option
+		}
+	}
+	r.nft = newNftConn()
+	if r.dryRun {
+		r.nft = newPlanNftConn(r.nft, "mycs_router_ipv4", "mycs_router_ipv6")
+	}
+
+	// tables left behind by a previous instance of the
+	// router are adopted if its saved state can be read
+	// otherwise they are replaced with new tables
+	if savedState, staleTables, err = r.readSavedState(); err != nil {
+		return nil, err
+	}
+	if savedState != nil {
+		// tables with ip lists created by an older version
+		// of the router are recreated with the saved state
+		// and the entries of the lists
+		if staleTables, ipLists, err = r.readOutdatedIPLists(); err != nil {
+			return nil, err
+		}
 	}
+	for _, table := range staleTables {
+		r.nft.DelTable(table)
+	}
+	adopt := savedState != nil && len(staleTables) == 0
 
 	r.table[0] = r.nft.AddTable(&nftables.Table{
 		Family: nftables.TableFamilyIPv4,
@@ -91,8 +228,8 @@ func (m *routeManager) NewFilterRouter(denyAll bool) (FilterRouter, error) {
 		Family: nftables.TableFamilyIPv6,
 		Name:   "mycs_router_ipv6",
 	})
-	r.chains[0] = make([]*nftables.Chain, 6)
-	r.chains[1] = make([]*nftables.Chain, 6)
+	r.chains[0] = make([]*nftables.Chain, 8)
+	r.chains[1] = make([]*nftables.Chain, 8)
 
 	// sets chain priority based on given default
 	var chainPriorityRef = func(p *nftables.ChainPriority) *nftables.ChainPriority {
@@ -140,6 +277,7 @@ func (m *routeManager) NewFilterRouter(denyAll bool) (FilterRouter, error) {
 		); err != nil {
 			return nil, err
 		}
+		r.ctstateVmap[i] = ctstateVmap
 		ctstateExpr := []expr.Any{
 			// [ ct load status => reg 1 ]
 			&expr.Ct{
@@ -159,9 +297,11 @@ func (m *routeManager) NewFilterRouter(denyAll bool) (FilterRouter, error) {
 
 		// set ip_denylist
 		r.ipDenyList[i] = &nftables.Set{
-			Name:     "ip_denylist",
-			Table:    table,
-			KeyType:  ipSetElemTypes[i],
+			Name:       "ip_denylist",
+			Table:      table,
+			KeyType:    ipSetElemTypes[i],
+			Interval:   true,
+			HasTimeout: true,
 		}
 		if err = r.nft.AddSet(r.ipDenyList[i], nil); err != nil {
 			return nil, err
@@ -169,9 +309,11 @@ func (m *routeManager) NewFilterRouter(denyAll bool) (FilterRouter, error) {
 
 		// set ip_allowlist
 		r.ipAllowList[i] = &nftables.Set{
-			Name:     "ip_allowlist",
-			Table:    table,
-			KeyType:  ipSetElemTypes[i],
+			Name:       "ip_allowlist",
+			Table:      table,
+			KeyType:    ipSetElemTypes[i],
+			Interval:   true,
+			HasTimeout: true,
 		}
 		if err = r.nft.AddSet(r.ipAllowList[i], nil); err != nil {
 			return nil, err
@@ -270,6 +412,30 @@ func (m *routeManager) NewFilterRouter(denyAll bool) (FilterRouter, error) {
 			Type:     nftables.ChainTypeNAT,
 			Policy:   chainPolicyRef(nftables.ChainPolicyAccept),
 		})
+		r.chains[i][manglePreRoute] = r.nft.AddChain(&nftables.Chain{
+			Name:     "mangle_prerouting",
+			Table:    table,
+			Hooknum:  nftables.ChainHookPrerouting,
+			Priority: chainPriorityRef(nftables.ChainPriorityMangle),
+			Type:     nftables.ChainTypeFilter,
+			Policy:   chainPolicyRef(nftables.ChainPolicyAccept),
+		})
+		// route chains re-route packets
+		// originating from the host when
+		// their mark is changed
+		r.chains[i][mangleOutput] = r.nft.AddChain(&nftables.Chain{
+			Name:     "mangle_output",
+			Table:    table,
+			Hooknum:  nftables.ChainHookOutput,
+			Priority: chainPriorityRef(nftables.ChainPriorityMangle),
+			Type:     nftables.ChainTypeRoute,
+			Policy:   chainPolicyRef(nftables.ChainPolicyAccept),
+		})
+
+		if adopt {
+			// base rules already exist in adopted tables
+			continue
+		}
 
 		// chain input
 		//
@@ -301,13 +467,45 @@ func (m *routeManager) NewFilterRouter(denyAll bool) (FilterRouter, error) {
 	}
 	// retrieve handle for ct state rule for forward chain. all 
 	// forward security groups will be inserted before this rule.
+	// the byte limits of input security groups are inserted
+	// before the ct state rule of the input chain.
 	for i, table := range r.table {
 		if forwardRules, err = r.nft.GetRules(table, r.chains[i][filterForward]); err != nil {
 			return nil, err
 		}
-		r.forwardChainCtPos[i] = forwardRules[0].Handle
+		if r.forwardChainCtPos[i], err = findCtStateRuleHandle(forwardRules); err != nil {
+			return nil, err
+		}
+		if inputRules, err = r.nft.GetRules(table, r.chains[i][filterInput]); err != nil {
+			return nil, err
+		}
+		if r.inputChainCtPos[i], err = findCtStateRuleHandle(inputRules); err != nil {
+			return nil, err
+		}
+	}
+	// packets dropped by the deny all policy are logged
+	// by a rule at the end of the input and forward chains
+	if denyAll && r.dropLogging != nil {
+		if err = r.addPolicyDropLogRules(
+			[]*nftables.Chain{
+				r.chains[0][filterInput], r.chains[0][filterForward],
+				r.chains[1][filterInput], r.chains[1][filterForward],
+			},
+		); err != nil {
+			return nil, err
+		}
+	}
+	if savedState != nil {
+		if err = r.restoreSavedState(savedState, ipLists); err != nil {
+			return nil, err
+		}
 	}
 
+	if r.dryRun {
+		// a router in dry-run mode does not
+		// replace the route manager's router
+		return r, nil
+	}
 	m.pfr = r
 	return m.pfr, nil
 }
@@ -375,26 +573,109 @@ func (r *packetFilterRouter) getInboundChain(ifname string) ([]*nftables.Chain,
 }
 
 func (r *packetFilterRouter) AddIPsToDenyList(ips []netip.Addr) error {
+	return r.addPrefixesToList(ipDenyListKey, ipPrefixes(ips), 0)
+}
+
+func (r *packetFilterRouter) AddIPsToDenyListWithTTL(ips []netip.Addr, ttl time.Duration) error {
+	return r.addPrefixesToList(ipDenyListKey, ipPrefixes(ips), ttl)
+}
+
+func (r *packetFilterRouter) DeleteIPsFromDenyList(ips []netip.Addr) error {
+	return r.deletePrefixesFromList(ipDenyListKey, ipPrefixes(ips))
+}
+
+func (r *packetFilterRouter) AddIPsToAllowList(ips []netip.Addr) error {
+	return r.addPrefixesToList(ipAllowListKey, ipPrefixes(ips), 0)
+}
+
+func (r *packetFilterRouter) AddIPsToAllowListWithTTL(ips []netip.Addr, ttl time.Duration) error {
+	return r.addPrefixesToList(ipAllowListKey, ipPrefixes(ips), ttl)
+}
+
+func (r *packetFilterRouter) DeleteIPsFromAllowList(ips []netip.Addr) error {
+	return r.deletePrefixesFromList(ipAllowListKey, ipPrefixes(ips))
+}
+
+// returns the ip set pair for the given list key
+func (r *packetFilterRouter) ipListSet(listKey string) []*nftables.Set {
+	if listKey == ipDenyListKey {
+		return r.ipDenyList
+	}
+	return r.ipAllowList
+}
+
+// queues the rules that bind the ip set pair of the
+// given list to the pre-routing chains if they have
+// not already been created
+func (r *packetFilterRouter) queueIPListRules(b *filterBatch, listKey string) error {
 
 	var (
-		err error
 		ok  bool
 
 		rules []*nftables.Rule
 	)
 
-	if len(ips) > 0 {
-		if err = r.addIPSetElements(r.ipDenyList, ips); err != nil {
-			return err
-		}
+	if _, ok = r.ruleMap[listKey]; ok {
+		return nil
+	}
+	if _, ok = b.rules[listKey]; ok {
+		return nil
+	}
+
+	ipSet := r.ipListSet(listKey)
+	for i, chain := range r.getChain(filterPreRoute) {
+		addrLen, srcOffset, _, _ := ipHeaderOffsets(i == 0)
+
+		if listKey == ipDenyListKey {
+			rules = append(rules, 
+				// ip saddr @ip_denylist drop
+				&nftables.Rule{
+					Table: chain.Table,
+					Chain: chain,
+					Exprs: []expr.Any{
+						// [ payload load 4b @ network header + 12 (src addr) => reg 1 ]
+						&expr.Payload{
+							DestRegister: 1,
+							Base:         expr.PayloadBaseNetworkHeader,
+							Offset:       srcOffset,
+							Len:          addrLen,
+						},
+						// [ lookup reg 1 set whitelist ]
+						&expr.Lookup{
+							SourceRegister: 1,
+							SetName:        ipSet[i].Name,
+						},
+						//[ immediate reg 0 drop ]
+						&expr.Verdict{
+							Kind: expr.VerdictDrop,
+						},
+					},
+				},
+			)
 
-		if _, ok = r.ruleMap["ip_denylist"]; !ok {
-			// if denylist lookup rule is not set then set it
-			for i, chain := range r.getChain(filterPreRoute) {
-				addrLen, srcOffset, _, _ := ipHeaderOffsets(i == 0)
-	
-				rules = append(rules, 
-					// ip saddr @ip_denylist drop
+		} else {
+			rules = append(rules, 
+				[]*nftables.Rule{
+					// iifname lo accept
+					&nftables.Rule{
+						Table: chain.Table,
+						Chain: chain,
+						Exprs: []expr.Any{
+							// [ meta load iifname => reg 1 ]
+							&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+							// [ cmp eq reg 1 lo ]
+							&expr.Cmp{
+								Op:       expr.CmpOpEq,
+								Register: 1,
+								Data:     []byte("lo\x00"),
+							},
+							//[ immediate reg 0 accept ]
+							&expr.Verdict{
+								Kind: expr.VerdictAccept,
+							},
+						},
+					},
+					// ip saddr != @ip_allowlist drop
 					&nftables.Rule{
 						Table: chain.Table,
 						Chain: chain,
@@ -409,7 +690,8 @@ func (r *packetFilterRouter) AddIPsToDenyList(ips []netip.Addr) error {
 							// [ lookup reg 1 set whitelist ]
 							&expr.Lookup{
 								SourceRegister: 1,
-								SetName:        r.ipDenyList[i].Name,
+								SetName:        ipSet[i].Name,
+								Invert:         true,
 							},
 							//[ immediate reg 0 drop ]
 							&expr.Verdict{
@@ -417,161 +699,11 @@ func (r *packetFilterRouter) AddIPsToDenyList(ips []netip.Addr) error {
 							},
 						},
 					},
-				)
-			}
-			err = r.saveFilterRules("ip_denylist", rules, false)
-		}
-	}
-	return err
-}
-
-func (r *packetFilterRouter) DeleteIPsFromDenyList(ips []netip.Addr) error {
-
-	var (
-		err  error
-		size []int
-	)
-
-	if size, err = r.deleteIPSetElements(r.ipDenyList, ips); err == nil && size[0] == 0 && size[1] == 0 {
-		err = r.DeleteFilter("ip_denylist")
-	}
-	return err
-}
-
-func (r *packetFilterRouter) AddIPsToAllowList(ips []netip.Addr) error {
-
-	var (
-		err error
-		ok  bool
-
-		rules []*nftables.Rule
-	)
-
-	if len(ips) > 0 {
-		if err = r.addIPSetElements(r.ipAllowList, ips); err != nil {
-			return err
-		}
-
-		if _, ok = r.ruleMap["ip_allowlist"]; !ok {
-			// if allowlist lookup rule is not set then set it
-			for i, chain := range r.getChain(filterPreRoute) {
-				addrLen, srcOffset, _, _ := ipHeaderOffsets(i == 0)
-
-				rules = append(rules, 
-					[]*nftables.Rule{
-						// iifname lo accept
-						&nftables.Rule{
-							Table: chain.Table,
-							Chain: chain,
-							Exprs: []expr.Any{
-								// [ meta load iifname => reg 1 ]
-								&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
-								// [ cmp eq reg 1 lo ]
-								&expr.Cmp{
-									Op:       expr.CmpOpEq,
-									Register: 1,
-									Data:     []byte("lo\x00"),
-								},
-								//[ immediate reg 0 accept ]
-								&expr.Verdict{
-									Kind: expr.VerdictAccept,
-								},
-							},
-						},
-						// ip saddr != @ip_allowlist drop
-						&nftables.Rule{
-							Table: chain.Table,
-							Chain: chain,
-							Exprs: []expr.Any{
-								// [ payload load 4b @ network header + 12 (src addr) => reg 1 ]
-								&expr.Payload{
-									DestRegister: 1,
-									Base:         expr.PayloadBaseNetworkHeader,
-									Offset:       srcOffset,
-									Len:          addrLen,
-								},
-								// [ lookup reg 1 set whitelist ]
-								&expr.Lookup{
-									SourceRegister: 1,
-									SetName:        r.ipAllowList[i].Name,
-									Invert:         true,
-								},
-								//[ immediate reg 0 drop ]
-								&expr.Verdict{
-									Kind: expr.VerdictDrop,
-								},
-							},
-						},
-					}...,
-				)
-			}
-			err = r.saveFilterRules("ip_allowlist", rules, false)
-		}
-	}
-	return nil
-}
-
-func (r *packetFilterRouter) DeleteIPsFromAllowList(ips []netip.Addr) error {
-
-	var (
-		err  error
-		size []int
-	)
-
-	if size, err = r.deleteIPSetElements(r.ipAllowList, ips); err == nil && size[0] == 0 && size[1] == 0 {
-		err = r.DeleteFilter("ip_allowlist")
-	}
-	return err
-}
-
-// add ips to an ip set pair
-func (r *packetFilterRouter) addIPSetElements(ipSet []*nftables.Set, ips []netip.Addr) error {
-
-	var (
-		err error
-	)
-
-	ipSetElems := createIPSetElements(ips)
-	for i, setElems := range ipSetElems {
-		if r.nft.SetAddElements(ipSet[i], setElems); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-// delete ips from an ip set pair and returns the size of the sets after deletion
-func (r *packetFilterRouter) deleteIPSetElements(ipSet []*nftables.Set, ips []netip.Addr) ([]int, error) {
-
-	var (
-		err error
-
-		elems []nftables.SetElement
-	)
-
-	ipSetElems := createIPSetElements(ips)
-	for i, setElems := range ipSetElems {
-		if r.nft.SetDeleteElements(ipSet[i], setElems); err != nil {
-			return nil, err
-		}
-	}
-	// commit changes
-	if err = r.nft.Flush(); err != nil {
-		return nil, err
-	}
-	// retrieve size of sets
-	size := []int{ 0, 0 }
-	for i, set := range ipSet {
-		if elems, err = r.nft.GetSetElements(set); err != nil {
-			logger.ErrorMessage(
-				"packetFilterRouter.deleteIPSetElements(): Failed to get list of elements for set '%s': %s",
-				set.Name, err.Error(),
+				}...,
 			)
-			continue
 		}
-		size[i] = len(elems)
 	}
-	return size, nil
+	return r.queueFilterRules(b, listKey, r.withDropLogRules(rules, listKey), false)
 }
 
 func (r *packetFilterRouter) SetSecurityGroups(sgs []SecurityGroup, iifName string) error {
@@ -606,6 +738,30 @@ func (r *packetFilterRouter) SetSecurityGroups(sgs []SecurityGroup, iifName stri
 	//   type proto . dport : verdict
 	// }
 
+	var (
+		err error
+	)
+
+	b := r.newFilterBatch()
+	for _, sg := range sgs {
+		if err = r.queueSecurityGroup(b, sg, iifName); err != nil {
+			logger.ErrorMessage("packetFilterRouter.SetSecurityGroups(): Skipping security group %# v: %s", sg, err.Error())
+		}
+	}
+	if err = r.commitFilterBatch(b); err != nil {
+		logger.ErrorMessage(
+			"packetFilterRouter.SetSecurityGroups(): Failed to create security group filter rules for interface '%s': %s",
+			iifName, err.Error(),
+		)
+		return err
+	}
+	return nil
+}
+
+// queues the port vmap elements and filter rules of a
+// security group on the given batch
+func (r *packetFilterRouter) queueSecurityGroup(b *filterBatch, sg SecurityGroup, iifName string) error {
+
 	var (
 		err error
 
@@ -616,299 +772,365 @@ func (r *packetFilterRouter) SetSecurityGroups(sgs []SecurityGroup, iifName stri
 		sgPortVmap *nftables.Set
 
 		verdict expr.VerdictKind
-		rules   []*nftables.Rule
+		rules,
+		pgRules []*nftables.Rule
 	)
 	nullPos := []uint64{0, 0}
 
-	for _, sg := range sgs {
-		logger.TraceMessage("packetFilterRouter.SetSecurityGroups(): Applying security group: %# v", sg)
+	logger.TraceMessage("packetFilterRouter.queueSecurityGroup(): Applying security group: %# v", sg)
 
-		// validate sg
-		if sg.SrcNetwork.IsValid() && sg.DstNetwork.IsValid() && sg.SrcNetwork.Addr().Is4() != sg.DstNetwork.Addr().Is4() {
-			logger.ErrorMessage("packetFilterRouter.SetSecurityGroups(): Cannot mix ipv4 and ipv6 types for SrcNetwork and DstNetwork: %# v", sg)
-			continue
-		}
-		// get sg keys
-		if sgKey, pgVmapName, err = sg.CreateSecurityGroupKeys(iifName); err != nil {
-			logger.ErrorMessage("packetFilterRouter.SetSecurityGroups(): Error creating security group keys: %s", err.Error())
-			continue
-		}
+	// validate sg
+	if sg.SrcNetwork.IsValid() && sg.DstNetwork.IsValid() && sg.SrcNetwork.Addr().Is4() != sg.DstNetwork.Addr().Is4() {
+		return fmt.Errorf("cannot mix ipv4 and ipv6 types for SrcNetwork and DstNetwork")
+	}
+	if err = sg.validateLimits(); err != nil {
+		return err
+	}
+	// get sg keys
+	if sgKey, pgVmapName, err = sg.CreateSecurityGroupKeys(iifName); err != nil {
+		return err
+	}
 
-		rules = nil
-		sgExprsPre := []expr.Any{}
+	sgExprsPre := []expr.Any{}
 
-		// For tcp and udp protocols create rule that binds to port group vmap
-		//
-		// iifname <iifName> ip saddr <sg.SrcNetwork> ip daddr <sg.DstNetwork> ip protocol . dport vmap @<sgPortVmap>
-		//
-		// For icmp protocol create rule with accept or deny
-		//
-		// iifname <iifName> ip saddr <sg.SrcNetwork> ip daddr <sg.DstNetwork> icmp type echo-request accept
-
-		// add filter to forward chain unless
-		// otherwise determined below
-		targetChain := r.getChain(filterForward)
-		insertPos := r.forwardChainCtPos
-		insert := true
-
-		if len(iifName) > 0 {
-			if !sg.DstNetwork.IsValid() {
-				// if interface name is set and no dst network then
-				// sg filter will be added to the inbound chain for
-				// that interface
-				if targetChain, err = r.getInboundChain(iifName); err != nil {
-					logger.ErrorMessage("packetFilterRouter.SetSecurityGroups(): Failed to get/create inbound chain for interface '%s': %s", iifName, err.Error())
-					continue
-				}
-				insertPos = nullPos
-				insert = false
+	// For tcp and udp protocols create rule that binds to port group vmap
+	//
+	// iifname <iifName> ip saddr <sg.SrcNetwork> ip daddr <sg.DstNetwork> ip protocol . dport vmap @<sgPortVmap>
+	//
+	// For icmp protocol create rule with accept or deny
+	//
+	// iifname <iifName> ip saddr <sg.SrcNetwork> ip daddr <sg.DstNetwork> icmp type echo-request accept
 
-			} else {
-				sgExprsPre = append(sgExprsPre,
-					// [ meta load iifname => reg 1 ]
-					&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
-					// [ cmp eq reg 1 <iifname> ]
-					&expr.Cmp{
-						Op:       expr.CmpOpEq,
-						Register: 1,
-						Data:     []byte(iifName+"\x00"),
-					},
-				)
-			}
+	// add filter to forward chain unless
+	// otherwise determined below
+	targetChain := r.getChain(filterForward)
+	insertPos := r.forwardChainCtPos
+	insert := true
 
-		} else if !sg.DstNetwork.IsValid() {
-			// no dst network so add filter to the input chain
-			targetChain = r.getChain(filterInput)
+	if len(iifName) > 0 {
+		if !sg.DstNetwork.IsValid() {
+			// if interface name is set and no dst network then
+			// sg filter will be added to the inbound chain for
+			// that interface
+			if targetChain, err = r.getInboundChain(iifName); err != nil {
+				return fmt.Errorf("failed to get/create inbound chain for interface '%s': %s", iifName, err.Error())
+			}
 			insertPos = nullPos
 			insert = false
-		}
-
-		// apply rules to both ip4 and ipv6 chains
-		// unless otherwise determined below
-		addToChain := []bool{ true, true }
-		if sg.SrcNetwork.IsValid() || sg.DstNetwork.IsValid() {
-			addToChain[0] = sg.SrcNetwork.Addr().Is4() || sg.DstNetwork.Addr().Is4() // apply rules to ip4 chain
-			addToChain[1] = sg.SrcNetwork.Addr().Is6() || sg.DstNetwork.Addr().Is6() // apply rules to ip6 chain
-		}
 
-		// set rule verdict for security group
-		if sg.Deny {
-			verdict = expr.VerdictDrop
 		} else {
-			verdict = expr.VerdictAccept
+			sgExprsPre = append(sgExprsPre,
+				// [ meta load iifname => reg 1 ]
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				// [ cmp eq reg 1 <iifname> ]
+				&expr.Cmp{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					Data:     []byte(iifName+"\x00"),
+				},
+			)
 		}
 
-		for i, chain := range targetChain {
-			sgExprs := sgExprsPre
+	} else if !sg.DstNetwork.IsValid() {
+		// no dst network so add filter to the input chain
+		targetChain = r.getChain(filterInput)
+		insertPos = nullPos
+		insert = false
+	}
 
-			if addToChain[i] {
-				sgPortVmap = nil
-				addICPMRule, addVMapPortRule := sync.Once{}, sync.Once{}
-				addrLen, srcOffset, destOffset, protoOffset := ipHeaderOffsets(i == 0)
+	// apply rules to both ip4 and ipv6 chains
+	// unless otherwise determined below
+	addToChain := []bool{ true, true }
+	if sg.SrcNetwork.IsValid() || sg.DstNetwork.IsValid() {
+		addToChain[0] = sg.SrcNetwork.Addr().Is4() || sg.DstNetwork.Addr().Is4() // apply rules to ip4 chain
+		addToChain[1] = sg.SrcNetwork.Addr().Is6() || sg.DstNetwork.Addr().Is6() // apply rules to ip6 chain
+	}
 
-				if sg.SrcNetwork.IsValid() {
-					srcNetworkMask := net.CIDRMask(sg.SrcNetwork.Bits(), int(addrLen)*8)
-					sgExprs = append(sgExprs,
-						// [ payload load 4b @ network header + 12 (src addr) => reg 1 ]
-						&expr.Payload{
-							DestRegister: 1,
-							Base:         expr.PayloadBaseNetworkHeader,
-							Offset:       srcOffset,
-							Len:          addrLen,
-						},
-						// [ bitwise reg 1 = (reg=1 & <srcNetwork Mask> ) ^ 0x00000000 ]
-						&expr.Bitwise{
-							SourceRegister: 1,
-							DestRegister:   1,
-							Len:            addrLen,
-							Mask:           []byte(srcNetworkMask),
-							Xor:            make([]byte, addrLen),
-						},
-						// [ cmp eq reg 1 <srcNetwork in canonical form> ]
-						&expr.Cmp{
-							Op:       expr.CmpOpEq,
-							Register: 1,
-							Data:     sg.SrcNetwork.Masked().Addr().AsSlice(),
-						},
-					)
-				}
-				if len(sg.Oifname) > 0 {
-					oifname := []byte(sg.Oifname+"\x00")
-					sgExprs = append(sgExprs,
-						// [ meta load oifname => reg 1 ]
-						&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
-						// [ cmp eq reg 1 <oifname> ]
-						&expr.Cmp{
-							Op:       expr.CmpOpEq,
-							Register: 1,
-							Data:     oifname,
-						},
-					)
-				}
-				if sg.DstNetwork.IsValid() {
-					dstNetworkMask := net.CIDRMask(sg.DstNetwork.Bits(), int(addrLen)*8)
-					sgExprs = append(sgExprs,
-						// [ payload load 4b @ network header + 16 (dest addr) => reg 1 ]
-						&expr.Payload{
-							DestRegister: 1,
-							Base:         expr.PayloadBaseNetworkHeader,
-							Offset:       destOffset,
-							Len:          addrLen,
-						},
-						// [ bitwise reg 1 = (reg=1 & dstNetwork Mask> ) ^ 0x00000000 ]
-						&expr.Bitwise{
-							SourceRegister: 1,
-							DestRegister:   1,
-							Len:            addrLen,
-							Mask:           []byte(dstNetworkMask),
-							Xor:            make([]byte, addrLen),
-						},
-						// [ cmp eq reg 1 <dstNetwork in canonical form> ]
-						&expr.Cmp{
-							Op:       expr.CmpOpEq,
-							Register: 1,
-							Data:     sg.DstNetwork.Masked().Addr().AsSlice(),
-						},
-					)
-				}
+	// set rule verdict for security group
+	if sg.Deny {
+		verdict = expr.VerdictDrop
+	} else {
+		verdict = expr.VerdictAccept
+	}
 
-				if len(sg.Ports) > 0 {
-					// add port filter rules to vmap
-					for _, pg := range sg.Ports {
-
-						if pg.Proto == ICMP {
-							// rule added only once for all port groups. so
-							// any additional port groups with icmp protocol
-							// will be ignored as icmp is a special case
-							addICPMRule.Do(func(){
-								// icmp needs to be handled as a seperate pool
-								// from port lookup as icmp packets do not have
-								// the a transport header port field
+	for i, chain := range targetChain {
+		sgExprs := sgExprsPre
+
+		if addToChain[i] {
+			sgPortVmap = nil
+			addICPMRule, addVMapPortRule := sync.Once{}, sync.Once{}
+			addrLen, srcOffset, destOffset, protoOffset := ipHeaderOffsets(i == 0)
+
+			if sg.SrcNetwork.IsValid() {
+				srcNetworkMask := net.CIDRMask(sg.SrcNetwork.Bits(), int(addrLen)*8)
+				sgExprs = append(sgExprs,
+					// [ payload load 4b @ network header + 12 (src addr) => reg 1 ]
+					&expr.Payload{
+						DestRegister: 1,
+						Base:         expr.PayloadBaseNetworkHeader,
+						Offset:       srcOffset,
+						Len:          addrLen,
+					},
+					// [ bitwise reg 1 = (reg=1 & <srcNetwork Mask> ) ^ 0x00000000 ]
+					&expr.Bitwise{
+						SourceRegister: 1,
+						DestRegister:   1,
+						Len:            addrLen,
+						Mask:           []byte(srcNetworkMask),
+						Xor:            make([]byte, addrLen),
+					},
+					// [ cmp eq reg 1 <srcNetwork in canonical form> ]
+					&expr.Cmp{
+						Op:       expr.CmpOpEq,
+						Register: 1,
+						Data:     sg.SrcNetwork.Masked().Addr().AsSlice(),
+					},
+				)
+			}
+			if len(sg.Oifname) > 0 {
+				oifname := []byte(sg.Oifname+"\x00")
+				sgExprs = append(sgExprs,
+					// [ meta load oifname => reg 1 ]
+					&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+					// [ cmp eq reg 1 <oifname> ]
+					&expr.Cmp{
+						Op:       expr.CmpOpEq,
+						Register: 1,
+						Data:     oifname,
+					},
+				)
+			}
+			if sg.DstNetwork.IsValid() {
+				dstNetworkMask := net.CIDRMask(sg.DstNetwork.Bits(), int(addrLen)*8)
+				sgExprs = append(sgExprs,
+					// [ payload load 4b @ network header + 16 (dest addr) => reg 1 ]
+					&expr.Payload{
+						DestRegister: 1,
+						Base:         expr.PayloadBaseNetworkHeader,
+						Offset:       destOffset,
+						Len:          addrLen,
+					},
+					// [ bitwise reg 1 = (reg=1 & dstNetwork Mask> ) ^ 0x00000000 ]
+					&expr.Bitwise{
+						SourceRegister: 1,
+						DestRegister:   1,
+						Len:            addrLen,
+						Mask:           []byte(dstNetworkMask),
+						Xor:            make([]byte, addrLen),
+					},
+					// [ cmp eq reg 1 <dstNetwork in canonical form> ]
+					&expr.Cmp{
+						Op:       expr.CmpOpEq,
+						Register: 1,
+						Data:     sg.DstNetwork.Masked().Addr().AsSlice(),
+					},
+				)
+			}
+
+			if len(sg.Ports) > 0 {
+				// add port filter rules to vmap
+				for j, pg := range sg.Ports {
+
+					if r.hasPortGroupRules(sg, pg) {
+						// port groups that are limited or logged are
+						// filtered by their own rules instead of the vmap
+						if pgRules, err = r.createPortGroupRules(
+							chain, insertPos[i], sgExprs, pg, verdict, limitMeterName(sgKey, j, i), i == 0,
+						); err != nil {
+							logger.ErrorMessage(
+								"packetFilterRouter.queueSecurityGroup(): Failed to create rules for port group %# v for table '%s': %s",
+								pg, chain.Table.Name, err.Error(),
+							)
+							continue
+						}
+						if pg.RateLimit != nil && pg.RateLimit.Bytes {
+							// byte limits apply to all packets of the port
+							// group so they need to precede the ct state rule.
+							// rules of the input and inbound chains follow the
+							// input chain's ct state rule so the limit is
+							// inserted before it in the input chain.
+							limitChain, limitPos, limitExprs := chain, insertPos[i], sgExprs
+							if !insert {
+								limitChain, limitPos = r.getChain(filterInput)[i], r.inputChainCtPos[i]
+								if len(iifName) > 0 {
+									limitExprs = append(
+										[]expr.Any{
+											// [ meta load iifname => reg 1 ]
+											&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+											// [ cmp eq reg 1 <iifname> ]
+											&expr.Cmp{
+												Op:       expr.CmpOpEq,
+												Register: 1,
+												Data:     []byte(iifName+"\x00"),
+											},
+										},
+										sgExprs...,
+									)
+								}
+							}
+							rules = append(rules, r.createByteLimitRule(limitChain, limitPos, limitExprs, pg))
+						}
+						rules = append(rules, pgRules...)
+
+					} else if pg.Proto == ICMP {
+						// rule added only once for all port groups. so
+						// any additional port groups with icmp protocol
+						// will be ignored as icmp is a special case
+						addICPMRule.Do(func(){
+							// icmp needs to be handled as a seperate pool
+							// from port lookup as icmp packets do not have
+							// the a transport header port field
+							rules = append(rules,
+								&nftables.Rule{
+									Table: chain.Table,
+									Chain: chain,
+									Position: insertPos[i],
+									Exprs: append(sgExprs,
+										// [ meta load l4proto => reg 1 ]
+										&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+										// [ cmp eq reg 1 <protoData> ]
+										&expr.Cmp{
+											Op:       expr.CmpOpEq,
+											Register: 1,
+											Data:     []byte{unix.IPPROTO_ICMP},
+										},
+										// [ immediate reg 0 drop/accept ]
+										&expr.Verdict{
+											Kind: verdict,
+										},
+									),
+								},
+							)
+						})
+
+					} else {
+						// rule added only once for all port groups
+						addVMapPortRule.Do(func(){
+							if sgPortVmap, err = r.getSecurityGroupPortVMap(pgVmapName[i], chain.Table); err == nil {
+								// port filters are added to the port vmap so
+								// the a vmap lookup binding needs to be created
 								rules = append(rules,
 									&nftables.Rule{
 										Table: chain.Table,
 										Chain: chain,
 										Position: insertPos[i],
 										Exprs: append(sgExprs,
-											// [ meta load l4proto => reg 1 ]
-											&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
-											// [ cmp eq reg 1 <protoData> ]
-											&expr.Cmp{
-												Op:       expr.CmpOpEq,
-												Register: 1,
-												Data:     []byte{unix.IPPROTO_ICMP},
+											// [ payload load 1b @ network header + <protoOffset> => reg 9 ]
+											&expr.Payload{
+												Len:          1,
+												Base:         expr.PayloadBaseNetworkHeader,
+												Offset:       protoOffset, // Protocol IPv4 / NextHdr IPv6
+												DestRegister: 9,
+											},
+											// [ payload load 2b @ transport header + 2 (dest port) => reg 10 ]
+											&expr.Payload{
+												Len:          2,
+												Base:         expr.PayloadBaseTransportHeader,
+												Offset:       2, // Destination Port
+												DestRegister: 10,
 											},
-											// [ immediate reg 0 drop/accept ]
-											&expr.Verdict{
-												Kind: verdict,
+											// [ lookup reg 1 map <sgPortVmap> ]
+											&expr.Lookup{
+												SourceRegister: 9,
+												SetName:        sgPortVmap.Name,
+												DestRegister:   0,
+												IsDestRegSet:   true,
 											},
 										),
 									},
 								)
-							})
-	
-						} else {
-							// rule added only once for all port groups
-							addVMapPortRule.Do(func(){
-								if sgPortVmap, err = r.getSecurityGroupPortVMap(pgVmapName[i], chain.Table); err == nil {
-									// port filters are added to the port vmap so
-									// the a vmap lookup binding needs to be created
-									rules = append(rules,
-										&nftables.Rule{
-											Table: chain.Table,
-											Chain: chain,
-											Position: insertPos[i],
-											Exprs: append(sgExprs,
-												// [ payload load 1b @ network header + <protoOffset> => reg 9 ]
-												&expr.Payload{
-													Len:          1,
-													Base:         expr.PayloadBaseNetworkHeader,
-													Offset:       protoOffset, // Protocol IPv4 / NextHdr IPv6
-													DestRegister: 9,
-												},
-												// [ payload load 2b @ transport header + 2 (dest port) => reg 10 ]
-												&expr.Payload{
-													Len:          2,
-													Base:         expr.PayloadBaseTransportHeader,
-													Offset:       2, // Destination Port
-													DestRegister: 10,
-												},
-												// [ lookup reg 1 map <sgPortVmap> ]
-												&expr.Lookup{
-													SourceRegister: 9,
-													SetName:        sgPortVmap.Name,
-													DestRegister:   0,
-													IsDestRegSet:   true,
-												},
-											),
-										},
-									)
-									
-								} else {
-									logger.ErrorMessage(
-										"packetFilterRouter.SetSecurityGroups(): Failed to retrieve security group port vmap with name '%s' for table '%s': %s",
-										 pgVmapName[i], chain.Table.Name, err.Error(),
-									)
-								}
-							})
-							if sgPortVmap == nil {
+								
+							} else {
+								logger.ErrorMessage(
+									"packetFilterRouter.queueSecurityGroup(): Failed to retrieve security group port vmap with name '%s' for table '%s': %s",
+									 pgVmapName[i], chain.Table.Name, err.Error(),
+								)
+							}
+						})
+						if sgPortVmap == nil {
+							continue
+						}
+						for p := pg.FromPort; p <= pg.ToPort; p++ {
+							
+							if keyData, err = createPortVMapKeyData(pg.Proto, p); err != nil {
+								logger.ErrorMessage(
+									"packetFilterRouter.queueSecurityGroup(): Unable to create key data for port access rule in map '%s' for table '%s': %s",
+									pgVmapName[i], chain.Table.Name, err.Error(),
+								)
 								continue
 							}
-							for p := pg.FromPort; p <= pg.ToPort; p++ {
-								
-								if keyData, err = createPortVMapKeyData(pg.Proto, p); err != nil {
-									logger.ErrorMessage(
-										"packetFilterRouter.SetSecurityGroups(): Unable to create key data for port access rule in map '%s' for table '%s': %s",
-										pgVmapName[i], chain.Table.Name, err.Error(),
-									)
-									continue
-								}
-								if err = r.nft.SetAddElements(sgPortVmap,
-									[]nftables.SetElement{
-										{
-											Key:         keyData,
-											VerdictData: &expr.Verdict{ Kind: verdict },
-										},
+							if err = r.nft.SetAddElements(sgPortVmap,
+								[]nftables.SetElement{
+									{
+										Key:         keyData,
+										VerdictData: &expr.Verdict{ Kind: verdict },
 									},
-								); err != nil {
-									logger.ErrorMessage(
-										"packetFilterRouter.SetSecurityGroups(): Failed to add port access rule in map '%s' for table '%s': %s",
-										pgVmapName[i], chain.Table.Name, err.Error(),
-									)
-								}
+								},
+							); err != nil {
+								logger.ErrorMessage(
+									"packetFilterRouter.queueSecurityGroup(): Failed to add port access rule in map '%s' for table '%s': %s",
+									pgVmapName[i], chain.Table.Name, err.Error(),
+								)
 							}
 						}
 					}
-
-				} else {
-					rules = append(rules,
-						&nftables.Rule{
-							Table: chain.Table,
-							Chain: chain,
-							Position: insertPos[i],
-							Exprs: append(sgExprs,
-								// [ immediate reg 0 drop/accept ]
-								&expr.Verdict{
-									Kind: verdict,
-								},
-							),
-						},
-					)
 				}
+
+			} else {
+				rules = append(rules,
+					&nftables.Rule{
+						Table: chain.Table,
+						Chain: chain,
+						Position: insertPos[i],
+						Exprs: append(sgExprs,
+							// [ immediate reg 0 drop/accept ]
+							&expr.Verdict{
+								Kind: verdict,
+							},
+						),
+					},
+				)
 			}
-		}		
-		if err = r.saveFilterRules(sgKey, rules, insert); err != nil {
+		}
+	}
+	if err = r.queueFilterRules(b, sgKey, r.withDropLogRules(rules, "sg"), insert); err != nil {
+		return err
+	}
+	r.securityGroups[sgKey] = appliedSecurityGroup{ sg: sg, iifName: iifName }
+	return nil
+}
+
+func (r *packetFilterRouter) DeleteSecurityGroups(sgs []SecurityGroup, iifName string) error {
+
+	var (
+		err error
+
+		vmapsTouched []*nftables.Set
+	)
+
+	for _, sg := range sgs {
+
+		b := r.newFilterBatch()
+		if vmapsTouched, err = r.queueDeleteSecurityGroup(b, sg, iifName); err != nil {
+			r.discardFilterBatch(b)
+			return err
+		}
+		if err = r.commitFilterBatch(b); err != nil {
 			logger.ErrorMessage(
-				"packetFilterRouter.SetSecurityGroups(): Failed to create security group filter rule with sgKey '%s': %s",
-				sgKey, err.Error(),
+				"packetFilterRouter.DeleteSecurityGroups(): Failed to delete security group %# v: %s",
+				sg, err.Error(),
 			)
-			return err
-		}	
+			continue
+		}
+		r.deleteEmptyPortVMaps(vmapsTouched)
 	}
+
 	return nil
 }
 
-func (r *packetFilterRouter) DeleteSecurityGroups(sgs []SecurityGroup, iifName string) error {
+// queues the deletion of the port vmap elements and filter rules
+// of a security group and returns the port vmaps that were touched
+func (r *packetFilterRouter) queueDeleteSecurityGroup(b *filterBatch, sg SecurityGroup, iifName string) ([]*nftables.Set, error) {
 
 	var (
 		err error
@@ -919,115 +1141,117 @@ func (r *packetFilterRouter) DeleteSecurityGroups(sgs []SecurityGroup, iifName s
 
 		keyData    []byte
 		sgPortVmap *nftables.Set
-		elements   []nftables.SetElement
 
 		vmapsTouched []*nftables.Set
 	)
 
-	for _, sg := range sgs {
-
-		// get sg keys
-		if sgKey, pgVmapName, err = sg.CreateSecurityGroupKeys(iifName); err != nil {
-			logger.ErrorMessage("packetFilterRouter.DeleteSecurityGroups(): Error creating security group keys: %s", err.Error())
-			continue
-		}
-
-		verdict := expr.VerdictAccept
-		if sg.Deny {
-			verdict = expr.VerdictDrop
-		}
+	// get sg keys
+	if sgKey, pgVmapName, err = sg.CreateSecurityGroupKeys(iifName); err != nil {
+		return nil, err
+	}
+	if _, ok = r.ruleMap[sgKey]; !ok {
+		return nil, fmt.Errorf(
+			"no filter rules associated for the security group with key '%s': %+v",
+			sgKey, sg,
+		)
+	}
 
-		if _, ok = r.ruleMap[sgKey]; ok {
+	verdict := expr.VerdictAccept
+	if sg.Deny {
+		verdict = expr.VerdictDrop
+	}
 
-			deleteFromTable:= []bool{ true, true }
-			if sg.SrcNetwork.IsValid() || sg.DstNetwork.IsValid() {
-				deleteFromTable[0] = sg.SrcNetwork.Addr().Is4() || sg.DstNetwork.Addr().Is4() // look for port group vmaps in ip4 table
-				deleteFromTable[1] = sg.SrcNetwork.Addr().Is6() || sg.DstNetwork.Addr().Is6() // look for port group vmaps in ip6 table
-			}
+	deleteFromTable:= []bool{ true, true }
+	if sg.SrcNetwork.IsValid() || sg.DstNetwork.IsValid() {
+		deleteFromTable[0] = sg.SrcNetwork.Addr().Is4() || sg.DstNetwork.Addr().Is4() // look for port group vmaps in ip4 table
+		deleteFromTable[1] = sg.SrcNetwork.Addr().Is6() || sg.DstNetwork.Addr().Is6() // look for port group vmaps in ip6 table
+	}
 
-			for i, table := range r.table {
-				if deleteFromTable[i] {
-
-					if sgPortVmap, err = r.getSecurityGroupPortVMap(pgVmapName[i], nil); sgPortVmap != nil {						
-						for _, pg := range sg.Ports {
-
-							if pg.Proto != ICMP {
-								for p := pg.FromPort; p <= pg.ToPort; p++ {
-									if keyData, err = createPortVMapKeyData(pg.Proto, p); err != nil {
-										logger.ErrorMessage(
-											"packetFilterRouter.DeleteSecurityGroups(): Unable to create key data for port access rule in map '%s' for table '%s': %s",
-											pgVmapName[i], table.Name, err.Error(),
-										)										
-										continue
-									}
-									if err = r.nft.SetDeleteElements(sgPortVmap,
-										[]nftables.SetElement{
-											{
-												Key:         keyData,
-												VerdictData: &expr.Verdict{ Kind: verdict },
-											},
-										},
-									); err != nil {
-										logger.ErrorMessage(
-											"packetFilterRouter.DeleteSecurityGroups(): Failed to delete port access rule in map '%s' for table '%s': %s",
-											pgVmapName[i], table.Name, err.Error(),
-										)
-									}
-								}
+	for i, table := range r.table {
+		if deleteFromTable[i] {
+
+			if sgPortVmap, err = r.getSecurityGroupPortVMap(pgVmapName[i], nil); sgPortVmap != nil {						
+				for _, pg := range sg.Ports {
+
+					if pg.Proto != ICMP && !r.hasPortGroupRules(sg, pg) {
+						for p := pg.FromPort; p <= pg.ToPort; p++ {
+							if keyData, err = createPortVMapKeyData(pg.Proto, p); err != nil {
+								logger.ErrorMessage(
+									"packetFilterRouter.queueDeleteSecurityGroup(): Unable to create key data for port access rule in map '%s' for table '%s': %s",
+									pgVmapName[i], table.Name, err.Error(),
+								)										
+								continue
+							}
+							if err = r.nft.SetDeleteElements(sgPortVmap,
+								[]nftables.SetElement{
+									{
+										Key:         keyData,
+										VerdictData: &expr.Verdict{ Kind: verdict },
+									},
+								},
+							); err != nil {
+								logger.ErrorMessage(
+									"packetFilterRouter.queueDeleteSecurityGroup(): Failed to delete port access rule in map '%s' for table '%s': %s",
+									pgVmapName[i], table.Name, err.Error(),
+								)
 							}
 						}
-						vmapsTouched = append(vmapsTouched, sgPortVmap)						
-
-					} else if err != nil {
-						logger.ErrorMessage(
-							"No security group port vmap set found for sgKey '%s' with name '%s' for table '%s': %s",
-							sgKey, pgVmapName[i], table.Name, err.Error(),
-						)
 					}
 				}
-			}
-			if err = r.DeleteFilter(sgKey); err != nil {
+				vmapsTouched = append(vmapsTouched, sgPortVmap)						
+
+			} else if err != nil {
 				logger.ErrorMessage(
-					"packetFilterRouter.DeleteSecurityGroups(): Failed to delete security group with key '%s': %s",
-					sgKey, err.Error(),
+					"No security group port vmap set found for sgKey '%s' with name '%s' for table '%s': %s",
+					sgKey, pgVmapName[i], table.Name, err.Error(),
 				)
-				continue
 			}
+		}
+	}
+	if err = r.queueDeleteFilter(b, sgKey); err != nil {
+		return nil, err
+	}
+	return vmapsTouched, nil
+}
 
-			// Delete any port group vmaps that were touched that have no elements
-			flush := false
-			for _, sgPortVmap = range vmapsTouched {
-				if elements, err = r.nft.GetSetElements(sgPortVmap); err != nil {
-					logger.ErrorMessage(
-						"packetFilterRouter.DeleteSecurityGroups(): Failed to get list of remaining elements for port group vmap '%s': %s",
-						sgPortVmap.Name, err.Error(),
-					)
-					continue
-				}
-				if len(elements) == 0 {
-					r.nft.DelSet(sgPortVmap)
-					delete(r.sgPortVmaps, sgPortVmap.Name)
-					flush = true
-				}
-			}
-			if flush {
-				if err = r.nft.Flush(); err != nil {
-					logger.ErrorMessage(
-						"packetFilterRouter.DeleteSecurityGroups(): Failed to delete empty maps that were associated with security group key '%s': %s",
-						sgKey, err.Error(),
-					)
-				}
-			}
+// deletes any of the given port group vmaps that have no elements.
+// this should be called once the batch that removed the vmap
+// elements and the rules referencing the vmaps has been committed.
+func (r *packetFilterRouter) deleteEmptyPortVMaps(vmaps []*nftables.Set) {
 
-		} else {
-			return fmt.Errorf(
-				"no filter rules associated for the security group with key '%s': %+v",
-				sgKey, sg,
+	var (
+		err error
+
+		elements []nftables.SetElement
+	)
+
+	flush := false
+	for _, sgPortVmap := range vmaps {
+		if _, ok := r.sgPortVmaps[sgPortVmap.Name]; !ok {
+			// vmap has already been deleted
+			continue
+		}
+		if elements, err = r.nft.GetSetElements(sgPortVmap); err != nil {
+			logger.ErrorMessage(
+				"packetFilterRouter.deleteEmptyPortVMaps(): Failed to get list of remaining elements for port group vmap '%s': %s",
+				sgPortVmap.Name, err.Error(),
+			)
+			continue
+		}
+		if len(elements) == 0 {
+			r.nft.DelSet(sgPortVmap)
+			delete(r.sgPortVmaps, sgPortVmap.Name)
+			flush = true
+		}
+	}
+	if flush {
+		if err = r.nft.Flush(); err != nil {
+			logger.ErrorMessage(
+				"packetFilterRouter.deleteEmptyPortVMaps(): Failed to delete empty port group vmaps: %s",
+				err.Error(),
 			)
 		}
 	}
-
-	return nil
 }
 
 func (r *packetFilterRouter) getSecurityGroupPortVMap(vmapName string, table *nftables.Table) (*nftables.Set, error) {
@@ -1082,6 +1306,64 @@ func (r *packetFilterRouter) DeleteForwardPort(dstPort int, forwardPort int, for
 
 func (r *packetFilterRouter) ForwardPortOnIP(dstPort, forwardPort int, dstIP, forwardIP netip.Addr, proto Protocol) (string, error) {
 
+	var (
+		err error
+
+		ruleKey string
+	)
+
+	b := r.newFilterBatch()
+	if ruleKey, err = r.queuePortForward(b,
+		PortForward{
+			Proto:       proto,
+			DstIP:       dstIP,
+			DstPort:     dstPort,
+			ForwardIP:   forwardIP,
+			ForwardPort: forwardPort,
+		},
+	); err != nil {
+		r.discardFilterBatch(b)
+		return "", err
+	}
+	return ruleKey, r.commitFilterBatch(b)
+}
+
+func (r *packetFilterRouter) AddPortForward(pf PortForward) (string, error) {
+
+	var (
+		err error
+
+		ruleKey string
+	)
+
+	b := r.newFilterBatch()
+	if ruleKey, err = r.queuePortForward(b, pf); err != nil {
+		r.discardFilterBatch(b)
+		return "", err
+	}
+	return ruleKey, r.commitFilterBatch(b)
+}
+
+func (r *packetFilterRouter) DeletePortForward(pf PortForward) error {
+	return r.DeleteFilter(pf.key())
+}
+
+func (r *packetFilterRouter) DeleteForwardPortOnIP(dstPort, forwardPort int, dstIP, forwardIP netip.Addr, proto Protocol) error {
+	return r.DeleteFilter(
+		PortForward{
+			Proto:       proto,
+			DstIP:       dstIP,
+			DstPort:     dstPort,
+			ForwardIP:   forwardIP,
+			ForwardPort: forwardPort,
+		}.key(),
+	)
+}
+
+// queues the nat and forward rules of a port forward
+// on the given batch and returns the filter key
+func (r *packetFilterRouter) queuePortForward(b *filterBatch, pf PortForward) (string, error) {
+
 	var (
 		err error
 
@@ -1090,18 +1372,26 @@ func (r *packetFilterRouter) ForwardPortOnIP(dstPort, forwardPort int, dstIP, fo
 		table  *nftables.Table
 		chains []*nftables.Chain
 		rules  []*nftables.Rule
+
+		maps     []*nftables.Set
+		mapElems [][]nftables.SetElement
+		natExprs []expr.Any
 	)
 
-	isDstIPValid := dstIP.IsValid()
+	if err = pf.validate(); err != nil {
+		return "", err
+	}
+	isDstIPValid := pf.DstIP.IsValid()
 
-	is4 := forwardIP.Is4()
+	backends := pf.backends()
+	is4 := backends[0].Is4()
 	addrLen, _, destOffset, _ := ipHeaderOffsets(is4)
 
 	if table, chains, err = r.getTable(is4); err != nil {
 		return "", err
 	}
 
-	switch proto {
+	switch pf.Proto {
 	case ICMP:
 		protoData = []byte{unix.IPPROTO_ICMP}
 	case TCP:
@@ -1112,6 +1402,17 @@ func (r *packetFilterRouter) ForwardPortOnIP(dstPort, forwardPort int, dstIP, fo
 		return "", fmt.Errorf("unsupported protocol")
 	}
 
+	// maps of backends and forwarded ports
+	// looked up by the dnat rule
+	if maps, mapElems, err = portForwardMaps(pf, table); err != nil {
+		return "", err
+	}
+	for i, m := range maps {
+		if err = r.nft.AddSet(m, mapElems[i]); err != nil {
+			return "", err
+		}
+	}
+
 	// add pre-routing dnat rule to forward to given ip:port
 	rule := &nftables.Rule{
 		Table: table,
@@ -1131,7 +1432,7 @@ func (r *packetFilterRouter) ForwardPortOnIP(dstPort, forwardPort int, dstIP, fo
 			&expr.Cmp{
 				Op:       expr.CmpOpEq,
 				Register: 1,
-				Data:     dstIP.AsSlice(),
+				Data:     pf.DstIP.AsSlice(),
 			},
 		}
 	}
@@ -1152,101 +1453,154 @@ func (r *packetFilterRouter) ForwardPortOnIP(dstPort, forwardPort int, dstIP, fo
 				Offset:       2, // Destination Port
 				Len:          2,
 			},
+		}...,
+	)
+	if pf.isRange() {
+		rule.Exprs = append(rule.Exprs,
+			// [ range eq reg 1 <dstPort> <dstToPort> ]
+			&expr.Range{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				FromData: binaryutil.BigEndian.PutUint16(uint16(pf.DstPort)),
+				ToData:   binaryutil.BigEndian.PutUint16(uint16(pf.DstToPort)),
+			},
+		)
+	} else {
+		rule.Exprs = append(rule.Exprs,
 			// [ cmp eq reg 1 <dstPort> ]
 			&expr.Cmp{
 				Op:       expr.CmpOpEq,
 				Register: 1,
-				Data:     binaryutil.BigEndian.PutUint16(uint16(dstPort)),
+				Data:     binaryutil.BigEndian.PutUint16(uint16(pf.DstPort)),
 			},
-			// [ immediate reg 1 <forwardIP> ]
-			&expr.Immediate{
+		)
+	}
+	if natExprs, err = dnatExprs(pf, maps, is4); err != nil {
+		return "", err
+	}
+	rule.Exprs = append(rule.Exprs, natExprs...)
+	rules = append(rules, rule)
+
+	for _, forwardIP := range backends {
+		// dest ip check expr
+		ipDaddrExpr := []expr.Any{
+			// [ payload load 4b @ network header + 16 (dest addr) => reg 1 ]
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseNetworkHeader,
+				Offset:       destOffset,
+				Len:          addrLen,
+			},
+			// cmp eq reg 1 <forwardIP>
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
 				Register: 1,
 				Data:     forwardIP.AsSlice(),
 			},
-			// [ immediate reg 2 <forwardPort> ]
-			&expr.Immediate{
-				Register: 2,
-				Data:     binaryutil.BigEndian.PutUint16(uint16(forwardPort)),
+		}
+		// add post-routing masq rule
+		rules = append(rules,
+			&nftables.Rule{
+				Table: table,
+				Chain: chains[natPostRoute],
+				// ip daddr <forwardIP> masquerade
+				Exprs: append(
+					ipDaddrExpr,
+					// masq
+					&expr.Masq{},
+				),
 			},
-			// [ nat dnat ip addr_min reg 1 addr_max reg 0 proto_min reg 2 proto_max reg 0 ]
-			&expr.NAT{
-				Type:        expr.NATTypeDestNAT,
-				Family:      ipFamily(is4),
-				RegAddrMin:  1,
-				RegAddrMax:  1,
-				RegProtoMin: 2,
-				RegProtoMax: 2,
+		)
+
+		// add forward ip accept rule
+		rules = append(rules,
+			&nftables.Rule{
+				Table: table,
+				Chain: chains[filterForward],
+				// ip daddr <forwardIP> accept
+				Exprs: append(
+					ipDaddrExpr,
+					// accept
+					&expr.Verdict{
+						// [ immediate reg 0 accept ]
+						Kind: expr.VerdictAccept,
+					},
+				),
 			},
-		}...,
-	)
-	rules = append(rules, rule)
+		)
+	}
 
-	// dest ip check expr
-	ipDaddrExpr := []expr.Any{
-		// [ payload load 4b @ network header + 16 (dest addr) => reg 1 ]
-		&expr.Payload{
-			DestRegister: 1,
-			Base:         expr.PayloadBaseNetworkHeader,
-			Offset:       destOffset,
-			Len:          addrLen,
-		},
-		// cmp eq reg 1 <forwardIP>
-		&expr.Cmp{
-			Op:       expr.CmpOpEq,
-			Register: 1,
-			Data:     forwardIP.AsSlice(),
-		},
+	ruleKey := pf.key()
+	if err = r.queueFilterRules(b, ruleKey, rules, false); err != nil {
+		return "", err
 	}
-	// add post-routing masq rule
-	rules = append(rules,
-		&nftables.Rule{
-			Table: table,
-			Chain: chains[natPostRoute],
-			// ip daddr <forwardIP> masquerade
-			Exprs: append(
-				ipDaddrExpr,
-				// masq
-				&expr.Masq{},
-			),
-		},
+	r.portForwards[ruleKey] = pf
+	return ruleKey, nil
+}
+
+func (r *packetFilterRouter) ForwardTraffic(srcItfName, dstItfName string, srcNetwork, dstNetwork netip.Prefix, withNat bool) (string, error) {
+
+	var (
+		err error
+
+		ruleKey string
 	)
 
-	// add forward ip accept rule
-	rules = append(rules,
-		&nftables.Rule{
-			Table: table,
-			Chain: chains[filterForward],
-			// ip daddr <forwardIP> accept
-			Exprs: append(
-				ipDaddrExpr,
-				// accept
-				&expr.Verdict{
-					// [ immediate reg 0 accept ]
-					Kind: expr.VerdictAccept,
-				},
-			),
+	b := r.newFilterBatch()
+	if ruleKey, err = r.queueTrafficForward(b,
+		TrafficForward{
+			SrcItfName: srcItfName,
+			DstItfName: dstItfName,
+			SrcNetwork: srcNetwork,
+			DstNetwork: dstNetwork,
+			WithNat:    withNat,
 		},
-	)
+	); err != nil {
+		r.discardFilterBatch(b)
+		return "", err
+	}
+	return ruleKey, r.commitFilterBatch(b)
+}
+
+func (r *packetFilterRouter) ForwardTrafficWithSnat(srcItfName, dstItfName string, srcNetwork, dstNetwork netip.Prefix, snat SourceNat) (string, error) {
+
+	var (
+		err error
 
-	ruleKey := fmt.Sprintf("%s:%d>%s:%d|%s",
-		dstIP.String(), dstPort,
-		forwardIP.String(), forwardPort,
-		string(proto),
+		ruleKey string
 	)
-	return ruleKey, r.saveFilterRules(ruleKey, rules, false)
+
+	b := r.newFilterBatch()
+	if ruleKey, err = r.queueTrafficForward(b,
+		TrafficForward{
+			SrcItfName: srcItfName,
+			DstItfName: dstItfName,
+			SrcNetwork: srcNetwork,
+			DstNetwork: dstNetwork,
+			WithNat:    true,
+			Snat:       snat,
+		},
+	); err != nil {
+		r.discardFilterBatch(b)
+		return "", err
+	}
+	return ruleKey, r.commitFilterBatch(b)
 }
 
-func (r *packetFilterRouter) DeleteForwardPortOnIP(dstPort, forwardPort int, dstIP, forwardIP netip.Addr, proto Protocol) error {
+func (r *packetFilterRouter) DeleteForwardTraffic(srcItfName, dstItfName string, srcNetwork, dstNetwork netip.Prefix) error {
 	return r.DeleteFilter(
-		fmt.Sprintf("%s:%d>%s:%d|%s",
-			dstIP.String(), dstPort,
-			forwardIP.String(), forwardPort,
-			string(proto),
-		),
+		TrafficForward{
+			SrcItfName: srcItfName,
+			DstItfName: dstItfName,
+			SrcNetwork: srcNetwork,
+			DstNetwork: dstNetwork,
+		}.key(),
 	)
 }
 
-func (r *packetFilterRouter) ForwardTraffic(srcItfName, dstItfName string, srcNetwork, dstNetwork netip.Prefix, withNat bool) (string, error) {
+// queues the forward and nat rules of a traffic forward
+// on the given batch and returns the filter key
+func (r *packetFilterRouter) queueTrafficForward(b *filterBatch, tf TrafficForward) (string, error) {
 
 	var (
 		err error
@@ -1256,22 +1610,25 @@ func (r *packetFilterRouter) ForwardTraffic(srcItfName, dstItfName string, srcNe
 		rules  []*nftables.Rule
 	)
 
-	if srcNetwork.Addr().BitLen() != dstNetwork.Addr().BitLen() {
+	if tf.SrcNetwork.Addr().BitLen() != tf.DstNetwork.Addr().BitLen() {
 		return "", fmt.Errorf("attempt to create forwarding rules between incompatible network address spaces")
 	}
+	if err = tf.validateSnat(); err != nil {
+		return "", err
+	}
 
-	is4 := srcNetwork.Addr().Is4()
+	is4 := tf.SrcNetwork.Addr().Is4()
 	addrLen, srcOffset, destOffset, _ := ipHeaderOffsets(is4)
 
 	if table, chains, err = r.getTable(is4); err != nil {
 		return "", err
 	}
 
-	iifname := []byte(srcItfName+"\x00")
-	oifname := []byte(dstItfName+"\x00")
+	iifname := []byte(tf.SrcItfName+"\x00")
+	oifname := []byte(tf.DstItfName+"\x00")
 
 	// ip saddr <srcNetwork> ip daddr <dstNetwork>
-	srcNetworkMask := net.CIDRMask(srcNetwork.Bits(), int(addrLen)*8)
+	srcNetworkMask := net.CIDRMask(tf.SrcNetwork.Bits(), int(addrLen)*8)
 	ipSrcDstExprs := []expr.Any{
 		// [ payload load 4b @ network header + 12 (src addr) => reg 1 ]
 		&expr.Payload{
@@ -1292,11 +1649,11 @@ func (r *packetFilterRouter) ForwardTraffic(srcItfName, dstItfName string, srcNe
 		&expr.Cmp{
 			Op:       expr.CmpOpEq,
 			Register: 1,
-			Data:     srcNetwork.Masked().Addr().AsSlice(),
+			Data:     tf.SrcNetwork.Masked().Addr().AsSlice(),
 		},
 	}
-	if dstNetwork != prefixWorld4 && dstNetwork != prefixWorld6 {
-		dstNetworkMask := net.CIDRMask(dstNetwork.Bits(), int(addrLen)*8)
+	if tf.DstNetwork != prefixWorld4 && tf.DstNetwork != prefixWorld6 {
+		dstNetworkMask := net.CIDRMask(tf.DstNetwork.Bits(), int(addrLen)*8)
 		ipSrcDstExprs = append(ipSrcDstExprs,
 			// [ payload load 4b @ network header + 16 (dest addr) => reg 1 ]
 			&expr.Payload{
@@ -1317,7 +1674,7 @@ func (r *packetFilterRouter) ForwardTraffic(srcItfName, dstItfName string, srcNe
 			&expr.Cmp{
 				Op:       expr.CmpOpEq,
 				Register: 1,
-				Data:     dstNetwork.Masked().Addr().AsSlice(),
+				Data:     tf.DstNetwork.Masked().Addr().AsSlice(),
 			},
 		)
 	}
@@ -1357,13 +1714,13 @@ func (r *packetFilterRouter) ForwardTraffic(srcItfName, dstItfName string, srcNe
 		},
 	)
 
-	if withNat {
+	if tf.WithNat {
 		rules = append(rules,
 			&nftables.Rule{
 				Table: table,
 				Chain: chains[natPostRoute],
 				Exprs: append(
-					// oifname "i" ip saddr <srcNetwork> ip daddr <dstNetwork> masquerade
+					// oifname "i" ip saddr <srcNetwork> ip daddr <dstNetwork> masquerade|snat to <addr>
 					[]expr.Any{
 						// meta load oifname => reg 1
 						&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
@@ -1376,110 +1733,379 @@ func (r *packetFilterRouter) ForwardTraffic(srcItfName, dstItfName string, srcNe
 					},
 					append(
 						ipSrcDstExprs,
-						// masq
-						&expr.Masq{},
+						snatExprs(tf.Snat, is4)...
 					)...
 				),
 			},
 		)
 	}
 
-	ruleKey := fmt.Sprintf("%s:%s>%s:%s",
-		srcItfName, srcNetwork.String(),
-		dstItfName, dstNetwork.String(),
-	)
-	return ruleKey, r.saveFilterRules(ruleKey, rules, false)
+	ruleKey := tf.key()
+	if err = r.queueFilterRules(b, ruleKey, rules, false); err != nil {
+		return "", err
+	}
+	r.trafficForwards[ruleKey] = tf
+	return ruleKey, nil
 }
 
-func (r *packetFilterRouter) DeleteForwardTraffic(srcItfName, dstItfName string, srcNetwork, dstNetwork netip.Prefix) error {
-	return r.DeleteFilter(
-		fmt.Sprintf("%s:%s>%s:%s",
-			srcItfName, srcNetwork.String(),
-			dstItfName, dstNetwork.String(),
-		),
+// returns the expressions that translate the source address
+// of forwarded traffic. the traffic is masqueraded if the
+// source nat does not have an address.
+func snatExprs(snat SourceNat, is4 bool) []expr.Any {
+
+	if !snat.FromIP.IsValid() {
+		return []expr.Any{
+			// [ masq flags <flags> ]
+			&expr.Masq{
+				Random:     snat.Random,
+				Persistent: snat.Persistent,
+			},
+		}
+	}
+
+	exprs := []expr.Any{
+		// [ immediate reg 1 <fromIP> ]
+		&expr.Immediate{
+			Register: 1,
+			Data:     snat.FromIP.AsSlice(),
+		},
+	}
+	regAddrMax := uint32(1)
+	if snat.ToIP.IsValid() && snat.ToIP != snat.FromIP {
+		exprs = append(exprs,
+			// [ immediate reg 2 <toIP> ]
+			&expr.Immediate{
+				Register: 2,
+				Data:     snat.ToIP.AsSlice(),
+			},
+		)
+		regAddrMax = 2
+	}
+	return append(exprs,
+		// [ nat snat ip addr_min reg 1 addr_max reg <1|2> flags <flags> ]
+		&expr.NAT{
+			Type:       expr.NATTypeSourceNAT,
+			Family:     ipFamily(is4),
+			RegAddrMin: 1,
+			RegAddrMax: regAddrMax,
+			Random:     snat.Random,
+			Persistent: snat.Persistent,
+		},
 	)
 }
 
-func (r *packetFilterRouter) saveFilterRules(key string, rules []*nftables.Rule, insert bool) error {
+// creates a new batch of rule changes. the state of the
+// router is saved so that it can be restored if the batch
+// fails to commit or is discarded.
+func (r *packetFilterRouter) newFilterBatch() *filterBatch {
+
+	if len(r.untracked) > 0 {
+		untracked := r.untracked
+		r.untracked = nil
+		if err := r.trackRules(sortedKeys(untracked), untracked); err != nil {
+			logger.ErrorMessage(
+				"packetFilterRouter.newFilterBatch(): Unable to re-adopt the rules of %d filters: %s",
+				len(r.untracked), err.Error(),
+			)
+		}
+	}
+
+	b := &filterBatch{
+		deleted: make(map[string]bool),
+		rules:   make(map[string][]*nftables.Rule),
+		state:   r.saveState(),
+	}
+	return b
+}
+
+// queues rules that do not already exist for addition and
+// associates them with the given key. rules that are shared
+// by multiple keys are added once and reference counted.
+func (r *packetFilterRouter) queueFilterRules(b *filterBatch, key string, rules []*nftables.Rule, insert bool) error {
 
 	var (
 		err error
 
 		savedRules []*nftables.Rule
-		foundRule  *nftables.Rule
 	)
 
-	// add rules that do not already exist
+	if len(rules) == 0 {
+		return nil
+	}
 	for _, rule := range rules {
+		// all filter rules count the traffic they match
+		rule.Exprs = withCounter(rule.Exprs)
+
 		if savedRules, err = r.nft.GetRules(rule.Table, rule.Chain); err != nil {
 			return err
 		}
-		if foundRule = findRuleInList(rule, savedRules); foundRule == nil {
-			if insert {
+		// exclude saved rules that will be deleted
+		// when the batch is committed and include
+		// rules that will be added by the batch
+		matchRules := []*nftables.Rule{}
+		for _, savedRule := range savedRules {
+			if !b.deleted[ruleRefKey(savedRule)] {
+				matchRules = append(matchRules, savedRule)
+			}
+		}
+		for _, addedRule := range b.added {
+			if addedRule.Table.Name == rule.Table.Name && addedRule.Chain.Name == rule.Chain.Name {
+				matchRules = append(matchRules, addedRule)
+			}
+		}
+		if findRuleInList(rule, matchRules) == nil {
+			// rules appended to a chain with a policy drop
+			// log rule need to be inserted before that rule
+			if pos, ok := r.policyLogPos[rule.Table.Name + "/" + rule.Chain.Name]; ok && !insert && rule.Position == 0 {
+				rule.Position = pos
+				r.nft.InsertRule(rule)
+			} else if insert || rule.Position != 0 {
+				// rules with a position are inserted
+				// before the rule at that position
 				r.nft.InsertRule(rule)
 			} else {
 				r.nft.AddRule(rule)
 			}
+			b.added = append(b.added, rule)
+		}
+	}
+	if _, exists := b.rules[key]; !exists {
+		b.keys = append(b.keys, key)
+	}
+	b.rules[key] = append(b.rules[key], rules...)
+	return nil
+}
+
+// queues the deletion of all rules associated with the given
+// key. rules are only deleted when they are no longer
+// referenced by any other key.
+func (r *packetFilterRouter) queueDeleteFilter(b *filterBatch, key string) error {
+
+	var (
+		err   error
+		ok    bool
+		rules []*nftables.Rule
+	)
+
+	if rules, ok = r.ruleMap[key]; !ok {
+		return fmt.Errorf(
+			"no filter rules associated with key '%s' was found",
+			key,
+		)
+	}
+	for _, rule := range rules {
+		// delete rule only when its ref count
+		// is zero. this ensures any shared rules
+		// are not deleted
+		refKey := ruleRefKey(rule)
+		if r.ruleRef[refKey] == 1 {
+			if err = r.nft.DelRule(rule); err != nil {
+				return err
+			}
+			delete(r.ruleRef, refKey)
+			b.deleted[refKey] = true
+
+		} else {
+			r.ruleRef[refKey] = r.ruleRef[refKey]-1
 		}
 	}
+	// connection limit meters and port forward maps
+	// are removed along with the rules that use them
+	r.queueDeleteRuleSets(b, rules)
+
+	delete(r.ruleMap, key)
+	delete(r.portForwards, key)
+	delete(r.trafficForwards, key)
+	delete(r.trafficMarks, key)
+	delete(r.securityGroups, key)
+	return nil
+}
+
+// queues the deletion of the sets that are only used
+// by the given rules if the rules are being deleted
+// by the batch
+func (r *packetFilterRouter) queueDeleteRuleSets(b *filterBatch, rules []*nftables.Rule) {
+	// a rule may be listed more than once if the
+	// filter was created more than once
+	deleted := make(map[string]bool)
+	deleteSet := func(table *nftables.Table, name string) {
+		setKey := table.Name + "/" + name
+		if !deleted[setKey] {
+			deleted[setKey] = true
+			r.nft.DelSet(&nftables.Set{
+				Table: table,
+				Name:  name,
+			})
+		}
+	}
+	for _, rule := range rules {
+		if !b.deleted[ruleRefKey(rule)] {
+			continue
+		}
+		for _, e := range rule.Exprs {
+			switch e := e.(type) {
+			case *expr.Dynset:
+				deleteSet(rule.Table, e.SetName)
+			case *expr.Lookup:
+				if strings.HasPrefix(e.SetName, portForwardMapPrefix + "_") {
+					deleteSet(rule.Table, e.SetName)
+				}
+			}
+		}
+	}
+}
+
+// commits all changes queued on the batch in a single
+// netlink transaction and retrieves the handles of the
+// rules that were added. if the commit fails the kernel
+// rejects the whole batch and the router state is restored.
+// once the batch has been committed its deletions are kept
+// even if the handles of the rules it added cannot be
+// retrieved in which case the rules are re-adopted later.
+func (r *packetFilterRouter) commitFilterBatch(b *filterBatch) error {
+
+	var (
+		err error
+	)
+
 	// flush rules
 	if err = r.nft.Flush(); err != nil {
+		r.restoreState(b.state)
 		return err
 	}
-	// get rule handles
-	if len(rules) > 0 {
+	err = r.trackRules(b.keys, b.rules)
+	r.writeSavedState()
+	return err
+}
+
+// retrieves the handles of the given rules which have been
+// committed and associates the rules with their keys. the
+// rules of keys that cannot all be found are added to the
+// router's untracked rules and the first error is returned.
+func (r *packetFilterRouter) trackRules(keys []string, rulesByKey map[string][]*nftables.Rule) error {
+
+	var (
+		err, trackErr error
+		ok            bool
+
+		savedRules []*nftables.Rule
+		foundRule  *nftables.Rule
+	)
+
+	// rules of each chain are read once
+	chainRules := make(map[string][]*nftables.Rule)
+
+	for _, key := range keys {
+		err = nil
+		rules := rulesByKey[key]
+		handles := make([]uint64, 0, len(rules))
 		for _, rule := range rules {
-			if savedRules, err = r.nft.GetRules(rule.Table, rule.Chain); err != nil {
-				return err
+			chainKey := rule.Table.Name + "/" + rule.Chain.Name
+			if savedRules, ok = chainRules[chainKey]; !ok {
+				if savedRules, err = r.nft.GetRules(rule.Table, rule.Chain); err != nil {
+					break
+				}
+				chainRules[chainKey] = savedRules
 			}
 			if foundRule = findRuleInList(rule, savedRules); foundRule == nil {
-				return fmt.Errorf("a saved rule instance was not found for rule with key '%s': %+v", key, rule)
+				err = fmt.Errorf("a saved rule instance was not found for rule with key '%s': %+v", key, rule)
+				break
+			}
+			handles = append(handles, foundRule.Handle)
+		}
+		if err != nil {
+			if r.untracked == nil {
+				r.untracked = make(map[string][]*nftables.Rule)
 			}
-			rule.Handle = foundRule.Handle
+			r.untracked[key] = rules
+			if trackErr == nil {
+				trackErr = err
+			}
+			continue
+		}
 
-			ruleRefKey := fmt.Sprintf("%s_%d", rule.Table.Name, rule.Handle)
-			r.ruleRef[ruleRefKey] = r.ruleRef[ruleRefKey]+1
+		for i, rule := range rules {
+			rule.Handle = handles[i]
+
+			refKey := ruleRefKey(rule)
+			r.ruleRef[refKey] = r.ruleRef[refKey]+1
 		}
 		r.ruleMap[key] = append(r.ruleMap[key], rules...)
 	}
-	return nil
+	return trackErr
+}
+
+// discards all changes queued on the batch
+// and restores the state of the router
+func (r *packetFilterRouter) discardFilterBatch(b *filterBatch) {
+	r.nft.reset()
+	r.restoreState(b.state)
+}
+
+// saves a copy of the router's filter state
+func (r *packetFilterRouter) saveState() filterState {
+
+	state := filterState{
+		inboundChains:   make(map[string][]*nftables.Chain),
+		sgPortVmaps:     make(map[string]*nftables.Set),
+		ruleMap:         make(map[string][]*nftables.Rule),
+		ruleRef:         make(map[string]int),
+		portForwards:    make(map[string]PortForward),
+		trafficForwards: make(map[string]TrafficForward),
+		trafficMarks:    make(map[string]TrafficMark),
+		securityGroups:  make(map[string]appliedSecurityGroup),
+	}
+	for k, v := range r.inboundChains {
+		state.inboundChains[k] = v
+	}
+	for k, v := range r.sgPortVmaps {
+		state.sgPortVmaps[k] = v
+	}
+	for k, v := range r.ruleMap {
+		state.ruleMap[k] = v
+	}
+	for k, v := range r.ruleRef {
+		state.ruleRef[k] = v
+	}
+	for k, v := range r.portForwards {
+		state.portForwards[k] = v
+	}
+	for k, v := range r.trafficForwards {
+		state.trafficForwards[k] = v
+	}
+	for k, v := range r.trafficMarks {
+		state.trafficMarks[k] = v
+	}
+	for k, v := range r.securityGroups {
+		state.securityGroups[k] = v
+	}
+	return state
+}
+
+// restores the router's filter state from a saved copy
+func (r *packetFilterRouter) restoreState(state filterState) {
+	r.inboundChains = state.inboundChains
+	r.sgPortVmaps = state.sgPortVmaps
+	r.ruleMap = state.ruleMap
+	r.ruleRef = state.ruleRef
+	r.portForwards = state.portForwards
+	r.trafficForwards = state.trafficForwards
+	r.trafficMarks = state.trafficMarks
+	r.securityGroups = state.securityGroups
 }
 
 func (r *packetFilterRouter) DeleteFilter(key string) error {
 
 	var (
-		err   error
-		ok    bool
-		rules []*nftables.Rule
+		err error
 	)
 
-	if rules, ok = r.ruleMap[key]; ok {
-		for _, rule := range rules {
-			// delete rule only when its ref count
-			// is zero. this ensures any shared rules
-			// are not deleted
-			ruleRefKey := fmt.Sprintf("%s_%d", rule.Table.Name, rule.Handle)
-			ruleRefCount := r.ruleRef[ruleRefKey]
-			if ruleRefCount == 1 {
-				if err = r.nft.DelRule(rule); err != nil {
-					return err
-				}	
-				delete(r.ruleRef, ruleRefKey)
-
-			} else {
-				r.ruleRef[ruleRefKey] = r.ruleRef[ruleRefKey]-1
-			}
-		}
-		delete(r.ruleMap, key)
-
-	} else {
-		return fmt.Errorf(
-			"no filter rules associated with key '%s' was found",
-			key,
-		)
+	b := r.newFilterBatch()
+	if err = r.queueDeleteFilter(b, key); err != nil {
+		r.discardFilterBatch(b)
+		return err
 	}
-
-	return r.nft.Flush()
+	return r.commitFilterBatch(b)
 }
 
 func (r *packetFilterRouter) Clear() {
@@ -1497,6 +2123,11 @@ func (r *packetFilterRouter) Clear() {
 
 		r.table = nil
 		r.chains = nil
+		r.untracked = nil
+
+		if len(FilterRouterStateFile) > 0 && !r.dryRun {
+			os.Remove(FilterRouterStateFile)
+		}
 	}
 }
 
@@ -1522,7 +2153,7 @@ func (r *packetFilterRouter) String() string {
 		fmt.Fprintf(&out, "- %s : %d ", handle, refCount)
 		for key, rules := range r.ruleMap { 
 			for _, rule := range rules  {
-				if handle == fmt.Sprintf("%s_%d", rule.Table.Name, rule.Handle) { 
+				if handle == ruleRefKey(rule) { 
 					fmt.Fprintf(&out, " (%s)", key) 
 				}
 			}
@@ -1532,6 +2163,55 @@ func (r *packetFilterRouter) String() string {
 	return out.String()
 }
 
+// filter spec key functions
+
+func (pf PortForward) key() string {
+	dstPorts := strconv.Itoa(pf.DstPort)
+	if pf.isRange() {
+		dstPorts += "-" + strconv.Itoa(pf.DstToPort)
+	}
+	forwardIPs := []string{}
+	for _, ip := range pf.backends() {
+		forwardIPs = append(forwardIPs, ip.String())
+	}
+	return fmt.Sprintf("%s:%s>%s:%d|%s",
+		pf.DstIP.String(), dstPorts,
+		strings.Join(forwardIPs, ","), pf.ForwardPort,
+		string(pf.Proto),
+	)
+}
+
+func (tf TrafficForward) key() string {
+	return fmt.Sprintf("%s:%s>%s:%s",
+		tf.SrcItfName, tf.SrcNetwork.String(),
+		tf.DstItfName, tf.DstNetwork.String(),
+	)
+}
+
+func (tf TrafficForward) validateSnat() error {
+
+	snat := tf.Snat
+	if snat == (SourceNat{}) {
+		return nil
+	}
+	if !tf.WithNat {
+		return fmt.Errorf("source nat requires nat to be enabled for the traffic forward: %+v", tf)
+	}
+	if !snat.FromIP.IsValid() {
+		if snat.ToIP.IsValid() {
+			return fmt.Errorf("source nat address range has no start address: %+v", snat)
+		}
+		return nil
+	}
+	if snat.FromIP.BitLen() != tf.SrcNetwork.Addr().BitLen() {
+		return fmt.Errorf("source nat address %s is not in the address space of the forwarded traffic", snat.FromIP)
+	}
+	if snat.ToIP.IsValid() && (snat.ToIP.BitLen() != snat.FromIP.BitLen() || snat.ToIP.Less(snat.FromIP)) {
+		return fmt.Errorf("invalid source nat address range %s-%s", snat.FromIP, snat.ToIP)
+	}
+	return nil
+}
+
 // security group functions
 
 func (sg SecurityGroup) CreateSecurityGroupKeys(iifName string) (string, []string, error) {
@@ -1570,6 +2250,12 @@ func (sg SecurityGroup) CreateSecurityGroupKeys(iifName string) (string, []strin
 				// add to sgKey signature
 				fmt.Fprintf(&sgKeyB, ".%d-%d", pg.FromPort, pg.ToPort)
 		}
+		if pg.RateLimit != nil {
+			fmt.Fprintf(&sgKeyB, "/r%d.%d.%t", pg.RateLimit.Rate, pg.RateLimit.Burst, pg.RateLimit.Bytes)
+		}
+		if pg.ConnLimit > 0 {
+			fmt.Fprintf(&sgKeyB, "/c%d", pg.ConnLimit)
+		}
 	}
 	if sgKey, err = utils.HashString(sgKeyB.String(), "sgs"); err != nil {
 		return "", nil,
@@ -1594,6 +2280,11 @@ func ipHeaderOffsets(is4 bool) (addrLen uint32, srcOffset uint32, destOffset uin
 	}
 }
 
+// returns the key used to reference count a rule
+func ruleRefKey(rule *nftables.Rule) string {
+	return fmt.Sprintf("%s_%d", rule.Table.Name, rule.Handle)
+}
+
 // returns the ip family
 func ipFamily(is4 bool) uint32 {
 	if is4 {
@@ -1635,7 +2326,7 @@ func findRuleInList(rule *nftables.Rule, ruleList []*nftables.Rule) *nftables.Ru
 	// marshal given rule's exprs for matching
 
 	for _, e := range rule.Exprs {
-		if exprData, err = expr.Marshal(byte(rule.Table.Family), e); err != nil {
+		if exprData, err = expr.Marshal(byte(rule.Table.Family), matchExpr(e)); err != nil {
 			logger.ErrorMessage("findRuleInList(): Rule marshal error: %s", err.Error())
 			return nil
 		}
@@ -1650,10 +2341,11 @@ func findRuleInList(rule *nftables.Rule, ruleList []*nftables.Rule) *nftables.Ru
 		// fmt.Println(debugPrintRule("Check match of rule from list", matchRule))
 
 		if matchRule.Flags == rule.Flags &&
+			len(matchRule.Exprs) == len(ruleExprData) &&
 			bytes.Equal(matchRule.UserData, rule.UserData) {
 
 			for i, e := range matchRule.Exprs {
-				if exprData, err = expr.Marshal(byte(matchRule.Table.Family), e); err != nil {
+				if exprData, err = expr.Marshal(byte(matchRule.Table.Family), matchExpr(e)); err != nil {
 					logger.ErrorMessage("findRuleInList(): Rule marshal error: %s", err.Error())
 					foundRuleC <-nil
 					return
@@ -1704,21 +2396,6 @@ func createPortVMapKeyData(proto Protocol, port int) ([]byte, error) {
 	return keyData, nil
 }
 
-// create separate lists of ip4 and ip6 set elements given a combine list of ip4/6 ips
-func createIPSetElements(ips []netip.Addr) [][]nftables.SetElement {
-
-	ipSetElems := make([][]nftables.SetElement, 2)
-	for _, ip := range ips {
-		if ip.Is4() {
-			ipSetElems[0] = append(ipSetElems[0], nftables.SetElement{ Key: ip.AsSlice() })
-		} else {
-			ipSetElems[1] = append(ipSetElems[1], nftables.SetElement{ Key: ip.AsSlice() })
-		}
-	}
-	return ipSetElems
-}
-
-// prints rule for debugging
 func debugPrintRule(msg string, rule *nftables.Rule) string {
 
 	var (
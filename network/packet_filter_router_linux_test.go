@@ -1,3 +1,1067 @@
 //go:build linux
 
-package network_test
\ No newline at end of file
+package network_test
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mevansam/goutils/network"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Packet Filter Router", func() {
+
+	var (
+		err error
+
+		nc           network.NetworkContext
+		filterRouter network.FilterRouter
+	)
+
+	Context("in dry-run mode", func() {
+
+		BeforeEach(func() {
+			nc, err = network.NewNetworkContext()
+			Expect(err).ToNot(HaveOccurred())
+			routeManager, err := nc.NewRouteManager()
+			Expect(err).ToNot(HaveOccurred())
+			filterRouter, err = routeManager.NewFilterRouter(true, network.FilterDryRun)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("records the changes to the packet filter in a plan", func() {
+
+			plan := filterRouter.Plan()
+			Expect(planCommands(plan)).To(ContainElements(
+				"add table ip mycs_router_ipv4",
+				"add table ip6 mycs_router_ipv6",
+				"add map ip mycs_router_ipv4 ctstate { type ct_state : verdict; }",
+				"add element ip mycs_router_ipv4 ctstate { invalid : drop, established : accept, related : accept }",
+				"add set ip mycs_router_ipv4 ip_denylist { type ipv4_addr; flags interval,timeout; }",
+				"add chain ip mycs_router_ipv4 input { type filter hook input priority filter; policy drop; }",
+				"add chain ip mycs_router_ipv4 nat_prerouting { type nat hook prerouting priority dstnat; policy accept; }",
+				"add rule ip mycs_router_ipv4 input ct state vmap @ctstate",
+			))
+			n := len(plan)
+
+			err = filterRouter.AddPrefixesToDenyList([]netip.Prefix{
+				netip.MustParsePrefix("192.168.100.2/32"),
+				netip.MustParsePrefix("10.10.0.0/24"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			err = filterRouter.SetSecurityGroups([]network.SecurityGroup{
+				{
+					SrcNetwork: netip.MustParsePrefix("192.168.10.0/24"),
+					Ports: []network.PortGroup{
+						{
+							Proto: network.TCP,
+							FromPort: 22,
+							ToPort: 22,
+						},
+					},
+				},
+			}, "")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = filterRouter.ForwardPort(8888, 80, netip.MustParseAddr("192.168.10.10"), network.TCP)
+			Expect(err).ToNot(HaveOccurred())
+
+			plan = filterRouter.Plan()
+			Expect(planCommands(plan[n:])).To(ContainElements(
+				"add element ip mycs_router_ipv4 ip_denylist { 10.10.0.0/24, 192.168.100.2 }",
+				"add rule ip mycs_router_ipv4 prerouting ip saddr @ip_denylist counter drop",
+				"add rule ip mycs_router_ipv4 nat_prerouting meta l4proto tcp th dport 8888 counter dnat to 192.168.10.10:80",
+				"add rule ip mycs_router_ipv4 nat_postrouting ip daddr 192.168.10.10 counter masquerade",
+			))
+			Expect(planCommands(plan[n:])).To(ContainElement(
+				MatchRegexp(`^add element ip mycs_router_ipv4 \S+ \{ tcp \. 22 : accept \}$`),
+			))
+			Expect(planCommands(plan[n:])).To(ContainElement(
+				MatchRegexp(`^insert rule ip mycs_router_ipv4 forward position \d+ ip daddr 192.168.10.10 counter accept$|^add rule ip mycs_router_ipv4 forward ip daddr 192.168.10.10 counter accept$`),
+			))
+			Expect(planCommands(plan[n:])).To(ContainElement(
+				MatchRegexp(`^add rule ip mycs_router_ipv4 input ip saddr 192.168.10.0/24 counter ip protocol \. th dport vmap @\S+$`),
+			))
+
+			// changes are applied to the plan's model of
+			// the packet filter so they can be reverted
+			n = len(plan)
+			err = filterRouter.DeleteForwardPort(8888, 80, netip.MustParseAddr("192.168.10.10"), network.TCP)
+			Expect(err).ToNot(HaveOccurred())
+			plan = filterRouter.Plan()
+			Expect(planCommands(plan[n:])).To(ContainElement(
+				MatchRegexp(`^delete rule ip mycs_router_ipv4 nat_prerouting handle \d+$`),
+			))
+
+			script, err := filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(script).To(MatchRegexp(`(?m)^\s+elements = \{ 10.10.0.0/24,\s+192.168.100.2 \}$`))
+			Expect(script).ToNot(MatchRegexp(`dnat to`))
+
+			filterRouter.Clear()
+			plan = filterRouter.Plan()
+			Expect(plan[len(plan)-1].String()).To(Equal("delete table ip6 mycs_router_ipv6"))
+		})
+	})
+
+	Context("with an in-memory packet filter", func() {
+
+		var (
+			restorePacketFilter func()
+
+			stateFile,
+			savedStateFile string
+		)
+
+		BeforeEach(func() {
+			restorePacketFilter = network.UseInMemoryPacketFilter()
+
+			stateDir, err := os.MkdirTemp("", "router_state")
+			Expect(err).ToNot(HaveOccurred())
+			stateFile = filepath.Join(stateDir, "router_state.json")
+			savedStateFile = network.FilterRouterStateFile
+			network.FilterRouterStateFile = stateFile
+
+			nc, err = network.NewNetworkContext()
+			Expect(err).ToNot(HaveOccurred())
+			routeManager, err := nc.NewRouteManager()
+			Expect(err).ToNot(HaveOccurred())
+			filterRouter, err = routeManager.NewFilterRouter(true)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			filterRouter.Clear()
+			network.FilterRouterStateFile = savedStateFile
+			os.RemoveAll(filepath.Dir(stateFile))
+			restorePacketFilter()
+		})
+
+		It("creates the router's tables", func() {
+			script, err := filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "input")).To(Equal([]string{
+				"type filter hook input priority filter; policy drop;",
+				"ct state vmap @ctstate",
+				"iifname vmap @inbound_ifname",
+			}))
+			Expect(chainRules(script, "ip6 mycs_router_ipv6", "forward")).To(Equal([]string{
+				"type filter hook forward priority filter; policy drop;",
+				"ct state vmap @ctstate",
+			}))
+			Expect(filterRouter.Plan()).To(BeNil())
+		})
+
+		It("manages the ip deny and allow lists", func() {
+			err = filterRouter.AddIPsToDenyList([]netip.Addr{
+				netip.MustParseAddr("192.168.100.2"),
+				netip.MustParseAddr("fd36:a851:bdf7:78d::10"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			err = filterRouter.AddPrefixesToDenyListWithTTL([]netip.Prefix{
+				netip.MustParsePrefix("10.10.0.0/24"),
+			}, time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			err = filterRouter.AddIPsToDenyListWithTTL([]netip.Addr{
+				netip.MustParseAddr("10.20.0.1"),
+			}, 100 * time.Millisecond)
+			Expect(err).ToNot(HaveOccurred())
+
+			denyList, err := filterRouter.ListDenyList()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ipListPrefixes(denyList)).To(ConsistOf(
+				"10.10.0.0/24", "10.20.0.1/32", "192.168.100.2/32", "fd36:a851:bdf7:78d::10/128",
+			))
+			for _, elem := range denyList {
+				if elem.Prefix.String() == "10.10.0.0/24" {
+					Expect(elem.TTL).To(Equal(time.Hour))
+					Expect(elem.Remaining).To(BeNumerically(">", 59 * time.Minute))
+				}
+			}
+
+			script, err := filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "prerouting")).To(ContainElement("ip saddr @ip_denylist counter drop"))
+			Expect(chainRules(script, "ip6 mycs_router_ipv6", "prerouting")).To(ContainElement("ip6 saddr @ip_denylist counter drop"))
+
+			// timed entries are removed once they expire
+			Eventually(func() []string {
+				denyList, err := filterRouter.ListDenyList()
+				Expect(err).ToNot(HaveOccurred())
+				return ipListPrefixes(denyList)
+			}).ShouldNot(ContainElement("10.20.0.1/32"))
+
+			err = filterRouter.DeletePrefixesFromDenyList([]netip.Prefix{
+				netip.MustParsePrefix("10.10.0.0/25"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			err = filterRouter.DeleteIPsFromDenyList([]netip.Addr{
+				netip.MustParseAddr("fd36:a851:bdf7:78d::10"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			denyList, err = filterRouter.ListDenyList()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ipListPrefixes(denyList)).To(ConsistOf("10.10.0.128/25", "192.168.100.2/32"))
+
+			// timed ranges that are split by a deletion
+			// keep the time remaining until they expire
+			err = filterRouter.AddPrefixesToDenyListWithTTL([]netip.Prefix{
+				netip.MustParsePrefix("10.30.0.0/24"),
+			}, 2 * time.Second)
+			Expect(err).ToNot(HaveOccurred())
+			time.Sleep(500 * time.Millisecond)
+			err = filterRouter.DeletePrefixesFromDenyList([]netip.Prefix{
+				netip.MustParsePrefix("10.30.0.0/25"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			denyList, err = filterRouter.ListDenyList()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ipListPrefixes(denyList)).To(ContainElement("10.30.0.128/25"))
+			for _, elem := range denyList {
+				if elem.Prefix.String() == "10.30.0.128/25" {
+					Expect(elem.TTL).To(Equal(2 * time.Second))
+					Expect(elem.Remaining).To(BeNumerically(">", 0))
+					Expect(elem.Remaining).To(BeNumerically("<=", 1500 * time.Millisecond))
+				}
+			}
+			// the ttl of a re-created range is kept
+			// when the list is updated again
+			err = filterRouter.AddIPsToDenyList([]netip.Addr{
+				netip.MustParseAddr("10.40.0.1"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			denyList, err = filterRouter.ListDenyList()
+			Expect(err).ToNot(HaveOccurred())
+			for _, elem := range denyList {
+				if elem.Prefix.String() == "10.30.0.128/25" {
+					Expect(elem.TTL).To(Equal(2 * time.Second))
+				}
+			}
+			Eventually(func() []string {
+				denyList, err := filterRouter.ListDenyList()
+				Expect(err).ToNot(HaveOccurred())
+				return ipListPrefixes(denyList)
+			}, 2 * time.Second).ShouldNot(ContainElement("10.30.0.128/25"))
+
+			err = filterRouter.AddPrefixesToAllowList([]netip.Prefix{
+				netip.MustParsePrefix("192.168.10.0/24"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			err = filterRouter.AddIPsToAllowListWithTTL([]netip.Addr{
+				netip.MustParseAddr("fd36:a851:bdf7:78d::20"),
+			}, time.Minute)
+			Expect(err).ToNot(HaveOccurred())
+
+			allowList, err := filterRouter.ListAllowList()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ipListPrefixes(allowList)).To(ConsistOf("192.168.10.0/24", "fd36:a851:bdf7:78d::20/128"))
+
+			script, err = filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "prerouting")).To(Equal([]string{
+				"type filter hook prerouting priority filter; policy accept;",
+				"ip saddr @ip_denylist counter drop",
+				`iifname "lo" counter accept`,
+				"ip saddr != @ip_allowlist counter drop",
+			}))
+
+			err = filterRouter.DeletePrefixesFromAllowList([]netip.Prefix{
+				netip.MustParsePrefix("192.168.10.0/24"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			err = filterRouter.DeleteIPsFromAllowList([]netip.Addr{
+				netip.MustParseAddr("fd36:a851:bdf7:78d::20"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			allowList, err = filterRouter.ListAllowList()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(allowList).To(BeEmpty())
+		})
+
+		It("adds ipv4 mapped ipv6 addresses to the ipv4 ip lists", func() {
+			err = filterRouter.AddIPsToDenyList([]netip.Addr{
+				netip.MustParseAddr("::ffff:192.168.100.2"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			err = filterRouter.AddPrefixesToDenyList([]netip.Prefix{
+				netip.MustParsePrefix("::ffff:10.10.0.0/120"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			// mapped prefixes must be within the ipv4 address range
+			err = filterRouter.AddPrefixesToDenyList([]netip.Prefix{
+				netip.MustParsePrefix("::ffff:0.0.0.0/80"),
+			})
+			Expect(err).To(HaveOccurred())
+
+			denyList, err := filterRouter.ListDenyList()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ipListPrefixes(denyList)).To(ConsistOf("10.10.0.0/24", "192.168.100.2/32"))
+
+			err = filterRouter.DeleteIPsFromDenyList([]netip.Addr{
+				netip.MustParseAddr("::ffff:192.168.100.2"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			denyList, err = filterRouter.ListDenyList()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ipListPrefixes(denyList)).To(ConsistOf("10.10.0.0/24"))
+		})
+
+		It("applies and deletes security groups", func() {
+			sgs := []network.SecurityGroup{
+				{
+					Deny: true,
+					Ports: []network.PortGroup{
+						{
+							Proto: network.TCP,
+							FromPort: 23,
+							ToPort: 23,
+						},
+					},
+				},
+				{
+					SrcNetwork: netip.MustParsePrefix("192.168.10.0/24"),
+					Ports: []network.PortGroup{
+						{
+							Proto: network.TCP,
+							FromPort: 22,
+							ToPort: 22,
+							RateLimit: &network.RateLimit{
+								Rate: 10,
+								Burst: 5,
+							},
+						},
+						{
+							Proto: network.UDP,
+							FromPort: 53,
+							ToPort: 53,
+							ConnLimit: 4,
+						},
+					},
+				},
+			}
+			err = filterRouter.SetSecurityGroups(sgs, "eth1")
+			Expect(err).ToNot(HaveOccurred())
+			// setting the same security groups again is a no-op
+			err = filterRouter.SetSecurityGroups(sgs, "eth1")
+			Expect(err).ToNot(HaveOccurred())
+
+			script, err := filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(script).To(ContainSubstring(`"eth1" : jump inbound_eth1`))
+			rules := chainRules(script, "ip mycs_router_ipv4", "inbound_eth1")
+			Expect(rules).To(HaveLen(5))
+			// port groups without limits are looked up in a vmap
+			Expect(rules[0]).To(MatchRegexp(`^counter ip protocol \. th dport vmap @\S+$`))
+			Expect(script).To(ContainSubstring("elements = { tcp . 23 : drop }"))
+			Expect(rules[1]).To(Equal("ip saddr 192.168.10.0/24 meta l4proto tcp th dport 22 ct state new limit rate over 10/second burst 5 packets counter drop"))
+			Expect(rules[2]).To(Equal("ip saddr 192.168.10.0/24 meta l4proto tcp th dport 22 counter accept"))
+			Expect(rules[3]).To(MatchRegexp(`^ip saddr 192.168.10.0/24 meta l4proto udp th dport 53 ct state new add @\S+ \{ ip saddr ct count over 4 \} counter drop$`))
+			Expect(rules[4]).To(Equal("ip saddr 192.168.10.0/24 meta l4proto udp th dport 53 counter accept"))
+
+			err = filterRouter.DeleteSecurityGroups(sgs[:1], "eth1")
+			Expect(err).ToNot(HaveOccurred())
+			script, err = filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "inbound_eth1")).To(HaveLen(4))
+			Expect(script).ToNot(ContainSubstring("tcp . 23 : drop"))
+
+			err = filterRouter.DeleteSecurityGroups(sgs[1:], "eth1")
+			Expect(err).ToNot(HaveOccurred())
+			script, err = filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "inbound_eth1")).To(BeEmpty())
+			// the connection limit meters are removed with their rules
+			Expect(script).ToNot(MatchRegexp(`set sgs_\S+_ct`))
+
+			// security groups for all interfaces use port vmaps
+			allowSSH := []network.SecurityGroup{
+				{
+					SrcNetwork: netip.MustParsePrefix("192.168.10.0/24"),
+					Ports: []network.PortGroup{
+						{
+							Proto: network.TCP,
+							FromPort: 22,
+							ToPort: 22,
+						},
+					},
+				},
+			}
+			err = filterRouter.SetSecurityGroups(allowSSH, "")
+			Expect(err).ToNot(HaveOccurred())
+			script, err = filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "input")).To(ContainElement(
+				MatchRegexp(`^ip saddr 192.168.10.0/24 counter ip protocol \. th dport vmap @\S+$`),
+			))
+			err = filterRouter.DeleteSecurityGroups(allowSSH, "")
+			Expect(err).ToNot(HaveOccurred())
+			script, err = filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "input")).To(HaveLen(3))
+		})
+
+		It("applies byte rate limits to all packets of a port group", func() {
+			byteLimit := network.PortGroup{
+				Proto: network.TCP,
+				FromPort: 443,
+				ToPort: 443,
+				RateLimit: &network.RateLimit{
+					Rate: 1048576,
+					Burst: 65536,
+					Bytes: true,
+				},
+			}
+			inboundSGs := []network.SecurityGroup{
+				{
+					SrcNetwork: netip.MustParsePrefix("192.168.10.0/24"),
+					Ports: []network.PortGroup{ byteLimit },
+				},
+			}
+			forwardSGs := []network.SecurityGroup{
+				{
+					DstNetwork: netip.MustParsePrefix("192.168.11.0/24"),
+					Ports: []network.PortGroup{ byteLimit },
+				},
+			}
+			err = filterRouter.SetSecurityGroups(inboundSGs, "eth1")
+			Expect(err).ToNot(HaveOccurred())
+			err = filterRouter.SetSecurityGroups(forwardSGs, "")
+			Expect(err).ToNot(HaveOccurred())
+
+			script, err := filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			// byte limits are not gated on new connections and
+			// precede the ct state rule that accepts the packets
+			// of established connections
+			Expect(chainRules(script, "ip mycs_router_ipv4", "input")).To(Equal([]string{
+				"type filter hook input priority filter; policy drop;",
+				`iifname "eth1" ip saddr 192.168.10.0/24 meta l4proto tcp th dport 443 limit rate over 1048576 bytes/second burst 65536 bytes counter drop`,
+				"ct state vmap @ctstate",
+				"iifname vmap @inbound_ifname",
+			}))
+			Expect(chainRules(script, "ip mycs_router_ipv4", "inbound_eth1")).To(Equal([]string{
+				"ip saddr 192.168.10.0/24 meta l4proto tcp th dport 443 counter accept",
+			}))
+			Expect(chainRules(script, "ip mycs_router_ipv4", "forward")).To(Equal([]string{
+				"type filter hook forward priority filter; policy drop;",
+				"ip daddr 192.168.11.0/24 meta l4proto tcp th dport 443 limit rate over 1048576 bytes/second burst 65536 bytes counter drop",
+				"ip daddr 192.168.11.0/24 meta l4proto tcp th dport 443 counter accept",
+				"ct state vmap @ctstate",
+			}))
+
+			err = filterRouter.DeleteSecurityGroups(inboundSGs, "eth1")
+			Expect(err).ToNot(HaveOccurred())
+			err = filterRouter.DeleteSecurityGroups(forwardSGs, "")
+			Expect(err).ToNot(HaveOccurred())
+			script, err = filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "input")).To(HaveLen(3))
+			Expect(chainRules(script, "ip mycs_router_ipv4", "forward")).To(HaveLen(2))
+		})
+
+		It("forwards ports and traffic", func() {
+			portKey, err := filterRouter.ForwardPortOnIP(8888, 80,
+				netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("192.168.10.10"), network.TCP)
+			Expect(err).ToNot(HaveOccurred())
+			trafficKey, err := filterRouter.ForwardTraffic("eth1", "eth2",
+				netip.MustParsePrefix("192.168.10.0/24"), netip.MustParsePrefix("192.168.11.0/24"), true)
+			Expect(err).ToNot(HaveOccurred())
+
+			script, err := filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "forward")).To(Equal([]string{
+				"type filter hook forward priority filter; policy drop;",
+				"ct state vmap @ctstate",
+				"ip daddr 192.168.10.10 counter accept",
+				`iifname "eth1" oifname "eth2" ip saddr 192.168.10.0/24 ip daddr 192.168.11.0/24 counter accept`,
+			}))
+			Expect(chainRules(script, "ip mycs_router_ipv4", "nat_prerouting")).To(ContainElement(
+				"ip daddr 10.0.0.1 meta l4proto tcp th dport 8888 counter dnat to 192.168.10.10:80",
+			))
+			Expect(chainRules(script, "ip mycs_router_ipv4", "nat_postrouting")).To(ContainElements(
+				"ip daddr 192.168.10.10 counter masquerade",
+				`oifname "eth2" ip saddr 192.168.10.0/24 ip daddr 192.168.11.0/24 counter masquerade`,
+			))
+
+			stats, err := filterRouter.Stats()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stats).To(HaveKey(portKey))
+			Expect(stats).To(HaveKey(trafficKey))
+
+			err = filterRouter.DeleteFilter(trafficKey)
+			Expect(err).ToNot(HaveOccurred())
+			err = filterRouter.DeleteForwardPortOnIP(8888, 80,
+				netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("192.168.10.10"), network.TCP)
+			Expect(err).ToNot(HaveOccurred())
+
+			script, err = filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "forward")).To(HaveLen(2))
+			Expect(chainRules(script, "ip mycs_router_ipv4", "nat_prerouting")).To(HaveLen(1))
+			Expect(chainRules(script, "ip mycs_router_ipv4", "nat_postrouting")).To(HaveLen(1))
+
+			stats, err = filterRouter.Stats()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stats).To(BeEmpty())
+		})
+
+		It("translates the source address of forwarded traffic", func() {
+			lan1 := netip.MustParsePrefix("192.168.10.0/24")
+			lan2 := netip.MustParsePrefix("192.168.11.0/24")
+
+			_, err = filterRouter.ForwardTrafficWithSnat("eth1", "eth2", lan1, lan2,
+				network.SourceNat{
+					FromIP: netip.MustParseAddr("203.0.113.10"),
+					ToIP: netip.MustParseAddr("203.0.113.20"),
+					Persistent: true,
+					Random: true,
+				},
+			)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = filterRouter.ForwardTrafficWithSnat("eth2", "eth1", lan2, lan1,
+				network.SourceNat{
+					FromIP: netip.MustParseAddr("203.0.113.30"),
+				},
+			)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = filterRouter.ForwardTrafficWithSnat("eth1", "eth3",
+				netip.MustParsePrefix("fd36:a851:bdf7:78d::/64"), netip.MustParsePrefix("::/0"),
+				network.SourceNat{
+					Random: true,
+				},
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			script, err := filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "nat_postrouting")).To(Equal([]string{
+				"type nat hook postrouting priority srcnat; policy accept;",
+				`oifname "eth2" ip saddr 192.168.10.0/24 ip daddr 192.168.11.0/24 counter snat to 203.0.113.10-203.0.113.20 random,persistent`,
+				`oifname "eth1" ip saddr 192.168.11.0/24 ip daddr 192.168.10.0/24 counter snat to 203.0.113.30`,
+			}))
+			Expect(chainRules(script, "ip6 mycs_router_ipv6", "nat_postrouting")).To(Equal([]string{
+				"type nat hook postrouting priority srcnat; policy accept;",
+				`oifname "eth3" ip6 saddr fd36:a851:bdf7:78d::/64 counter masquerade random`,
+			}))
+
+			// the nat address of an applied traffic forward can be changed
+			err = filterRouter.Apply(network.FilterSpec{
+				TrafficForwards: []network.TrafficForward{
+					{
+						SrcItfName: "eth1",
+						DstItfName: "eth2",
+						SrcNetwork: lan1,
+						DstNetwork: lan2,
+						WithNat: true,
+						Snat: network.SourceNat{
+							FromIP: netip.MustParseAddr("203.0.113.40"),
+						},
+					},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			script, err = filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "nat_postrouting")).To(Equal([]string{
+				"type nat hook postrouting priority srcnat; policy accept;",
+				`oifname "eth2" ip saddr 192.168.10.0/24 ip daddr 192.168.11.0/24 counter snat to 203.0.113.40`,
+			}))
+
+			_, err = filterRouter.ForwardTrafficWithSnat("eth2", "eth1", lan2, lan1,
+				network.SourceNat{
+					FromIP: netip.MustParseAddr("fd36:a851:bdf7:78d::10"),
+				},
+			)
+			Expect(err).To(HaveOccurred())
+			_, err = filterRouter.ForwardTrafficWithSnat("eth2", "eth1", lan2, lan1,
+				network.SourceNat{
+					FromIP: netip.MustParseAddr("203.0.113.20"),
+					ToIP: netip.MustParseAddr("203.0.113.10"),
+				},
+			)
+			Expect(err).To(HaveOccurred())
+			err = filterRouter.Apply(network.FilterSpec{
+				TrafficForwards: []network.TrafficForward{
+					{
+						SrcItfName: "eth1",
+						DstItfName: "eth2",
+						SrcNetwork: lan1,
+						DstNetwork: lan2,
+						Snat: network.SourceNat{
+							FromIP: netip.MustParseAddr("203.0.113.40"),
+						},
+					},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("forwards port ranges and load balances ports across backends", func() {
+			rangeKey, err := filterRouter.AddPortForward(network.PortForward{
+				Proto: network.TCP,
+				DstPort: 8000,
+				DstToPort: 8010,
+				ForwardIP: netip.MustParseAddr("192.168.10.10"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = filterRouter.AddPortForward(network.PortForward{
+				Proto: network.UDP,
+				DstIP: netip.MustParseAddr("10.0.0.1"),
+				DstPort: 9000,
+				DstToPort: 9002,
+				ForwardIP: netip.MustParseAddr("192.168.10.10"),
+				ForwardPort: 7000,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			balancedPF := network.PortForward{
+				Proto: network.TCP,
+				DstPort: 443,
+				ForwardPort: 8443,
+				ForwardIPs: []netip.Addr{
+					netip.MustParseAddr("192.168.10.11"),
+					netip.MustParseAddr("192.168.10.12"),
+				},
+			}
+			_, err = filterRouter.AddPortForward(balancedPF)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = filterRouter.AddPortForward(network.PortForward{
+				Proto: network.TCP,
+				DstPort: 22,
+				ForwardIPs: []netip.Addr{
+					netip.MustParseAddr("fd36:a851:bdf7:78d::11"),
+					netip.MustParseAddr("fd36:a851:bdf7:78d::12"),
+				},
+				Balance: network.BalanceSourceHash,
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			script, err := filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "nat_prerouting")).To(ConsistOf(
+				"type nat hook prerouting priority dstnat; policy accept;",
+				"meta l4proto tcp th dport 8000-8010 counter dnat to 192.168.10.10",
+				MatchRegexp(`^ip daddr 10.0.0.1 meta l4proto udp th dport 9000-9002 counter dnat to 192.168.10.10:th dport map @pfm_\w+_port$`),
+				MatchRegexp(`^meta l4proto tcp th dport 443 counter dnat to numgen inc mod 2 map @pfm_\w+_addr:8443$`),
+			))
+			Expect(chainRules(script, "ip mycs_router_ipv4", "nat_postrouting")).To(ConsistOf(
+				"type nat hook postrouting priority srcnat; policy accept;",
+				"ip daddr 192.168.10.10 counter masquerade",
+				"ip daddr 192.168.10.11 counter masquerade",
+				"ip daddr 192.168.10.12 counter masquerade",
+			))
+			Expect(chainRules(script, "ip6 mycs_router_ipv6", "nat_prerouting")).To(ContainElement(
+				MatchRegexp(`^meta l4proto tcp th dport 22 counter dnat to jhash ip6 saddr mod 2 seed 0x0 map @pfm_\w+_addr$`),
+			))
+			Expect(chainRules(script, "ip6 mycs_router_ipv6", "forward")).To(ContainElements(
+				"ip6 daddr fd36:a851:bdf7:78d::11 counter accept",
+				"ip6 daddr fd36:a851:bdf7:78d::12 counter accept",
+			))
+			Expect(script).To(MatchRegexp(`elements = \{ 9000 : 7000,\s+9001 : 7001,\s+9002 : 7002 \}`))
+			Expect(script).To(MatchRegexp(`elements = \{ 0x00000000 : 192.168.10.11,\s+0x00000001 : 192.168.10.12 \}`))
+
+			// the maps of a port forward are deleted with its rules
+			err = filterRouter.DeleteFilter(rangeKey)
+			Expect(err).ToNot(HaveOccurred())
+			err = filterRouter.DeletePortForward(balancedPF)
+			Expect(err).ToNot(HaveOccurred())
+			script, err = filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "nat_prerouting")).To(HaveLen(2))
+			Expect(chainRules(script, "ip mycs_router_ipv4", "nat_postrouting")).To(HaveLen(2))
+			Expect(script).To(MatchRegexp(`map pfm_\w+_port`))
+			Expect(script).ToNot(MatchRegexp(`192.168.10.11`))
+
+			// load balanced port forwards can be applied
+			err = filterRouter.Apply(network.FilterSpec{
+				PortForwards: []network.PortForward{ balancedPF },
+			})
+			Expect(err).ToNot(HaveOccurred())
+			script, err = filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "nat_prerouting")).To(ConsistOf(
+				"type nat hook prerouting priority dstnat; policy accept;",
+				MatchRegexp(`^meta l4proto tcp th dport 443 counter dnat to numgen inc mod 2 map @pfm_\w+_addr:8443$`),
+			))
+			Expect(script).ToNot(MatchRegexp(`_port|ip6 saddr`))
+
+			_, err = filterRouter.AddPortForward(network.PortForward{
+				Proto: network.TCP,
+				DstPort: 443,
+				ForwardIPs: []netip.Addr{
+					netip.MustParseAddr("192.168.10.11"),
+					netip.MustParseAddr("fd36:a851:bdf7:78d::12"),
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			_, err = filterRouter.AddPortForward(network.PortForward{
+				Proto: network.TCP,
+				DstPort: 443,
+				ForwardIP: netip.MustParseAddr("192.168.10.10"),
+				Balance: "least-conn",
+			})
+			Expect(err).To(HaveOccurred())
+			_, err = filterRouter.AddPortForward(network.PortForward{
+				Proto: network.TCP,
+				DstPort: 8000,
+				DstToPort: 7000,
+				ForwardIP: netip.MustParseAddr("192.168.10.10"),
+			})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("marks traffic for policy based routing", func() {
+			_, err = filterRouter.MarkTraffic(network.TrafficMark{
+				SrcItfName: "eth1",
+				SrcNetwork: netip.MustParsePrefix("192.168.10.0/24"),
+				Mark: 0x10,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			webMark := network.TrafficMark{
+				DstNetwork: netip.MustParsePrefix("203.0.113.0/24"),
+				Proto: network.TCP,
+				DstPort: 443,
+				Mark: 0x20,
+			}
+			_, err = filterRouter.MarkTraffic(webMark)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = filterRouter.MarkTraffic(network.TrafficMark{
+				Proto: network.UDP,
+				DstPort: 53,
+				Mark: 0x30,
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			script, err := filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "mangle_prerouting")).To(Equal([]string{
+				"type filter hook prerouting priority mangle; policy accept;",
+				`iifname "eth1" ip saddr 192.168.10.0/24 counter meta mark set 0x00000010`,
+				"ip daddr 203.0.113.0/24 meta l4proto tcp th dport 443 counter meta mark set 0x00000020",
+				"meta l4proto udp th dport 53 counter meta mark set 0x00000030",
+			}))
+			// traffic from the host is only marked if the
+			// mark is not bound to an inbound interface
+			Expect(chainRules(script, "ip mycs_router_ipv4", "mangle_output")).To(Equal([]string{
+				"type route hook output priority mangle; policy accept;",
+				"ip daddr 203.0.113.0/24 meta l4proto tcp th dport 443 counter meta mark set 0x00000020",
+				"meta l4proto udp th dport 53 counter meta mark set 0x00000030",
+			}))
+			Expect(chainRules(script, "ip6 mycs_router_ipv6", "mangle_output")).To(Equal([]string{
+				"type route hook output priority mangle; policy accept;",
+				"meta l4proto udp th dport 53 counter meta mark set 0x00000030",
+			}))
+
+			err = filterRouter.DeleteTrafficMark(webMark)
+			Expect(err).ToNot(HaveOccurred())
+			script, err = filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "mangle_output")).To(Equal([]string{
+				"type route hook output priority mangle; policy accept;",
+				"meta l4proto udp th dport 53 counter meta mark set 0x00000030",
+			}))
+
+			// the mark of an applied traffic mark can be changed
+			err = filterRouter.Apply(network.FilterSpec{
+				TrafficMarks: []network.TrafficMark{
+					{
+						SrcItfName: "eth1",
+						SrcNetwork: netip.MustParsePrefix("192.168.10.0/24"),
+						Mark: 0x40,
+					},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			script, err = filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "mangle_prerouting")).To(Equal([]string{
+				"type filter hook prerouting priority mangle; policy accept;",
+				`iifname "eth1" ip saddr 192.168.10.0/24 counter meta mark set 0x00000040`,
+			}))
+			Expect(chainRules(script, "ip6 mycs_router_ipv6", "mangle_output")).To(HaveLen(1))
+
+			_, err = filterRouter.MarkTraffic(network.TrafficMark{
+				SrcNetwork: netip.MustParsePrefix("192.168.10.0/24"),
+			})
+			Expect(err).To(HaveOccurred())
+			_, err = filterRouter.MarkTraffic(network.TrafficMark{
+				DstPort: 53,
+				Mark: 0x10,
+			})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("applies a declarative filter spec", func() {
+			spec := network.FilterSpec{
+				DenyList: []netip.Addr{
+					netip.MustParseAddr("192.168.11.10"),
+				},
+				SecurityGroups: map[string][]network.SecurityGroup{
+					"eth1": {
+						{
+							Ports: []network.PortGroup{
+								{
+									Proto: network.TCP,
+									FromPort: 22,
+									ToPort: 22,
+								},
+							},
+						},
+					},
+				},
+				PortForwards: []network.PortForward{
+					{
+						Proto: network.TCP,
+						DstPort: 8888,
+						ForwardIP: netip.MustParseAddr("192.168.10.10"),
+						ForwardPort: 80,
+					},
+				},
+				TrafficForwards: []network.TrafficForward{
+					{
+						SrcItfName: "eth1",
+						DstItfName: "eth2",
+						SrcNetwork: netip.MustParsePrefix("192.168.10.0/24"),
+						DstNetwork: netip.MustParsePrefix("192.168.11.0/24"),
+					},
+				},
+			}
+			err = filterRouter.Apply(spec)
+			Expect(err).ToNot(HaveOccurred())
+			script, err := filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+
+			// re-applying the same spec should be a no-op
+			err = filterRouter.Apply(spec)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(filterRouter.NftScript()).To(Equal(script))
+
+			Expect(chainRules(script, "ip mycs_router_ipv4", "inbound_eth1")).To(ConsistOf(
+				MatchRegexp(`^counter ip protocol \. th dport vmap @\S+$`),
+			))
+			Expect(script).To(ContainSubstring("elements = { tcp . 22 : accept }"))
+			Expect(chainRules(script, "ip mycs_router_ipv4", "forward")).To(HaveLen(4))
+
+			spec.PortForwards = nil
+			spec.TrafficForwards[0].WithNat = true
+			err = filterRouter.Apply(spec)
+			Expect(err).ToNot(HaveOccurred())
+			script, err = filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "nat_prerouting")).To(HaveLen(1))
+			Expect(chainRules(script, "ip mycs_router_ipv4", "nat_postrouting")).To(Equal([]string{
+				"type nat hook postrouting priority srcnat; policy accept;",
+				`oifname "eth2" ip saddr 192.168.10.0/24 ip daddr 192.168.11.0/24 counter masquerade`,
+			}))
+
+			// applying an empty spec removes all filters
+			err = filterRouter.Apply(network.FilterSpec{})
+			Expect(err).ToNot(HaveOccurred())
+			denyList, err := filterRouter.ListDenyList()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(denyList).To(BeEmpty())
+			script, err = filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "inbound_eth1")).To(BeEmpty())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "forward")).To(HaveLen(2))
+			Expect(chainRules(script, "ip mycs_router_ipv4", "nat_postrouting")).To(HaveLen(1))
+		})
+
+		It("adopts the filters of a previous filter router", func() {
+			allowSSH := network.SecurityGroup{
+				Ports: []network.PortGroup{
+					{
+						Proto: network.TCP,
+						FromPort: 22,
+						ToPort: 22,
+					},
+				},
+			}
+			err = filterRouter.SetSecurityGroups([]network.SecurityGroup{ allowSSH }, "")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = filterRouter.ForwardPort(8888, 80, netip.MustParseAddr("192.168.10.10"), network.TCP)
+			Expect(err).ToNot(HaveOccurred())
+			err = filterRouter.AddIPsToDenyList([]netip.Addr{ netip.MustParseAddr("192.168.11.10") })
+			Expect(err).ToNot(HaveOccurred())
+			script, err := filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+
+			// simulate a restart by creating a new filter
+			// router without clearing the current one
+			routeManager, err := nc.NewRouteManager()
+			Expect(err).ToNot(HaveOccurred())
+			filterRouter, err = routeManager.NewFilterRouter(true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(filterRouter.NftScript()).To(Equal(script))
+
+			// filters created before the restart can be deleted
+			err = filterRouter.DeleteForwardPort(8888, 80, netip.MustParseAddr("192.168.10.10"), network.TCP)
+			Expect(err).ToNot(HaveOccurred())
+			err = filterRouter.DeleteSecurityGroups([]network.SecurityGroup{ allowSSH }, "")
+			Expect(err).ToNot(HaveOccurred())
+			script, err = filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "input")).To(HaveLen(3))
+			Expect(chainRules(script, "ip mycs_router_ipv4", "forward")).To(HaveLen(2))
+
+			// tables without a saved state are replaced
+			os.Remove(stateFile)
+			routeManager, err = nc.NewRouteManager()
+			Expect(err).ToNot(HaveOccurred())
+			filterRouter, err = routeManager.NewFilterRouter(true)
+			Expect(err).ToNot(HaveOccurred())
+			denyList, err := filterRouter.ListDenyList()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(denyList).To(BeEmpty())
+		})
+
+		It("recreates the tables of a previous filter router with outdated ip lists", func() {
+			allowSSH := network.SecurityGroup{
+				Ports: []network.PortGroup{
+					{
+						Proto: network.TCP,
+						FromPort: 22,
+						ToPort: 22,
+					},
+				},
+			}
+			err = filterRouter.SetSecurityGroups([]network.SecurityGroup{ allowSSH }, "")
+			Expect(err).ToNot(HaveOccurred())
+			err = filterRouter.AddIPsToDenyList([]netip.Addr{
+				netip.MustParseAddr("192.168.11.10"),
+				netip.MustParseAddr("192.168.11.20"),
+				netip.MustParseAddr("2001:db8::1"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			script, err := filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+
+			// simulate an upgrade from a version of the router
+			// whose ip lists were plain sets of addresses
+			network.DowngradeIPLists()
+			routeManager, err := nc.NewRouteManager()
+			Expect(err).ToNot(HaveOccurred())
+			filterRouter, err = routeManager.NewFilterRouter(true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(filterRouter.NftScript()).To(Equal(script))
+
+			denyList, err := filterRouter.ListDenyList()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ipListPrefixes(denyList)).To(ConsistOf("192.168.11.10/32", "192.168.11.20/32", "2001:db8::1/128"))
+
+			// the recreated lists accept timed prefixes
+			err = filterRouter.AddPrefixesToDenyListWithTTL([]netip.Prefix{
+				netip.MustParsePrefix("10.30.0.0/24"),
+			}, time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			denyList, err = filterRouter.ListDenyList()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ipListPrefixes(denyList)).To(ContainElement("10.30.0.0/24"))
+		})
+
+		It("re-adopts the rules of a committed batch whose handles could not be retrieved", func() {
+			_, err = filterRouter.ForwardPort(8888, 80, netip.MustParseAddr("192.168.10.10"), network.TCP)
+			Expect(err).ToNot(HaveOccurred())
+
+			// the deletion and the addition are committed
+			// but the added rules cannot be tracked
+			network.FailRuleRetrievalAfterNextCommit()
+			err = filterRouter.Apply(network.FilterSpec{
+				PortForwards: []network.PortForward{
+					{ Proto: network.TCP, DstPort: 8889, ForwardIP: netip.MustParseAddr("192.168.10.11"), ForwardPort: 80 },
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			script, err := filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(script).ToNot(ContainSubstring("192.168.10.10"))
+			Expect(script).To(ContainSubstring("192.168.10.11"))
+			state, err := os.ReadFile(stateFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(state)).ToNot(ContainSubstring("192.168.10.10"))
+			Expect(string(state)).To(ContainSubstring("192.168.10.11"))
+
+			// the rules are re-adopted by the next change
+			// so the filter they belong to can be deleted
+			err = filterRouter.AddIPsToDenyList([]netip.Addr{ netip.MustParseAddr("192.168.11.10") })
+			Expect(err).ToNot(HaveOccurred())
+			err = filterRouter.Apply(network.FilterSpec{})
+			Expect(err).ToNot(HaveOccurred())
+			script, err = filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(script).ToNot(ContainSubstring("192.168.10.11"))
+		})
+
+		It("logs packets dropped by the filter router", func() {
+			filterRouter.Clear()
+			routeManager, err := nc.NewRouteManager()
+			Expect(err).ToNot(HaveOccurred())
+			filterRouter, err = routeManager.NewFilterRouter(true, network.DropLogging{
+				Prefix: "mycs ",
+				RateLimit: 10,
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = filterRouter.AddIPsToDenyList([]netip.Addr{ netip.MustParseAddr("192.168.11.10") })
+			Expect(err).ToNot(HaveOccurred())
+			_, err = filterRouter.ForwardTraffic("eth1", "eth2",
+				netip.MustParsePrefix("192.168.10.0/24"), netip.MustParsePrefix("192.168.11.0/24"), false)
+			Expect(err).ToNot(HaveOccurred())
+
+			script, err := filterRouter.NftScript()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(chainRules(script, "ip mycs_router_ipv4", "prerouting")).To(Equal([]string{
+				"type filter hook prerouting priority filter; policy accept;",
+				`ip saddr @ip_denylist limit rate 10/second burst 5 packets log prefix "mycs ip_denylist: " level warn`,
+				"ip saddr @ip_denylist counter drop",
+			}))
+			// the policy log rule remains the last rule of the chain
+			Expect(chainRules(script, "ip mycs_router_ipv4", "forward")).To(Equal([]string{
+				"type filter hook forward priority filter; policy drop;",
+				"ct state vmap @ctstate",
+				`iifname "eth1" oifname "eth2" ip saddr 192.168.10.0/24 ip daddr 192.168.11.0/24 counter accept`,
+				`limit rate 10/second burst 5 packets log prefix "mycs policy: " level warn`,
+			}))
+
+			_, err = routeManager.NewFilterRouter(true, network.DropLogging{ Level: "loud" })
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
+
+// returns the statements of a chain in an nft script
+func chainRules(script, table, chain string) []string {
+
+	rules := []string{}
+	tableBlock := regexp.MustCompile(`(?ms)^table ` + regexp.QuoteMeta(table) + ` \{$.*?^\}$`).FindString(script)
+	chainBlock := regexp.MustCompile(`(?ms)^\tchain ` + regexp.QuoteMeta(chain) + ` \{$.*?^\t\}$`).FindString(tableBlock)
+	lines := strings.Split(chainBlock, "\n")
+	for i := 1; i < len(lines) - 1; i++ {
+		rules = append(rules, strings.TrimSpace(lines[i]))
+	}
+	return rules
+}
+
+// returns the prefixes of the elements of an ip list as strings
+func ipListPrefixes(list []network.IPListElement) []string {
+	prefixes := make([]string, 0, len(list))
+	for _, elem := range list {
+		prefixes = append(prefixes, elem.Prefix.String())
+	}
+	return prefixes
+}
+
+// returns the nft commands of the steps of a plan
+func planCommands(plan network.FilterPlan) []string {
+	commands := make([]string, 0, len(plan))
+	for _, step := range plan {
+		commands = append(commands, step.String())
+	}
+	return commands
+}
+
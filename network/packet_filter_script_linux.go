@@ -0,0 +1,1031 @@
+//go:build linux
+
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// The router's tables are rendered in the syntax read by
+// 'nft -f' so they can be reviewed, diffed and loaded on
+// hosts where the router is not running. The script
+// replaces any existing router tables when it is loaded.
+// Rule expressions are rendered from the expression
+// sequences that the router creates so the script
+// reflects the rules as they exist in the kernel.
+
+// returns the router's tables as an nft script
+func (r *packetFilterRouter) NftScript() (string, error) {
+
+	var (
+		err error
+
+		out bytes.Buffer
+	)
+
+	for i, table := range r.table {
+		// declaring the table before deleting it
+		// ensures the delete does not fail if
+		// the table does not exist
+		fmt.Fprintf(&out, "table %s\n", nftTableText(table))
+		fmt.Fprintf(&out, "delete table %s\n\n", nftTableText(table))
+		fmt.Fprintf(&out, "table %s {\n", nftTableText(table))
+
+		chains := append([]*nftables.Chain{}, r.chains[i]...)
+		for _, name := range sortedKeys(r.inboundChains) {
+			chains = append(chains, r.inboundChains[name][i])
+		}
+		chainRules := make([][]*nftables.Rule, len(chains))
+		for j, chain := range chains {
+			if chainRules[j], err = r.nft.GetRules(table, chain); err != nil {
+				return "", err
+			}
+		}
+
+		for _, set := range r.scriptSets(i, chainRules) {
+			if err = r.writeNftSet(&out, set); err != nil {
+				return "", err
+			}
+		}
+		for j, chain := range chains {
+			if err = writeNftChain(&out, chain, chainRules[j]); err != nil {
+				return "", err
+			}
+		}
+		fmt.Fprintln(&out, "}")
+		if i < len(r.table)-1 {
+			fmt.Fprintln(&out)
+		}
+	}
+	return out.String(), nil
+}
+
+// returns the sets of the table at the given index. the
+// kernel does not return the key types of concatenated
+// and verdict map sets so the router's set definitions
+// are used instead of those retrieved from the kernel.
+func (r *packetFilterRouter) scriptSets(i int, chainRules [][]*nftables.Rule) []*nftables.Set {
+
+	table := r.table[i]
+	sets := []*nftables.Set{
+		r.ctstateVmap[i],
+		r.ipDenyList[i],
+		r.ipAllowList[i],
+		r.inboundIFNameVmap[i],
+	}
+	for _, name := range sortedKeys(r.sgPortVmaps) {
+		if set := r.sgPortVmaps[name]; set.Table.Name == table.Name {
+			sets = append(sets, set)
+		}
+	}
+	// connection limit meters are only
+	// referenced by the rules that use them
+	meters := map[string]*nftables.Set{}
+	for _, rules := range chainRules {
+		for _, rule := range rules {
+			for _, e := range rule.Exprs {
+				if dynset, ok := e.(*expr.Dynset); ok {
+					meters[dynset.SetName] = &nftables.Set{
+						Name:    dynset.SetName,
+						Table:   table,
+						KeyType: ipSetElemTypes[i],
+						Dynamic: true,
+					}
+				}
+			}
+		}
+	}
+	for _, name := range sortedKeys(meters) {
+		sets = append(sets, meters[name])
+	}
+	// maps of port forwards to more than one
+	// backend or to a different port range
+	for _, key := range sortedKeys(r.portForwards) {
+		pf := r.portForwards[key]
+		if pf.backends()[0].Is4() != (i == 0) {
+			continue
+		}
+		if maps, _, err := portForwardMaps(pf, table); err == nil {
+			sets = append(sets, maps...)
+		}
+	}
+	return sets
+}
+
+// writes a set or map declaration with its elements
+//
+// set <name> {
+//   type <key type>[ : <data type>]
+//   flags <flags>
+//   elements = { <element>, ... }
+// }
+func (r *packetFilterRouter) writeNftSet(out *bytes.Buffer, set *nftables.Set) error {
+
+	var (
+		err error
+
+		elems  []setElement
+		ranges []ipRange
+	)
+
+	elemTexts := []string{}
+	if set.Interval {
+		// interval elements are rendered as prefixes
+		if ranges, err = r.getIPSetRanges(set); err != nil {
+			return err
+		}
+		for _, rg := range ranges {
+			for _, prefix := range rg.prefixes() {
+				elemTexts = append(elemTexts, nftPrefixText(prefix)+nftTimeoutText(rg.ttl, rg.remaining))
+			}
+		}
+
+	} else if !set.Dynamic {
+		if elems, err = r.nft.getSetElements(set); err != nil {
+			return err
+		}
+		for _, elem := range elems {
+			text := nftDataText(set.KeyType, elem.key) + nftTimeoutText(elem.timeout, elem.expiration)
+			if set.IsMap {
+				switch {
+				case elem.verdict != nil:
+					text += " : " + nftVerdictText(elem.verdict)
+				case len(elem.val) > 0:
+					text += " : " + nftDataText(set.DataType, elem.val)
+				default:
+					return fmt.Errorf("element %s of map '%s' does not have any data", text, set.Name)
+				}
+			}
+			elemTexts = append(elemTexts, text)
+		}
+	}
+
+	fmt.Fprintf(out, "\t%s %s {\n", nftSetObject(set), set.Name)
+	for _, decl := range nftSetDecls(set) {
+		fmt.Fprintf(out, "\t\t%s\n", decl)
+	}
+	if len(elemTexts) > 0 {
+		fmt.Fprintf(out, "\t\telements = { %s }\n", strings.Join(elemTexts, ",\n\t\t\t     "))
+	}
+	fmt.Fprintln(out, "\t}")
+	return nil
+}
+
+// writes a chain declaration with its rules
+//
+// chain <name> {
+//   type <type> hook <hook> priority <priority>; policy <policy>;
+//   <rule>
+//   ...
+// }
+func writeNftChain(out *bytes.Buffer, chain *nftables.Chain, rules []*nftables.Rule) error {
+
+	var (
+		err error
+
+		text string
+	)
+
+	fmt.Fprintf(out, "\tchain %s {\n", chain.Name)
+	if chain.Hooknum != nil {
+		fmt.Fprintf(out, "\t\t%s\n", nftChainHook(chain))
+	}
+	for _, rule := range rules {
+		if text, err = nftRuleText(rule); err != nil {
+			return fmt.Errorf(
+				"failed to render rule with handle %d in chain '%s' of table '%s': %s",
+				rule.Handle, chain.Name, chain.Table.Name, err.Error(),
+			)
+		}
+		fmt.Fprintf(out, "\t\t%s\n", text)
+	}
+	fmt.Fprintln(out, "\t}")
+	return nil
+}
+
+// the value loaded into a register by a rule expression
+type nftRegValue struct {
+	// the nft expression of the value i.e. "ip saddr"
+	text string
+	// the data type the value is formatted as
+	dataType nftables.SetDatatype
+	// immediate data loaded into the register
+	data []byte
+	// mask applied to the value
+	mask []byte
+
+	// load sequence and length used to
+	// determine concatenated values
+	seq, len uint32
+}
+
+// renders the expressions of a rule as an nft rule statement
+func nftRuleText(rule *nftables.Rule) (string, error) {
+
+	var (
+		err  error
+		text string
+	)
+
+	regs := map[uint32]*nftRegValue{}
+	seq := uint32(0)
+	load := func(reg uint32, value *nftRegValue) {
+		seq++
+		value.seq = seq
+		regs[reg] = value
+	}
+	is4 := rule.Table.Family != nftables.TableFamilyIPv6
+
+	stmts := []string{}
+	for _, e := range rule.Exprs {
+		switch e := e.(type) {
+
+		case *expr.Payload:
+			if e.OperationType != expr.PayloadLoad {
+				return "", fmt.Errorf("payload write is not supported")
+			}
+			load(e.DestRegister, nftPayloadValue(e, is4))
+
+		case *expr.Meta:
+			if e.SourceRegister {
+				value := nftMetaValue(e.Key)
+				if value == nil {
+					return "", fmt.Errorf("meta key %d is not supported", e.Key)
+				}
+				if text, err = nftNATRegText(regs, e.Register, 0, value.dataType); err != nil {
+					return "", err
+				}
+				stmts = append(stmts, fmt.Sprintf("%s set %s", value.text, text))
+			} else {
+				value := nftMetaValue(e.Key)
+				if value == nil {
+					return "", fmt.Errorf("meta key %d is not supported", e.Key)
+				}
+				load(e.Register, value)
+			}
+
+		case *expr.Ct:
+			value := nftCtValue(e.Key)
+			if value == nil {
+				return "", fmt.Errorf("ct key %d is not supported", e.Key)
+			}
+			if e.SourceRegister {
+				if text, err = nftNATRegText(regs, e.Register, 0, value.dataType); err != nil {
+					return "", err
+				}
+				stmts = append(stmts, fmt.Sprintf("%s set %s", value.text, text))
+			} else {
+				load(e.Register, value)
+			}
+
+		case *expr.Bitwise:
+			value, ok := regs[e.SourceRegister]
+			if !ok || !isZero(e.Xor) {
+				return "", fmt.Errorf("bitwise operation on register %d is not supported", e.SourceRegister)
+			}
+			masked := *value
+			masked.mask = e.Mask
+			regs[e.DestRegister] = &masked
+
+		case *expr.Cmp:
+			value, ok := regs[e.Register]
+			if !ok {
+				return "", fmt.Errorf("compare of unloaded register %d", e.Register)
+			}
+			if text, err = nftCmpText(value, e.Op, e.Data); err != nil {
+				return "", err
+			}
+			stmts = append(stmts, text)
+
+		case *expr.Range:
+			value, ok := regs[e.Register]
+			if !ok {
+				return "", fmt.Errorf("range of unloaded register %d", e.Register)
+			}
+			op := ""
+			if e.Op == expr.CmpOpNeq {
+				op = "!= "
+			}
+			stmts = append(stmts, fmt.Sprintf("%s %s%s-%s",
+				value.text, op,
+				nftDataText(value.dataType, e.FromData),
+				nftDataText(value.dataType, e.ToData),
+			))
+
+		case *expr.Lookup:
+			if text, err = nftConcatText(regs, e.SourceRegister); err != nil {
+				return "", err
+			}
+			switch {
+			case e.IsDestRegSet && e.DestRegister == 0:
+				stmts = append(stmts, fmt.Sprintf("%s vmap @%s", text, e.SetName))
+			case e.IsDestRegSet:
+				load(e.DestRegister, &nftRegValue{ text: fmt.Sprintf("%s map @%s", text, e.SetName) })
+			case e.Invert:
+				stmts = append(stmts, fmt.Sprintf("%s != @%s", text, e.SetName))
+			default:
+				stmts = append(stmts, fmt.Sprintf("%s @%s", text, e.SetName))
+			}
+
+		case *expr.Immediate:
+			load(e.Register, &nftRegValue{ data: e.Data, len: uint32(len(e.Data)) })
+
+		case *expr.Numgen:
+			text = "numgen inc"
+			if e.Type == unix.NFT_NG_RANDOM {
+				text = "numgen random"
+			}
+			load(e.Register, &nftRegValue{ text: fmt.Sprintf("%s mod %d", text, e.Modulus) + nftOffsetText(e.Offset), len: 4 })
+
+		case *expr.Hash:
+			if text, err = nftHashText(regs, e); err != nil {
+				return "", err
+			}
+			load(e.DestRegister, &nftRegValue{ text: text, len: 4 })
+
+		case *expr.Counter:
+			stmts = append(stmts, "counter")
+
+		case *expr.Limit:
+			stmts = append(stmts, nftLimitText(e))
+
+		case *expr.Connlimit:
+			stmts = append(stmts, nftConnlimitText(e))
+
+		case *expr.Dynset:
+			if text, err = nftDynsetText(regs, e); err != nil {
+				return "", err
+			}
+			stmts = append(stmts, text)
+
+		case *expr.Log:
+			stmts = append(stmts, nftLogText(e))
+
+		case *expr.Masq:
+			text = "masquerade"
+			if e.ToPorts {
+				if text, err = nftNATRegText(regs, e.RegProtoMin, e.RegProtoMax, nftables.TypeInetService); err != nil {
+					return "", err
+				}
+				text = "masquerade to :" + text
+			}
+			stmts = append(stmts, text+nftNATFlagsText(e.Random, e.FullyRandom, e.Persistent))
+
+		case *expr.NAT:
+			if text, err = nftNATText(regs, e); err != nil {
+				return "", err
+			}
+			stmts = append(stmts, text)
+
+		case *expr.Verdict:
+			stmts = append(stmts, nftVerdictText(e))
+
+		default:
+			return "", fmt.Errorf("expression %T is not supported", e)
+		}
+	}
+	return strings.Join(stmts, " "), nil
+}
+
+// returns the value loaded by a payload expression
+func nftPayloadValue(e *expr.Payload, is4 bool) *nftRegValue {
+
+	value := &nftRegValue{ len: e.Len }
+	switch e.Base {
+	case expr.PayloadBaseNetworkHeader:
+		switch {
+		case e.Offset == 12 && e.Len == 4:
+			value.text, value.dataType = "ip saddr", nftables.TypeIPAddr
+		case e.Offset == 16 && e.Len == 4:
+			value.text, value.dataType = "ip daddr", nftables.TypeIPAddr
+		case e.Offset == 9 && e.Len == 1 && is4:
+			value.text, value.dataType = "ip protocol", nftables.TypeInetProto
+		case e.Offset == 8 && e.Len == 16:
+			value.text, value.dataType = "ip6 saddr", nftables.TypeIP6Addr
+		case e.Offset == 24 && e.Len == 16:
+			value.text, value.dataType = "ip6 daddr", nftables.TypeIP6Addr
+		case e.Offset == 6 && e.Len == 1 && !is4:
+			value.text, value.dataType = "ip6 nexthdr", nftables.TypeInetProto
+		default:
+			value.text = fmt.Sprintf("@nh,%d,%d", e.Offset*8, e.Len*8)
+		}
+	case expr.PayloadBaseTransportHeader:
+		switch {
+		case e.Offset == 0 && e.Len == 2:
+			value.text, value.dataType = "th sport", nftables.TypeInetService
+		case e.Offset == 2 && e.Len == 2:
+			value.text, value.dataType = "th dport", nftables.TypeInetService
+		default:
+			value.text = fmt.Sprintf("@th,%d,%d", e.Offset*8, e.Len*8)
+		}
+	default:
+		value.text = fmt.Sprintf("@ll,%d,%d", e.Offset*8, e.Len*8)
+	}
+	return value
+}
+
+// returns the value of a meta key
+func nftMetaValue(key expr.MetaKey) *nftRegValue {
+	switch key {
+	case expr.MetaKeyL4PROTO:
+		return &nftRegValue{ text: "meta l4proto", dataType: nftables.TypeInetProto, len: 1 }
+	case expr.MetaKeyNFPROTO:
+		return &nftRegValue{ text: "meta nfproto", len: 1 }
+	case expr.MetaKeyIIFNAME:
+		return &nftRegValue{ text: "iifname", dataType: nftables.TypeIFName, len: 16 }
+	case expr.MetaKeyOIFNAME:
+		return &nftRegValue{ text: "oifname", dataType: nftables.TypeIFName, len: 16 }
+	case expr.MetaKeyMARK:
+		return &nftRegValue{ text: "meta mark", dataType: nftables.TypeMark, len: 4 }
+	}
+	return nil
+}
+
+// returns the value of a conntrack key
+func nftCtValue(key expr.CtKey) *nftRegValue {
+	switch key {
+	case expr.CtKeySTATE:
+		return &nftRegValue{ text: "ct state", dataType: nftables.TypeCTState, len: 4 }
+	case expr.CtKeyMARK:
+		return &nftRegValue{ text: "ct mark", dataType: nftables.TypeMark, len: 4 }
+	}
+	return nil
+}
+
+var nftCmpOps = map[expr.CmpOp]string{
+	expr.CmpOpEq:  "",
+	expr.CmpOpNeq: "!= ",
+	expr.CmpOpLt:  "< ",
+	expr.CmpOpLte: "<= ",
+	expr.CmpOpGt:  "> ",
+	expr.CmpOpGte: ">= ",
+}
+
+// returns the comparison of a register value with the given data
+func nftCmpText(value *nftRegValue, op expr.CmpOp, data []byte) (string, error) {
+
+	opText, ok := nftCmpOps[op]
+	if !ok {
+		return "", fmt.Errorf("compare operation %d is not supported", op)
+	}
+	if value.mask != nil {
+		switch value.dataType.Name {
+		case nftables.TypeCTState.Name:
+			// ct state & <flags> != 0 is rendered as a flag match
+			if op == expr.CmpOpNeq && isZero(data) {
+				return fmt.Sprintf("%s %s", value.text, nftDataText(value.dataType, value.mask)), nil
+			}
+		case nftables.TypeIPAddr.Name, nftables.TypeIP6Addr.Name:
+			// an address compared with a network mask is a prefix match
+			if addr, ok := netip.AddrFromSlice(data); ok {
+				prefixLen := 0
+				for _, b := range value.mask {
+					prefixLen += bits.OnesCount8(b)
+				}
+				return fmt.Sprintf("%s %s%s", value.text, opText, nftPrefixText(netip.PrefixFrom(addr, prefixLen))), nil
+			}
+		}
+		return "", fmt.Errorf("masked compare of '%s' is not supported", value.text)
+	}
+	return fmt.Sprintf("%s %s%s", value.text, opText, nftDataText(value.dataType, data)), nil
+}
+
+// returns the text of the value in the given register
+func nftRegText(regs map[uint32]*nftRegValue, reg uint32) (string, error) {
+	value, ok := regs[reg]
+	if !ok {
+		return "", fmt.Errorf("register %d has not been loaded", reg)
+	}
+	if value.data != nil {
+		return nftDataText(value.dataType, value.data), nil
+	}
+	return value.text, nil
+}
+
+// returns the text of the value in the given register along
+// with any values concatenated to it. values are concatenated
+// when loaded in sequence into adjacent 32 bit registers.
+func nftConcatText(regs map[uint32]*nftRegValue, reg uint32) (string, error) {
+
+	value, ok := regs[reg]
+	if !ok {
+		return "", fmt.Errorf("register %d has not been loaded", reg)
+	}
+	parts := []string{ value.text }
+	for reg >= unix.NFT_REG32_00 {
+		reg += (value.len + 3) / 4
+		next, ok := regs[reg]
+		if !ok || next.seq != value.seq+1 {
+			break
+		}
+		parts = append(parts, next.text)
+		value = next
+	}
+	return strings.Join(parts, " . "), nil
+}
+
+// limit rate [over] <rate>[ bytes]/<unit> [burst <burst> packets|bytes]
+func nftLimitText(e *expr.Limit) string {
+
+	units := map[expr.LimitTime]string{
+		expr.LimitTimeSecond: "second",
+		expr.LimitTimeMinute: "minute",
+		expr.LimitTimeHour:   "hour",
+		expr.LimitTimeDay:    "day",
+		expr.LimitTimeWeek:   "week",
+	}
+	over := ""
+	if e.Over {
+		over = "over "
+	}
+	if e.Type == expr.LimitTypePktBytes {
+		text := fmt.Sprintf("limit rate %s%d bytes/%s", over, e.Rate, units[e.Unit])
+		if e.Burst > 0 {
+			text += fmt.Sprintf(" burst %d bytes", e.Burst)
+		}
+		return text
+	}
+	text := fmt.Sprintf("limit rate %s%d/%s", over, e.Rate, units[e.Unit])
+	if e.Burst > 0 {
+		text += fmt.Sprintf(" burst %d packets", e.Burst)
+	}
+	return text
+}
+
+// ct count [over] <count>
+func nftConnlimitText(e *expr.Connlimit) string {
+	if e.Flags & expr.NFT_CONNLIMIT_F_INV != 0 {
+		return fmt.Sprintf("ct count over %d", e.Count)
+	}
+	return fmt.Sprintf("ct count %d", e.Count)
+}
+
+// add|update @<set> { <key> [timeout <timeout>] [<stmt>] }
+func nftDynsetText(regs map[uint32]*nftRegValue, e *expr.Dynset) (string, error) {
+
+	var (
+		err error
+
+		key string
+	)
+
+	ops := map[uint32]string{
+		unix.NFT_DYNSET_OP_ADD:    "add",
+		unix.NFT_DYNSET_OP_UPDATE: "update",
+	}
+	op, ok := ops[e.Operation]
+	if !ok {
+		return "", fmt.Errorf("dynset operation %d is not supported", e.Operation)
+	}
+	if key, err = nftConcatText(regs, e.SrcRegKey); err != nil {
+		return "", err
+	}
+	elem := []string{ key }
+	if e.Timeout > 0 {
+		elem = append(elem, "timeout "+nftDurationText(e.Timeout))
+	}
+	for _, se := range e.Exprs {
+		switch se := se.(type) {
+		case *expr.Connlimit:
+			elem = append(elem, nftConnlimitText(se))
+		case *expr.Limit:
+			elem = append(elem, nftLimitText(se))
+		case *expr.Counter:
+			elem = append(elem, "counter")
+		default:
+			return "", fmt.Errorf("dynset expression %T is not supported", se)
+		}
+	}
+	return fmt.Sprintf("%s @%s { %s }", op, e.SetName, strings.Join(elem, " ")), nil
+}
+
+// log [prefix "<prefix>"] [level <level>] [group <group>]
+func nftLogText(e *expr.Log) string {
+
+	text := []string{ "log" }
+	if e.Key & (1 << unix.NFTA_LOG_PREFIX) != 0 {
+		text = append(text, fmt.Sprintf("prefix \"%s\"", strings.TrimRight(string(e.Data), "\x00")))
+	}
+	if e.Key & (1 << unix.NFTA_LOG_GROUP) != 0 {
+		text = append(text, fmt.Sprintf("group %d", e.Group))
+	}
+	if e.Key & (1 << unix.NFTA_LOG_LEVEL) != 0 {
+		for name, level := range logLevels {
+			if level == e.Level {
+				text = append(text, "level "+name)
+				break
+			}
+		}
+	}
+	return strings.Join(text, " ")
+}
+
+// dnat|snat to <addr>[-<addr>][:<port>[-<port>]] [flags]
+func nftNATText(regs map[uint32]*nftRegValue, e *expr.NAT) (string, error) {
+
+	var (
+		err error
+
+		addr, port string
+	)
+
+	natType := "dnat"
+	if e.Type == expr.NATTypeSourceNAT {
+		natType = "snat"
+	}
+	is4 := e.Family == unix.NFPROTO_IPV4
+	addrType := nftables.TypeIPAddr
+	if !is4 {
+		addrType = nftables.TypeIP6Addr
+	}
+	if e.RegAddrMin != 0 {
+		if addr, err = nftNATRegText(regs, e.RegAddrMin, e.RegAddrMax, addrType); err != nil {
+			return "", err
+		}
+	}
+	if e.RegProtoMin != 0 {
+		if port, err = nftNATRegText(regs, e.RegProtoMin, e.RegProtoMax, nftables.TypeInetService); err != nil {
+			return "", err
+		}
+		if _, err = netip.ParseAddr(addr); err == nil && !is4 {
+			addr = "[" + addr + "]"
+		}
+		addr += ":" + port
+	}
+	return fmt.Sprintf("%s to %s", natType, addr) + nftNATFlagsText(e.Random, e.FullyRandom, e.Persistent), nil
+}
+
+// returns the hash of the value in the source register
+func nftHashText(regs map[uint32]*nftRegValue, e *expr.Hash) (string, error) {
+
+	if e.Type == expr.HashTypeSym {
+		return fmt.Sprintf("symhash mod %d", e.Modulus) + nftOffsetText(e.Offset), nil
+	}
+	value, ok := regs[e.SourceRegister]
+	if !ok {
+		return "", fmt.Errorf("hash of unloaded register %d", e.SourceRegister)
+	}
+	return fmt.Sprintf("jhash %s mod %d seed 0x%x", value.text, e.Modulus, e.Seed) + nftOffsetText(e.Offset), nil
+}
+
+func nftOffsetText(offset uint32) string {
+	if offset == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" offset %d", offset)
+}
+
+// returns the value or range of values in the
+// given registers formatted as the given type
+func nftNATRegText(regs map[uint32]*nftRegValue, regMin, regMax uint32, dataType nftables.SetDatatype) (string, error) {
+
+	var (
+		text string
+	)
+
+	value := func(reg uint32) (string, error) {
+		value, ok := regs[reg]
+		if !ok {
+			return "", fmt.Errorf("register %d has not been loaded", reg)
+		}
+		if value.data != nil {
+			return nftDataText(dataType, value.data), nil
+		}
+		return value.text, nil
+	}
+	min, err := value(regMin)
+	if err != nil {
+		return "", err
+	}
+	text = min
+	if regMax != 0 && regMax != regMin {
+		max, err := value(regMax)
+		if err != nil {
+			return "", err
+		}
+		text += "-" + max
+	}
+	return text, nil
+}
+
+func nftNATFlagsText(random, fullyRandom, persistent bool) string {
+	flags := []string{}
+	if random {
+		flags = append(flags, "random")
+	}
+	if fullyRandom {
+		flags = append(flags, "fully-random")
+	}
+	if persistent {
+		flags = append(flags, "persistent")
+	}
+	if len(flags) == 0 {
+		return ""
+	}
+	return " " + strings.Join(flags, ",")
+}
+
+// returns the verdict statement
+func nftVerdictText(v *expr.Verdict) string {
+	switch v.Kind {
+	case expr.VerdictAccept:
+		return "accept"
+	case expr.VerdictDrop:
+		return "drop"
+	case expr.VerdictReturn:
+		return "return"
+	case expr.VerdictContinue:
+		return "continue"
+	case expr.VerdictJump:
+		return "jump " + v.Chain
+	case expr.VerdictGoto:
+		return "goto " + v.Chain
+	}
+	return fmt.Sprintf("verdict %d", v.Kind)
+}
+
+var nftProtoNames = map[byte]string{
+	unix.IPPROTO_ICMP:    "icmp",
+	unix.IPPROTO_TCP:     "tcp",
+	unix.IPPROTO_UDP:     "udp",
+	unix.IPPROTO_GRE:     "gre",
+	unix.IPPROTO_ESP:     "esp",
+	unix.IPPROTO_AH:      "ah",
+	unix.IPPROTO_ICMPV6:  "icmpv6",
+	unix.IPPROTO_SCTP:    "sctp",
+}
+
+var nftCtStateNames = []struct {
+	bit  uint32
+	name string
+}{
+	{ expr.CtStateBitINVALID, "invalid" },
+	{ expr.CtStateBitESTABLISHED, "established" },
+	{ expr.CtStateBitRELATED, "related" },
+	{ expr.CtStateBitNEW, "new" },
+	{ expr.CtStateBitUNTRACKED, "untracked" },
+}
+
+// formats data as a value of the given type
+func nftDataText(dataType nftables.SetDatatype, data []byte) string {
+
+	switch dataType.Name {
+	case nftables.TypeIPAddr.Name, nftables.TypeIP6Addr.Name:
+		if addr, ok := netip.AddrFromSlice(data); ok {
+			return addr.String()
+		}
+	case nftables.TypeInetProto.Name:
+		if len(data) > 0 {
+			if name, ok := nftProtoNames[data[0]]; ok {
+				return name
+			}
+			return fmt.Sprintf("%d", data[0])
+		}
+	case nftables.TypeInetService.Name:
+		if len(data) >= 2 {
+			return fmt.Sprintf("%d", binary.BigEndian.Uint16(data))
+		}
+	case nftables.TypeIFName.Name:
+		return fmt.Sprintf("\"%s\"", strings.TrimRight(string(data), "\x00"))
+	case nftables.TypeCTState.Name:
+		if len(data) == 4 {
+			state := binaryutil.NativeEndian.Uint32(data)
+			names := []string{}
+			for _, s := range nftCtStateNames {
+				if state & s.bit != 0 {
+					names = append(names, s.name)
+				}
+			}
+			return strings.Join(names, ",")
+		}
+	case nftables.TypeMark.Name:
+		if len(data) == 4 {
+			return fmt.Sprintf("0x%08x", binaryutil.NativeEndian.Uint32(data))
+		}
+	}
+	if strings.Contains(dataType.Name, " . ") {
+		// concatenated values are each aligned to 4 bytes
+		parts := []string{}
+		for _, t := range nftables.ConcatSetTypeElements(dataType) {
+			n := int(t.Bytes)
+			if n > len(data) {
+				break
+			}
+			parts = append(parts, nftDataText(t, data[:n]))
+			data = data[(n+3)/4*4:]
+		}
+		return strings.Join(parts, " . ")
+	}
+	return fmt.Sprintf("0x%x", data)
+}
+
+// returns the prefix as a single address if it
+// covers one address otherwise in cidr notation
+func nftPrefixText(prefix netip.Prefix) string {
+	if prefix.IsSingleIP() {
+		return prefix.Addr().String()
+	}
+	return prefix.String()
+}
+
+// returns the timeout and remaining time of an element
+func nftTimeoutText(timeout, expiration time.Duration) string {
+	if timeout == 0 {
+		return ""
+	}
+	text := " timeout " + nftDurationText(timeout)
+	if expiration > 0 {
+		text += " expires " + nftDurationText(expiration)
+	}
+	return text
+}
+
+// formats a duration in the form <days>d<hours>h<minutes>m<seconds>s<millis>ms
+func nftDurationText(d time.Duration) string {
+
+	var (
+		out bytes.Buffer
+	)
+
+	units := []struct {
+		d    time.Duration
+		name string
+	}{
+		{ 24 * time.Hour, "d" },
+		{ time.Hour, "h" },
+		{ time.Minute, "m" },
+		{ time.Second, "s" },
+		{ time.Millisecond, "ms" },
+	}
+	for _, u := range units {
+		if n := d / u.d; n > 0 {
+			fmt.Fprintf(&out, "%d%s", n, u.name)
+			d -= n * u.d
+		}
+	}
+	if out.Len() == 0 {
+		return "0s"
+	}
+	return out.String()
+}
+
+// returns the family and name of a table i.e. "ip mycs_router_ipv4"
+func nftTableText(table *nftables.Table) string {
+	return nftFamilyName(table.Family) + " " + table.Name
+}
+
+// returns "map" for maps otherwise "set"
+func nftSetObject(set *nftables.Set) string {
+	if set.IsMap {
+		return "map"
+	}
+	return "set"
+}
+
+// returns the declarations of a set's type and flags
+func nftSetDecls(set *nftables.Set) []string {
+
+	decls := []string{}
+	if set.IsMap {
+		decls = append(decls, fmt.Sprintf("type %s : %s", set.KeyType.Name, set.DataType.Name))
+	} else {
+		decls = append(decls, fmt.Sprintf("type %s", set.KeyType.Name))
+	}
+
+	flags := []string{}
+	if set.Constant {
+		flags = append(flags, "constant")
+	}
+	if set.Dynamic {
+		flags = append(flags, "dynamic")
+	}
+	if set.Interval {
+		flags = append(flags, "interval")
+	}
+	if set.HasTimeout {
+		flags = append(flags, "timeout")
+	}
+	if len(flags) > 0 {
+		decls = append(decls, fmt.Sprintf("flags %s", strings.Join(flags, ",")))
+	}
+	if set.Timeout > 0 {
+		decls = append(decls, fmt.Sprintf("timeout %s", nftDurationText(set.Timeout)))
+	}
+	return decls
+}
+
+// returns the set declarations in the form used
+// when a set is added with a single nft command
+//
+// { type <type>; flags <flags>; }
+func nftSetSpec(set *nftables.Set) string {
+	return "{ " + strings.Join(nftSetDecls(set), "; ") + "; }"
+}
+
+// returns the hook declaration of a base chain
+//
+// type <type> hook <hook> priority <priority>; policy <policy>;
+func nftChainHook(chain *nftables.Chain) string {
+	decl := fmt.Sprintf("type %s hook %s priority %s;",
+		chain.Type, nftHookName(*chain.Hooknum), nftPriorityText(chain),
+	)
+	if chain.Policy != nil {
+		if *chain.Policy == nftables.ChainPolicyDrop {
+			decl += " policy drop;"
+		} else {
+			decl += " policy accept;"
+		}
+	}
+	return decl
+}
+
+// returns the hook declaration of a base chain in the form
+// used when a chain is added with a single nft command
+func nftChainSpec(chain *nftables.Chain) string {
+	if chain.Hooknum == nil {
+		return ""
+	}
+	return "{ " + nftChainHook(chain) + " }"
+}
+
+func nftFamilyName(family nftables.TableFamily) string {
+	switch family {
+	case nftables.TableFamilyIPv4:
+		return "ip"
+	case nftables.TableFamilyIPv6:
+		return "ip6"
+	case nftables.TableFamilyINet:
+		return "inet"
+	case nftables.TableFamilyARP:
+		return "arp"
+	case nftables.TableFamilyBridge:
+		return "bridge"
+	case nftables.TableFamilyNetdev:
+		return "netdev"
+	}
+	return fmt.Sprintf("%d", family)
+}
+
+func nftHookName(hook nftables.ChainHook) string {
+	switch hook {
+	case *nftables.ChainHookPrerouting:
+		return "prerouting"
+	case *nftables.ChainHookInput:
+		return "input"
+	case *nftables.ChainHookForward:
+		return "forward"
+	case *nftables.ChainHookOutput:
+		return "output"
+	case *nftables.ChainHookPostrouting:
+		return "postrouting"
+	}
+	return fmt.Sprintf("%d", hook)
+}
+
+// returns the chain priority relative to the standard
+// priority of the chain's type and hook i.e. "filter + 10"
+func nftPriorityText(chain *nftables.Chain) string {
+
+	if chain.Priority == nil {
+		return "filter"
+	}
+	name, base := "filter", *nftables.ChainPriorityFilter
+	// the router's chains are offset from the base priorities
+	if int64(*chain.Priority) - int64(NftChainPriorityOffset) <= int64(*nftables.ChainPriorityMangle) {
+		name, base = "mangle", *nftables.ChainPriorityMangle
+	}
+	if chain.Type == nftables.ChainTypeNAT {
+		if *chain.Hooknum == *nftables.ChainHookPrerouting || *chain.Hooknum == *nftables.ChainHookOutput {
+			name, base = "dstnat", *nftables.ChainPriorityNATDest
+		} else {
+			name, base = "srcnat", *nftables.ChainPriorityNATSource
+		}
+	}
+	switch offset := int64(*chain.Priority) - int64(base); {
+	case offset > 0:
+		return fmt.Sprintf("%s + %d", name, offset)
+	case offset < 0:
+		return fmt.Sprintf("%s - %d", name, -offset)
+	}
+	return name
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,271 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+	"net/netip"
+	"reflect"
+	"sort"
+
+	"github.com/google/nftables"
+)
+
+// Applies the given filter spec as the complete desired
+// state of the router. The installed filters are diffed
+// against the spec and only the filters that have been
+// added, changed or removed are updated. All changes are
+// committed in a single nftables transaction so either
+// the whole spec is applied or nothing is changed.
+func (r *packetFilterRouter) Apply(desired FilterSpec) error {
+
+	var (
+		err error
+
+		vmapsTouched []*nftables.Set
+	)
+
+	if r.table == nil {
+		return fmt.Errorf("packet filter router has not been initialized")
+	}
+	if err = desired.validate(); err != nil {
+		return err
+	}
+
+	b := r.newFilterBatch()
+	if vmapsTouched, err = r.queueFilterSpec(b, desired); err != nil {
+		r.discardFilterBatch(b)
+		return err
+	}
+	if err = r.commitFilterBatch(b); err != nil {
+		return err
+	}
+	// port group vmaps that are no longer referenced
+	// can only be removed once the rules that
+	// referenced them have been deleted
+	r.deleteEmptyPortVMaps(vmapsTouched)
+	return nil
+}
+
+// queues the changes required to transition the
+// installed filters to the desired filter spec
+// and returns the port group vmaps touched
+func (r *packetFilterRouter) queueFilterSpec(b *filterBatch, desired FilterSpec) ([]*nftables.Set, error) {
+
+	var (
+		err error
+		ok  bool
+
+		sgKey string
+
+		touched,
+		vmapsTouched []*nftables.Set
+	)
+
+	// index the desired filters by their filter keys
+
+	desiredPortForwards := make(map[string]PortForward)
+	for _, pf := range desired.PortForwards {
+		desiredPortForwards[pf.key()] = pf
+	}
+	desiredTrafficForwards := make(map[string]TrafficForward)
+	for _, tf := range desired.TrafficForwards {
+		desiredTrafficForwards[tf.key()] = tf
+	}
+	desiredTrafficMarks := make(map[string]TrafficMark)
+	for _, tm := range desired.TrafficMarks {
+		desiredTrafficMarks[tm.key()] = tm
+	}
+
+	iifNames := make([]string, 0, len(desired.SecurityGroups))
+	for iifName := range desired.SecurityGroups {
+		iifNames = append(iifNames, iifName)
+	}
+	sort.Strings(iifNames)
+
+	sgKeys := []string{}
+	desiredSecurityGroups := make(map[string]appliedSecurityGroup)
+	for _, iifName := range iifNames {
+		for _, sg := range desired.SecurityGroups[iifName] {
+			if sgKey, _, err = sg.CreateSecurityGroupKeys(iifName); err != nil {
+				return nil, err
+			}
+			if _, ok = desiredSecurityGroups[sgKey]; !ok {
+				sgKeys = append(sgKeys, sgKey)
+			}
+			desiredSecurityGroups[sgKey] = appliedSecurityGroup{ sg: sg, iifName: iifName }
+		}
+	}
+
+	// remove installed filters that are not
+	// in the spec or that have changed
+
+	for key, pf := range r.portForwards {
+		if desiredPF, ok := desiredPortForwards[key]; !ok || !reflect.DeepEqual(desiredPF, pf) {
+			if err = r.queueDeleteFilter(b, key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for key, tf := range r.trafficForwards {
+		if desiredTF, ok := desiredTrafficForwards[key]; !ok || desiredTF != tf {
+			if err = r.queueDeleteFilter(b, key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for key, tm := range r.trafficMarks {
+		if desiredTM, ok := desiredTrafficMarks[key]; !ok || desiredTM != tm {
+			if err = r.queueDeleteFilter(b, key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for key, asg := range r.securityGroups {
+		if desiredSG, ok := desiredSecurityGroups[key]; !ok || !reflect.DeepEqual(desiredSG, asg) {
+			if touched, err = r.queueDeleteSecurityGroup(b, asg.sg, asg.iifName); err != nil {
+				return nil, err
+			}
+			vmapsTouched = append(vmapsTouched, touched...)
+		}
+	}
+
+	// reconcile ip lists
+
+	if err = r.queueIPListSpec(b, ipDenyListKey, append(ipPrefixes(desired.DenyList), desired.DenyPrefixes...)); err != nil {
+		return nil, err
+	}
+	if err = r.queueIPListSpec(b, ipAllowListKey, append(ipPrefixes(desired.AllowList), desired.AllowPrefixes...)); err != nil {
+		return nil, err
+	}
+
+	// add filters in the spec that are not installed
+	// in the order in which they appear in the spec
+
+	for _, sgKey = range sgKeys {
+		if _, ok = r.securityGroups[sgKey]; !ok {
+			asg := desiredSecurityGroups[sgKey]
+			if err = r.queueSecurityGroup(b, asg.sg, asg.iifName); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, pf := range desired.PortForwards {
+		if _, ok = r.portForwards[pf.key()]; !ok {
+			if _, err = r.queuePortForward(b, pf); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, tf := range desired.TrafficForwards {
+		if _, ok = r.trafficForwards[tf.key()]; !ok {
+			if _, err = r.queueTrafficForward(b, tf); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, tm := range desired.TrafficMarks {
+		if _, ok = r.trafficMarks[tm.key()]; !ok {
+			if _, err = r.queueTrafficMark(b, tm); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return vmapsTouched, nil
+}
+
+// queues the element changes required to make the permanent
+// ranges of the given list match the given prefixes and adds
+// or removes the rules that bind the list depending on whether
+// it is empty. timed ranges are not part of the spec so they
+// are only removed where they are covered by the spec.
+func (r *packetFilterRouter) queueIPListSpec(b *filterBatch, listKey string, prefixes []netip.Prefix) error {
+
+	var (
+		err  error
+		ok   bool
+		size int
+
+		desiredRanges [][]ipRange
+	)
+
+	if desiredRanges, err = prefixRanges(prefixes); err != nil {
+		return err
+	}
+	if size, err = r.queueIPListUpdate(listKey, func(i int, current []ipRange) []ipRange {
+		timed := []ipRange{}
+		for _, rg := range current {
+			if rg.ttl > 0 {
+				timed = append(timed, rg)
+			}
+		}
+		permanent := mergeIPRanges(desiredRanges[i])
+		return sortIPRanges(append(permanent, subtractIPRanges(timed, permanent)...))
+	}); err != nil {
+		return err
+	}
+
+	if size > 0 {
+		return r.queueIPListRules(b, listKey)
+	}
+	if _, ok = r.ruleMap[listKey]; ok {
+		return r.queueDeleteFilter(b, listKey)
+	}
+	return nil
+}
+
+// validates the filters in the spec so that invalid
+// filters are rejected before any changes are queued
+func (s FilterSpec) validate() error {
+
+	var validateProto = func(proto Protocol) error {
+		switch proto {
+		case ICMP, TCP, UDP:
+			return nil
+		default:
+			return fmt.Errorf("unsupported protocol: %s", string(proto))
+		}
+	}
+
+	for iifName, sgs := range s.SecurityGroups {
+		for _, sg := range sgs {
+			if sg.SrcNetwork.IsValid() && sg.DstNetwork.IsValid() && sg.SrcNetwork.Addr().Is4() != sg.DstNetwork.Addr().Is4() {
+				return fmt.Errorf(
+					"security group for interface '%s' cannot mix ipv4 and ipv6 types for SrcNetwork and DstNetwork: %+v",
+					iifName, sg,
+				)
+			}
+			for _, pg := range sg.Ports {
+				if err := validateProto(pg.Proto); err != nil {
+					return err
+				}
+			}
+			if err := sg.validateLimits(); err != nil {
+				return err
+			}
+		}
+	}
+	for _, pf := range s.PortForwards {
+		if err := pf.validate(); err != nil {
+			return err
+		}
+		if err := validateProto(pf.Proto); err != nil {
+			return err
+		}
+	}
+	for _, tf := range s.TrafficForwards {
+		if tf.SrcNetwork.Addr().BitLen() != tf.DstNetwork.Addr().BitLen() {
+			return fmt.Errorf("traffic forward between incompatible network address spaces: %+v", tf)
+		}
+		if err := tf.validateSnat(); err != nil {
+			return err
+		}
+	}
+	for _, tm := range s.TrafficMarks {
+		if err := tm.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+//go:build linux
+
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+
+	"github.com/mevansam/goutils/logger"
+)
+
+// the filter specs of a router that are saved to
+// the state file so that a new router instance can
+// adopt the nftables tables of a previous instance
+type savedFilterState struct {
+	SecurityGroups  []savedSecurityGroup `json:"securityGroups"`
+	PortForwards    []PortForward        `json:"portForwards"`
+	TrafficForwards []TrafficForward     `json:"trafficForwards"`
+	TrafficMarks    []TrafficMark        `json:"trafficMarks"`
+
+	IPRangeTTLs map[string]time.Duration `json:"ipRangeTTLs,omitempty"`
+}
+
+type savedSecurityGroup struct {
+	IifName       string        `json:"iifName"`
+	SecurityGroup SecurityGroup `json:"securityGroup"`
+}
+
+// reads the state saved by a previous instance of the
+// router. if the router's tables exist but the saved
+// state cannot be read the tables are returned as stale
+// as the filters they contain can no longer be managed.
+func (r *packetFilterRouter) readSavedState() (*savedFilterState, []*nftables.Table, error) {
+
+	var (
+		err error
+
+		tables []*nftables.Table
+		data   []byte
+	)
+
+	existingTables := []*nftables.Table{}
+	for _, family := range []nftables.TableFamily{ nftables.TableFamilyIPv4, nftables.TableFamilyIPv6 } {
+		if tables, err = r.nft.ListTablesOfFamily(family); err != nil {
+			return nil, nil, err
+		}
+		for _, table := range tables {
+			if table.Name == "mycs_router_ipv4" || table.Name == "mycs_router_ipv6" {
+				existingTables = append(existingTables, table)
+			}
+		}
+	}
+	if len(existingTables) == 0 {
+		// no tables to adopt so any saved state is stale
+		if len(FilterRouterStateFile) > 0 && !r.dryRun {
+			os.Remove(FilterRouterStateFile)
+		}
+		return nil, nil, nil
+	}
+	if len(FilterRouterStateFile) == 0 {
+		return nil, existingTables, nil
+	}
+
+	if data, err = os.ReadFile(FilterRouterStateFile); err != nil {
+		logger.ErrorMessage(
+			"packetFilterRouter.readSavedState(): Unable to read saved state for existing router tables from '%s'. The tables will be recreated: %s",
+			FilterRouterStateFile, err.Error(),
+		)
+		return nil, existingTables, nil
+	}
+	state := &savedFilterState{}
+	if err = json.Unmarshal(data, state); err != nil {
+		logger.ErrorMessage(
+			"packetFilterRouter.readSavedState(): Unable to parse saved state for existing router tables from '%s'. The tables will be recreated: %s",
+			FilterRouterStateFile, err.Error(),
+		)
+		return nil, existingTables, nil
+	}
+	if len(existingTables) != 2 {
+		logger.ErrorMessage(
+			"packetFilterRouter.readSavedState(): Only %d of the router's tables exist so they will be recreated.",
+			len(existingTables),
+		)
+		return nil, existingTables, nil
+	}
+	return state, nil, nil
+}
+
+// returns the router's tables if their ip lists were created
+// by an older version of the router which did not create the
+// lists as interval sets with element timeouts. as the flags
+// of a set cannot be changed the tables need to be recreated
+// so the entries of the lists are returned as ranges that can
+// be added to the new lists.
+func (r *packetFilterRouter) readOutdatedIPLists() ([]*nftables.Table, map[string][][]ipRange, error) {
+
+	var (
+		err error
+
+		sets  []*nftables.Set
+		elems []setElement
+	)
+
+	outdated := false
+	ipLists := map[string][][]ipRange{
+		ipDenyListKey:  make([][]ipRange, 2),
+		ipAllowListKey: make([][]ipRange, 2),
+	}
+	tables := []*nftables.Table{
+		{ Family: nftables.TableFamilyIPv4, Name: "mycs_router_ipv4" },
+		{ Family: nftables.TableFamilyIPv6, Name: "mycs_router_ipv6" },
+	}
+	for i, table := range tables {
+		if sets, err = r.nft.GetSets(table); err != nil {
+			return nil, nil, err
+		}
+		for _, set := range sets {
+			if set.Name != ipDenyListKey && set.Name != ipAllowListKey {
+				continue
+			}
+			if !set.Interval || !set.HasTimeout {
+				outdated = true
+			}
+			set.Table = table
+			if elems, err = r.nft.getSetElements(set); err != nil {
+				return nil, nil, err
+			}
+			if set.Interval {
+				ipLists[set.Name][i] = ipSetElementRanges(elems)
+				continue
+			}
+			// the elements of lists that are not
+			// interval sets are single addresses
+			permanent, timed := []ipRange{}, []ipRange{}
+			for _, elem := range elems {
+				if addr, ok := netip.AddrFromSlice(elem.key); ok {
+					rg := ipRange{
+						start:     addr,
+						end:       addr,
+						ttl:       elem.timeout,
+						remaining: elem.expiration,
+					}
+					if rg.ttl == 0 {
+						permanent = append(permanent, rg)
+					} else {
+						timed = append(timed, rg)
+					}
+				}
+			}
+			ipLists[set.Name][i] = sortIPRanges(append(mergeIPRanges(permanent), timed...))
+		}
+	}
+	if !outdated {
+		return nil, nil, nil
+	}
+	logger.ErrorMessage(
+		"packetFilterRouter.readOutdatedIPLists(): The router's ip lists were created by an older version of the router so the tables will be recreated.",
+	)
+	return tables, ipLists, nil
+}
+
+// re-applies the saved filter specs to the adopted tables.
+// as the rules of the specs already exist they are only
+// matched to rebuild the key to rule mapping. any rules
+// that have gone missing are recreated. the given ip list
+// ranges are added to the lists which are bound to the
+// pre-routing chains if they are not empty.
+func (r *packetFilterRouter) restoreSavedState(state *savedFilterState, ipLists map[string][][]ipRange) error {
+
+	var (
+		err  error
+		size int
+	)
+
+	b := r.newFilterBatch()
+	for _, ssg := range state.SecurityGroups {
+		if err = r.queueSecurityGroup(b, ssg.SecurityGroup, ssg.IifName); err != nil {
+			logger.ErrorMessage(
+				"packetFilterRouter.restoreSavedState(): Skipping saved security group %# v: %s",
+				ssg.SecurityGroup, err.Error(),
+			)
+		}
+	}
+	for _, pf := range state.PortForwards {
+		if _, err = r.queuePortForward(b, pf); err != nil {
+			r.discardFilterBatch(b)
+			return err
+		}
+	}
+	for _, tf := range state.TrafficForwards {
+		if _, err = r.queueTrafficForward(b, tf); err != nil {
+			r.discardFilterBatch(b)
+			return err
+		}
+	}
+	for _, tm := range state.TrafficMarks {
+		if _, err = r.queueTrafficMark(b, tm); err != nil {
+			r.discardFilterBatch(b)
+			return err
+		}
+	}
+	// ip lists are bound to the pre-routing
+	// chains only if they have elements
+	if state.IPRangeTTLs != nil {
+		r.ipRangeTTLs = state.IPRangeTTLs
+	}
+	for _, listKey := range []string{ ipDenyListKey, ipAllowListKey } {
+		if size, err = r.queueIPListUpdate(listKey, func(i int, current []ipRange) []ipRange {
+			if ipLists == nil {
+				return current
+			}
+			return append(current, ipLists[listKey][i]...)
+		}); err != nil {
+			r.discardFilterBatch(b)
+			return err
+		}
+		if size > 0 {
+			if err = r.queueIPListRules(b, listKey); err != nil {
+				r.discardFilterBatch(b)
+				return err
+			}
+		}
+	}
+	return r.commitFilterBatch(b)
+}
+
+// saves the router's filter specs to the state file
+func (r *packetFilterRouter) writeSavedState() {
+
+	var (
+		err error
+
+		data []byte
+	)
+
+	if len(FilterRouterStateFile) == 0 || r.dryRun {
+		return
+	}
+
+	state := savedFilterState{
+		SecurityGroups:  []savedSecurityGroup{},
+		PortForwards:    []PortForward{},
+		TrafficForwards: []TrafficForward{},
+		TrafficMarks:    []TrafficMark{},
+		IPRangeTTLs:     r.ipRangeTTLs,
+	}
+	for _, key := range sortedKeys(r.securityGroups) {
+		asg := r.securityGroups[key]
+		state.SecurityGroups = append(state.SecurityGroups,
+			savedSecurityGroup{
+				IifName:       asg.iifName,
+				SecurityGroup: asg.sg,
+			},
+		)
+	}
+	for _, key := range sortedKeys(r.portForwards) {
+		state.PortForwards = append(state.PortForwards, r.portForwards[key])
+	}
+	for _, key := range sortedKeys(r.trafficForwards) {
+		state.TrafficForwards = append(state.TrafficForwards, r.trafficForwards[key])
+	}
+	for _, key := range sortedKeys(r.trafficMarks) {
+		state.TrafficMarks = append(state.TrafficMarks, r.trafficMarks[key])
+	}
+
+	if data, err = json.MarshalIndent(state, "", "  "); err != nil {
+		logger.ErrorMessage("packetFilterRouter.writeSavedState(): Failed to serialize router state: %s", err.Error())
+		return
+	}
+	// write to a temporary file and rename it
+	// so the state file is replaced atomically
+	if err = os.MkdirAll(filepath.Dir(FilterRouterStateFile), 0700); err == nil {
+		tmpFile := FilterRouterStateFile + ".tmp"
+		if err = os.WriteFile(tmpFile, data, 0600); err == nil {
+			err = os.Rename(tmpFile, FilterRouterStateFile)
+		}
+	}
+	if err != nil {
+		logger.ErrorMessage(
+			"packetFilterRouter.writeSavedState(): Failed to save router state to '%s': %s",
+			FilterRouterStateFile, err.Error(),
+		)
+	}
+}
+
+// returns the handle of the ct state rule in the given rules
+func findCtStateRuleHandle(rules []*nftables.Rule) (uint64, error) {
+	for _, rule := range rules {
+		if len(rule.Exprs) > 0 {
+			if ct, ok := rule.Exprs[0].(*expr.Ct); ok && ct.Key == expr.CtKeySTATE {
+				return rule.Handle, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("ct state rule not found in chain")
+}
+
+// returns the keys of a map in sorted order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,115 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// Returns the packets and bytes matched by the rules
+// of each filter keyed by the filter's key. The keys
+// are the same as those returned when the filters are
+// created and by SecurityGroup.CreateSecurityGroupKeys.
+func (r *packetFilterRouter) Stats() (map[string]FilterStats, error) {
+
+	var (
+		err error
+		ok  bool
+
+		chainRules []*nftables.Rule
+	)
+
+	if r.table == nil {
+		return nil, fmt.Errorf("packet filter router has not been initialized")
+	}
+
+	// retrieve the counters of the rules in
+	// each chain referenced by the filters
+	counters := make(map[string]*expr.Counter)
+	chainsRead := make(map[string]bool)
+	for _, rules := range r.ruleMap {
+		for _, rule := range rules {
+			chainKey := rule.Table.Name + "/" + rule.Chain.Name
+			if chainsRead[chainKey] {
+				continue
+			}
+			chainsRead[chainKey] = true
+
+			if chainRules, err = r.nft.GetRules(rule.Table, rule.Chain); err != nil {
+				return nil, err
+			}
+			for _, chainRule := range chainRules {
+				for _, e := range chainRule.Exprs {
+					if counter, isCounter := e.(*expr.Counter); isCounter {
+						counters[ruleRefKey(chainRule)] = counter
+						break
+					}
+				}
+			}
+		}
+	}
+
+	stats := make(map[string]FilterStats)
+	for key, rules := range r.ruleMap {
+		filterStats := FilterStats{}
+		for _, rule := range rules {
+			var counter *expr.Counter
+			if counter, ok = counters[ruleRefKey(rule)]; ok {
+				filterStats.Packets += counter.Packets
+				filterStats.Bytes += counter.Bytes
+			}
+		}
+		stats[key] = filterStats
+	}
+	return stats, nil
+}
+
+// returns a copy of the given rule expressions with a
+// counter added before the rule's final statement. the
+// counter is placed ahead of any register loads that
+// the statement depends on such as the keys of a vmap
+// lookup or the addresses of a nat statement.
+func withCounter(exprs []expr.Any) []expr.Any {
+
+	for _, e := range exprs {
+		if _, ok := e.(*expr.Counter); ok {
+			return exprs
+		}
+	}
+	n := len(exprs)
+	if n == 0 {
+		return exprs
+	}
+	// packets matched by drop log rules are
+	// counted by the drop rule that follows
+	if _, ok := exprs[n-1].(*expr.Log); ok {
+		return exprs
+	}
+	pos := n-1
+	for pos > 0 {
+		switch exprs[pos-1].(type) {
+		case *expr.Payload, *expr.Meta, *expr.Immediate:
+			pos--
+			continue
+		}
+		break
+	}
+	counted := make([]expr.Any, 0, n+1)
+	counted = append(counted, exprs[:pos]...)
+	counted = append(counted, &expr.Counter{})
+	counted = append(counted, exprs[pos:]...)
+	return counted
+}
+
+// returns the expression to use when matching rules.
+// counters are reset as their values change with
+// the traffic matched by a rule.
+func matchExpr(e expr.Any) expr.Any {
+	if _, ok := e.(*expr.Counter); ok {
+		return &expr.Counter{}
+	}
+	return e
+}
@@ -0,0 +1,330 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// timeout of a probe if the context
+// it is run with has no deadline
+var ProbeTimeout = 5 * time.Second
+
+type ProbeType string
+
+const (
+	ProbeTCP  ProbeType = "tcp"
+	ProbeTLS  ProbeType = "tls"
+	ProbeHTTP ProbeType = "http"
+	ProbeUDP  ProbeType = "udp"
+)
+
+// result of a reachability probe
+type ProbeResult struct {
+	Type   ProbeType `json:"type"`
+	Target string    `json:"target"`
+
+	// whether the target was reachable
+	Success bool `json:"success"`
+	// tcp connect time or the round trip
+	// time of the udp echo or http request
+	Latency time.Duration `json:"latency"`
+	// the reason the probe failed
+	Error string `json:"error,omitempty"`
+
+	// tls handshake details of tls probes
+	TLS *TLSProbeInfo `json:"tls,omitempty"`
+
+	// response details of http probes
+	HTTPStatus int    `json:"httpStatus,omitempty"`
+	Location   string `json:"location,omitempty"`
+}
+
+// details of the tls handshake and
+// the certificate presented by the server
+type TLSProbeInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipherSuite"`
+	// time taken by the tls handshake
+	HandshakeTime time.Duration `json:"handshakeTime"`
+
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dnsNames,omitempty"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+
+	// whether the certificate chain was verified and
+	// the reason verification failed if it was not
+	Verified    bool   `json:"verified"`
+	VerifyError string `json:"verifyError,omitempty"`
+}
+
+// probes the given tcp port by connecting to it
+func ProbeTCPConnect(ctx context.Context, host string, port int) *ProbeResult {
+
+	ctx, cancel := probeContext(ctx)
+	defer cancel()
+
+	result := &ProbeResult{
+		Type:   ProbeTCP,
+		Target: net.JoinHostPort(host, strconv.Itoa(port)),
+	}
+	conn, err := result.dial(ctx, "tcp")
+	if err != nil {
+		return result
+	}
+	conn.Close()
+	result.Success = true
+	return result
+}
+
+// probes the tls server at the given port. the server's
+// certificate chain is verified against the root cas of
+// the given tls configuration or the host's roots if it
+// is nil. the details of the certificate presented by the
+// server are returned even if it could not be verified.
+func ProbeTLSHandshake(ctx context.Context, host string, port int, config *tls.Config) *ProbeResult {
+
+	var (
+		err error
+
+		conn net.Conn
+	)
+
+	ctx, cancel := probeContext(ctx)
+	defer cancel()
+
+	result := &ProbeResult{
+		Type:   ProbeTLS,
+		Target: net.JoinHostPort(host, strconv.Itoa(port)),
+	}
+	if conn, err = result.dial(ctx, "tcp"); err != nil {
+		return result
+	}
+	defer conn.Close()
+
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if len(config.ServerName) == 0 {
+		config.ServerName = host
+	}
+	// the chain is verified after the handshake so
+	// that the certificate details can be returned
+	// when the certificate is not trusted
+	roots := config.RootCAs
+	config.InsecureSkipVerify = true
+
+	tlsConn := tls.Client(conn, config)
+	start := time.Now()
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		result.Error = fmt.Sprintf("tls handshake failed: %s", err.Error())
+		return result
+	}
+	state := tlsConn.ConnectionState()
+	leaf := state.PeerCertificates[0]
+
+	info := &TLSProbeInfo{
+		Version:       tls.VersionName(state.Version),
+		CipherSuite:   tls.CipherSuiteName(state.CipherSuite),
+		HandshakeTime: time.Since(start),
+
+		Subject:   leaf.Subject.String(),
+		Issuer:    leaf.Issuer.String(),
+		DNSNames:  leaf.DNSNames,
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+	}
+	result.TLS = info
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       config.ServerName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	}); err != nil {
+		info.VerifyError = err.Error()
+		result.Error = fmt.Sprintf("certificate verification failed: %s", err.Error())
+		return result
+	}
+	info.Verified = true
+	result.Success = true
+	return result
+}
+
+// probes the given url by sending a get request and returns
+// the status of the response. redirects are not followed.
+// the probe succeeds if the response status is not an error.
+func ProbeHTTPGet(ctx context.Context, url string, client *http.Client) *ProbeResult {
+	result, _ := probeHTTPGet(ctx, url, client, 0)
+	return result
+}
+
+// probes the given url and returns up to
+// the given number of bytes of the response
+func probeHTTPGet(ctx context.Context, url string, client *http.Client, bodyLimit int64) (*ProbeResult, []byte) {
+
+	var (
+		err error
+
+		request  *http.Request
+		response *http.Response
+		body     []byte
+	)
+
+	ctx, cancel := probeContext(ctx)
+	defer cancel()
+
+	result := &ProbeResult{
+		Type:   ProbeHTTP,
+		Target: url,
+	}
+	if request, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil); err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+
+	probeClient := &http.Client{}
+	if client != nil {
+		*probeClient = *client
+	}
+	probeClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	start := time.Now()
+	if response, err = probeClient.Do(request); err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+	defer response.Body.Close()
+	result.Latency = time.Since(start)
+
+	result.HTTPStatus = response.StatusCode
+	result.Location = response.Header.Get("Location")
+	if bodyLimit > 0 {
+		if body, err = io.ReadAll(io.LimitReader(response.Body, bodyLimit)); err != nil {
+			result.Error = fmt.Sprintf("error reading response: %s", err.Error())
+			return result, nil
+		}
+	}
+	if response.StatusCode >= 400 {
+		result.Error = fmt.Sprintf("server responded with '%s'", response.Status)
+		return result, body
+	}
+	result.Success = true
+	return result, body
+}
+
+// probes the given udp port by sending the payload and waiting
+// for the server to echo it back. a random payload is sent if
+// none is given.
+func ProbeUDPEcho(ctx context.Context, host string, port int, payload []byte) *ProbeResult {
+
+	var (
+		err error
+
+		conn net.Conn
+		n    int
+	)
+
+	ctx, cancel := probeContext(ctx)
+	defer cancel()
+
+	result := &ProbeResult{
+		Type:   ProbeUDP,
+		Target: net.JoinHostPort(host, strconv.Itoa(port)),
+	}
+	if len(payload) == 0 {
+		payload = make([]byte, 16)
+		if _, err = rand.Read(payload); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	}
+	if conn, err = result.dial(ctx, "udp"); err != nil {
+		return result
+	}
+	defer conn.Close()
+
+	// unblock the read if the
+	// context is cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	start := time.Now()
+	if _, err = conn.Write(payload); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	buffer := make([]byte, len(payload)+1)
+	for {
+		if n, err = conn.Read(buffer); err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			result.Error = fmt.Sprintf("no echo received: %s", err.Error())
+			return result
+		}
+		// ignore datagrams that are not the echo
+		if bytes.Equal(buffer[:n], payload) {
+			break
+		}
+	}
+	result.Latency = time.Since(start)
+	result.Success = true
+	return result
+}
+
+// returns a human readable summary of the result
+func (r *ProbeResult) String() string {
+	if r.Success {
+		return fmt.Sprintf("%s probe of %s succeeded in %s", r.Type, r.Target, r.Latency)
+	}
+	return fmt.Sprintf("%s probe of %s failed: %s", r.Type, r.Target, r.Error)
+}
+
+// connects to the target of the probe and
+// records the connect time or the error
+func (r *ProbeResult) dial(ctx context.Context, network string) (net.Conn, error) {
+
+	dialer := &net.Dialer{}
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, network, r.Target)
+	if err != nil {
+		r.Error = err.Error()
+		return nil, err
+	}
+	r.Latency = time.Since(start)
+	return conn, nil
+}
+
+// returns the given context with the probe
+// timeout if it does not have a deadline
+func probeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, ProbeTimeout)
+}
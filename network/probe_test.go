@@ -0,0 +1,125 @@
+package network_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+
+	"github.com/mevansam/goutils/network"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reachability Probes", func() {
+
+	hostPort := func(addr net.Addr) (string, int) {
+		host, port, err := net.SplitHostPort(addr.String())
+		Expect(err).ToNot(HaveOccurred())
+		p, err := strconv.Atoi(port)
+		Expect(err).ToNot(HaveOccurred())
+		return host, p
+	}
+
+	It("probes tcp ports", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		host, port := hostPort(listener.Addr())
+
+		result := network.ProbeTCPConnect(context.Background(), host, port)
+		Expect(result.Success).To(BeTrue())
+		Expect(result.Latency).To(BeNumerically(">", 0))
+
+		listener.Close()
+		result = network.ProbeTCPConnect(context.Background(), host, port)
+		Expect(result.Success).To(BeFalse())
+		Expect(result.Error).To(ContainSubstring("refused"))
+	})
+
+	It("probes tls servers and returns the server's certificate details", func() {
+		server := httptest.NewTLSServer(http.NotFoundHandler())
+		defer server.Close()
+		host, port := hostPort(server.Listener.Addr())
+
+		// the test server's certificate is
+		// not trusted by the host's roots
+		result := network.ProbeTLSHandshake(context.Background(), host, port, nil)
+		Expect(result.Success).To(BeFalse())
+		Expect(result.TLS).ToNot(BeNil())
+		Expect(result.TLS.Verified).To(BeFalse())
+		Expect(result.TLS.VerifyError).To(ContainSubstring("unknown authority"))
+		Expect(result.TLS.DNSNames).To(ContainElement("example.com"))
+
+		roots := x509.NewCertPool()
+		roots.AddCert(server.Certificate())
+		result = network.ProbeTLSHandshake(context.Background(), host, port, &tls.Config{ RootCAs: roots })
+		Expect(result.Success).To(BeTrue())
+		Expect(result.TLS.Verified).To(BeTrue())
+		Expect(result.TLS.Version).To(Equal("TLS 1.3"))
+		Expect(result.TLS.NotAfter).To(BeTemporally(">", time.Now()))
+	})
+
+	It("probes urls and returns the response status", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/ok":
+				w.WriteHeader(http.StatusNoContent)
+			case "/redirect":
+				http.Redirect(w, r, "http://portal.example/login", http.StatusFound)
+			default:
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer server.Close()
+
+		result := network.ProbeHTTPGet(context.Background(), server.URL + "/ok", nil)
+		Expect(result.Success).To(BeTrue())
+		Expect(result.HTTPStatus).To(Equal(http.StatusNoContent))
+
+		result = network.ProbeHTTPGet(context.Background(), server.URL + "/redirect", nil)
+		Expect(result.Success).To(BeTrue())
+		Expect(result.HTTPStatus).To(Equal(http.StatusFound))
+		Expect(result.Location).To(Equal("http://portal.example/login"))
+
+		result = network.ProbeHTTPGet(context.Background(), server.URL + "/unavailable", nil)
+		Expect(result.Success).To(BeFalse())
+		Expect(result.HTTPStatus).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("probes udp echo servers and times out when cancelled", func() {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		host, port := hostPort(conn.LocalAddr())
+
+		echo := make(chan bool, 1)
+		go func() {
+			buffer := make([]byte, 512)
+			for {
+				n, addr, err := conn.ReadFrom(buffer)
+				if err != nil {
+					return
+				}
+				if <-echo {
+					conn.WriteTo(buffer[:n], addr)
+				}
+			}
+		}()
+
+		echo <- true
+		result := network.ProbeUDPEcho(context.Background(), host, port, nil)
+		Expect(result.Success).To(BeTrue())
+
+		echo <- false
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100 * time.Millisecond, cancel)
+		result = network.ProbeUDPEcho(ctx, host, port, []byte("ping"))
+		Expect(result.Success).To(BeFalse())
+		Expect(result.Error).To(ContainSubstring("context canceled"))
+	})
+})
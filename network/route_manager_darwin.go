@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mevansam/goutils/logger"
 )
@@ -105,11 +107,12 @@ func (m *routeManager) NewRoutableInterface(ifaceName, address string) (Routable
 		return nil, err
 	}
 	return &routableInterface{
+		ifaceName:      ifaceName,
 		gatewayAddress: gatewayAddress,
 	}, nil
 }
 
-func (m *routeManager) NewFilterRouter(denyAll bool) (FilterRouter, error) {
+func (m *routeManager) NewFilterRouter(denyAll bool, options ...FilterRouterOption) (FilterRouter, error) {
 	return nil, fmt.Errorf("filter router has not been implemented for darwin os")
 }
 
@@ -143,6 +146,42 @@ func (m *routeManager) AddDefaultRoute(gateway string) error {
 	return addDefaultRoute(gateway)
 }
 
+func (m *routeManager) CreateTunInterface(ifaceName string) (string, error) {
+	return "", fmt.Errorf("creating interfaces has not been implemented for darwin os")
+}
+
+func (m *routeManager) CreateWireguardInterface(ifaceName string, config WireguardConfig) (string, error) {
+	return "", fmt.Errorf("creating interfaces has not been implemented for darwin os")
+}
+
+func (m *routeManager) ConfigureWireguardInterface(ifaceName string, config WireguardConfig) error {
+	return fmt.Errorf("creating interfaces has not been implemented for darwin os")
+}
+
+func (m *routeManager) DeleteInterface(ifaceName string) error {
+	return fmt.Errorf("creating interfaces has not been implemented for darwin os")
+}
+
+func (m *routeManager) AddRoutingRule(rule RoutingRule) error {
+	return fmt.Errorf("policy based routing has not been implemented for darwin os")
+}
+
+func (m *routeManager) DeleteRoutingRule(rule RoutingRule) error {
+	return fmt.Errorf("policy based routing has not been implemented for darwin os")
+}
+
+func (m *routeManager) AddTableRoute(route TableRoute) error {
+	return fmt.Errorf("policy based routing has not been implemented for darwin os")
+}
+
+func (m *routeManager) DeleteTableRoute(route TableRoute) error {
+	return fmt.Errorf("policy based routing has not been implemented for darwin os")
+}
+
+func (m *routeManager) AddRoutesToNames(names []string, ifaceName string, refresh time.Duration) (NamedRoutes, error) {
+	return nil, fmt.Errorf("routes to names have not been implemented for darwin os")
+}
+
 func (m *routeManager) Clear() {
 	
 	var (
@@ -178,6 +217,21 @@ func (i *routableInterface) Address6() (string, string, error) {
 	return "", "", nil
 }
 
+func (i *routableInterface) MTU() (int, error) {
+	iface, err := net.InterfaceByName(i.ifaceName)
+	if err != nil {
+		return 0, err
+	}
+	return iface.MTU, nil
+}
+
+func (i *routableInterface) SetMTU(mtu int) error {
+	if err := validateMTU(mtu); err != nil {
+		return err
+	}
+	return ifconfig.Run([]string{ i.ifaceName, "mtu", strconv.Itoa(mtu) })
+}
+
 func (i *routableInterface) MakeDefaultRoute() error {
 	return addDefaultRoute(i.gatewayAddress)
 }
@@ -0,0 +1,226 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/mevansam/goutils/logger"
+)
+
+func (m *routeManager) CreateTunInterface(ifaceName string) (string, error) {
+
+	var (
+		err error
+	)
+
+	if ifaceName, err = newInterfaceName(ifaceName, "tun"); err != nil {
+		return "", err
+	}
+	// the tun device is persistent so that
+	// the process that handles its packets
+	// can attach to it by name
+	link := &netlink.Tuntap{
+		LinkAttrs: netlink.LinkAttrs{ Name: ifaceName },
+		Mode:      netlink.TUNTAP_MODE_TUN,
+		Flags:     netlink.TUNTAP_DEFAULTS | netlink.TUNTAP_NO_PI,
+	}
+	if err = m.addLink(link); err != nil {
+		return "", err
+	}
+	return ifaceName, nil
+}
+
+func (m *routeManager) CreateWireguardInterface(ifaceName string, config WireguardConfig) (string, error) {
+
+	var (
+		err error
+
+		wgConfig wgtypes.Config
+	)
+
+	// validate the configuration before
+	// the interface is created
+	if wgConfig, err = config.wgConfig(); err != nil {
+		return "", err
+	}
+	if ifaceName, err = newInterfaceName(ifaceName, "wg"); err != nil {
+		return "", err
+	}
+	link := &netlink.GenericLink{
+		LinkAttrs: netlink.LinkAttrs{ Name: ifaceName },
+		LinkType:  "wireguard",
+	}
+	if err = m.addLink(link); err != nil {
+		return "", err
+	}
+	if err = configureWireguardDevice(ifaceName, wgConfig); err != nil {
+		m.DeleteInterface(ifaceName)
+		return "", err
+	}
+	return ifaceName, nil
+}
+
+func (m *routeManager) ConfigureWireguardInterface(ifaceName string, config WireguardConfig) error {
+
+	var (
+		err error
+
+		wgConfig wgtypes.Config
+	)
+
+	if wgConfig, err = config.wgConfig(); err != nil {
+		return err
+	}
+	return configureWireguardDevice(ifaceName, wgConfig)
+}
+
+func (m *routeManager) DeleteInterface(ifaceName string) error {
+
+	var (
+		err error
+
+		link netlink.Link
+	)
+
+	for i, name := range m.nc.createdLinks {
+		if name == ifaceName {
+			if link, err = netlink.LinkByName(ifaceName); err != nil {
+				return err
+			}
+			if err = netlink.LinkDel(link); err != nil {
+				return fmt.Errorf("unable to delete interface '%s': %s", ifaceName, err.Error())
+			}
+			m.nc.createdLinks = append(m.nc.createdLinks[:i], m.nc.createdLinks[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("interface '%s' was not created by the route manager", ifaceName)
+}
+
+// deletes all interfaces created by the route manager
+func (m *routeManager) deleteCreatedLinks() {
+
+	for _, ifaceName := range append([]string{}, m.nc.createdLinks...) {
+		if err := m.DeleteInterface(ifaceName); err != nil {
+			logger.ErrorMessage(
+				"routeManager.Clear(): Unable to delete interface '%s': %s",
+				ifaceName, err.Error())
+		}
+	}
+	m.nc.createdLinks = nil
+}
+
+// adds the link, brings it up and records
+// it so that it is deleted on clear
+func (m *routeManager) addLink(link netlink.Link) error {
+
+	var (
+		err error
+	)
+
+	ifaceName := link.Attrs().Name
+	if err = netlink.LinkAdd(link); err != nil {
+		return fmt.Errorf("unable to create interface '%s': %s", ifaceName, err.Error())
+	}
+	m.nc.createdLinks = append(m.nc.createdLinks, ifaceName)
+
+	if err = netlink.LinkSetUp(link); err != nil {
+		m.DeleteInterface(ifaceName)
+		return fmt.Errorf("unable to bring up interface '%s': %s", ifaceName, err.Error())
+	}
+	return nil
+}
+
+// returns the given interface name or the
+// next available one with the given prefix
+func newInterfaceName(ifaceName, prefix string) (string, error) {
+	if len(ifaceName) > 0 {
+		return ifaceName, nil
+	}
+	return GetNextAvailabeInterface(prefix)
+}
+
+func configureWireguardDevice(ifaceName string, wgConfig wgtypes.Config) error {
+
+	var (
+		err error
+
+		client *wgctrl.Client
+	)
+
+	if client, err = wgctrl.New(); err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err = client.ConfigureDevice(ifaceName, wgConfig); err != nil {
+		return fmt.Errorf("unable to configure wireguard interface '%s': %s", ifaceName, err.Error())
+	}
+	return nil
+}
+
+// returns the wgctrl configuration of the interface
+func (config WireguardConfig) wgConfig() (wgtypes.Config, error) {
+
+	var (
+		err error
+
+		key wgtypes.Key
+	)
+
+	wgConfig := wgtypes.Config{
+		ReplacePeers: true,
+		Peers:        []wgtypes.PeerConfig{},
+	}
+	if key, err = wgtypes.ParseKey(config.PrivateKey); err != nil {
+		return wgConfig, fmt.Errorf("invalid wireguard private key: %s", err.Error())
+	}
+	wgConfig.PrivateKey = &key
+	if config.ListenPort != 0 {
+		if config.ListenPort < 0 || config.ListenPort > 0xffff {
+			return wgConfig, fmt.Errorf("invalid wireguard listen port: %d", config.ListenPort)
+		}
+		listenPort := config.ListenPort
+		wgConfig.ListenPort = &listenPort
+	}
+
+	for _, peer := range config.Peers {
+		peerConfig := wgtypes.PeerConfig{
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        []net.IPNet{},
+		}
+		if peerConfig.PublicKey, err = wgtypes.ParseKey(peer.PublicKey); err != nil {
+			return wgConfig, fmt.Errorf("invalid wireguard peer public key: %s", err.Error())
+		}
+		if len(peer.PresharedKey) > 0 {
+			if key, err = wgtypes.ParseKey(peer.PresharedKey); err != nil {
+				return wgConfig, fmt.Errorf("invalid wireguard peer preshared key: %s", err.Error())
+			}
+			presharedKey := key
+			peerConfig.PresharedKey = &presharedKey
+		}
+		if len(peer.Endpoint) > 0 {
+			if peerConfig.Endpoint, err = net.ResolveUDPAddr("udp", peer.Endpoint); err != nil {
+				return wgConfig, fmt.Errorf("invalid wireguard peer endpoint '%s': %s", peer.Endpoint, err.Error())
+			}
+		}
+		for _, prefix := range peer.AllowedIPs {
+			if !prefix.IsValid() {
+				return wgConfig, fmt.Errorf("invalid wireguard peer allowed ip: %s", prefix)
+			}
+			peerConfig.AllowedIPs = append(peerConfig.AllowedIPs, *prefixIPNet(prefix.Masked()))
+		}
+		if peer.PersistentKeepalive > 0 {
+			keepalive := peer.PersistentKeepalive
+			peerConfig.PersistentKeepaliveInterval = &keepalive
+		}
+		wgConfig.Peers = append(wgConfig.Peers, peerConfig)
+	}
+	return wgConfig, nil
+}
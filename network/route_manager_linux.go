@@ -18,8 +18,11 @@ type routeManager struct {
 }
 
 type routableInterface struct {
-	link           netlink.Link
-	gatewayAddress net.IP
+	link netlink.Link
+
+	// ipv4 and ipv6 gateways
+	gatewayAddress  net.IP
+	gatewayAddress6 net.IP
 
 	m *routeManager
 }
@@ -41,19 +44,26 @@ func (m *routeManager) GetDefaultInterface() (RoutableInterface, error) {
 	)
 	itf := routableInterface{m:m}
 
-	if Network.DefaultIPv4Route != nil {
-		if itf.link, err = netlink.LinkByName(Network.DefaultIPv4Route.InterfaceName); err != nil {
+	defaultIPv4Route, defaultIPv6Route := defaultRoutes()
+	if defaultIPv4Route != nil {
+		if itf.link, err = netlink.LinkByName(defaultIPv4Route.InterfaceName); err != nil {
 			return nil, err
 		}
-		itf.gatewayAddress = Network.DefaultIPv4Route.GatewayIP.AsSlice()
-
-	} else if Network.DefaultIPv6Route != nil {
-		if itf.link, err = netlink.LinkByName(Network.DefaultIPv6Route.InterfaceName); err != nil {
-			return nil, err
+		itf.gatewayAddress = defaultIPv4Route.GatewayIP.AsSlice()
+	}
+	if defaultIPv6Route != nil {
+		if itf.link == nil {
+			if itf.link, err = netlink.LinkByName(defaultIPv6Route.InterfaceName); err != nil {
+				return nil, err
+			}
 		}
-		itf.gatewayAddress = Network.DefaultIPv6Route.GatewayIP.AsSlice()
-
-	} else {
+		// the ipv6 default route may be
+		// via a different interface
+		if itf.link.Attrs().Name == defaultIPv6Route.InterfaceName {
+			itf.gatewayAddress6 = defaultIPv6Route.GatewayIP.AsSlice()
+		}
+	}
+	if itf.link == nil {
 		return nil, fmt.Errorf("default interface not found")
 	}
 	return &itf, nil
@@ -70,31 +80,13 @@ func (m *routeManager) GetRoutableInterface(ifaceName string) (RoutableInterface
 		return nil, err
 	}
 
-	// default interface
-	if Network.DefaultIPv4Route != nil &&
-		Network.DefaultIPv4Route.InterfaceName == ifaceName {
-
-		itf.gatewayAddress = Network.DefaultIPv4Route.GatewayIP.AsSlice()
-		return &itf, nil
-	}
-	if Network.DefaultIPv6Route != nil &&
-		Network.DefaultIPv6Route.InterfaceName == ifaceName {
-
-		itf.gatewayAddress = Network.DefaultIPv6Route.GatewayIP.AsSlice()
-		return &itf, nil
+	gateways := interfaceGateways(ifaceName)
+	if gateways[0].IsValid() {
+		itf.gatewayAddress = gateways[0].AsSlice()
 	}
-
-	// search static routes
-	for _, r := range Network.StaticRoutes {
-		if r.InterfaceName == ifaceName {
-			if r.GatewayIP.IsValid() {
-
-				itf.gatewayAddress = r.GatewayIP.AsSlice()
-				return &itf, nil
-			}
-		}
+	if gateways[1].IsValid() {
+		itf.gatewayAddress6 = gateways[1].AsSlice()
 	}
-
 	return &itf, nil
 }
 
@@ -111,11 +103,15 @@ func (m *routeManager) NewRoutableInterface(ifaceName, address string) (Routable
 	if ip, ipNet, err = net.ParseCIDR(address); err != nil {
 		return nil, err
 	}
-	size, _ := ipNet.Mask.Size()
-	if (size == 32) {
-		// default to a /24 if address
-		// does not indicate network
-		ipNet.Mask = net.CIDRMask(24, 32)
+	size, bits := ipNet.Mask.Size()
+	if (size == bits) {
+		// default to a /24 for ipv4 and a /64 for
+		// ipv6 if address does not indicate network
+		if bits == 32 {
+			ipNet.Mask = net.CIDRMask(24, 32)
+		} else {
+			ipNet.Mask = net.CIDRMask(64, 128)
+		}
 	}
 
 	if itf.link, err = netlink.LinkByName(ifaceName); err != nil {
@@ -133,8 +129,13 @@ func (m *routeManager) NewRoutableInterface(ifaceName, address string) (Routable
 	}
 
 	// determine gateway from interface's subnet
-	itf.gatewayAddress = ip.Mask(ipNet.Mask);
-	IncIP(itf.gatewayAddress)
+	gatewayAddress := ip.Mask(ipNet.Mask);
+	IncIP(gatewayAddress)
+	if bits == 32 {
+		itf.gatewayAddress = gatewayAddress
+	} else {
+		itf.gatewayAddress6 = gatewayAddress
+	}
 
 	m.nc.routedItfs = append(m.nc.routedItfs, itf)
 	return &itf, nil
@@ -147,20 +148,32 @@ func (m *routeManager) AddExternalRouteToIPs(ips []string) error {
 
 		destIP net.IP
 	)
-	gatewayIP := Network.DefaultIPv4Route.GatewayIP.AsSlice()
 
+	defaultIPv4Route, defaultIPv6Route := defaultRoutes()
 	for _, ip := range ips {
 		if destIP = net.ParseIP(ip); destIP != nil {
+			// routes are via the default
+			// route of the ip's family
+			defaultRoute, bits := defaultIPv4Route, 32
+			if destIP.To4() == nil {
+				defaultRoute, bits = defaultIPv6Route, 128
+			}
+			if defaultRoute == nil {
+				logger.ErrorMessage(
+					"routeManager.AddExternalRouteToIPs(): Unable to add static route to %s as there is no default route for its address family",
+					ip)
+				continue
+			}
 			route := netlink.Route{
 				Scope:     netlink.SCOPE_UNIVERSE,
-				LinkIndex: Network.DefaultIPv4Route.InterfaceIndex,
-				Dst:       &net.IPNet{IP: destIP, Mask: net.CIDRMask(32, 32)},
-				Gw:        gatewayIP,
+				LinkIndex: defaultRoute.InterfaceIndex,
+				Dst:       &net.IPNet{IP: destIP, Mask: net.CIDRMask(bits, bits)},
+				Gw:        defaultRoute.GatewayIP.AsSlice(),
 			}
 			if err = netlink.RouteAdd(&route); err != nil {
 				logger.ErrorMessage(
 					"routeManager.AddExternalRouteToIPs(): Unable to add static route %s via gateway %s: %s",
-					route.Dst, Network.DefaultIPv4Route.GatewayIP.String(), err.Error())
+					route.Dst, defaultRoute.GatewayIP.String(), err.Error())
 			}	else {
 				m.nc.routedIPs = append(m.nc.routedIPs, route)
 			}
@@ -193,8 +206,11 @@ func (m *routeManager) AddDefaultRoute(gateway string) error {
 				gateway, route.Gw.String(),
 			)
 		}
-		itf := routableInterface{
-			gatewayAddress: gwIP,
+		itf := routableInterface{m:m}
+		if gwIP.To4() != nil {
+			itf.gatewayAddress = gwIP
+		} else {
+			itf.gatewayAddress6 = gwIP
 		}
 		if itf.link, err = netlink.LinkByIndex(route.LinkIndex); err != nil {
 			return err
@@ -239,16 +255,67 @@ func (m *routeManager) Clear() {
 		m.nc.routedIPs = nil
 	}
 
-	// restore default lan route
-	if err = netlink.RouteReplace(&netlink.Route{
-		Scope:     netlink.SCOPE_UNIVERSE,
-		LinkIndex: Network.DefaultIPv4Route.InterfaceIndex,
-		Gw:        Network.DefaultIPv4Route.GatewayIP.AsSlice(),
-	}); err != nil {
-		logger.ErrorMessage(
-			"routeManager.Clear(): Unable to restore default route: %s",
-			err.Error())
+	// stop resolving names and remove
+	// the routes to their addresses
+	for _, nr := range append([]*namedRoutes{}, m.nc.namedRoutes...) {
+		nr.Delete()
+	}
+	m.nc.namedRoutes = nil
+
+	// remove policy routing rules and the
+	// routes added to their custom tables
+	m.clearPolicyRouting()
+
+	// delete the interfaces that were created
+	// along with the routes via the interfaces
+	m.deleteCreatedLinks()
+
+	// restore the default routes that were
+	// replaced via the context's interfaces
+	for _, defaultRoute := range m.nc.replacedDefaultRoutes {
+		if defaultRoute == nil || !defaultRoute.GatewayIP.IsValid() {
+			continue
+		}
+		if err = netlink.RouteReplace(&netlink.Route{
+			Scope:     netlink.SCOPE_UNIVERSE,
+			LinkIndex: defaultRoute.InterfaceIndex,
+			Gw:        defaultRoute.GatewayIP.AsSlice(),
+		}); err != nil {
+			logger.ErrorMessage(
+				"routeManager.Clear(): Unable to restore default route via %s: %s",
+				defaultRoute.GatewayIP.String(), err.Error())
+		}
+	}
+	m.nc.replacedDefaultRoutes = nil
+}
+
+// returns the ipv4 and ipv6 gateways of the default
+// and static routes via the given interface. the
+// gateway of a family is invalid if there is none.
+func interfaceGateways(ifaceName string) []netip.Addr {
+
+	networkMx.RLock()
+	defer networkMx.RUnlock()
+
+	gateways := make([]netip.Addr, 2)
+	if r := Network.DefaultIPv4Route; r != nil && r.InterfaceName == ifaceName {
+		gateways[0] = r.GatewayIP
+	}
+	if r := Network.DefaultIPv6Route; r != nil && r.InterfaceName == ifaceName {
+		gateways[1] = r.GatewayIP
 	}
+	for _, r := range Network.StaticRoutes {
+		if r.InterfaceName == ifaceName && r.GatewayIP.IsValid() {
+			i := 0
+			if r.GatewayIP.Is6() {
+				i = 1
+			}
+			if !gateways[i].IsValid() {
+				gateways[i] = r.GatewayIP
+			}
+		}
+	}
+	return gateways
 }
 
 func (i *routableInterface) Name() string {
@@ -289,13 +356,68 @@ func (i *routableInterface) address(family int) (netip.Addr, netip.Prefix, error
 	return a, p, nil
 }
 
+func (i *routableInterface) MTU() (int, error) {
+
+	// the link's attributes are read when the
+	// interface is looked up so they may be stale
+	link, err := netlink.LinkByIndex(i.link.Attrs().Index)
+	if err != nil {
+		return 0, err
+	}
+	return link.Attrs().MTU, nil
+}
+
+func (i *routableInterface) SetMTU(mtu int) error {
+
+	if err := validateMTU(mtu); err != nil {
+		return err
+	}
+	if err := netlink.LinkSetMTU(i.link, mtu); err != nil {
+		return fmt.Errorf("unable to set mtu of interface %s to %d: %s", i.link.Attrs().Name, mtu, err.Error())
+	}
+	return nil
+}
+
 func (i *routableInterface) MakeDefaultRoute() error {
 
-	return netlink.RouteReplace(&netlink.Route{
-		Scope:     netlink.SCOPE_UNIVERSE,
-		LinkIndex: i.link.Attrs().Index,
-		Gw:        i.gatewayAddress,
-	})
+	var (
+		err error
+
+		currentRoutes [2]*Route
+	)
+
+	if i.gatewayAddress == nil && i.gatewayAddress6 == nil {
+		return fmt.Errorf("interface %s does not have a gateway", i.link.Attrs().Name)
+	}
+	// the current default routes are read from the
+	// routing tables as the global network properties
+	// are only refreshed while the network is monitored
+	if currentRoutes[0], currentRoutes[1], _, err = readDefaultRoutes(); err != nil {
+		return err
+	}
+	// replace the default route of
+	// each family with a gateway
+	for family, gw := range []net.IP{ i.gatewayAddress, i.gatewayAddress6 } {
+		if gw == nil {
+			continue
+		}
+		// only the routes that were replaced first are
+		// recorded as they are the routes of the host
+		if i.m.nc.replacedDefaultRoutes == nil {
+			i.m.nc.replacedDefaultRoutes = make(map[int]*Route)
+		}
+		if _, ok := i.m.nc.replacedDefaultRoutes[family]; !ok {
+			i.m.nc.replacedDefaultRoutes[family] = currentRoutes[family]
+		}
+		if err = netlink.RouteReplace(&netlink.Route{
+			Scope:     netlink.SCOPE_UNIVERSE,
+			LinkIndex: i.link.Attrs().Index,
+			Gw:        gw,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (i *routableInterface) SetSecurityGroups(sgs []SecurityGroup) error {
@@ -0,0 +1,267 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/mevansam/goutils/logger"
+)
+
+var (
+	// interval at which names are resolved
+	// if a refresh interval is not given
+	NamedRoutesRefreshInterval = 5 * time.Minute
+
+	// timeout of the resolution of a name
+	NamedRoutesLookupTimeout = 10 * time.Second
+
+	// resolves the names and updates the routes
+	// of named routes. replaced by rootless tests.
+	lookupNetIP = net.DefaultResolver.LookupNetIP
+	routeAdd    = netlink.RouteAdd
+	routeDel    = netlink.RouteDel
+)
+
+type namedRoutes struct {
+	m *routeManager
+
+	names     []string
+	linkIndex int
+	// gateways of the ipv4 and ipv6
+	// routes via the interface if any
+	gateways []netip.Addr
+
+	mx sync.Mutex
+
+	// last resolved addresses of each name
+	// and the installed routes by address
+	addrs  map[string][]netip.Addr
+	routes map[netip.Addr]*netlink.Route
+
+	deleted bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (m *routeManager) AddRoutesToNames(names []string, ifaceName string, refresh time.Duration) (NamedRoutes, error) {
+
+	var (
+		err error
+
+		link netlink.Link
+	)
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no names to route were given")
+	}
+	if link, err = netlink.LinkByName(ifaceName); err != nil {
+		return nil, err
+	}
+	if refresh <= 0 {
+		refresh = NamedRoutesRefreshInterval
+	}
+
+	nr := &namedRoutes{
+		m: m,
+
+		names:     append([]string{}, names...),
+		linkIndex: link.Attrs().Index,
+		gateways:  interfaceGateways(ifaceName),
+
+		addrs:  make(map[string][]netip.Addr),
+		routes: make(map[netip.Addr]*netlink.Route),
+
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if err = nr.Refresh(); err != nil {
+		nr.deleteRoutes()
+		return nil, err
+	}
+	m.nc.namedRoutes = append(m.nc.namedRoutes, nr)
+
+	go func() {
+		defer close(nr.done)
+
+		ticker := time.NewTicker(refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-nr.stop:
+				return
+			case <-ticker.C:
+				if err := nr.Refresh(); err != nil {
+					logger.ErrorMessage(
+						"namedRoutes.Refresh(): Unable to update routes to names %v: %s",
+						nr.names, err.Error())
+				}
+			}
+		}
+	}()
+	return nr, nil
+}
+
+func (nr *namedRoutes) Addresses() map[string][]netip.Addr {
+
+	nr.mx.Lock()
+	defer nr.mx.Unlock()
+
+	addrs := make(map[string][]netip.Addr)
+	for name, a := range nr.addrs {
+		addrs[name] = append([]netip.Addr{}, a...)
+	}
+	return addrs
+}
+
+// resolves the names and adds routes to new addresses and
+// deletes the routes to addresses that are no longer
+// resolved. the previous addresses of a name that cannot
+// be resolved are kept so that a failed lookup does not
+// remove its routes.
+func (nr *namedRoutes) Refresh() error {
+
+	var (
+		err, lookupErr error
+
+		resolved []netip.Addr
+	)
+
+	nr.mx.Lock()
+	defer nr.mx.Unlock()
+
+	if nr.deleted {
+		return fmt.Errorf("routes to names %v have been deleted", nr.names)
+	}
+
+	for _, name := range nr.names {
+		ctx, cancel := context.WithTimeout(context.Background(), NamedRoutesLookupTimeout)
+		resolved, err = lookupNetIP(ctx, "ip", name)
+		cancel()
+
+		if err != nil {
+			logger.ErrorMessage(
+				"namedRoutes.Refresh(): Unable to resolve name '%s': %s",
+				name, err.Error())
+			if lookupErr == nil {
+				lookupErr = fmt.Errorf("unable to resolve name '%s': %s", name, err.Error())
+			}
+			continue
+		}
+		addrs := []netip.Addr{}
+		for _, addr := range resolved {
+			addrs = append(addrs, addr.Unmap())
+		}
+		sort.Slice(addrs, func(i, j int) bool {
+			return addrs[i].Less(addrs[j])
+		})
+		nr.addrs[name] = addrs
+	}
+
+	desired := make(map[netip.Addr]bool)
+	for _, addrs := range nr.addrs {
+		for _, addr := range addrs {
+			desired[addr] = true
+		}
+	}
+	for addr, route := range nr.routes {
+		if !desired[addr] {
+			if err = routeDel(route); err != nil {
+				logger.ErrorMessage(
+					"namedRoutes.Refresh(): Unable to delete route to %s: %s",
+					addr, err.Error())
+			}
+			delete(nr.routes, addr)
+		}
+	}
+	for addr := range desired {
+		if _, ok := nr.routes[addr]; !ok {
+			route := nr.route(addr)
+			if err = routeAdd(route); err != nil {
+				// the address may already be routed
+				// by another route that is not managed
+				// by this set of named routes
+				logger.ErrorMessage(
+					"namedRoutes.Refresh(): Unable to add route to %s: %s",
+					addr, err.Error())
+				continue
+			}
+			nr.routes[addr] = route
+		}
+	}
+	return lookupErr
+}
+
+func (nr *namedRoutes) Delete() error {
+
+	nr.mx.Lock()
+	if nr.deleted {
+		nr.mx.Unlock()
+		return fmt.Errorf("routes to names %v have already been deleted", nr.names)
+	}
+	nr.deleted = true
+	nr.mx.Unlock()
+
+	close(nr.stop)
+	<-nr.done
+	nr.deleteRoutes()
+
+	namedRoutes := nr.m.nc.namedRoutes
+	for i, r := range namedRoutes {
+		if r == nr {
+			nr.m.nc.namedRoutes = append(namedRoutes[:i], namedRoutes[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// deletes all installed routes
+func (nr *namedRoutes) deleteRoutes() {
+
+	nr.mx.Lock()
+	defer nr.mx.Unlock()
+
+	for addr, route := range nr.routes {
+		if err := routeDel(route); err != nil {
+			logger.ErrorMessage(
+				"namedRoutes.Delete(): Unable to delete route to %s: %s",
+				addr, err.Error())
+		}
+	}
+	nr.routes = make(map[netip.Addr]*netlink.Route)
+	nr.deleted = true
+}
+
+// returns the host route to the given address. the
+// address is routed directly via the interface if it
+// does not have a gateway for the address's family.
+func (nr *namedRoutes) route(addr netip.Addr) *netlink.Route {
+
+	route := &netlink.Route{
+		LinkIndex: nr.linkIndex,
+		Scope:     netlink.SCOPE_LINK,
+		Dst: &net.IPNet{
+			IP:   addr.AsSlice(),
+			Mask: net.CIDRMask(addr.BitLen(), addr.BitLen()),
+		},
+	}
+	gateway := nr.gateways[0]
+	if addr.Is6() {
+		gateway = nr.gateways[1]
+	}
+	if gateway.IsValid() {
+		route.Scope = netlink.SCOPE_UNIVERSE
+		route.Gw = gateway.AsSlice()
+	}
+	return route
+}
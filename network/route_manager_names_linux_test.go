@@ -0,0 +1,108 @@
+//go:build linux
+
+package network_test
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/mevansam/goutils/network"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Routes to Names", func() {
+
+	var (
+		err error
+
+		mx    sync.Mutex
+		names map[string][]netip.Addr
+
+		routed  func() []string
+		restore func()
+
+		routeManager network.RouteManager
+	)
+
+	BeforeEach(func() {
+		names = map[string][]netip.Addr{
+			"api.example.com": {
+				netip.MustParseAddr("203.0.113.10"),
+				netip.MustParseAddr("2001:db8::10"),
+			},
+			"cdn.example.com": {
+				netip.MustParseAddr("203.0.113.20"),
+				netip.MustParseAddr("203.0.113.10"),
+			},
+		}
+		routed, restore = network.UseFakeNamedRouting(func(name string) ([]netip.Addr, error) {
+			mx.Lock()
+			defer mx.Unlock()
+			if addrs, ok := names[name]; ok {
+				return addrs, nil
+			}
+			return nil, fmt.Errorf("no such host")
+		})
+
+		nc, err := network.NewNetworkContext()
+		Expect(err).ToNot(HaveOccurred())
+		routeManager, err = nc.NewRouteManager()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		restore()
+	})
+
+	It("routes the addresses of names and updates them as they change", func() {
+		namedRoutes, err := routeManager.AddRoutesToNames(
+			[]string{ "api.example.com", "cdn.example.com" }, "lo", 50 * time.Millisecond)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(routed()).To(Equal([]string{
+			"2001:db8::10/128", "203.0.113.10/32", "203.0.113.20/32",
+		}))
+		Expect(namedRoutes.Addresses()["cdn.example.com"]).To(Equal([]netip.Addr{
+			netip.MustParseAddr("203.0.113.10"),
+			netip.MustParseAddr("203.0.113.20"),
+		}))
+
+		// routes are updated when the names are re-resolved
+		mx.Lock()
+		names["cdn.example.com"] = []netip.Addr{ netip.MustParseAddr("203.0.113.30") }
+		mx.Unlock()
+		Eventually(routed).Should(Equal([]string{
+			"2001:db8::10/128", "203.0.113.10/32", "203.0.113.30/32",
+		}))
+
+		// routes of a name that cannot be resolved are kept
+		mx.Lock()
+		delete(names, "api.example.com")
+		mx.Unlock()
+		err = namedRoutes.Refresh()
+		Expect(err).To(HaveOccurred())
+		Expect(routed()).To(ContainElement("2001:db8::10/128"))
+
+		err = namedRoutes.Delete()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(routed()).To(BeEmpty())
+		Expect(namedRoutes.Delete()).To(HaveOccurred())
+	})
+
+	It("deletes the routes to names when routes are cleared", func() {
+		_, err = routeManager.AddRoutesToNames([]string{ "api.example.com" }, "lo", time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(routed()).To(HaveLen(2))
+
+		_, err = routeManager.AddRoutesToNames([]string{ "unknown.example.com" }, "lo", time.Hour)
+		Expect(err).To(HaveOccurred())
+		_, err = routeManager.AddRoutesToNames([]string{ "api.example.com" }, "nosuchitf0", time.Hour)
+		Expect(err).To(HaveOccurred())
+
+		routeManager.Clear()
+		Expect(routed()).To(BeEmpty())
+	})
+})
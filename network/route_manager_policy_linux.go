@@ -0,0 +1,248 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/mevansam/goutils/logger"
+)
+
+func (m *routeManager) AddRoutingRule(rule RoutingRule) error {
+
+	var (
+		err error
+
+		rules []*netlink.Rule
+	)
+
+	for _, r := range m.nc.routingRules {
+		if r == rule {
+			return fmt.Errorf("routing rule has already been added: %+v", rule)
+		}
+	}
+	if rules, err = rule.netlinkRules(); err != nil {
+		return err
+	}
+	for i, r := range rules {
+		if err = netlink.RuleAdd(r); err != nil {
+			// remove rules of the other
+			// families that were added
+			for _, r := range rules[:i] {
+				_ = netlink.RuleDel(r)
+			}
+			return fmt.Errorf("unable to add routing rule %+v: %s", rule, err.Error())
+		}
+	}
+	m.nc.routingRules = append(m.nc.routingRules, rule)
+	return nil
+}
+
+func (m *routeManager) DeleteRoutingRule(rule RoutingRule) error {
+
+	var (
+		err error
+
+		rules []*netlink.Rule
+	)
+
+	for i, r := range m.nc.routingRules {
+		if r == rule {
+			if rules, err = rule.netlinkRules(); err != nil {
+				return err
+			}
+			for _, r := range rules {
+				if err = netlink.RuleDel(r); err != nil {
+					return fmt.Errorf("unable to delete routing rule %+v: %s", rule, err.Error())
+				}
+			}
+			m.nc.routingRules = append(m.nc.routingRules[:i], m.nc.routingRules[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("routing rule was not added by the route manager: %+v", rule)
+}
+
+func (m *routeManager) AddTableRoute(route TableRoute) error {
+
+	var (
+		err error
+
+		nlRoute *netlink.Route
+	)
+
+	for _, r := range m.nc.tableRoutes {
+		if r == route {
+			return fmt.Errorf("route has already been added to table %d: %+v", route.Table, route)
+		}
+	}
+	if nlRoute, err = route.netlinkRoute(); err != nil {
+		return err
+	}
+	if err = netlink.RouteAdd(nlRoute); err != nil {
+		return fmt.Errorf("unable to add route %s to table %d: %s", route.Dst, route.Table, err.Error())
+	}
+	m.nc.tableRoutes = append(m.nc.tableRoutes, route)
+	return nil
+}
+
+func (m *routeManager) DeleteTableRoute(route TableRoute) error {
+
+	var (
+		err error
+
+		nlRoute *netlink.Route
+	)
+
+	for i, r := range m.nc.tableRoutes {
+		if r == route {
+			if nlRoute, err = route.netlinkRoute(); err != nil {
+				return err
+			}
+			if err = netlink.RouteDel(nlRoute); err != nil {
+				return fmt.Errorf("unable to delete route %s from table %d: %s", route.Dst, route.Table, err.Error())
+			}
+			m.nc.tableRoutes = append(m.nc.tableRoutes[:i], m.nc.tableRoutes[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("route was not added by the route manager: %+v", route)
+}
+
+// deletes the routing rules and the custom table
+// routes that were added by the route manager
+func (m *routeManager) clearPolicyRouting() {
+
+	var (
+		err error
+
+		rules   []*netlink.Rule
+		nlRoute *netlink.Route
+	)
+
+	for _, rule := range m.nc.routingRules {
+		if rules, err = rule.netlinkRules(); err == nil {
+			for _, r := range rules {
+				if err = netlink.RuleDel(r); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			logger.ErrorMessage(
+				"routeManager.Clear(): Unable to delete routing rule %+v: %s",
+				rule, err.Error())
+		}
+	}
+	m.nc.routingRules = nil
+
+	for _, route := range m.nc.tableRoutes {
+		if nlRoute, err = route.netlinkRoute(); err == nil {
+			err = netlink.RouteDel(nlRoute)
+		}
+		if err != nil {
+			logger.ErrorMessage(
+				"routeManager.Clear(): Unable to delete route %s from table %d: %s",
+				route.Dst, route.Table, err.Error())
+		}
+	}
+	m.nc.tableRoutes = nil
+}
+
+// returns the netlink rules of the routing rule. a rule
+// without a source prefix is added for both ip families.
+func (rule RoutingRule) netlinkRules() ([]*netlink.Rule, error) {
+
+	if rule.Table <= 0 {
+		return nil, fmt.Errorf("routing rule has an invalid table: %+v", rule)
+	}
+	if !rule.SrcPrefix.IsValid() && len(rule.IifName) == 0 && rule.Mark == 0 {
+		return nil, fmt.Errorf("routing rule does not have a source prefix, interface or mark: %+v", rule)
+	}
+	if rule.Mask != 0 && rule.Mark == 0 {
+		return nil, fmt.Errorf("routing rule has a mark mask without a mark: %+v", rule)
+	}
+
+	families := []int{ netlink.FAMILY_V4, netlink.FAMILY_V6 }
+	if rule.SrcPrefix.IsValid() {
+		if rule.SrcPrefix.Addr().Is4() {
+			families = families[:1]
+		} else {
+			families = families[1:]
+		}
+	}
+
+	rules := []*netlink.Rule{}
+	for _, family := range families {
+		r := netlink.NewRule()
+		r.Family = family
+		r.Table = rule.Table
+		if rule.Priority > 0 {
+			r.Priority = rule.Priority
+		}
+		if rule.SrcPrefix.IsValid() {
+			r.Src = &net.IPNet{
+				IP:   rule.SrcPrefix.Masked().Addr().AsSlice(),
+				Mask: net.CIDRMask(rule.SrcPrefix.Bits(), rule.SrcPrefix.Addr().BitLen()),
+			}
+		}
+		r.IifName = rule.IifName
+		if rule.Mark != 0 {
+			r.Mark = int(rule.Mark)
+			if rule.Mask != 0 {
+				r.Mask = int(rule.Mask)
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// returns the netlink route of the table route
+func (route TableRoute) netlinkRoute() (*netlink.Route, error) {
+
+	var (
+		err error
+
+		link netlink.Link
+	)
+
+	if route.Table <= 0 {
+		return nil, fmt.Errorf("route has an invalid table: %+v", route)
+	}
+	if !route.Dst.IsValid() {
+		return nil, fmt.Errorf("route has an invalid destination: %+v", route)
+	}
+	if !route.GatewayIP.IsValid() && len(route.InterfaceName) == 0 {
+		return nil, fmt.Errorf("route does not have a gateway or interface: %+v", route)
+	}
+	if route.GatewayIP.IsValid() && route.GatewayIP.Is4() != route.Dst.Addr().Is4() {
+		return nil, fmt.Errorf("route cannot mix ipv4 and ipv6 addresses: %+v", route)
+	}
+
+	nlRoute := &netlink.Route{
+		Table: route.Table,
+		Scope: netlink.SCOPE_UNIVERSE,
+		Dst: &net.IPNet{
+			IP:   route.Dst.Masked().Addr().AsSlice(),
+			Mask: net.CIDRMask(route.Dst.Bits(), route.Dst.Addr().BitLen()),
+		},
+	}
+	if len(route.InterfaceName) > 0 {
+		if link, err = netlink.LinkByName(route.InterfaceName); err != nil {
+			return nil, err
+		}
+		nlRoute.LinkIndex = link.Attrs().Index
+	}
+	if route.GatewayIP.IsValid() {
+		nlRoute.Gw = route.GatewayIP.AsSlice()
+	} else {
+		// the destination is directly
+		// reachable via the interface
+		nlRoute.Scope = netlink.SCOPE_LINK
+	}
+	return nlRoute, nil
+}
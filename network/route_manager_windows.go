@@ -5,6 +5,7 @@ package network
 import (
 	"fmt"
 	"net/netip"
+	"time"
 )
 
 type routeManager struct {	
@@ -35,7 +36,7 @@ func (m *routeManager) NewRoutableInterface(ifaceName, address string) (Routable
 	return &routableInterface{}, nil
 }
 
-func (m *routeManager) NewFilterRouter(denyAll bool) (FilterRouter, error) {
+func (m *routeManager) NewFilterRouter(denyAll bool, options ...FilterRouterOption) (FilterRouter, error) {
 	return nil, fmt.Errorf("filter router has not been implemented for windows os")
 }
 
@@ -47,6 +48,42 @@ func (m *routeManager) AddDefaultRoute(gateway string) error {
 	return nil
 }
 
+func (m *routeManager) CreateTunInterface(ifaceName string) (string, error) {
+	return "", fmt.Errorf("creating interfaces has not been implemented for windows os")
+}
+
+func (m *routeManager) CreateWireguardInterface(ifaceName string, config WireguardConfig) (string, error) {
+	return "", fmt.Errorf("creating interfaces has not been implemented for windows os")
+}
+
+func (m *routeManager) ConfigureWireguardInterface(ifaceName string, config WireguardConfig) error {
+	return fmt.Errorf("creating interfaces has not been implemented for windows os")
+}
+
+func (m *routeManager) DeleteInterface(ifaceName string) error {
+	return fmt.Errorf("creating interfaces has not been implemented for windows os")
+}
+
+func (m *routeManager) AddRoutingRule(rule RoutingRule) error {
+	return fmt.Errorf("policy based routing has not been implemented for windows os")
+}
+
+func (m *routeManager) DeleteRoutingRule(rule RoutingRule) error {
+	return fmt.Errorf("policy based routing has not been implemented for windows os")
+}
+
+func (m *routeManager) AddTableRoute(route TableRoute) error {
+	return fmt.Errorf("policy based routing has not been implemented for windows os")
+}
+
+func (m *routeManager) DeleteTableRoute(route TableRoute) error {
+	return fmt.Errorf("policy based routing has not been implemented for windows os")
+}
+
+func (m *routeManager) AddRoutesToNames(names []string, ifaceName string, refresh time.Duration) (NamedRoutes, error) {
+	return nil, fmt.Errorf("routes to names have not been implemented for windows os")
+}
+
 func (m *routeManager) Clear() {
 }
 
@@ -66,6 +103,14 @@ func (i *routableInterface) MakeDefaultRoute() error {
 	return nil
 }
 
+func (i *routableInterface) MTU() (int, error) {
+	return 0, fmt.Errorf("interface mtu has not been implemented for windows os")
+}
+
+func (i *routableInterface) SetMTU(mtu int) error {
+	return fmt.Errorf("interface mtu has not been implemented for windows os")
+}
+
 func (i *routableInterface) SetSecurityGroups(sgs []SecurityGroup) error {
 	return nil
 }
@@ -1,9 +1,9 @@
 package network
 
 import (
-	"fmt"
 	"net"
 	"net/netip"
+	"strconv"
 	"time"
 
 	"github.com/mevansam/goutils/logger"
@@ -40,6 +40,14 @@ func IsPrivateAddr(addr netip.Addr) bool {
 // to the given names. The second list is 
 // a list of ips resolved for each name.
 func ResolveNames(dnsNames []string, flatten bool) ([]string, [][]string, error) {
+	return resolveNames(dnsNames, flatten, net.LookupIP)
+}
+
+func resolveNames(
+	dnsNames []string, 
+	flatten bool, 
+	lookupIP func(name string) ([]net.IP, error),
+) ([]string, [][]string, error) {
 
 	var (
 		err error
@@ -50,11 +58,10 @@ func ResolveNames(dnsNames []string, flatten bool) ([]string, [][]string, error)
 	namedIPs := [][]string{}
 
 	for _, name := range dnsNames {	
-		if resolvedIPs, err = net.LookupIP(name); err != nil {
+		if resolvedIPs, err = lookupIP(name); err != nil {
 			return nil, nil, err
 		}
 		ips := []string{}
-		namedIPs = append(namedIPs, ips)
 
 		for i, ip := range resolvedIPs {			
 			ipAddr := ip.String()
@@ -65,6 +72,7 @@ func ResolveNames(dnsNames []string, flatten bool) ([]string, [][]string, error)
 				ipsFlat = append(ipsFlat, ipAddr)
 			}
 		}	
+		namedIPs = append(namedIPs, ips)
 	}
 
 	return ipsFlat, namedIPs, nil
@@ -73,7 +81,7 @@ func ResolveNames(dnsNames []string, flatten bool) ([]string, [][]string, error)
 // test tcp connection
 func CanConnect(host string, port int) bool {
 
-	endpoint := fmt.Sprintf("%s:%d", host, port)
+	endpoint := net.JoinHostPort(host, strconv.Itoa(port))
 	conn, err := net.DialTimeout("tcp", endpoint, time.Second)
 	if err != nil {
 		logger.TraceMessage(